@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// providerHealth is the state of one provider as reported by /health
+type providerHealth struct {
+	Breaker BreakerState `json:"breaker,omitempty"`
+}
+
+// serveHealth reports the circuit breaker state of every provider whose
+// client is wrapped in a breaker. Providers are never called.
+func (a *App) serveHealth(w http.ResponseWriter) {
+	providers := map[Provider]providerHealth{}
+	for provider, client := range a.clients() {
+		var health providerHealth
+		if breaker, ok := client.(*CircuitBreakerClient); ok {
+			health.Breaker = breaker.State()
+		}
+		providers[provider] = health
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "ok",
+		"providers": providers,
+	})
+}
+
+// providerUsage describes how a provider is used by the config
+type providerUsage struct {
+	Provider Provider `json:"provider"`
+	// Registered is false for providers the config refers to without a client
+	Registered bool `json:"registered"`
+	// Disabled is set for providers disabled with DisableProvider
+	Disabled bool `json:"disabled,omitempty"`
+	Primary  int  `json:"primary"`
+	Fallback int  `json:"fallback"`
+}
+
+// serveProviders lists every provider along with how many configs use it as
+// their primary provider and as their fallback. Providers of a config's first
+// tier count as primary, those of later tiers as fallback. Providers are never called.
+func (a *App) serveProviders(w http.ResponseWriter) {
+	clients := a.clients()
+	usages := map[Provider]*providerUsage{}
+	usage := func(provider Provider) *providerUsage {
+		if usages[provider] == nil {
+			_, registered := clients[provider]
+			usages[provider] = &providerUsage{Provider: provider, Registered: registered, Disabled: a.ProviderDisabled(provider)}
+		}
+		return usages[provider]
+	}
+
+	for provider := range clients {
+		usage(provider)
+	}
+	for _, config := range a.config() {
+		for i, tier := range a.tiersFor(config) {
+			for _, provider := range tier {
+				if i == 0 {
+					usage(provider).Primary++
+				} else {
+					usage(provider).Fallback++
+				}
+			}
+		}
+	}
+
+	list := make([]*providerUsage, 0, len(usages))
+	for _, u := range usages {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Provider < list[j].Provider })
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// inFlightPath reports how many requests and fetches are running
+const inFlightPath = "/debug/inflight"
+
+// inFlight is the body of /debug/inflight
+type inFlight struct {
+	// Requests counts every running request, including this one
+	Requests int64 `json:"requests"`
+	// Fetches counts the goroutines fetching the content of a config
+	Fetches int64 `json:"fetches"`
+}
+
+// serveInFlight reports the number of running requests and fetches, e.g. to
+// debug overload
+func (a *App) serveInFlight(w http.ResponseWriter) {
+	writeJSON(w, http.StatusOK, inFlight{
+		Requests: atomic.LoadInt64(&a.inFlightRequests),
+		Fetches:  atomic.LoadInt64(&a.inFlightFetches),
+	})
+}
+
+// cacheFlushPath flushes the whole cache, followed by a provider it only
+// flushes the pages containing that provider's items
+const cacheFlushPath = "/cache/flush"
+
+// serveCacheFlush removes pages from the cache. It has to be posted with the
+// AdminToken as bearer token and is disabled if there is no AdminToken.
+func (a *App) serveCacheFlush(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if !a.requireAdmin(w, req) {
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		sendError(w, http.StatusMethodNotAllowed, "the cache must be flushed with POST")
+		return
+	}
+	if a.Cache == nil {
+		sendError(w, http.StatusNotFound, "there is no cache")
+		return
+	}
+
+	provider := Provider(strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, cacheFlushPath), "/"))
+	if provider != "" {
+		if _, ok := a.client(provider); !ok {
+			sendError(w, http.StatusNotFound, fmt.Sprintf("unknown provider %s", provider))
+			return
+		}
+	}
+	flushed := a.Cache.flush(provider)
+	logf(ctx, "flushed %d cached pages", flushed)
+	writeJSON(w, http.StatusOK, map[string]int{"flushed": flushed})
+}
+
+// requireAdmin responds with a 404 if there is no AdminToken and with a 401
+// if the request does not carry it, returning false in both cases
+func (a *App) requireAdmin(w http.ResponseWriter, req *http.Request) bool {
+	if a.AdminToken == "" {
+		sendError(w, http.StatusNotFound, "admin endpoints are disabled")
+		return false
+	}
+	if !a.isAdmin(req) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		sendError(w, http.StatusUnauthorized, "a valid admin token is required")
+		return false
+	}
+	return true
+}
+
+// configPath reports the configuration the server actually uses
+const configPath = "/config"
+
+// resolvedConfig is a ContentConfig as it is fetched, with the
+// DefaultFallback applied and the timeout of each of its providers
+type resolvedConfig struct {
+	Type     Provider            `json:"type"`
+	Fallback *Provider           `json:"fallback,omitempty"`
+	Tiers    ProviderTiers       `json:"tiers"`
+	Timeouts map[Provider]string `json:"timeouts"`
+}
+
+// resolvedSettings is the body of /config
+type resolvedSettings struct {
+	Config                 []resolvedConfig            `json:"config"`
+	Mixes                  map[string][]resolvedConfig `json:"mixes,omitempty"`
+	MaxCount               int                         `json:"max_count"`
+	RequestTimeout         string                      `json:"request_timeout"`
+	DefaultProviderTimeout string                      `json:"default_provider_timeout"`
+}
+
+// serveConfig reports the Config and Mixes with every default applied, to
+// check what a deployment actually runs with. Like every admin endpoint, it
+// requires the AdminToken. Timeouts of 0s mean no timeout.
+func (a *App) serveConfig(w http.ResponseWriter, req *http.Request) {
+	if !a.requireAdmin(w, req) {
+		return
+	}
+	settings := resolvedSettings{
+		Config:                 a.resolveMix(a.config()),
+		MaxCount:               a.MaxCount,
+		RequestTimeout:         a.RequestTimeout.String(),
+		DefaultProviderTimeout: a.DefaultProviderTimeout.String(),
+	}
+	if len(a.Mixes) > 0 {
+		settings.Mixes = make(map[string][]resolvedConfig, len(a.Mixes))
+		for name, mix := range a.Mixes {
+			settings.Mixes[name] = a.resolveMix(mix)
+		}
+	}
+	writeJSON(w, http.StatusOK, settings)
+}
+
+func (a *App) resolveMix(mix ContentMix) []resolvedConfig {
+	resolved := make([]resolvedConfig, len(mix))
+	for i, config := range mix {
+		tiers := a.tiersFor(config)
+		resolved[i] = resolvedConfig{Type: config.Type, Tiers: tiers, Timeouts: map[Provider]string{}}
+		if config.Tiers == nil {
+			resolved[i].Fallback = a.fallbackFor(config)
+		}
+		for _, tier := range tiers {
+			for _, provider := range tier {
+				resolved[i].Timeouts[provider] = a.providerTimeout(provider).String()
+			}
+		}
+	}
+	return resolved
+}
+
+// isAdmin reports whether the request carries the AdminToken as a bearer
+// token, i.e. as "Authorization: Bearer <token>"
+func (a *App) isAdmin(req *http.Request) bool {
+	const scheme = "Bearer "
+	authorization := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, scheme) {
+		return false
+	}
+	token := authorization[len(scheme):]
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.AdminToken)) == 1
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProvidersEndpointCountsConfigUsage(t *testing.T) {
+	clients, counters := countingClients()
+	srv, _ := NewApp(DefaultConfig, clients)
+
+	response := runRawRequest(srv, "/providers")
+
+	var usages []providerUsage
+	if err := json.NewDecoder(response.Body).Decode(&usages); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	want := []providerUsage{
+		{Provider: Provider1, Registered: true, Primary: 5, Fallback: 1},
+		{Provider: Provider2, Registered: true, Primary: 2, Fallback: 4},
+		{Provider: Provider3, Registered: true, Primary: 1, Fallback: 2},
+	}
+	if len(usages) != len(want) {
+		t.Fatalf("Got %d providers, want %d", len(usages), len(want))
+	}
+	for i := range want {
+		if usages[i] != want[i] {
+			t.Errorf("Got %+v, want %+v", usages[i], want[i])
+		}
+	}
+	if calls := totalCalls(counters); calls != 0 {
+		t.Errorf("Providers were called %d times", calls)
+	}
+}
+
+func TestProvidersEndpointCountsDefaultFallback(t *testing.T) {
+	srv := &App{
+		ContentClients:  sampleClients(),
+		Config:          ContentMix{config4, config4},
+		DefaultFallback: &Provider3,
+	}
+
+	var usages []providerUsage
+	json.NewDecoder(runRawRequest(srv, "/providers").Body).Decode(&usages)
+
+	for _, usage := range usages {
+		if usage.Provider == Provider3 && usage.Fallback != 2 {
+			t.Errorf("Got %d fallback usages of the default fallback, want 2", usage.Fallback)
+		}
+	}
+}
+
+func flushCache(srv http.Handler, target, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, req)
+	return response
+}
+
+func TestCacheFlushRefetchesContent(t *testing.T) {
+	clients, counters := countingClients()
+	srv, _ := NewApp(DefaultConfig, clients, WithCache(time.Minute), WithAdminToken("secret"))
+
+	runRequest(t, srv, SimpleContentRequest)
+	calls := totalCalls(counters)
+
+	if response := flushCache(srv, "/cache/flush", "secret"); response.Code != http.StatusOK {
+		t.Fatalf("Response code is %d, want 200", response.Code)
+	}
+	runRequest(t, srv, SimpleContentRequest)
+
+	if totalCalls(counters) == calls {
+		t.Error("Providers were not called again after the cache was flushed")
+	}
+}
+
+func TestCacheFlushByProviderKeepsOtherPages(t *testing.T) {
+	clients, counters := countingClients()
+	srv, _ := NewApp(
+		DefaultConfig,
+		clients,
+		WithCache(time.Minute),
+		WithAdminToken("secret"),
+		WithMix("one", ContentMix{{Type: Provider1}}),
+		WithMix("two", ContentMix{{Type: Provider2}}),
+	)
+	one := httptest.NewRequest("GET", "/mix/one?count=2", nil)
+	two := httptest.NewRequest("GET", "/mix/two?count=2", nil)
+	runRequest(t, srv, one)
+	runRequest(t, srv, two)
+	calls := totalCalls(counters)
+
+	flushCache(srv, "/cache/flush/2", "secret")
+	runRequest(t, srv, one)
+	if totalCalls(counters) != calls {
+		t.Error("Page without items of the flushed provider was refetched")
+	}
+	runRequest(t, srv, two)
+	if totalCalls(counters) == calls {
+		t.Error("Page with items of the flushed provider was not refetched")
+	}
+}
+
+func TestCacheFlushRequiresAdminToken(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithCache(time.Minute), WithAdminToken("secret"))
+
+	if response := flushCache(srv, "/cache/flush", ""); response.Code != http.StatusUnauthorized {
+		t.Errorf("Got status %d without a token, want 401", response.Code)
+	}
+	if response := flushCache(srv, "/cache/flush", "wrong"); response.Code != http.StatusUnauthorized {
+		t.Errorf("Got status %d with a wrong token, want 401", response.Code)
+	}
+
+	bare := httptest.NewRequest("POST", "/cache/flush", nil)
+	bare.Header.Set("Authorization", "secret")
+	response := httptest.NewRecorder()
+	if srv.ServeHTTP(response, bare); response.Code != http.StatusUnauthorized {
+		t.Errorf("Got status %d with the token but no Bearer scheme, want 401", response.Code)
+	}
+
+	disabled, _ := NewApp(DefaultConfig, sampleClients(), WithCache(time.Minute))
+	if response := flushCache(disabled, "/cache/flush", ""); response.Code != http.StatusNotFound {
+		t.Errorf("Got status %d without an admin token configured, want 404", response.Code)
+	}
+}
+
+func TestPagesFetchedBeforeAFlushAreNotCached(t *testing.T) {
+	cache := NewPageCache(time.Minute)
+	generation := cache.currentGeneration()
+	cache.flush("")
+
+	cache.set(pageKey{count: 1}, []returnedItem{{Item: &ContentItem{}}}, generation)
+
+	if _, ok := cache.get(pageKey{count: 1}); ok {
+		t.Error("Page fetched before the flush was cached")
+	}
+}
+
+// waitForInFlight polls /debug/inflight until it reports want or a second
+// passed
+func waitForInFlight(t *testing.T, srv *App, want inFlight) {
+	t.Helper()
+	var got inFlight
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if err := json.NewDecoder(runRawRequest(srv, "/debug/inflight").Body).Decode(&got); err != nil {
+			t.Fatalf("couldn't decode Response json: %v", err)
+		}
+		if got == want {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("Got %+v in flight, want %+v", got, want)
+}
+
+func TestInFlightReportsRunningRequestsAndFetches(t *testing.T) {
+	release := make(chan struct{})
+	clients := map[Provider]Client{Provider1: GatedContentProvider{Client: SampleContentProvider{Source: Provider1}, Release: release}}
+	srv, _ := NewApp(ContentMix{config4}, clients)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runRawRequest(srv, "/?count=2")
+		}()
+	}
+
+	// the requests for /debug/inflight count themselves
+	waitForInFlight(t, srv, inFlight{Requests: 4, Fetches: 3})
+	close(release)
+	wg.Wait()
+	waitForInFlight(t, srv, inFlight{Requests: 1})
+}
+
+func TestRequestsBeyondMaxInFlightAreShed(t *testing.T) {
+	release := make(chan struct{})
+	clients := map[Provider]Client{Provider1: GatedContentProvider{Client: SampleContentProvider{Source: Provider1}, Release: release}}
+	srv, _ := NewApp(ContentMix{config4}, clients, WithMaxInFlight(2))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if response := runRawRequest(srv, "/?count=2"); response.Code != http.StatusOK {
+				t.Errorf("Got status %d for a request within the limit, want 200", response.Code)
+			}
+		}()
+	}
+	waitForInFlight(t, srv, inFlight{Requests: 3, Fetches: 2})
+
+	for _, path := range []string{"/?count=2", "/bulk?count=2"} {
+		response := runRawRequest(srv, path)
+		if response.Code != http.StatusServiceUnavailable || response.Header().Get("Retry-After") != "1" {
+			t.Errorf("%s: Got status %d and Retry-After %q at capacity, want 503 and 1", path, response.Code, response.Header().Get("Retry-After"))
+		}
+	}
+	if response := runRawRequest(srv, "/health"); response.Code != http.StatusOK {
+		t.Errorf("Got status %d for /health at capacity, want 200", response.Code)
+	}
+
+	close(release)
+	wg.Wait()
+	if response := runRawRequest(srv, "/?count=2"); response.Code != http.StatusOK {
+		t.Errorf("Got status %d once below capacity again, want 200", response.Code)
+	}
+}
+
+func TestQueuedRequestsWaitForASlot(t *testing.T) {
+	release := make(chan struct{})
+	clients := map[Provider]Client{Provider1: GatedContentProvider{Client: SampleContentProvider{Source: Provider1}, Release: release}}
+	srv, _ := NewApp(ContentMix{config4}, clients, WithMaxInFlight(1), WithRequestQueue(1, time.Minute))
+
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() { codes <- runRawRequest(srv, "/?count=2").Code }()
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&srv.queuedRequests) < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if response := runRawRequest(srv, "/?count=2"); response.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %d with the queue full, want 503", response.Code)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("Got status %d for a running or queued request, want 200", code)
+		}
+	}
+}
+
+func TestQueuedRequestsOfAppLiteralsWakeUpWhenASlotIsFreed(t *testing.T) {
+	release := make(chan struct{})
+	srv := &App{
+		ContentClients: map[Provider]Client{Provider1: GatedContentProvider{Client: SampleContentProvider{Source: Provider1}, Release: release}},
+		Config:         ContentMix{config4},
+		MaxInFlight:    1,
+		MaxQueued:      1,
+		MaxQueueWait:   time.Minute,
+	}
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() { codes <- runRawRequest(srv, "/?count=2").Code }()
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&srv.queuedRequests) < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if running := atomic.LoadInt64(&srv.contentRequests); running != 1 {
+		t.Errorf("Got %d running requests, want the queued one kept out", running)
+	}
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case code := <-codes:
+			if code != http.StatusOK {
+				t.Errorf("Got status %d, want 200", code)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Queued request was not woken up when the slot was freed")
+		}
+	}
+}
+
+func TestQueuedRequestsAreShedAfterTheMaxWait(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	clients := map[Provider]Client{Provider1: GatedContentProvider{Client: SampleContentProvider{Source: Provider1}, Release: release}}
+	srv, _ := NewApp(ContentMix{config4}, clients, WithMaxInFlight(1), WithRequestQueue(1, 20*time.Millisecond))
+
+	go runRawRequest(srv, "/?count=2")
+	waitForInFlight(t, srv, inFlight{Requests: 2, Fetches: 1})
+
+	start := time.Now()
+	response := runRawRequest(srv, "/?count=2")
+	if response.Code != http.StatusServiceUnavailable || response.Header().Get("Retry-After") != "1" {
+		t.Errorf("Got status %d and Retry-After %q, want 503 and 1", response.Code, response.Header().Get("Retry-After"))
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Request was shed after %v, want it queued for the max wait", elapsed)
+	}
+}
+
+func TestConfigEndpointReportsAppliedDefaults(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config1, config4}, sampleClients(),
+		WithAdminToken("secret"), WithDefaultFallback(Provider3), WithProviderTimeout(Provider2, time.Second))
+
+	req := httptest.NewRequest("GET", "/config", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, req)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Got status %d, want 200", response.Code)
+	}
+	var settings resolvedSettings
+	if err := json.NewDecoder(response.Body).Decode(&settings); err != nil {
+		t.Fatalf("Couldn't decode config: %v", err)
+	}
+
+	if len(settings.Config) != 2 {
+		t.Fatalf("Got %d configs, want 2", len(settings.Config))
+	}
+	if fallback := settings.Config[0].Fallback; fallback == nil || *fallback != Provider2 {
+		t.Errorf("Got fallback %v for a config with its own fallback, want 2", fallback)
+	}
+	if fallback := settings.Config[1].Fallback; fallback == nil || *fallback != Provider3 {
+		t.Errorf("Got fallback %v for a config without one, want the default 3", fallback)
+	}
+	if timeout := settings.Config[0].Timeouts[Provider2]; timeout != "1s" {
+		t.Errorf("Got timeout %q for provider 2, want 1s", timeout)
+	}
+	if settings.MaxCount != DefaultMaxCount {
+		t.Errorf("Got max count %d, want %d", settings.MaxCount, DefaultMaxCount)
+	}
+	if settings.RequestTimeout != DefaultRequestTimeout.String() {
+		t.Errorf("Got request timeout %q, want %s", settings.RequestTimeout, DefaultRequestTimeout)
+	}
+}
+
+func TestConfigEndpointRequiresAdminToken(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithAdminToken("secret"))
+	if response := runRawRequest(srv, "/config"); response.Code != http.StatusUnauthorized {
+		t.Errorf("Got status %d without a token, want 401", response.Code)
+	}
+
+	disabled, _ := NewApp(DefaultConfig, sampleClients())
+	if response := runRawRequest(disabled, "/config"); response.Code != http.StatusNotFound {
+		t.Errorf("Got status %d without an admin token configured, want 404", response.Code)
+	}
+}
+
+func switchProvider(srv http.Handler, target, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", target, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, req)
+	return response
+}
+
+func TestDisabledProviderGoesToFallback(t *testing.T) {
+	clients, _ := countingClients()
+	srv, _ := NewApp(ContentMix{config1}, clients, WithAdminToken("secret"))
+
+	if response := switchProvider(srv, "/providers/1/disable", "secret"); response.Code != http.StatusOK {
+		t.Fatalf("Got status %d disabling provider 1, want 200", response.Code)
+	}
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=3", nil))
+	if sources := providerSequence(content); sources != "222" {
+		t.Errorf("Got providers %s with provider 1 disabled, want the fallback 222", sources)
+	}
+	if calls := clients[Provider1].(*CountingContentProvider).Calls(); calls != 0 {
+		t.Errorf("Disabled provider was called %d times", calls)
+	}
+
+	switchProvider(srv, "/providers/1/enable", "secret")
+	content = runRequest(t, srv, httptest.NewRequest("GET", "/?count=3", nil))
+	if sources := providerSequence(content); sources != "111" {
+		t.Errorf("Got providers %s with provider 1 enabled again, want 111", sources)
+	}
+}
+
+func TestProviderSwitchIsRestricted(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithAdminToken("secret"))
+
+	for target, status := range map[string]int{
+		"/providers/1/disable": http.StatusUnauthorized,
+		"/providers/4/disable": http.StatusNotFound,
+		"/providers/1/pause":   http.StatusNotFound,
+	} {
+		token := "secret"
+		if status == http.StatusUnauthorized {
+			token = "wrong"
+		}
+		if response := switchProvider(srv, target, token); response.Code != status {
+			t.Errorf("%s: Got status %d, want %d", target, response.Code, status)
+		}
+	}
+	if srv.ProviderDisabled(Provider1) {
+		t.Error("Provider was disabled without the admin token")
+	}
+	if err := srv.DisableProvider(Provider("4")); err == nil {
+		t.Error("Got no error disabling an unknown provider")
+	}
+}
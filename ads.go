@@ -0,0 +1,63 @@
+package main
+
+// adsEnabled reports whether an AdsMix is interleaved with the content
+func (a *App) adsEnabled() bool {
+	return len(a.AdsMix) > 0 && a.AdsInterval > 0
+}
+
+// isAdSlot reports whether the item at position, counted from 0, is an ad
+func (a *App) isAdSlot(position int) bool {
+	return a.adsEnabled() && (position+1)%a.AdsInterval == 0
+}
+
+// adSlotsBefore returns how many of the positions before position are ads
+func (a *App) adSlotsBefore(position int) int {
+	if !a.adsEnabled() {
+		return 0
+	}
+	return position / a.AdsInterval
+}
+
+// organicRequest returns the part of the request which is served from the
+// request's own config rather than the AdsMix. Its offset and count leave
+// out the ad slots, so that the organic rotation continues across pages
+// as if there were no ads.
+func (a *App) organicRequest(request pageRequest) pageRequest {
+	ads := a.adSlotsBefore(request.offset + request.count)
+	adsBefore := a.adSlotsBefore(request.offset)
+	request.offset -= adsBefore
+	request.count -= ads - adsBefore
+	return request
+}
+
+// interleaveAds puts the configs of the AdsMix into the ad slots of the
+// request, in the order they are listed, and the organic configs into the
+// others. The mix ends early if the organic configs run out.
+func (a *App) interleaveAds(organic ContentMix, request pageRequest) ContentMix {
+	if !a.adsEnabled() {
+		return organic
+	}
+	mix := make(ContentMix, 0, request.count)
+	next := 0
+	for position := request.offset; position < request.offset+request.count; position++ {
+		if a.isAdSlot(position) {
+			mix = append(mix, a.AdsMix[a.adSlotsBefore(position)%len(a.AdsMix)])
+			continue
+		}
+		if next == len(organic) {
+			break
+		}
+		mix = append(mix, organic[next])
+		next++
+	}
+	return mix
+}
+
+// configIndex returns the position in config of the config filling the
+// item at position, or its position in the AdsMix for ad slots
+func (a *App) configIndex(config ContentMix, position int) (index int, ad bool) {
+	if a.isAdSlot(position) {
+		return a.adSlotsBefore(position) % len(a.AdsMix), true
+	}
+	return (position - a.adSlotsBefore(position)) % len(config), false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestAdsAreInterleavedAtFixedPositions(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4, {Type: Provider2}}, sampleClients(), WithAdsMix(ContentMix{{Type: Provider3}}, 4))
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=12", nil))
+
+	want := []Provider{Provider1, Provider2, Provider1, Provider3, Provider2, Provider1, Provider2, Provider3, Provider1, Provider2, Provider1, Provider3}
+	if len(content) != len(want) {
+		t.Fatalf("Got %d items, want %d", len(content), len(want))
+	}
+	for i, item := range content {
+		if item.Source != string(want[i]) {
+			t.Errorf("Position %d: Got source %s, want %s", i+1, item.Source, want[i])
+		}
+	}
+}
+
+func TestOrganicRotationContinuesAcrossPagesWithAds(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4, {Type: Provider2}}, sampleClients(), WithAdsMix(ContentMix{{Type: Provider3}}, 4))
+	full := runRequest(t, srv, httptest.NewRequest("GET", "/?count=12", nil))
+
+	for _, offset := range []int{3, 4, 5, 7} {
+		page := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4&offset="+strconv.Itoa(offset), nil))
+		for i, item := range page {
+			if item.Source != full[offset+i].Source {
+				t.Errorf("Offset %d, position %d: Got source %s, want %s", offset, i, item.Source, full[offset+i].Source)
+			}
+		}
+	}
+}
+
+func TestAdsAreMarkedInDebugMode(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4, {Type: Provider2}}, sampleClients(), WithAdsMix(ContentMix{{Type: Provider3}}, 4))
+
+	response := runRawRequest(srv, "/?count=5&debug=true")
+
+	var content []struct {
+		Debug itemDebug `json:"debug"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&content); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	want := []itemDebug{
+		{ConfigIndex: 0, Provider: Provider1},
+		{ConfigIndex: 1, Provider: Provider2},
+		{ConfigIndex: 0, Provider: Provider1},
+		{ConfigIndex: 0, Ad: true, Provider: Provider3},
+		{ConfigIndex: 1, Provider: Provider2},
+	}
+	if len(content) != len(want) {
+		t.Fatalf("Got %d items, want %d", len(content), len(want))
+	}
+	for i, item := range content {
+		if item.Debug != want[i] {
+			t.Errorf("Position %d: Got %+v, want %+v", i+1, item.Debug, want[i])
+		}
+	}
+}
+
+func TestAdsMixIsValidated(t *testing.T) {
+	if _, err := NewApp(DefaultConfig, sampleClients(), WithAdsMix(ContentMix{{Type: "unknown"}}, 4)); err == nil {
+		t.Error("Got no error for an ads mix with an unknown provider")
+	}
+	if _, err := NewApp(DefaultConfig, sampleClients(), WithAdsMix(ContentMix{{Type: Provider3}}, 1)); err == nil {
+		t.Error("Got no error for an ads interval of 1")
+	}
+}
@@ -1,10 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var (
@@ -73,3 +87,1764 @@ func TestOffsetResponseOrder(t *testing.T) {
 		}
 	}
 }
+
+// FailingContentProvider is a client whose provider is always unavailable
+type FailingContentProvider struct{}
+
+func (FailingContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	return nil, errors.New("provider unavailable")
+}
+
+// UnmarshallableContentProvider returns items that cannot be encoded to JSON,
+// as their expiry lies outside of the range RFC 3339 can represent
+type UnmarshallableContentProvider struct{}
+
+func (UnmarshallableContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	resp := make([]*ContentItem, count)
+	for i := range resp {
+		resp[i] = &ContentItem{ID: strconv.Itoa(i), Expiry: time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC)}
+	}
+	return resp, nil
+}
+
+func TestFallbackIsUsedIfSourceFails(t *testing.T) {
+	srv := &App{
+		ContentClients: map[Provider]Client{
+			Provider1: FailingContentProvider{},
+			Provider2: SampleContentProvider{Source: Provider2},
+		},
+		Config: ContentMix{config1},
+	}
+
+	content := runRequest(t, srv, SimpleContentRequest)
+
+	if len(content) != 5 {
+		t.Fatalf("Got %d items back, want 5", len(content))
+	}
+	for i, item := range content {
+		if Provider(item.Source) != Provider2 {
+			t.Errorf("Position %d: Got Provider %v instead of fallback Provider %v", i, item.Source, Provider2)
+		}
+	}
+}
+
+func TestListGetsCutOffIfSourceAndFallbackFail(t *testing.T) {
+	srv := &App{
+		ContentClients: map[Provider]Client{
+			Provider1: SampleContentProvider{Source: Provider1},
+			Provider2: FailingContentProvider{},
+			Provider3: FailingContentProvider{},
+		},
+		Config: ContentMix{config1, config1, config2, config3},
+	}
+
+	content := runRequest(t, srv, SimpleContentRequest)
+
+	if len(content) != 2 {
+		t.Fatalf("Got %d items back, want 2", len(content))
+	}
+	for i, item := range content {
+		if Provider(item.Source) != Provider1 {
+			t.Errorf("Position %d: Got Provider %v instead of Provider %v", i, item.Source, Provider1)
+		}
+	}
+}
+
+func TestShortfallIsReportedWhenTheListGetsCutOff(t *testing.T) {
+	srv := &App{
+		ContentClients: map[Provider]Client{
+			Provider1: SampleContentProvider{Source: Provider1},
+			Provider2: FailingContentProvider{},
+			Provider3: FailingContentProvider{},
+		},
+		Config:          ContentMix{config1, config1, config2, config3},
+		ReportShortfall: true,
+	}
+
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, SimpleContentRequest)
+
+	if got := response.Header().Get(requestedCountHeader); got != "5" {
+		t.Errorf("Got %s %q, want 5", requestedCountHeader, got)
+	}
+	if got := response.Header().Get(returnedCountHeader); got != "2" {
+		t.Errorf("Got %s %q, want 2", returnedCountHeader, got)
+	}
+}
+
+func TestShortfallCountsPlaceholdersAsMissing(t *testing.T) {
+	clients := sampleClients()
+	clients[Provider2] = FailingContentProvider{}
+	srv, _ := NewApp(ContentMix{config4, {Type: Provider2}}, clients, WithDefaultItem(ContentItem{ID: "house-ad"}), WithShortfallHeaders())
+
+	response := runRawRequest(srv, "/?count=4")
+
+	if got := response.Header().Get(returnedCountHeader); got != "2" {
+		t.Errorf("Got %s %q, want 2", returnedCountHeader, got)
+	}
+}
+
+func TestShortfallIsNotReportedByDefault(t *testing.T) {
+	response := runRawRequest(app, "/?count=2")
+
+	if response.Header().Get(requestedCountHeader) != "" || response.Header().Get(returnedCountHeader) != "" {
+		t.Errorf("Got shortfall headers %v", response.Header())
+	}
+}
+
+func TestTruncatedPagesArePartialContentUnderTheOption(t *testing.T) {
+	clients := map[Provider]Client{
+		Provider1: SampleContentProvider{Source: Provider1},
+		Provider2: FailingContentProvider{},
+		Provider3: FailingContentProvider{},
+	}
+	srv, _ := NewApp(ContentMix{config1, config1, config2, config3}, clients, WithPartialContentStatus())
+
+	response := runRawRequest(srv, "/?count=5")
+
+	if response.Code != http.StatusPartialContent {
+		t.Errorf("Got status %d for a truncated page, want 206", response.Code)
+	}
+	if got := response.Header().Get("Content-Range"); got != "items 0-1/*" {
+		t.Errorf("Got Content-Range %q, want items 0-1/*", got)
+	}
+	if got, want := response.Header().Get(requestedCountHeader)+"/"+response.Header().Get(returnedCountHeader), "5/2"; got != want {
+		t.Errorf("Got requested and returned counts %s, want %s", got, want)
+	}
+
+	if response := runRawRequest(srv, "/?count=2"); response.Code != http.StatusOK {
+		t.Errorf("Got status %d for a complete page, want 200", response.Code)
+	}
+	defaults, _ := NewApp(ContentMix{config1, config1, config2, config3}, clients)
+	if response := runRawRequest(defaults, "/?count=5"); response.Code != http.StatusOK {
+		t.Errorf("Got status %d for a truncated page by default, want 200", response.Code)
+	}
+}
+
+func TestInvalidParametersAreRejected(t *testing.T) {
+	for _, target := range []string{"/", "/?count=abc", "/?count=-1", "/?count=5&offset=x", "/?count=5&offset=9223372036854775807", "/?count=9223372036854775807&offset=1"} {
+		response := httptest.NewRecorder()
+		app.ServeHTTP(response, httptest.NewRequest("GET", target, nil))
+
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("%s: Response code is %d, want 400", target, response.Code)
+		}
+	}
+}
+
+func TestMarshallingFailureReturnsCleanInternalServerError(t *testing.T) {
+	srv := &App{
+		ContentClients: map[Provider]Client{Provider1: UnmarshallableContentProvider{}},
+		Config:         ContentMix{config4},
+	}
+
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, SimpleContentRequest)
+
+	if response.Code != http.StatusInternalServerError {
+		t.Fatalf("Response code is %d, want 500", response.Code)
+	}
+	want := `{"error":"Internal Server Error"}` + "\n"
+	if response.Body.String() != want {
+		t.Errorf("Got body %q, want %q", response.Body.String(), want)
+	}
+}
+
+func TestAllProvidersFailingReturnsEmptyArray(t *testing.T) {
+	srv := &App{
+		ContentClients: map[Provider]Client{
+			Provider1: FailingContentProvider{},
+			Provider2: FailingContentProvider{},
+		},
+		Config: ContentMix{config1},
+	}
+
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, SimpleContentRequest)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Response code is %d, want 200", response.Code)
+	}
+	if body := strings.TrimSpace(response.Body.String()); body != "[]" {
+		t.Errorf("Got body %q, want []", body)
+	}
+}
+
+func TestZeroCountReturnsEmptyArray(t *testing.T) {
+	response := httptest.NewRecorder()
+	app.ServeHTTP(response, httptest.NewRequest("GET", "/?count=0", nil))
+
+	if body := strings.TrimSpace(response.Body.String()); body != "[]" {
+		t.Errorf("Got body %q, want []", body)
+	}
+}
+
+func TestAllProvidersFailingWithNoContentPolicy(t *testing.T) {
+	srv := &App{
+		ContentClients:      map[Provider]Client{Provider1: FailingContentProvider{}},
+		Config:              ContentMix{config4},
+		EmptyResponsePolicy: EmptyResponseNoContent,
+	}
+
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, SimpleContentRequest)
+
+	if response.Code != http.StatusNoContent {
+		t.Fatalf("Response code is %d, want 204", response.Code)
+	}
+	if response.Body.Len() != 0 {
+		t.Errorf("Got body %q, want none", response.Body.String())
+	}
+}
+
+func runRawRequest(srv http.Handler, target string) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, httptest.NewRequest("GET", target, nil))
+	return response
+}
+
+func TestFieldsParameterRestrictsItemFields(t *testing.T) {
+	response := runRawRequest(app, "/?count=3&fields=source,id")
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Response code is %d, want 200", response.Code)
+	}
+	var content []map[string]interface{}
+	if err := json.NewDecoder(response.Body).Decode(&content); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	if len(content) != 3 {
+		t.Fatalf("Got %d items back, want 3", len(content))
+	}
+	for i, item := range content {
+		if len(item) != 2 || item["source"] == nil || item["id"] == nil {
+			t.Errorf("Position %d: Got fields %v, want only source and id", i, item)
+		}
+	}
+}
+
+func TestSummaryParameterReturnsItemSummaries(t *testing.T) {
+	for query, wantFields := range map[string]int{"summary=true": 2, "summary=false": 6, "summary=1&fields=title": 2} {
+		response := runRawRequest(app, "/?count=3&"+query)
+		if response.Code != http.StatusOK {
+			t.Fatalf("%s: Response code is %d, want 200", query, response.Code)
+		}
+		var content []map[string]interface{}
+		if err := json.NewDecoder(response.Body).Decode(&content); err != nil {
+			t.Fatalf("%s: couldn't decode Response json: %v", query, err)
+		}
+		for i, item := range content {
+			if len(item) != wantFields || item["source"] == nil || item["id"] == nil {
+				t.Errorf("%s: Position %d: Got fields %v, want %d fields including source and id", query, i, item, wantFields)
+			}
+		}
+	}
+
+	if response := runRawRequest(app, "/?count=3&summary=maybe"); response.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for an invalid summary, want 400", response.Code)
+	}
+}
+
+func TestUnknownFieldsAreIgnoredUnlessStrict(t *testing.T) {
+	response := runRawRequest(app, "/?count=1&fields=source,colour")
+	if response.Code != http.StatusOK {
+		t.Fatalf("Lenient: Response code is %d, want 200", response.Code)
+	}
+	if body := response.Body.String(); !strings.Contains(body, `"source"`) || strings.Contains(body, "colour") {
+		t.Errorf("Lenient: Got body %q, want only the source field", body)
+	}
+
+	strict, _ := NewApp(DefaultConfig, sampleClients(), WithStrictFields())
+	response = runRawRequest(strict, "/?count=1&fields=source,colour")
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("Strict: Response code is %d, want 400", response.Code)
+	}
+}
+
+func TestProvidedRequestIDIsEchoed(t *testing.T) {
+	r := httptest.NewRequest("GET", "/?count=1", nil)
+	r.Header.Set("X-Request-ID", "abc-123")
+	response := httptest.NewRecorder()
+	app.ServeHTTP(response, r)
+
+	if id := response.Header().Get("X-Request-ID"); id != "abc-123" {
+		t.Errorf("Got request id %q, want abc-123", id)
+	}
+}
+
+func TestRequestIDIsGeneratedIfAbsent(t *testing.T) {
+	uuidPattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	first := runRawRequest(app, "/?count=1").Header().Get("X-Request-ID")
+	second := runRawRequest(app, "/?count=1").Header().Get("X-Request-ID")
+
+	if !uuidPattern.MatchString(first) {
+		t.Errorf("Got request id %q, want a UUID", first)
+	}
+	if first == second {
+		t.Errorf("Got the same request id %q for two requests", first)
+	}
+}
+
+func TestRequestIDIsLoggedForProviderFailures(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	srv := &App{
+		ContentClients: map[Provider]Client{Provider1: FailingContentProvider{}},
+		Config:         ContentMix{config4},
+	}
+	r := httptest.NewRequest("GET", "/?count=1", nil)
+	r.Header.Set("X-Request-ID", "trace-me")
+	srv.ServeHTTP(httptest.NewRecorder(), r)
+
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if !strings.Contains(line, "[trace-me]") {
+			t.Errorf("Log line %q misses the request id", line)
+		}
+	}
+	if !strings.Contains(logs.String(), "could not fetch content") {
+		t.Errorf("Provider failure was not logged: %q", logs.String())
+	}
+}
+
+// FixedContentProvider always returns the same items, however many were asked for
+type FixedContentProvider struct {
+	Items []*ContentItem
+}
+
+func (cp FixedContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	resp := make([]*ContentItem, len(cp.Items))
+	copy(resp, cp.Items)
+	return resp, nil
+}
+
+func fixedItems(source Provider, ids ...string) FixedContentProvider {
+	items := make([]*ContentItem, len(ids))
+	for i, id := range ids {
+		items[i] = &ContentItem{ID: id, Source: string(source)}
+	}
+	return FixedContentProvider{Items: items}
+}
+
+func itemIDs(content []*ContentItem) string {
+	ids := make([]string, len(content))
+	for i, item := range content {
+		ids[i] = item.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestDuplicatesAreSkippedAndBackfilled(t *testing.T) {
+	srv := &App{
+		ContentClients: map[Provider]Client{
+			Provider1: fixedItems(Provider1, "a", "b"),
+			Provider2: fixedItems(Provider2, "a", "x", "y"),
+		},
+		Config:        ContentMix{{Type: Provider1}, {Type: Provider2}},
+		DeduplicateBy: "id",
+	}
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	if ids := itemIDs(content); ids != "a,x,b,y" {
+		t.Errorf("Got items %s, want a,x,b,y", ids)
+	}
+}
+
+func TestDeduplicationCutsOffWhenConfigIsExhausted(t *testing.T) {
+	srv := &App{
+		ContentClients: map[Provider]Client{
+			Provider1: fixedItems(Provider1, "a", "b", "c"),
+			Provider2: fixedItems(Provider2, "a", "b"),
+		},
+		Config:        ContentMix{{Type: Provider1}, {Type: Provider2}},
+		DeduplicateBy: "id",
+	}
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	if ids := itemIDs(content); ids != "a,b,c" {
+		t.Errorf("Got items %s, want a,b,c", ids)
+	}
+}
+
+func TestDuplicatesAreKeptWithoutDeduplication(t *testing.T) {
+	srv := &App{
+		ContentClients: map[Provider]Client{
+			Provider1: fixedItems(Provider1, "a", "b"),
+			Provider2: fixedItems(Provider2, "a", "x"),
+		},
+		Config: ContentMix{{Type: Provider1}, {Type: Provider2}},
+	}
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	if ids := itemIDs(content); ids != "a,a,b,x" {
+		t.Errorf("Got items %s, want a,a,b,x", ids)
+	}
+}
+
+func TestSurplusItemsAreTrimmedToTheRequestedCount(t *testing.T) {
+	ids := make([]string, 50)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+	}
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: fixedItems(Provider1, ids...)})
+
+	contents := srv.fetchItemsForConfig(context.Background(), config4, 3, "")
+	if len(contents.Items) != 3 || cap(contents.Items) != 3 {
+		t.Errorf("Got %d items with capacity %d, want the 3 requested only", len(contents.Items), cap(contents.Items))
+	}
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=3", nil))
+	if got := itemIDs(content); got != "0,1,2" {
+		t.Errorf("Got items %s, want 0,1,2", got)
+	}
+}
+
+// SharedSliceContentProvider returns its own slice of items rather than a
+// copy, so that every caller shares its backing array
+type SharedSliceContentProvider struct {
+	Items []*ContentItem
+}
+
+func (cp SharedSliceContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	if count > len(cp.Items) {
+		count = len(cp.Items)
+	}
+	return cp.Items[:count], nil
+}
+
+func TestConfigsSharingABackingSliceGetTheirOwnItems(t *testing.T) {
+	shared := fixedItems(Provider1, "a", "b", "c", "d", "e", "f").Items
+	srv, _ := NewApp(ContentMix{config1, config4}, map[Provider]Client{
+		Provider1: SharedSliceContentProvider{Items: shared},
+		Provider2: FailingContentProvider{},
+	})
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=6", nil))
+
+	if ids := itemIDs(content); ids != "a,a,b,b,c,c" {
+		t.Errorf("Got items %s, want a,a,b,b,c,c", ids)
+	}
+	if ids := itemIDs(shared); ids != "a,b,c,d,e,f" {
+		t.Errorf("Provider's items were changed to %s", ids)
+	}
+}
+
+func TestBackfillDoesNotWriteIntoSharedBackingSlice(t *testing.T) {
+	shared := fixedItems(Provider1, "a", "b", "c", "d", "e", "f").Items
+	srv, _ := NewApp(ContentMix{config4, {Type: Provider2}}, map[Provider]Client{
+		Provider1: SharedSliceContentProvider{Items: shared},
+		Provider2: FailingContentProvider{},
+	}, WithBackfill(1))
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	if ids := itemIDs(content); ids != "a,b,a,b" {
+		t.Errorf("Got items %s, want a,b,a,b", ids)
+	}
+	if ids := itemIDs(shared); ids != "a,b,c,d,e,f" {
+		t.Errorf("Provider's items were changed to %s", ids)
+	}
+}
+
+// CountingContentProvider counts how often the wrapped client gets called
+// and how many items it was asked for in total
+type CountingContentProvider struct {
+	Client    Client
+	calls     int32
+	requested int32
+}
+
+func (cp *CountingContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	atomic.AddInt32(&cp.calls, 1)
+	atomic.AddInt32(&cp.requested, int32(count))
+	return cp.Client.GetContent(ctx, userIP, count)
+}
+
+func (cp *CountingContentProvider) Calls() int {
+	return int(atomic.LoadInt32(&cp.calls))
+}
+
+func (cp *CountingContentProvider) Requested() int {
+	return int(atomic.LoadInt32(&cp.requested))
+}
+
+func TestHealthReportsBreakerState(t *testing.T) {
+	breaker := NewCircuitBreakerClient(FailingContentProvider{}, 1, time.Minute)
+	srv := &App{
+		ContentClients: map[Provider]Client{
+			Provider1: breaker,
+			Provider2: SampleContentProvider{Source: Provider2},
+		},
+		Config: ContentMix{config1},
+	}
+	runRequest(t, srv, httptest.NewRequest("GET", "/?count=1", nil))
+
+	response := runRawRequest(srv, "/health")
+
+	var health struct {
+		Providers map[Provider]providerHealth `json:"providers"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&health); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	if state := health.Providers[Provider1].Breaker; state != BreakerOpen {
+		t.Errorf("Got breaker state %q for provider 1, want %q", state, BreakerOpen)
+	}
+	if _, ok := health.Providers[Provider2]; !ok {
+		t.Errorf("Provider 2 is missing from %v", health.Providers)
+	}
+}
+
+func providerSequence(content []*ContentItem) string {
+	sources := make([]string, len(content))
+	for i, item := range content {
+		sources[i] = item.Source
+	}
+	return strings.Join(sources, "")
+}
+
+func TestMixStrategiesDistributeProviders(t *testing.T) {
+	config2 := ContentConfig{Type: Provider2}
+	srv := &App{
+		ContentClients: app.ContentClients,
+		Config:         ContentMix{config4, config4, config4, config4, config2, config2},
+	}
+	request := httptest.NewRequest("GET", "/?count=12", nil)
+
+	rotation := providerSequence(runRequest(t, srv, request))
+	srv.MixStrategy = MixWeighted
+	weighted := providerSequence(runRequest(t, srv, request))
+
+	if rotation != "111122111122" {
+		t.Errorf("Rotation: Got providers %s, want 111122111122", rotation)
+	}
+	if weighted != "121121121121" {
+		t.Errorf("Weighted: Got providers %s, want 121121121121", weighted)
+	}
+	for _, sequence := range []string{rotation, weighted} {
+		if strings.Count(sequence, "1") != 8 || strings.Count(sequence, "2") != 4 {
+			t.Errorf("Got providers %s, want 8 items of provider 1 and 4 of provider 2", sequence)
+		}
+	}
+}
+
+func TestFallbackItemsAreAnnotated(t *testing.T) {
+	srv := &App{
+		ContentClients: map[Provider]Client{
+			Provider1: FailingContentProvider{},
+			Provider2: SampleContentProvider{Source: Provider2},
+		},
+		Config:            ContentMix{config1, config2},
+		AnnotateFallbacks: true,
+	}
+
+	response := runRawRequest(srv, "/?count=4")
+
+	var content []annotatedItem
+	if err := json.NewDecoder(response.Body).Decode(&content); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	if len(content) != 4 {
+		t.Fatalf("Got %d items back, want 4", len(content))
+	}
+	for i, item := range content {
+		wantFallback := i%2 == 0
+		if item.Fallback != wantFallback || item.Provider != Provider2 {
+			t.Errorf("Position %d: Got provider %v with fallback %t, want provider 2 with fallback %t",
+				i, item.Provider, item.Fallback, wantFallback)
+		}
+	}
+}
+
+func TestItemsAreNotAnnotatedByDefault(t *testing.T) {
+	response := runRawRequest(app, "/?count=1")
+
+	if body := response.Body.String(); strings.Contains(body, `"fallback"`) {
+		t.Errorf("Got annotated body %q", body)
+	}
+}
+
+func TestDebugAnnotatesItemsWithTheirConfigPosition(t *testing.T) {
+	response := runRawRequest(app, "/?offset=6&count=6&debug=true")
+
+	var content []struct {
+		Source Provider  `json:"source"`
+		Debug  itemDebug `json:"debug"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&content); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	if len(content) != 6 {
+		t.Fatalf("Got %d items back, want 6", len(content))
+	}
+	for i, item := range content {
+		wantIndex := (6 + i) % len(DefaultConfig)
+		if item.Debug.ConfigIndex != wantIndex {
+			t.Errorf("Position %d: Got config index %d, want %d", i, item.Debug.ConfigIndex, wantIndex)
+		}
+		if want := DefaultConfig[wantIndex].Type; item.Debug.Provider != want || item.Source != want {
+			t.Errorf("Position %d: Got provider %v serving source %v, want %v", i, item.Debug.Provider, item.Source, want)
+		}
+	}
+}
+
+func TestDebugAnnotationsFollowSummaries(t *testing.T) {
+	response := runRawRequest(app, "/?count=1&summary=true&debug=true")
+
+	var content []map[string]json.RawMessage
+	if err := json.NewDecoder(response.Body).Decode(&content); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	if len(content) != 1 || content[0]["debug"] == nil || content[0]["expiry"] != nil {
+		t.Errorf("Got %v, want a debug annotated summary", content)
+	}
+}
+
+func TestItemsHaveNoDebugAnnotationsByDefault(t *testing.T) {
+	for _, target := range []string{"/?count=2", "/?count=2&debug=false"} {
+		response := runRawRequest(app, target)
+
+		if body := response.Body.String(); strings.Contains(body, `"debug"`) {
+			t.Errorf("%s: Got debug annotated body %q", target, body)
+		}
+	}
+}
+
+func TestInvalidDebugIsRejected(t *testing.T) {
+	response := runRawRequest(app, "/?count=2&debug=maybe")
+
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d, want 400", response.Code)
+	}
+}
+
+// ThrottlingContentProvider answers with a RateLimitedError for the first
+// Throttled calls and then delegates to the wrapped client
+type ThrottlingContentProvider struct {
+	Client     Client
+	Throttled  int32
+	RetryAfter time.Duration
+	calls      int32
+}
+
+func (cp *ThrottlingContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	if atomic.AddInt32(&cp.calls, 1) <= cp.Throttled {
+		return nil, RateLimitedError{After: cp.RetryAfter}
+	}
+	return cp.Client.GetContent(ctx, userIP, count)
+}
+
+func TestThrottledProviderSkipsToFallback(t *testing.T) {
+	srv := &App{
+		ContentClients: map[Provider]Client{
+			Provider1: &ThrottlingContentProvider{Client: SampleContentProvider{Source: Provider1}, Throttled: 1, RetryAfter: time.Millisecond},
+			Provider2: SampleContentProvider{Source: Provider2},
+		},
+		Config: ContentMix{config1},
+	}
+
+	content := runRequest(t, srv, SimpleContentRequest)
+
+	if sources := providerSequence(content); sources != "22222" {
+		t.Errorf("Got providers %s, want 22222", sources)
+	}
+}
+
+func TestThrottledProviderIsRetriedWithinMaxRetryWait(t *testing.T) {
+	srv := &App{
+		ContentClients: map[Provider]Client{
+			Provider1: &ThrottlingContentProvider{Client: SampleContentProvider{Source: Provider1}, Throttled: 1, RetryAfter: 10 * time.Millisecond},
+			Provider2: SampleContentProvider{Source: Provider2},
+		},
+		Config:       ContentMix{config1},
+		MaxRetryWait: time.Second,
+	}
+
+	content := runRequest(t, srv, SimpleContentRequest)
+
+	if sources := providerSequence(content); sources != "11111" {
+		t.Errorf("Got providers %s, want 11111", sources)
+	}
+}
+
+func TestAllProvidersThrottledReturnsTooManyRequests(t *testing.T) {
+	srv := &App{
+		ContentClients: map[Provider]Client{
+			Provider1: &ThrottlingContentProvider{Throttled: 1, RetryAfter: 2500 * time.Millisecond},
+			Provider2: &ThrottlingContentProvider{Throttled: 1, RetryAfter: 4 * time.Second},
+		},
+		Config: ContentMix{config1},
+	}
+
+	response := runRawRequest(srv, "/?count=2")
+
+	if response.Code != http.StatusTooManyRequests {
+		t.Fatalf("Response code is %d, want 429", response.Code)
+	}
+	if retryAfter := response.Header().Get("Retry-After"); retryAfter != "3" {
+		t.Errorf("Got Retry-After %q, want 3", retryAfter)
+	}
+}
+
+func TestDuplicateParametersAreRejected(t *testing.T) {
+	for _, target := range []string{"/?count=5&count=10", "/?count=5&offset=1&offset=2"} {
+		response := runRawRequest(app, target)
+
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("%s: Response code is %d, want 400", target, response.Code)
+		}
+		if body := response.Body.String(); !strings.Contains(body, "only be given once") {
+			t.Errorf("%s: Got body %q, want a hint about the repeated parameter", target, body)
+		}
+	}
+}
+
+func TestDuplicateParametersUseFirstValueWhenLenient(t *testing.T) {
+	lenient, _ := NewApp(DefaultConfig, sampleClients(), WithLenientQuery())
+
+	content := runRequest(t, lenient, httptest.NewRequest("GET", "/?count=2&count=10", nil))
+	if len(content) != 2 {
+		t.Errorf("Got %d items back, want 2", len(content))
+	}
+
+	content = runRequest(t, lenient, httptest.NewRequest("GET", "/?count=5&offset=5&offset=0", nil))
+	for j, item := range content {
+		i := j + 5
+		if Provider(item.Source) != DefaultConfig[i%len(DefaultConfig)].Type {
+			t.Errorf("Position %d: Got Provider %v instead of Provider %v", i, item.Source, DefaultConfig[i].Type)
+		}
+	}
+}
+
+func TestDefaultFallbackAppliesToConfigsWithoutFallback(t *testing.T) {
+	srv, err := NewApp(
+		ContentMix{config1, config4},
+		map[Provider]Client{
+			Provider1: FailingContentProvider{},
+			Provider2: SampleContentProvider{Source: Provider2},
+			Provider3: SampleContentProvider{Source: Provider3},
+		},
+		WithDefaultFallback(Provider3),
+	)
+	if err != nil {
+		t.Fatalf("NewApp failed: %v", err)
+	}
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	// config1 falls back to its own fallback 2, config4 to the default 3
+	if sources := providerSequence(content); sources != "2323" {
+		t.Errorf("Got providers %s, want 2323", sources)
+	}
+}
+
+// BlockingContentProvider blocks until the request's context is done and
+// reports every call on Started
+type BlockingContentProvider struct {
+	Started chan struct{}
+}
+
+func (cp BlockingContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	cp.Started <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCancelledRequestStopsFetching(t *testing.T) {
+	blocking := BlockingContentProvider{Started: make(chan struct{}, 10)}
+	fallback := &CountingContentProvider{Client: SampleContentProvider{Source: Provider2}}
+	srv := &App{
+		ContentClients: map[Provider]Client{Provider1: blocking, Provider2: fallback},
+		Config:         ContentMix{config1},
+	}
+	goroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.ServeHTTP(httptest.NewRecorder(), SimpleContentRequest.WithContext(ctx))
+		close(done)
+	}()
+	<-blocking.Started
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Request did not return after its context was cancelled")
+	}
+	if fallback.Calls() != 0 {
+		t.Errorf("Fallback was called %d times after the request was cancelled", fallback.Calls())
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if leaked := runtime.NumGoroutine() - goroutines; leaked > 0 {
+		t.Errorf("%d goroutines are still running after the request was cancelled", leaked)
+	}
+}
+
+func TestNamedMixesAreRouted(t *testing.T) {
+	srv, err := NewApp(DefaultConfig, sampleClients(),
+		WithMix("mobile", ContentMix{config2, config3}),
+		WithMix("web", ContentMix{config3, config4}),
+	)
+	if err != nil {
+		t.Fatalf("NewApp failed: %v", err)
+	}
+
+	mobile := providerSequence(runRequest(t, srv, httptest.NewRequest("GET", "/mix/mobile?count=4&offset=1", nil)))
+	web := providerSequence(runRequest(t, srv, httptest.NewRequest("GET", "/mix/web?count=4", nil)))
+	root := providerSequence(runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil)))
+
+	if mobile != "3232" {
+		t.Errorf("Mobile: Got providers %s, want 3232", mobile)
+	}
+	if web != "3131" {
+		t.Errorf("Web: Got providers %s, want 3131", web)
+	}
+	if root != "1123" {
+		t.Errorf("Default: Got providers %s, want 1123", root)
+	}
+}
+
+func TestUnknownMixIsNotFound(t *testing.T) {
+	response := runRawRequest(app, "/mix/tv?count=4")
+
+	if response.Code != http.StatusNotFound {
+		t.Errorf("Response code is %d, want 404", response.Code)
+	}
+}
+
+// TimestampingContentProvider records when it gets called
+type TimestampingContentProvider struct {
+	Client Client
+
+	mu    *sync.Mutex
+	calls *[]time.Time
+}
+
+func (cp TimestampingContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	cp.mu.Lock()
+	*cp.calls = append(*cp.calls, time.Now())
+	cp.mu.Unlock()
+	return cp.Client.GetContent(ctx, userIP, count)
+}
+
+// callSpread returns the time between the first and the last provider call
+// of a request to a mix of eight different providers
+func callSpread(t *testing.T, maxJitter time.Duration) time.Duration {
+	var mu sync.Mutex
+	var calls []time.Time
+	srv := &App{ContentClients: map[Provider]Client{}, MaxJitter: maxJitter}
+	for i := 0; i < 8; i++ {
+		provider := Provider(strconv.Itoa(i))
+		srv.ContentClients[provider] = TimestampingContentProvider{
+			Client: SampleContentProvider{Source: provider},
+			mu:     &mu,
+			calls:  &calls,
+		}
+		srv.Config = append(srv.Config, ContentConfig{Type: provider})
+	}
+
+	runRequest(t, srv, httptest.NewRequest("GET", "/?count=8", nil))
+
+	first, last := calls[0], calls[0]
+	for _, call := range calls {
+		if call.Before(first) {
+			first = call
+		}
+		if call.After(last) {
+			last = call
+		}
+	}
+	return last.Sub(first)
+}
+
+func TestJitterSpreadsProviderCalls(t *testing.T) {
+	if spread := callSpread(t, 0); spread > 20*time.Millisecond {
+		t.Errorf("Without jitter: Calls were spread over %v, want them to be simultaneous", spread)
+	}
+	if spread := callSpread(t, 200*time.Millisecond); spread < 20*time.Millisecond {
+		t.Errorf("With jitter: Calls were spread over %v, want them to be spread out", spread)
+	}
+}
+
+func TestStrictModeFailsRequestWhenAProviderFails(t *testing.T) {
+	clients := map[Provider]Client{
+		Provider1: SampleContentProvider{Source: Provider1},
+		Provider2: FailingContentProvider{},
+		Provider3: FailingContentProvider{},
+	}
+	config := ContentMix{config1, config1, config2, config3}
+
+	lenient, _ := NewApp(config, clients)
+	if content := runRequest(t, lenient, SimpleContentRequest); len(content) != 2 {
+		t.Errorf("Lenient: Got %d items back, want 2", len(content))
+	}
+
+	strict, _ := NewApp(config, clients, WithStrictMode())
+	response := runRawRequest(strict, "/?count=5")
+	if response.Code != http.StatusBadGateway {
+		t.Errorf("Strict: Response code is %d, want 502", response.Code)
+	}
+}
+
+func TestStrictModeServesCompletePages(t *testing.T) {
+	strict, _ := NewApp(DefaultConfig, sampleClients(), WithStrictMode())
+
+	if content := runRequest(t, strict, SimpleContentRequest); len(content) != 5 {
+		t.Errorf("Got %d items back, want 5", len(content))
+	}
+}
+
+func TestSuccessfulResponsesCarryCachingHeaders(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithCacheMaxAge(time.Minute))
+
+	before := time.Now().Truncate(time.Second)
+	response := runRawRequest(srv, "/?count=1")
+
+	if cacheControl := response.Header().Get("Cache-Control"); cacheControl != "public, max-age=60" {
+		t.Errorf("Got Cache-Control %q, want public, max-age=60", cacheControl)
+	}
+	expires, err := http.ParseTime(response.Header().Get("Expires"))
+	if err != nil {
+		t.Fatalf("couldn't parse Expires: %v", err)
+	}
+	if expires.Before(before.Add(time.Minute)) || expires.After(time.Now().Add(time.Minute)) {
+		t.Errorf("Got Expires %v, want a minute from now", expires)
+	}
+}
+
+func TestErrorResponsesAreNotCached(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithCacheMaxAge(time.Minute))
+
+	response := runRawRequest(srv, "/?count=x")
+
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Response code is %d, want 400", response.Code)
+	}
+	if cacheControl := response.Header().Get("Cache-Control"); cacheControl != "no-store" {
+		t.Errorf("Got Cache-Control %q, want no-store", cacheControl)
+	}
+	if expires := response.Header().Get("Expires"); expires != "" {
+		t.Errorf("Got Expires %q, want none", expires)
+	}
+}
+
+func TestNoStoreMixesAreNotCached(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(),
+		WithCacheMaxAge(time.Minute),
+		WithMix("live", ContentMix{config4}),
+		WithNoStoreMix("live"),
+	)
+
+	response := runRawRequest(srv, "/mix/live?count=1")
+
+	if cacheControl := response.Header().Get("Cache-Control"); cacheControl != "no-store" {
+		t.Errorf("Got Cache-Control %q, want no-store", cacheControl)
+	}
+}
+
+func TestOverFetchAsksProvidersForMore(t *testing.T) {
+	provider := &CountingContentProvider{Client: SampleContentProvider{Source: Provider1}}
+	clients := map[Provider]Client{Provider1: provider}
+
+	srv, _ := NewApp(ContentMix{config4}, clients, WithOverFetch(1.5), WithMaxCount(0))
+	content := runRequest(t, srv, SimpleContentRequest)
+
+	if provider.Requested() != 8 {
+		t.Errorf("Provider was asked for %d items, want 8", provider.Requested())
+	}
+	if len(content) != 5 {
+		t.Errorf("Got %d items back, want 5", len(content))
+	}
+}
+
+func TestHealthyProviderOfFirstTierIsUsed(t *testing.T) {
+	tierTwo := &CountingContentProvider{Client: SampleContentProvider{Source: Provider3}}
+	tiers := ProviderTiers{{Provider1, Provider2}, {Provider3}}
+	srv, err := NewApp(
+		ContentMix{{Type: Provider1, Tiers: &tiers}},
+		map[Provider]Client{
+			Provider1: FailingContentProvider{},
+			Provider2: SampleContentProvider{Source: Provider2},
+			Provider3: tierTwo,
+		},
+	)
+	if err != nil {
+		t.Fatalf("NewApp failed: %v", err)
+	}
+
+	// round-robin starts the tier at either provider, both must end on 2
+	for i := 0; i < 2; i++ {
+		content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=3", nil))
+		if sources := providerSequence(content); sources != "222" {
+			t.Errorf("Got providers %s, want 222", sources)
+		}
+	}
+	if tierTwo.Calls() != 0 {
+		t.Errorf("Second tier was called %d times, want 0", tierTwo.Calls())
+	}
+}
+
+func TestRandomTierSelectionSpreadsCalls(t *testing.T) {
+	first := &CountingContentProvider{Client: SampleContentProvider{Source: Provider1}}
+	second := &CountingContentProvider{Client: SampleContentProvider{Source: Provider2}}
+	tiers := ProviderTiers{{Provider1, Provider2}}
+	srv, _ := NewApp(
+		ContentMix{{Type: Provider1, Tiers: &tiers}},
+		map[Provider]Client{Provider1: first, Provider2: second},
+		WithTierSelection(TierRandom),
+	)
+
+	for i := 0; i < 50; i++ {
+		runRequest(t, srv, httptest.NewRequest("GET", "/?count=1", nil))
+	}
+	if first.Calls() == 0 || second.Calls() == 0 {
+		t.Errorf("Got %d and %d calls, want both providers to be used", first.Calls(), second.Calls())
+	}
+	if first.Calls()+second.Calls() != 50 {
+		t.Errorf("Got %d calls, want 50", first.Calls()+second.Calls())
+	}
+}
+
+func TestAdaptiveFallbacksPreferReliableProviders(t *testing.T) {
+	flaky := &CountingContentProvider{Client: SampleContentProvider{Source: Provider2}}
+	reliable := &CountingContentProvider{Client: SampleContentProvider{Source: Provider3}}
+	tiers := ProviderTiers{{Provider1}, {Provider2, Provider3}}
+	srv, _ := NewApp(
+		ContentMix{{Type: Provider1, Tiers: &tiers}},
+		map[Provider]Client{Provider1: FailingContentProvider{}, Provider2: flaky, Provider3: reliable},
+		WithAdaptiveFallbacks(),
+	)
+	for i := 0; i < 10; i++ {
+		srv.Metrics.observeProvider(Provider2, time.Millisecond)
+		srv.Metrics.observeProvider(Provider3, time.Millisecond)
+	}
+	for i := 0; i < 6; i++ {
+		srv.Metrics.observeProviderError(Provider2, classUnavailable)
+	}
+	srv.Metrics.observeProviderError(Provider3, classUnavailable)
+
+	for i := 0; i < 10; i++ {
+		if sources := providerSequence(runRequest(t, srv, httptest.NewRequest("GET", "/?count=1", nil))); sources != "3" {
+			t.Errorf("Got providers %s, want the reliable fallback 3", sources)
+		}
+	}
+	if flaky.Calls() != 0 {
+		t.Errorf("Flaky fallback was called %d times, want 0", flaky.Calls())
+	}
+}
+
+func TestAdaptiveFallbacksAreReproducibleWithSeed(t *testing.T) {
+	tiers := ProviderTiers{{Provider1}, {Provider2, Provider3}}
+	fallbacks := func() string {
+		clients := sampleClients()
+		clients[Provider1] = FailingContentProvider{}
+		srv, _ := NewApp(ContentMix{{Type: Provider1, Tiers: &tiers}}, clients, WithAdaptiveFallbacks(), WithRandSeed(7))
+		var sources string
+		for i := 0; i < 20; i++ {
+			sources += providerSequence(runRequest(t, srv, httptest.NewRequest("GET", "/?count=1", nil)))
+		}
+		return sources
+	}
+
+	if first, second := fallbacks(), fallbacks(); first != second {
+		t.Errorf("Got fallbacks %s and %s with the same seed, want the same", first, second)
+	}
+}
+
+func TestSeededTierSelectionIsReproducible(t *testing.T) {
+	tiers := ProviderTiers{{Provider1, Provider2, Provider3}}
+	selections := func() string {
+		srv, _ := NewApp(ContentMix{{Type: Provider1, Tiers: &tiers}}, sampleClients(), WithTierSelection(TierRandom), WithRandSeed(42))
+		var sources string
+		for i := 0; i < 30; i++ {
+			sources += providerSequence(runRequest(t, srv, httptest.NewRequest("GET", "/?count=1", nil)))
+		}
+		return sources
+	}
+
+	first, second := selections(), selections()
+	if first != second {
+		t.Errorf("Got providers %s and %s with the same seed, want the same", first, second)
+	}
+	if strings.Trim(first, "1") == "" || strings.Trim(first, "2") == "" || strings.Trim(first, "3") == "" {
+		t.Errorf("Got providers %s, want random ones", first)
+	}
+}
+
+func TestShuffledTiersAreReproducibleWithSeed(t *testing.T) {
+	tiers := ProviderTiers{{Provider1, Provider2, Provider3}}
+	chains := func() []string {
+		srv, _ := NewApp(ContentMix{{Type: Provider1, Tiers: &tiers}}, sampleClients(), WithTierSelection(TierShuffle), WithRandSeed(42))
+		orders := make([]string, 30)
+		for i := range orders {
+			orders[i] = fmt.Sprint(srv.providerChain(srv.Config[0]))
+		}
+		return orders
+	}
+
+	first, second := chains(), chains()
+	distinct := map[string]bool{}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("Fetch %d: Got chains %s and %s with the same seed, want the same", i, first[i], second[i])
+		}
+		distinct[first[i]] = true
+	}
+	// rotating a tier of three providers only gives three of its six orders
+	if len(distinct) != 6 {
+		t.Errorf("Got %d distinct orders, want all 6 shuffles: %v", len(distinct), distinct)
+	}
+}
+
+func TestBatchSizesBoundProviderRequests(t *testing.T) {
+	tests := map[string]struct {
+		min, max      int
+		count         int
+		wantCalls     int
+		wantRequested int
+	}{
+		"minimum":     {3, 0, 1, 1, 3},
+		"maximum":     {0, 2, 5, 3, 5},
+		"both":        {3, 4, 5, 2, 7},
+		"within both": {1, 10, 4, 1, 4},
+	}
+
+	for name, test := range tests {
+		counter := &CountingContentProvider{Client: SampleContentProvider{Source: Provider1}}
+		srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: counter}, WithBatchSize(Provider1, test.min, test.max))
+
+		content := runRequest(t, srv, httptest.NewRequest("GET", fmt.Sprintf("/?count=%d", test.count), nil))
+
+		if len(content) != test.count {
+			t.Errorf("%s: Got %d items, want %d", name, len(content), test.count)
+		}
+		if counter.Calls() != test.wantCalls || counter.Requested() != test.wantRequested {
+			t.Errorf("%s: Provider was asked for %d items in %d calls, want %d in %d",
+				name, counter.Requested(), counter.Calls(), test.wantRequested, test.wantCalls)
+		}
+	}
+}
+
+func TestBatchesAreAlignedToTheProviderMultiple(t *testing.T) {
+	tests := map[string]struct {
+		max           int
+		count         int
+		wantCalls     int
+		wantRequested int
+	}{
+		"rounded up":      {0, 3, 1, 5},
+		"aligned already": {0, 10, 1, 10},
+		"within maximum":  {10, 13, 2, 15},
+	}
+
+	for name, test := range tests {
+		counter := &CountingContentProvider{Client: SampleContentProvider{Source: Provider1}}
+		srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: counter},
+			WithBatchSize(Provider1, 0, test.max), WithBatchMultiple(Provider1, 5))
+
+		content := runRequest(t, srv, httptest.NewRequest("GET", fmt.Sprintf("/?count=%d", test.count), nil))
+
+		if len(content) != test.count {
+			t.Errorf("%s: Got %d items, want %d", name, len(content), test.count)
+		}
+		if counter.Calls() != test.wantCalls || counter.Requested() != test.wantRequested {
+			t.Errorf("%s: Provider was asked for %d items in %d calls, want %d in %d",
+				name, counter.Requested(), counter.Calls(), test.wantRequested, test.wantCalls)
+		}
+	}
+}
+
+func TestProviderTimeoutsApplyPerProvider(t *testing.T) {
+	srv, err := NewApp(
+		ContentMix{config1, {Type: Provider3}},
+		map[Provider]Client{
+			Provider1: SlowContentProvider{Client: SampleContentProvider{Source: Provider1}, Delay: time.Second},
+			Provider2: SampleContentProvider{Source: Provider2},
+			Provider3: SlowContentProvider{Client: SampleContentProvider{Source: Provider3}, Delay: 50 * time.Millisecond},
+		},
+		WithProviderTimeout(Provider1, 10*time.Millisecond),
+		WithDefaultProviderTimeout(time.Second),
+	)
+	if err != nil {
+		t.Fatalf("NewApp failed: %v", err)
+	}
+
+	start := time.Now()
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	// 1 times out and falls back to 2, the slower 3 is within its timeout
+	if sources := providerSequence(content); sources != "2323" {
+		t.Errorf("Got providers %s, want 2323", sources)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Request took %v, want it to stop waiting for provider 1", elapsed)
+	}
+}
+
+// BudgetRecordingContentProvider records how much of the request's budget
+// is left when it is called
+type BudgetRecordingContentProvider struct {
+	Client    Client
+	Remaining chan time.Duration
+}
+
+func (cp BudgetRecordingContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		cp.Remaining <- -1
+	} else {
+		cp.Remaining <- time.Until(deadline)
+	}
+	return cp.Client.GetContent(ctx, userIP, count)
+}
+
+func TestFallbackGetsOnlyTheRemainingBudget(t *testing.T) {
+	remaining := make(chan time.Duration, 1)
+	srv, _ := NewApp(
+		ContentMix{config1},
+		map[Provider]Client{
+			Provider1: SlowContentProvider{Client: FailingContentProvider{}, Delay: 150 * time.Millisecond},
+			Provider2: BudgetRecordingContentProvider{Client: SampleContentProvider{Source: Provider2}, Remaining: remaining},
+		},
+		WithDefaultProviderTimeout(time.Second),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=1", nil).WithContext(ctx))
+
+	if sources := providerSequence(content); sources != "2" {
+		t.Errorf("Got providers %s, want fallback 2", sources)
+	}
+	if got := <-remaining; got <= 0 || got > 50*time.Millisecond {
+		t.Errorf("Fallback got %v, want at most the 50ms left of the request budget", got)
+	}
+}
+
+// regionalMix swaps provider 2 for provider 3 for clients in the EU
+func regionalMix(header http.Header, mix ContentMix) ContentMix {
+	if header.Get("X-Region") != "eu" {
+		return mix
+	}
+	selected := make(ContentMix, len(mix))
+	for i, config := range mix {
+		if config.Type == Provider2 {
+			config = ContentConfig{Type: Provider3}
+		}
+		selected[i] = config
+	}
+	return selected
+}
+
+func TestMixSelectorRewritesMixByHeader(t *testing.T) {
+	srv, _ := NewApp(
+		ContentMix{{Type: Provider1}, {Type: Provider2}},
+		sampleClients(),
+		WithMixSelector(regionalMix),
+		WithCache(time.Minute),
+		WithCacheMaxAge(time.Minute),
+	)
+
+	req := httptest.NewRequest("GET", "/?count=4", nil)
+	req.Header.Set("X-Region", "eu")
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, req)
+	var content []*ContentItem
+	if err := json.NewDecoder(response.Body).Decode(&content); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	if sources := providerSequence(content); sources != "1313" {
+		t.Errorf("Got providers %s for the EU, want 1313", sources)
+	}
+	if cacheControl := response.Header().Get("Cache-Control"); cacheControl != "no-store" {
+		t.Errorf("Got Cache-Control %q for a rewritten mix, want no-store", cacheControl)
+	}
+
+	content = runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+	if sources := providerSequence(content); sources != "1212" {
+		t.Errorf("Got providers %s elsewhere, want 1212", sources)
+	}
+}
+
+// HangingContentProvider ignores the request's context and only returns once
+// Release is closed, so its result never arrives in time
+type HangingContentProvider struct {
+	Release chan struct{}
+}
+
+func (cp HangingContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	<-cp.Release
+	return nil, errors.New("released")
+}
+
+func TestMissingResultDoesNotBlockRequest(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv, _ := NewApp(
+		ContentMix{{Type: Provider1}, {Type: Provider2}},
+		map[Provider]Client{
+			Provider1: SampleContentProvider{Source: Provider1},
+			Provider2: HangingContentProvider{Release: release},
+		},
+		WithRequestTimeout(50*time.Millisecond),
+	)
+
+	start := time.Now()
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Request took %v, want it to give up after the request timeout", elapsed)
+	}
+	if sources := providerSequence(content); sources != "1" {
+		t.Errorf("Got providers %s, want 1", sources)
+	}
+}
+
+func TestCollectingStopsWhenResultsAreMissing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	results := make(chan fetchResult, 2)
+	results <- fetchResult{config: config1, contents: &FetchedContents{Provider: Provider1}}
+
+	contents := getMapOfFetchedContents(ctx, results, 2)
+
+	if len(contents) != 1 || contents[config1] == nil {
+		t.Errorf("Got %v, want only the result which arrived", contents)
+	}
+}
+
+func TestOrderedFanOutCollectsInMixOrder(t *testing.T) {
+	configs := []ContentConfig{config1, config2, config3, config4}
+	for run := 0; run < 20; run++ {
+		slots := make([]chan fetchResult, len(configs))
+		for i, config := range configs {
+			slots[i] = make(chan fetchResult, 1)
+			go func(config ContentConfig, slot chan<- fetchResult) {
+				time.Sleep(time.Duration(rand.Intn(1000)) * time.Microsecond)
+				slot <- fetchResult{config: config, contents: &FetchedContents{Provider: config.Type}}
+			}(config, slots[i])
+		}
+
+		results := collectInOrder(context.Background(), slots)
+
+		if len(results) != len(configs) {
+			t.Fatalf("Run %d: Got %d results, want %d", run, len(results), len(configs))
+		}
+		for i, result := range results {
+			if result.config != configs[i] {
+				t.Fatalf("Run %d: Got config %+v at position %d, want %+v", run, result.config, i, configs[i])
+			}
+		}
+	}
+}
+
+func TestOrderedFanOutServesTheSameContent(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithOrderedFanOut())
+
+	content := runRequest(t, srv, SimpleContentRequest)
+
+	if sources := providerSequence(content); sources != providerSequence(runRequest(t, app, SimpleContentRequest)) {
+		t.Errorf("Got providers %s, want the same as without ordered fan-out", sources)
+	}
+}
+
+func TestExcludedProvidersAreSkipped(t *testing.T) {
+	srv, _ := NewApp(ContentMix{{Type: Provider1}, {Type: Provider2}, {Type: Provider3}}, sampleClients())
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4&exclude=2", nil))
+
+	if sources := providerSequence(content); sources != "1313" {
+		t.Errorf("Got providers %s, want 1313", sources)
+	}
+}
+
+func TestExcludedProvidersFallThroughToFallbacks(t *testing.T) {
+	srv, _ := NewApp(
+		ContentMix{{Type: Provider1, Fallback: &Provider3}, {Type: Provider2}},
+		sampleClients(),
+		WithFallbackAnnotations(),
+	)
+
+	response := runRawRequest(srv, "/?count=4&exclude=1")
+	var content []annotatedItem
+	if err := json.NewDecoder(response.Body).Decode(&content); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+
+	want := []annotatedItem{{Provider: Provider3, Fallback: true}, {Provider: Provider2}, {Provider: Provider3, Fallback: true}, {Provider: Provider2}}
+	if len(content) != len(want) {
+		t.Fatalf("Got %d items back, want %d", len(content), len(want))
+	}
+	for i := range want {
+		if content[i].Provider != want[i].Provider || content[i].Fallback != want[i].Fallback {
+			t.Errorf("Position %d: Got provider %s (fallback %v), want %s (fallback %v)",
+				i, content[i].Provider, content[i].Fallback, want[i].Provider, want[i].Fallback)
+		}
+	}
+}
+
+func TestExcludingEveryProviderIsRejected(t *testing.T) {
+	srv, _ := NewApp(ContentMix{{Type: Provider1, Fallback: &Provider2}}, sampleClients())
+
+	for _, query := range []string{"exclude=1,2", "exclude=1&exclude=2", "exclude=unknown"} {
+		if response := runRawRequest(srv, "/?count=4&"+query); response.Code != http.StatusBadRequest {
+			t.Errorf("%s: Got status %d, want 400", query, response.Code)
+		}
+	}
+}
+
+// ErroringContentProvider always fails with Err
+type ErroringContentProvider struct {
+	Err error
+}
+
+func (cp ErroringContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	return nil, cp.Err
+}
+
+func TestProviderErrorsAreClassified(t *testing.T) {
+	tests := map[string]struct {
+		err       error
+		sentinel  error
+		class     errorClass
+		wantCalls int
+	}{
+		"timeout":      {&ProviderTimeoutError{Err: errors.New("slow")}, ErrProviderTimeout, classTimeout, 2},
+		"unavailable":  {&ProviderUnavailableError{Err: errors.New("down")}, ErrProviderUnavailable, classUnavailable, 1},
+		"bad response": {&ProviderBadResponseError{Err: errors.New("garbage")}, ErrProviderBadResponse, classBadResponse, 1},
+		"untyped":      {errors.New("unknown"), nil, classOther, 1},
+	}
+	for name, test := range tests {
+		if test.sentinel != nil && !errors.Is(test.err, test.sentinel) {
+			t.Errorf("%s: error does not match its sentinel", name)
+		}
+		if class := classifyError(fmt.Errorf("wrapped: %w", test.err)); class != test.class {
+			t.Errorf("%s: Got class %s, want %s", name, class, test.class)
+		}
+
+		failing := &CountingContentProvider{Client: ErroringContentProvider{Err: test.err}}
+		srv, _ := NewApp(
+			ContentMix{{Type: Provider1, Fallback: &Provider2}},
+			map[Provider]Client{Provider1: failing, Provider2: SampleContentProvider{Source: Provider2}},
+		)
+		content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=2", nil))
+
+		if sources := providerSequence(content); sources != "22" {
+			t.Errorf("%s: Got providers %s, want the fallback 22", name, sources)
+		}
+		if failing.Calls() != test.wantCalls {
+			t.Errorf("%s: Failing provider was called %d times, want %d", name, failing.Calls(), test.wantCalls)
+		}
+		if count := srv.Metrics.snapshot().ProviderErrors[Provider1][test.class]; count != uint64(test.wantCalls) {
+			t.Errorf("%s: Got %d %s errors in the metrics, want %d", name, count, test.class, test.wantCalls)
+		}
+	}
+}
+
+func TestExceededProviderTimeoutIsATimeoutError(t *testing.T) {
+	srv, _ := NewApp(
+		ContentMix{config4},
+		map[Provider]Client{Provider1: SlowContentProvider{Client: SampleContentProvider{Source: Provider1}, Delay: time.Second}},
+		WithProviderTimeout(Provider1, 10*time.Millisecond),
+	)
+
+	_, err := srv.getContent(context.Background(), Provider1, "", 1)
+
+	var timeout *ProviderTimeoutError
+	if !errors.As(err, &timeout) || timeout.Provider != Provider1 {
+		t.Errorf("Got %v, want a ProviderTimeoutError for provider 1", err)
+	}
+}
+
+func TestMissingClientsAreServiceUnavailable(t *testing.T) {
+	for _, clients := range []map[Provider]Client{nil, {}} {
+		srv := &App{ContentClients: clients, Config: DefaultConfig}
+
+		for _, path := range []string{"/?count=4", "/bulk?count=4&pages=2"} {
+			response := runRawRequest(srv, path)
+			if response.Code != http.StatusServiceUnavailable {
+				t.Errorf("%s: Got status %d, want 503", path, response.Code)
+			}
+			if !strings.Contains(response.Body.String(), "no content providers are configured") {
+				t.Errorf("%s: Got body %s, want it to explain that there are no providers", path, response.Body)
+			}
+		}
+	}
+}
+
+func TestDefaultItemFillsSlotsOfFailedProviders(t *testing.T) {
+	clients := map[Provider]Client{Provider1: FailingContentProvider{}, Provider2: FailingContentProvider{}}
+	srv, _ := NewApp(ContentMix{config1}, clients, WithDefaultItem(ContentItem{ID: "house-ad", Title: "Ad"}))
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	if len(content) != 4 {
+		t.Fatalf("Got %d items, want 4 placeholders", len(content))
+	}
+	for i, item := range content {
+		if item.ID != "house-ad" || !item.Placeholder {
+			t.Errorf("Item %d is %+v, want the default item marked as placeholder", i, item)
+		}
+	}
+}
+
+func TestDefaultItemOnlyFillsFailedSlots(t *testing.T) {
+	clients := map[Provider]Client{Provider1: SampleContentProvider{Source: Provider1}, Provider2: FailingContentProvider{}}
+	srv, _ := NewApp(ContentMix{config4, {Type: Provider2}}, clients, WithDefaultItem(ContentItem{ID: "house-ad"}), WithCache(time.Minute))
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	var got []string
+	for _, item := range content {
+		if item.Placeholder {
+			got = append(got, "default")
+		} else {
+			got = append(got, item.Source)
+		}
+	}
+	if sequence := strings.Join(got, ","); sequence != "1,default,1,default" {
+		t.Errorf("Got %s, want 1,default,1,default", sequence)
+	}
+	if _, ok := srv.Cache.get(pageKey{count: 4}); ok {
+		t.Error("Page with placeholders was cached")
+	}
+}
+
+func TestUnsupportedMethodsAreNotAllowed(t *testing.T) {
+	clients, counters := countingClients()
+	srv, _ := NewApp(DefaultConfig, clients)
+
+	for _, method := range []string{"DELETE", "PATCH", "PUT", "POST"} {
+		for _, path := range []string{"/?count=4", "/bulk?count=4", "/mix/tv?count=4", "/health"} {
+			response := httptest.NewRecorder()
+			srv.ServeHTTP(response, httptest.NewRequest(method, path, nil))
+
+			if response.Code != http.StatusMethodNotAllowed {
+				t.Errorf("%s %s: Got status %d, want 405", method, path, response.Code)
+			}
+			if allow := response.Header().Get("Allow"); allow != "GET, HEAD" {
+				t.Errorf("%s %s: Got Allow %q, want GET, HEAD", method, path, allow)
+			}
+		}
+	}
+	if calls := totalCalls(counters); calls != 0 {
+		t.Errorf("Providers were called %d times", calls)
+	}
+}
+
+func TestItemOrderSortsPages(t *testing.T) {
+	clients := map[Provider]Client{
+		Provider1: fixedItems(Provider1, "c", "a"),
+		Provider2: fixedItems(Provider2, "d", "b"),
+	}
+	mix := ContentMix{config4, {Type: Provider2}}
+	byID := func(a, b *ContentItem) bool { return a.ID < b.ID }
+
+	sorted, _ := NewApp(mix, clients, WithItemOrder(byID))
+	if ids := itemIDs(runRequest(t, sorted, httptest.NewRequest("GET", "/?count=4", nil))); ids != "a,b,c,d" {
+		t.Errorf("Got items %s, want a,b,c,d", ids)
+	}
+
+	unsorted, _ := NewApp(mix, clients)
+	if ids := itemIDs(runRequest(t, unsorted, httptest.NewRequest("GET", "/?count=4", nil))); ids != "c,d,a,b" {
+		t.Errorf("Got items %s without an order, want the mix order c,d,a,b", ids)
+	}
+}
+
+func byID(a, b *ContentItem) bool { return a.ID < b.ID }
+
+func TestFirstToRespondDoesNotWaitForSlowProviders(t *testing.T) {
+	slow := CancelRecordingContentProvider{Called: make(chan struct{}), Cancelled: make(chan error, 1)}
+	// the fast provider only responds once the slow one is called, so that
+	// the slow one is cancelled in the middle of its call
+	clients := map[Provider]Client{
+		Provider1: GatedContentProvider{Client: fixedItems(Provider1, "c", "a", "b", "d"), Release: slow.Called},
+		Provider2: slow,
+	}
+	srv, _ := NewApp(ContentMix{config4, {Type: Provider2}}, clients, WithFirstToRespond(byID))
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=3", nil))
+
+	if ids := itemIDs(content); ids != "a,b,c" {
+		t.Errorf("Got items %s, want a,b,c", ids)
+	}
+	select {
+	case err := <-slow.Cancelled:
+		if err != context.Canceled {
+			t.Errorf("Got slow provider's context error %v, want it cancelled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Slow provider was not cancelled once the page was full")
+	}
+}
+
+func TestFirstToRespondWaitsUntilThePageIsFull(t *testing.T) {
+	clients := map[Provider]Client{
+		Provider1: fixedItems(Provider1, "c", "a"),
+		Provider2: SlowContentProvider{Client: fixedItems(Provider2, "d", "b"), Delay: 20 * time.Millisecond},
+	}
+	srv, _ := NewApp(ContentMix{config4, {Type: Provider2}}, clients, WithFirstToRespond(byID))
+
+	if ids := itemIDs(runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))); ids != "a,b,c,d" {
+		t.Errorf("Got items %s, want a,b,c,d", ids)
+	}
+}
+
+// IPRecordingContentProvider records the user IPs it is called with
+type IPRecordingContentProvider struct {
+	Client Client
+	mu     sync.Mutex
+	ips    []string
+}
+
+func (cp *IPRecordingContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	cp.mu.Lock()
+	cp.ips = append(cp.ips, userIP)
+	cp.mu.Unlock()
+	return cp.Client.GetContent(ctx, userIP, count)
+}
+
+func TestClientIPIsTheRemoteAddressByDefault(t *testing.T) {
+	provider := &IPRecordingContentProvider{Client: SampleContentProvider{Source: Provider1}}
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: provider})
+
+	request := httptest.NewRequest("GET", "/?count=1", nil)
+	request.RemoteAddr = "192.0.2.1:1234"
+	request.Header.Set("X-Forwarded-For", "198.51.100.1")
+	runRequest(t, srv, request)
+
+	if len(provider.ips) != 1 || provider.ips[0] != "192.0.2.1" {
+		t.Errorf("Provider was called with IPs %v, want the remote address 192.0.2.1", provider.ips)
+	}
+}
+
+func TestClientIPCanBeCustomised(t *testing.T) {
+	cdnIP := func(req *http.Request) string { return req.Header.Get("CF-Connecting-IP") }
+	for name, test := range map[string]struct {
+		clientIP func(req *http.Request) string
+		want     string
+	}{
+		"cdn header":    {cdnIP, "203.0.113.1"},
+		"forwarded for": {ForwardedForIP, "198.51.100.1"},
+	} {
+		provider := &IPRecordingContentProvider{Client: SampleContentProvider{Source: Provider1}}
+		srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: provider}, WithClientIP(test.clientIP))
+
+		request := httptest.NewRequest("GET", "/?count=1", nil)
+		request.RemoteAddr = "192.0.2.1:1234"
+		request.Header.Set("X-Forwarded-For", "198.51.100.1, 192.0.2.1")
+		request.Header.Set("CF-Connecting-IP", "203.0.113.1")
+		runRequest(t, srv, request)
+
+		if len(provider.ips) != 1 || provider.ips[0] != test.want {
+			t.Errorf("%s: Provider was called with IPs %v, want %s", name, provider.ips, test.want)
+		}
+	}
+}
+
+func TestUnknownPathsAreNotFound(t *testing.T) {
+	provider := &CountingContentProvider{Client: SampleContentProvider{Source: Provider1}}
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: provider})
+
+	for _, path := range []string{"/favicon.ico", "/robots.txt", "/content/"} {
+		if response := runRawRequest(srv, path+"?count=1"); response.Code != http.StatusNotFound {
+			t.Errorf("%s: Got status %d, want 404", path, response.Code)
+		}
+	}
+	if calls := provider.Calls(); calls != 0 {
+		t.Errorf("Provider was called %d times for unknown paths", calls)
+	}
+}
+
+func TestContentIsServedUnderTheConfiguredPaths(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, sampleClients(), WithContentPaths("/feed", "/v1/feed"))
+
+	for path, want := range map[string]int{"/feed": http.StatusOK, "/v1/feed": http.StatusOK, "/": http.StatusNotFound} {
+		if response := runRawRequest(srv, path+"?count=1"); response.Code != want {
+			t.Errorf("%s: Got status %d, want %d", path, response.Code, want)
+		}
+	}
+	if response := runRawRequest(srv, "/health"); response.Code != http.StatusOK {
+		t.Errorf("/health: Got status %d, want the endpoints to be kept", response.Code)
+	}
+}
+
+func TestDegradedPositionsAreReported(t *testing.T) {
+	clients := sampleClients()
+	clients[Provider1] = FailingContentProvider{}
+	srv, _ := NewApp(ContentMix{config1, config2, config4}, clients)
+
+	response := runRawRequest(srv, "/?count=5")
+
+	// config1 falls back to 2 and config4 has no fallback, cutting the page off
+	if degraded := response.Header().Get(contentDegradedHeader); degraded != "fallback=0; missing=2,3,4" {
+		t.Errorf("Got %s %q, want \"fallback=0; missing=2,3,4\"", contentDegradedHeader, degraded)
+	}
+	if degraded := runRawRequest(app, "/?count=5").Header().Get(contentDegradedHeader); degraded != "" {
+		t.Errorf("Got %s %q for a healthy page, want none", contentDegradedHeader, degraded)
+	}
+}
+
+func TestLogicalTotalEndsTheContent(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithLogicalTotal(10))
+
+	for _, test := range []struct {
+		target     string
+		want       int
+		nextCursor bool
+	}{
+		{"/?offset=0&count=5", 5, true},
+		{"/?offset=5&count=4", 4, true},
+		{"/?offset=5&count=5", 5, false},
+		{"/?offset=8&count=5", 2, false},
+		{"/?offset=10&count=5", 0, false},
+		{"/?offset=25&count=5", 0, false},
+	} {
+		response := runRawRequest(srv, test.target)
+		if response.Code != http.StatusOK {
+			t.Errorf("%s: Got status %d, want 200", test.target, response.Code)
+			continue
+		}
+		var content []*ContentItem
+		if err := json.NewDecoder(response.Body).Decode(&content); err != nil {
+			t.Fatalf("%s: couldn't decode Response json: %v", test.target, err)
+		}
+		if len(content) != test.want {
+			t.Errorf("%s: Got %d items, want %d", test.target, len(content), test.want)
+		}
+		if got := response.Header().Get(nextCursorHeader) != ""; got != test.nextCursor {
+			t.Errorf("%s: Got next cursor %t, want %t", test.target, got, test.nextCursor)
+		}
+		if degraded := response.Header().Get(contentDegradedHeader); degraded != "" {
+			t.Errorf("%s: Got degraded positions %q past the end", test.target, degraded)
+		}
+	}
+}
+
+func TestLogicalTotalBoundsBulkPages(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithLogicalTotal(7))
+
+	response := runRawRequest(srv, bulkPath+"?count=3&pages=4")
+
+	var pages [][]*ContentItem
+	if err := json.NewDecoder(response.Body).Decode(&pages); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	want := []int{3, 3, 1, 0}
+	for i, page := range pages {
+		if len(page) != want[i] {
+			t.Errorf("Page %d: Got %d items, want %d", i, len(page), want[i])
+		}
+	}
+}
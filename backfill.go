@@ -0,0 +1,101 @@
+package main
+
+import "context"
+
+// backfill lays the config out over the requested items again, leaving out
+// every config that failed, and fetches whatever the remaining configs need
+// in addition. This is repeated until no further config fails or
+// MaxBackfillPasses is reached. It returns the mix to assemble the page with.
+func (a *App) backfill(ctx context.Context, request pageRequest, config ContentMix, contents FetchedContentsMap) ContentMix {
+	mix := stretchContentMixOverCount(config, request.count, request.offset)
+	for pass := 0; pass < a.MaxBackfillPasses && hasFailedConfig(mix, contents); pass++ {
+		mix = stretchHealthyConfigs(config, request.count, request.offset, contents)
+		missing := getMissingCounts(mix, contents)
+		if len(missing) == 0 {
+			break
+		}
+		logf(ctx, "backfill pass %d: fetching more for %d configs", pass+1, len(missing))
+
+		// the goroutines may outlive this pass, so they get copies of contents
+		previous := FetchedContentsMap{}
+		for config := range missing {
+			if fetched := contents[config]; fetched != nil {
+				snapshot := *fetched
+				previous[config] = &snapshot
+			}
+		}
+		fetchedMore := a.fanOut(ctx, mix, missing, func(config ContentConfig, count int) *FetchedContents {
+			if fetched := previous[config]; fetched != nil {
+				return a.fetchMoreForConfig(ctx, fetched, count, request.userIP)
+			}
+			return a.fetchItemsForConfig(ctx, config, count, request.userIP)
+		})
+		for config, fetched := range fetchedMore {
+			contents[config] = fetched
+		}
+	}
+	return mix
+}
+
+// hasFailedConfig reports whether any config of the mix failed to deliver
+func hasFailedConfig(mix ContentMix, contents FetchedContentsMap) bool {
+	for _, config := range mix {
+		if fetched := contents[config]; fetched == nil || fetched.Failed {
+			return true
+		}
+	}
+	return false
+}
+
+// stretchHealthyConfigs works like stretchContentMixOverCount but skips the
+// configs which failed, so that their slots go to the next healthy config
+// in the rotation.
+func stretchHealthyConfigs(config ContentMix, count int, offset int, contents FetchedContentsMap) ContentMix {
+	mix := ContentMix{}
+	healthy := false
+	for _, c := range config {
+		if fetched := contents[c]; fetched == nil || !fetched.Failed {
+			healthy = true
+		}
+	}
+	for i := offset; healthy && len(mix) < count; i++ {
+		c := config[i%len(config)]
+		if fetched := contents[c]; fetched != nil && fetched.Failed {
+			continue
+		}
+		mix = append(mix, c)
+	}
+	return mix
+}
+
+// getMissingCounts returns how many more items each config of the mix needs
+// than it has fetched already
+func getMissingCounts(mix ContentMix, contents FetchedContentsMap) CountsPerConfig {
+	missing := CountsPerConfig{}
+	for config, count := range getCountsPerConfig(mix) {
+		have := 0
+		if fetched := contents[config]; fetched != nil {
+			have = len(fetched.Items)
+		}
+		if count > have {
+			missing[config] = count - have
+		}
+	}
+	return missing
+}
+
+// fetchMoreForConfig asks the provider which already served a config for
+// count more items and returns the combined contents. If that fails, the
+// config is marked as failed.
+func (a *App) fetchMoreForConfig(ctx context.Context, fetched *FetchedContents, count int, userIP string) *FetchedContents {
+	combined := *fetched
+	items, err := a.getContentWithRetry(ctx, combined.Provider, userIP, count)
+	if err != nil {
+		logf(ctx, "could not backfill from provider %s: %v", combined.Provider, err)
+		combined.Failed = true
+	} else {
+		items = a.trimSurplus(ctx, combined.Provider, items, count)
+		combined.Items = append(combined.Items[:len(combined.Items):len(combined.Items)], items...)
+	}
+	return &combined
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBackfillFillsSlotsOfFailedProvider(t *testing.T) {
+	healthy := &CountingContentProvider{Client: SampleContentProvider{Source: Provider1}}
+	srv := &App{
+		ContentClients: map[Provider]Client{
+			Provider1: healthy,
+			Provider2: FailingContentProvider{},
+		},
+		Config:            ContentMix{config4, {Type: Provider2}},
+		MaxBackfillPasses: 2,
+	}
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	if sources := providerSequence(content); sources != "1111" {
+		t.Errorf("Got providers %s, want 1111", sources)
+	}
+	if healthy.Calls() != 2 {
+		t.Errorf("Healthy provider was called %d times, want 2", healthy.Calls())
+	}
+}
+
+func TestBackfillFetchesConfigsOutsideThePage(t *testing.T) {
+	srv := &App{
+		ContentClients: map[Provider]Client{
+			Provider1: FailingContentProvider{},
+			Provider2: SampleContentProvider{Source: Provider2},
+			Provider3: SampleContentProvider{Source: Provider3},
+		},
+		Config:            ContentMix{{Type: Provider2}, config4, {Type: Provider3}},
+		MaxBackfillPasses: 1,
+	}
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=2", nil))
+
+	if sources := providerSequence(content); sources != "23" {
+		t.Errorf("Got providers %s, want 23", sources)
+	}
+}
+
+func TestListIsCutOffWithoutBackfill(t *testing.T) {
+	srv := &App{
+		ContentClients: map[Provider]Client{
+			Provider1: SampleContentProvider{Source: Provider1},
+			Provider2: FailingContentProvider{},
+		},
+		Config: ContentMix{config4, {Type: Provider2}},
+	}
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	if len(content) != 1 {
+		t.Errorf("Got %d items back, want 1", len(content))
+	}
+}
+
+// FlakyContentProvider delegates its first Successes calls to the wrapped
+// client and fails afterwards
+type FlakyContentProvider struct {
+	Client    Client
+	Successes int32
+	calls     int32
+}
+
+func (cp *FlakyContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	if atomic.AddInt32(&cp.calls, 1) > cp.Successes {
+		return nil, errors.New("provider became unavailable")
+	}
+	return cp.Client.GetContent(ctx, userIP, count)
+}
+
+func TestBackfillPassesAreCapped(t *testing.T) {
+	for passes, want := range map[int]string{1: "13", 2: "333"} {
+		srv := &App{
+			ContentClients: map[Provider]Client{
+				Provider1: &FlakyContentProvider{Client: SampleContentProvider{Source: Provider1}, Successes: 1},
+				Provider2: FailingContentProvider{},
+				Provider3: SampleContentProvider{Source: Provider3},
+			},
+			Config:            ContentMix{config4, {Type: Provider2}, {Type: Provider3}},
+			MaxBackfillPasses: passes,
+		}
+
+		content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=3", nil))
+
+		if sources := providerSequence(content); sources != want {
+			t.Errorf("%d passes: Got providers %s, want %s", passes, sources, want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by a CircuitBreakerClient while it is refusing
+// calls to its failing provider
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState describes whether a circuit breaker lets calls through
+type BreakerState string
+
+const (
+	// BreakerClosed lets all calls through
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen rejects all calls until the cooldown has elapsed
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a single probe call through
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// CircuitBreakerClient wraps a provider's client. After FailureThreshold
+// consecutive failures it stops calling the provider for Cooldown, so that
+// requests go to the fallback straight away. Once the cooldown has elapsed,
+// one probe call is let through which decides whether the breaker closes
+// again. It is safe for concurrent use and meant to be shared by all requests.
+type CircuitBreakerClient struct {
+	Client           Client
+	FailureThreshold int
+	Cooldown         time.Duration
+
+	// now returns the current time, it can be replaced in tests
+	now func() time.Time
+
+	mu                  sync.Mutex
+	state               BreakerState
+	consecutiveFailures int
+	openedAt            time.Time
+}
+
+// NewCircuitBreakerClient wraps client in a circuit breaker
+func NewCircuitBreakerClient(client Client, failureThreshold int, cooldown time.Duration) *CircuitBreakerClient {
+	return &CircuitBreakerClient{
+		Client:           client,
+		FailureThreshold: failureThreshold,
+		Cooldown:         cooldown,
+		now:              time.Now,
+		state:            BreakerClosed,
+	}
+}
+
+// GetContent calls the wrapped client unless the breaker is open. A call
+// which panics counts as failed before the panic goes on.
+func (b *CircuitBreakerClient) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	if !b.allow() {
+		return nil, ErrCircuitOpen
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			b.record(fmt.Errorf("client panicked: %v", recovered))
+			panic(recovered)
+		}
+	}()
+	items, err := b.Client.GetContent(ctx, userIP, count)
+	if ctx.Err() != nil {
+		// the caller gave up, which says nothing about the provider
+		b.release()
+		return items, err
+	}
+	b.record(err)
+	return items, err
+}
+
+// State returns the current state of the breaker
+func (b *CircuitBreakerClient) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == "" {
+		return BreakerClosed
+	}
+	return b.state
+}
+
+func (b *CircuitBreakerClient) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.currentTime().Sub(b.openedAt) < b.Cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		return true
+	case BreakerHalfOpen:
+		// a probe is already in flight
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *CircuitBreakerClient) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.state = BreakerClosed
+		b.consecutiveFailures = 0
+		return
+	}
+
+	b.consecutiveFailures++
+	// a provider reporting itself as unavailable need not be tried again
+	unavailable := errors.Is(err, ErrProviderUnavailable)
+	if unavailable || b.state == BreakerHalfOpen || b.consecutiveFailures >= b.FailureThreshold {
+		b.state = BreakerOpen
+		b.openedAt = b.currentTime()
+	}
+}
+
+// release lets another probe through if the call which was let through did
+// not tell whether the provider recovered
+func (b *CircuitBreakerClient) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.state = BreakerOpen
+	}
+}
+
+func (b *CircuitBreakerClient) currentTime() time.Time {
+	if b.now == nil {
+		return time.Now()
+	}
+	return b.now()
+}
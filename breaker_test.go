@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestBreaker(client Client, clock *time.Time) *CircuitBreakerClient {
+	breaker := NewCircuitBreakerClient(client, 3, time.Minute)
+	breaker.now = func() time.Time { return *clock }
+	return breaker
+}
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	clock := time.Now()
+	provider := &CountingContentProvider{Client: FailingContentProvider{}}
+	breaker := newTestBreaker(provider, &clock)
+
+	for i := 0; i < 5; i++ {
+		breaker.GetContent(context.Background(), "", 1)
+	}
+
+	if provider.Calls() != 3 {
+		t.Errorf("Provider was called %d times, want 3", provider.Calls())
+	}
+	if breaker.State() != BreakerOpen {
+		t.Errorf("Got state %q, want %q", breaker.State(), BreakerOpen)
+	}
+	if _, err := breaker.GetContent(context.Background(), "", 1); err != ErrCircuitOpen {
+		t.Errorf("Got error %v, want ErrCircuitOpen", err)
+	}
+}
+
+func TestBreakerProbesAfterCooldown(t *testing.T) {
+	clock := time.Now()
+	failing := &CountingContentProvider{Client: FailingContentProvider{}}
+	breaker := newTestBreaker(failing, &clock)
+	for i := 0; i < 3; i++ {
+		breaker.GetContent(context.Background(), "", 1)
+	}
+
+	clock = clock.Add(time.Minute)
+	breaker.GetContent(context.Background(), "", 1)
+	if failing.Calls() != 4 {
+		t.Fatalf("Provider was called %d times, want a probe after the cooldown", failing.Calls())
+	}
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("Got state %q after a failed probe, want %q", breaker.State(), BreakerOpen)
+	}
+
+	clock = clock.Add(time.Minute)
+	breaker.Client = SampleContentProvider{Source: Provider1}
+	if _, err := breaker.GetContent(context.Background(), "", 1); err != nil {
+		t.Fatalf("Probe failed: %v", err)
+	}
+	if breaker.State() != BreakerClosed {
+		t.Errorf("Got state %q after a successful probe, want %q", breaker.State(), BreakerClosed)
+	}
+}
+
+func TestPanickingProbeReopensTheBreaker(t *testing.T) {
+	clock := time.Now()
+	breaker := newTestBreaker(FailingContentProvider{}, &clock)
+	for i := 0; i < 3; i++ {
+		breaker.GetContent(context.Background(), "", 1)
+	}
+
+	clock = clock.Add(time.Minute)
+	breaker.Client = PanickingContentProvider{}
+	func() {
+		defer func() { recover() }()
+		breaker.GetContent(context.Background(), "", 1)
+	}()
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("Got state %q after a panicking probe, want %q", breaker.State(), BreakerOpen)
+	}
+
+	clock = clock.Add(time.Minute)
+	breaker.Client = SampleContentProvider{Source: Provider1}
+	if _, err := breaker.GetContent(context.Background(), "", 1); err != nil {
+		t.Errorf("Probe after the next cooldown failed: %v", err)
+	}
+}
+
+func TestOpenBreakerSkipsToFallback(t *testing.T) {
+	clock := time.Now()
+	failing := &CountingContentProvider{Client: FailingContentProvider{}}
+	srv := &App{
+		ContentClients: map[Provider]Client{
+			Provider1: newTestBreaker(failing, &clock),
+			Provider2: SampleContentProvider{Source: Provider2},
+		},
+		Config: ContentMix{config1},
+	}
+
+	for i := 0; i < 5; i++ {
+		content := runRequest(t, srv, SimpleContentRequest)
+		if len(content) != 5 || Provider(content[0].Source) != Provider2 {
+			t.Fatalf("Request %d: Got %d items, want 5 from the fallback", i, len(content))
+		}
+	}
+
+	if failing.Calls() != 3 {
+		t.Errorf("Failing provider was called %d times, want 3", failing.Calls())
+	}
+}
+
+func TestCancelledCallsDoNotTripTheBreaker(t *testing.T) {
+	breaker := NewCircuitBreakerClient(SlowContentProvider{Client: SampleContentProvider{}, Delay: time.Second}, 1, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	breaker.GetContent(ctx, "", 1)
+
+	if breaker.State() != BreakerClosed {
+		t.Errorf("Got state %q after a cancelled call, want %q", breaker.State(), BreakerClosed)
+	}
+}
+
+func TestBreakerOpensOnUnavailableProvider(t *testing.T) {
+	breaker := NewCircuitBreakerClient(ErroringContentProvider{Err: &ProviderUnavailableError{}}, 5, time.Minute)
+
+	breaker.GetContent(context.Background(), "", 1)
+
+	if state := breaker.State(); state != BreakerOpen {
+		t.Errorf("Got state %s after an unavailable provider, want open", state)
+	}
+}
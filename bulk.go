@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// bulkPath serves several consecutive pages of the Config at once
+const bulkPath = "/bulk"
+
+// MaxBulkPages is the largest number of pages a bulk request may ask for
+const MaxBulkPages = 10
+
+// serveBulk responds with a JSON array of pages, each of them the list of
+// items a content request would return. The first page starts at the
+// requested offset, every further one where the previous one ended. The pages
+// are assembled concurrently and handled like the page of a content request,
+// falling back to the EmergencyContent and answering with a 429 if a page is
+// throttled without any items. All pages together must not hold more than
+// MaxCount items. Bulk responses exceeding MaxResponseBytes are always
+// rejected, as cutting them short would drop whole pages.
+func (a *App) serveBulk(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if !a.requireClients(w) || !a.acquireSlot(ctx, w) {
+		return
+	}
+	defer a.releaseSlot()
+	elapsed := a.Metrics.startTimer()
+	defer func() { a.Metrics.observeRequest(elapsed()) }()
+
+	request := pageRequest{config: a.config()}
+	format, err := a.parseContentRequest(req, &request)
+	if err != nil {
+		a.sendContentRequestError(w, err)
+		return
+	}
+	pageCount, err := parsePages(req, a.LenientQuery)
+	if err != nil {
+		sendBadRequest(w, err.Error())
+		return
+	}
+	if a.MaxCount > 0 && pageCount*request.count > a.MaxCount {
+		sendBadRequest(w, fmt.Sprintf("pages times count must not exceed %d", a.MaxCount))
+		return
+	}
+
+	a.Metrics.observePage(request.count, request.offset)
+
+	pages := make([]page, pageCount)
+	var wg sync.WaitGroup
+	for i := range pages {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pageRequest := request
+			pageRequest.offset += i * request.count
+			pageRequest = a.withinLogicalTotal(pageRequest)
+			pages[i] = a.emergencyPage(ctx, pageRequest, a.getPage(ctx, pageRequest))
+		}(i)
+	}
+	wg.Wait()
+	rethrowProviderPanic(ctx)
+
+	body := make([][]interface{}, len(pages))
+	stale, emergency := false, false
+	for i, page := range pages {
+		if page.err != nil {
+			logf(ctx, "could not assemble page %d: %v", i, page.err)
+			sendError(w, http.StatusBadGateway, page.err.Error())
+			return
+		}
+		if len(page.items) == 0 && page.throttled {
+			sendTooManyRequests(w, page.retryAfter)
+			return
+		}
+		stale = stale || page.stale
+		emergency = emergency || page.emergency
+		body[i] = make([]interface{}, len(page.items))
+		for j, item := range page.items {
+			body[i][j] = renderItem(item, format)
+		}
+	}
+
+	encoded, err := json.Marshal(body)
+	if err == nil && format.Pretty {
+		encoded, err = json.MarshalIndent(body, "", "  ")
+	}
+	if err != nil {
+		logf(ctx, "could not marshal bulk response: %v", err)
+		sendInternalServerError(w)
+		return
+	}
+	if format.MaxBytes > 0 && len(encoded) > format.MaxBytes {
+		sendError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf(
+			"response exceeds %d bytes, request fewer pages, items or fields", format.MaxBytes))
+		return
+	}
+	switch {
+	case emergency:
+		w.Header().Set(emergencyContentHeader, "true")
+		setCacheHeaders(w, 0)
+	case stale:
+		w.Header().Set(servedStaleHeader, "true")
+		setCacheHeaders(w, 0)
+	default:
+		setCacheHeaders(w, a.cacheMaxAgeFor(request))
+	}
+	last := a.withinLogicalTotal(pageRequest{offset: request.offset + (pageCount-1)*request.count, count: request.count})
+	if !a.endsContent(last) {
+		w.Header().Set(nextCursorHeader, a.encodeCursor(request.offset+pageCount*request.count, request.config))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(encoded, '\n'))
+}
+
+// parsePages reads the pages URL parameter, which defaults to 1
+func parsePages(req *http.Request, lenient bool) (int, error) {
+	values := req.URL.Query()["pages"]
+	if len(values) == 0 {
+		return 1, nil
+	}
+	if len(values) > 1 && !lenient {
+		return 0, errors.New("pages must only be given once")
+	}
+	pages, err := parseNonNegativeInt(values[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid pages: %v", err)
+	}
+	if pages < 1 || pages > MaxBulkPages {
+		return 0, fmt.Errorf("pages must be between 1 and %d", MaxBulkPages)
+	}
+	return pages, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBulkReturnsConsecutivePages(t *testing.T) {
+	response := runRawRequest(app, "/bulk?offset=1&count=5&pages=3")
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Response code is %d, want 200", response.Code)
+	}
+	var pages [][]*ContentItem
+	if err := json.NewDecoder(response.Body).Decode(&pages); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	if len(pages) != 3 {
+		t.Fatalf("Got %d pages, want 3", len(pages))
+	}
+
+	// the pages continue the same rotation as single requests would
+	for i, page := range pages {
+		want := runRequest(t, app, httptest.NewRequest("GET", fmt.Sprintf("/?offset=%d&count=5", 1+5*i), nil))
+		if got, want := providerSequence(page), providerSequence(want); got != want {
+			t.Errorf("Page %d: Got providers %s, want %s", i, got, want)
+		}
+	}
+	if sources := providerSequence(pages[0]) + providerSequence(pages[1]) + providerSequence(pages[2]); sources != "123111211231112" {
+		t.Errorf("Got providers %s across the pages, want 123111211231112", sources)
+	}
+}
+
+func TestBulkRejectsInvalidPages(t *testing.T) {
+	for _, pages := range []string{"0", "-1", "11", "two"} {
+		if response := runRawRequest(app, "/bulk?count=5&pages="+pages); response.Code != http.StatusBadRequest {
+			t.Errorf("pages=%s: Got status %d, want 400", pages, response.Code)
+		}
+	}
+}
+
+func TestBulkRejectsMoreThanMaxCountItems(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithMaxCount(10))
+
+	if response := runRawRequest(srv, "/bulk?count=5&pages=3"); response.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for 15 items, want 400", response.Code)
+	}
+	if response := runRawRequest(srv, "/bulk?count=5&pages=2"); response.Code != http.StatusOK {
+		t.Errorf("Got status %d for 10 items, want 200", response.Code)
+	}
+}
+
+func TestBulkPagesAreHandledLikeSinglePages(t *testing.T) {
+	throttled, _ := NewApp(ContentMix{config4}, map[Provider]Client{
+		Provider1: &ThrottlingContentProvider{Throttled: 10, RetryAfter: time.Second},
+	})
+	if response := runRawRequest(throttled, "/bulk?count=2&pages=2"); response.Code != http.StatusTooManyRequests {
+		t.Errorf("Got status %d with a throttled provider, want 429", response.Code)
+	}
+
+	emergency, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: FailingContentProvider{}},
+		WithEmergencyContent([]*ContentItem{{ID: "e1"}, {ID: "e2"}, {ID: "e3"}, {ID: "e4"}}))
+	response := runRawRequest(emergency, "/bulk?count=2&pages=2")
+
+	var pages [][]*ContentItem
+	if err := json.NewDecoder(response.Body).Decode(&pages); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	if len(pages) != 2 || itemIDs(pages[0]) != "e1,e2" || itemIDs(pages[1]) != "e3,e4" {
+		t.Errorf("Got pages %v, want the emergency content", pages)
+	}
+	if response.Header().Get(emergencyContentHeader) != "true" {
+		t.Error("Bulk response is not marked as emergency content")
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"encoding/gob"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxPrefetches is how many pages a PageCache prefetches at once
+	DefaultMaxPrefetches = 4
+
+	// DefaultMaxCacheEntries is how many pages a PageCache keeps at most
+	DefaultMaxCacheEntries = 10000
+)
+
+// PageCache keeps complete pages of content for a while, keyed by their
+// mix, offset and count. Cached pages are shared by all users. It is safe for
+// concurrent use and has to be created with NewPageCache.
+type PageCache struct {
+	TTL time.Duration
+
+	// StaleGrace keeps pages this long after they expired, so that they can
+	// stand in for content the providers fail to deliver. 0 drops pages as
+	// soon as they expire.
+	StaleGrace time.Duration
+
+	// Compress keeps pages gzip-compressed, trading the CPU time to
+	// decompress them on every hit for memory. It pays off for caches of
+	// large pages, small ones hardly shrink.
+	Compress bool
+
+	// MaxEntries is the number of pages kept at most, as clients can ask
+	// for any offset and count. Once it is reached, the least recently used
+	// page is dropped. 0 means no limit.
+	MaxEntries int
+
+	// now returns the current time, it can be replaced in tests
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[pageKey]*list.Element
+	// recency holds the *cacheEntry of every page, the most recently used
+	// first
+	recency *list.List
+	// generation is increased by every flush, so that pages fetched before
+	// a flush are not cached after it
+	generation uint64
+
+	// prefetchSlots caps the number of concurrent prefetches
+	prefetchSlots chan struct{}
+}
+
+type pageKey struct {
+	// surface keeps apart the pages of the surfaces of a Router sharing
+	// the cache
+	surface string
+	mix     string
+	offset  int
+	count   int
+}
+
+func (a *App) cacheKey(r pageRequest) pageKey {
+	return pageKey{surface: a.surface, mix: r.mix, offset: r.offset, count: r.count}
+}
+
+type cacheEntry struct {
+	key   pageKey
+	items []returnedItem
+	// compressed holds the items instead if the cache compresses them,
+	// along with their providers for flushing
+	compressed []byte
+	providers  []Provider
+	expires    time.Time
+}
+
+// NewPageCache creates a cache which keeps pages for ttl
+func NewPageCache(ttl time.Duration) *PageCache {
+	return &PageCache{
+		TTL:           ttl,
+		MaxEntries:    DefaultMaxCacheEntries,
+		now:           time.Now,
+		entries:       map[pageKey]*list.Element{},
+		recency:       list.New(),
+		prefetchSlots: make(chan struct{}, DefaultMaxPrefetches),
+	}
+}
+
+func (c *PageCache) get(key pageKey) ([]returnedItem, bool) {
+	c.mu.Lock()
+	entry, ok := c.lookup(key)
+	ok = ok && c.now().Before(entry.expires)
+	c.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+	return entry.pageItems()
+}
+
+// getStale returns a page which has expired but is still within the
+// StaleGrace
+func (c *PageCache) getStale(key pageKey) ([]returnedItem, bool) {
+	c.mu.Lock()
+	entry, ok := c.lookup(key)
+	c.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+	return entry.pageItems()
+}
+
+// pageItems returns the entry's items, decompressing them if need be. An
+// entry which cannot be decompressed counts as missing.
+func (e cacheEntry) pageItems() ([]returnedItem, bool) {
+	if e.compressed == nil {
+		return e.items, true
+	}
+	items, err := decompressItems(e.compressed)
+	if err != nil {
+		log.Printf("could not decompress cached page: %v", err)
+		return nil, false
+	}
+	return items, true
+}
+
+// contains reports whether the entry holds items of provider
+func (e cacheEntry) contains(provider Provider) bool {
+	if e.compressed == nil {
+		return containsProvider(e.items, provider)
+	}
+	for _, candidate := range e.providers {
+		if candidate == provider {
+			return true
+		}
+	}
+	return false
+}
+
+// compressItems gob-encodes and gzips items. Unlike JSON, gob keeps every
+// field of the items, such as their CacheTTL.
+func compressItems(items []returnedItem) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if err := gob.NewEncoder(writer).Encode(items); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func decompressItems(compressed []byte) ([]returnedItem, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	var items []returnedItem
+	err = gob.NewDecoder(reader).Decode(&items)
+	return items, err
+}
+
+// lookup returns the entry for key, removing it if it is past its grace
+func (c *PageCache) lookup(key pageKey) (cacheEntry, bool) {
+	element, ok := c.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires.Add(c.StaleGrace)) {
+		c.remove(element)
+		return cacheEntry{}, false
+	}
+	c.recency.MoveToFront(element)
+	return *entry, true
+}
+
+func (c *PageCache) remove(element *list.Element) {
+	c.recency.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).key)
+}
+
+// set keeps items for the shortest CacheTTL among them, or the cache's TTL
+// for items without one. Nothing is kept if the cache was flushed since
+// generation was taken, as the items might be stale.
+func (c *PageCache) set(key pageKey, items []returnedItem, generation uint64) {
+	entry := &cacheEntry{key: key, items: items}
+	if c.Compress {
+		compressed, err := compressItems(items)
+		if err != nil {
+			log.Printf("could not compress page, not caching it: %v", err)
+			return
+		}
+		entry = &cacheEntry{key: key, compressed: compressed, providers: itemProviders(items)}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	entry.expires = c.now().Add(c.ttlFor(items))
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.recency.MoveToFront(element)
+		return
+	}
+	if c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries {
+		c.remove(c.recency.Back())
+	}
+	c.entries[key] = c.recency.PushFront(entry)
+}
+
+// itemProviders lists the distinct providers of items
+func itemProviders(items []returnedItem) []Provider {
+	var providers []Provider
+	seen := map[Provider]bool{}
+	for _, item := range items {
+		if !seen[item.Provider] {
+			seen[item.Provider] = true
+			providers = append(providers, item.Provider)
+		}
+	}
+	return providers
+}
+
+// currentGeneration is to be taken before fetching a page which is cached
+// with set
+func (c *PageCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// flush removes all pages, or if provider is not empty only the pages which
+// contain items of provider. It returns the number of removed pages.
+func (c *PageCache) flush(provider Provider) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if provider == "" {
+		flushed := len(c.entries)
+		c.entries = map[pageKey]*list.Element{}
+		c.recency.Init()
+		return flushed
+	}
+	flushed := 0
+	for element := c.recency.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*cacheEntry).contains(provider) {
+			c.remove(element)
+			flushed++
+		}
+		element = next
+	}
+	return flushed
+}
+
+func containsProvider(items []returnedItem, provider Provider) bool {
+	for _, item := range items {
+		if item.Provider == provider {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *PageCache) ttlFor(items []returnedItem) time.Duration {
+	ttl := c.TTL
+	for i, item := range items {
+		hint := item.Item.CacheTTL
+		if hint <= 0 {
+			hint = c.TTL
+		}
+		if i == 0 || hint < ttl {
+			ttl = hint
+		}
+	}
+	return ttl
+}
+
+// getPage serves a page from the cache if possible and otherwise fetches it.
+// Only complete pages are cached, so that a temporary provider failure does
+// not stick around. Neither are pages of custom mixes. If the fetched page is
+// incomplete, its missing items are taken from an expired copy of the page
+// within the cache's StaleGrace, if there is one.
+func (a *App) getPage(ctx context.Context, request pageRequest) page {
+	cached := a.Cache != nil && !request.custom && !request.uncached
+	if cached {
+		if items, ok := a.Cache.get(a.cacheKey(request)); ok {
+			logf(ctx, "serving offset %d and count %d from cache", request.offset, request.count)
+			return page{items: items}
+		}
+	}
+
+	var generation uint64
+	if cached {
+		generation = a.Cache.currentGeneration()
+	}
+	page := a.fetchPage(ctx, request)
+	if !cached {
+		return page
+	}
+	if page.err == nil && len(page.items) == request.count && !hasPlaceholders(page.items) {
+		a.Cache.set(a.cacheKey(request), page.items, generation)
+		return page
+	}
+	if stale, ok := a.Cache.getStale(a.cacheKey(request)); ok {
+		return fillFromStale(ctx, page, stale)
+	}
+	return page
+}
+
+// fillFromStale completes an incomplete page with the items of a stale copy
+// of it, keeping the items which were fetched. Placeholders are replaced by
+// the stale items in their place. A page which failed entirely is replaced by
+// the stale copy.
+func fillFromStale(ctx context.Context, fetched page, stale []returnedItem) page {
+	if fetched.err != nil {
+		logf(ctx, "serving stale page instead of failing: %v", fetched.err)
+		return page{items: stale, stale: true}
+	}
+	items := make([]returnedItem, len(fetched.items), len(stale)+len(fetched.items))
+	copy(items, fetched.items)
+	replaced := 0
+	for i, item := range items {
+		if item.Item.Placeholder && i < len(stale) {
+			items[i] = stale[i]
+			replaced++
+		}
+	}
+	if len(items) < len(stale) {
+		replaced += len(stale) - len(items)
+		items = append(items, stale[len(items):]...)
+	}
+	if replaced == 0 {
+		return fetched
+	}
+	logf(ctx, "serving %d stale items along with %d fetched ones", replaced, len(items)-replaced)
+	return page{items: items, stale: true}
+}
+
+func hasPlaceholders(items []returnedItem) bool {
+	for _, item := range items {
+		if item.Item.Placeholder {
+			return true
+		}
+	}
+	return false
+}
+
+// prefetchPage fetches a page into the cache unless it is already cached.
+// It is skipped if the cache is already running its maximum number of
+// prefetches.
+func (a *App) prefetchPage(requestID string, request pageRequest) {
+	select {
+	case a.Cache.prefetchSlots <- struct{}{}:
+		defer func() { <-a.Cache.prefetchSlots }()
+	default:
+		return
+	}
+
+	if _, ok := a.Cache.get(a.cacheKey(request)); ok {
+		return
+	}
+	ctx := contextWithRequestID(context.Background(), requestID)
+	defer recoverBackgroundPanic(ctx, "prefetching")
+	logf(ctx, "prefetching offset %d and count %d", request.offset, request.count)
+	a.getPage(ctx, request)
+}
+
+// Warmup fetches the first WarmupCount items of the Config into the cache, so
+// that the first requests after startup do not have to wait for providers.
+// Failures are only logged, as the content is fetched on demand anyway.
+func (a *App) Warmup(ctx context.Context) {
+	if a.Cache == nil || a.WarmupCount <= 0 {
+		return
+	}
+	request := a.withinLogicalTotal(pageRequest{config: a.config(), count: a.WarmupCount})
+	logf(ctx, "warming up cache with count %d", request.count)
+
+	page := a.getPage(ctx, request)
+	switch {
+	case page.err != nil:
+		logf(ctx, "could not warm up cache: %v", page.err)
+	case len(page.items) < request.count:
+		logf(ctx, "could not warm up cache, got %d of %d items", len(page.items), request.count)
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func countingClients() (map[Provider]Client, []*CountingContentProvider) {
+	var counters []*CountingContentProvider
+	clients := map[Provider]Client{}
+	for provider, client := range sampleClients() {
+		counter := &CountingContentProvider{Client: client}
+		counters = append(counters, counter)
+		clients[provider] = counter
+	}
+	return clients, counters
+}
+
+func totalCalls(counters []*CountingContentProvider) int {
+	total := 0
+	for _, counter := range counters {
+		total += counter.Calls()
+	}
+	return total
+}
+
+// waitForCachedPage polls the cache until the page shows up or a second passed
+func waitForCachedPage(t *testing.T, cache *PageCache, offset int, count int) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := cache.get(pageKey{offset: offset, count: count}); ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Page with offset %d and count %d was never cached", offset, count)
+}
+
+func TestCachedPageDoesNotCallProviders(t *testing.T) {
+	clients, counters := countingClients()
+	srv, _ := NewApp(DefaultConfig, clients, WithCache(time.Minute))
+
+	first := runRequest(t, srv, SimpleContentRequest)
+	calls := totalCalls(counters)
+	second := runRequest(t, srv, SimpleContentRequest)
+
+	if totalCalls(counters) != calls {
+		t.Errorf("Providers were called %d times for a cached page", totalCalls(counters)-calls)
+	}
+	if itemIDs(first) != itemIDs(second) {
+		t.Errorf("Got items %s from cache, want %s", itemIDs(second), itemIDs(first))
+	}
+}
+
+func TestCachedPageExpires(t *testing.T) {
+	clients, counters := countingClients()
+	srv, _ := NewApp(DefaultConfig, clients, WithCache(time.Minute))
+	clock := time.Now()
+	srv.Cache.now = func() time.Time { return clock }
+
+	runRequest(t, srv, SimpleContentRequest)
+	calls := totalCalls(counters)
+	clock = clock.Add(time.Minute)
+	runRequest(t, srv, SimpleContentRequest)
+
+	if totalCalls(counters) == calls {
+		t.Error("Providers were not called again after the page expired")
+	}
+}
+
+func TestIncompletePagesAreNotCached(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: FailingContentProvider{}}, WithCache(time.Minute))
+
+	runRequest(t, srv, SimpleContentRequest)
+
+	if _, ok := srv.Cache.get(pageKey{offset: 0, count: 5}); ok {
+		t.Error("An empty page was cached")
+	}
+}
+
+func TestNextPageIsPrefetched(t *testing.T) {
+	clients, counters := countingClients()
+	srv, _ := NewApp(DefaultConfig, clients, WithCache(time.Minute), WithPrefetch())
+
+	runRequest(t, srv, SimpleContentRequest)
+	waitForCachedPage(t, srv.Cache, 5, 5)
+	calls := totalCalls(counters)
+
+	content := runRequest(t, srv, OffsetContentRequest)
+
+	if totalCalls(counters) != calls {
+		t.Errorf("Providers were called %d times for a prefetched page", totalCalls(counters)-calls)
+	}
+	for j, item := range content {
+		i := j + 5
+		if Provider(item.Source) != DefaultConfig[i%len(DefaultConfig)].Type {
+			t.Errorf("Position %d: Got Provider %v instead of Provider %v", i, item.Source, DefaultConfig[i].Type)
+		}
+	}
+}
+
+func TestPrefetchIsSkippedWhenAllSlotsAreBusy(t *testing.T) {
+	clients, _ := countingClients()
+	srv, _ := NewApp(DefaultConfig, clients, WithCache(time.Minute))
+	for i := 0; i < DefaultMaxPrefetches; i++ {
+		srv.Cache.prefetchSlots <- struct{}{}
+	}
+
+	srv.prefetchPage("test", pageRequest{config: DefaultConfig, count: 5, offset: 5})
+
+	if _, ok := srv.Cache.get(pageKey{offset: 5, count: 5}); ok {
+		t.Error("Page was prefetched although all prefetch slots were busy")
+	}
+}
+
+func TestWarmupPopulatesCache(t *testing.T) {
+	clients, counters := countingClients()
+	srv, _ := NewApp(DefaultConfig, clients, WithCache(time.Minute), WithWarmup(5))
+
+	srv.Warmup(context.Background())
+	calls := totalCalls(counters)
+	if calls == 0 {
+		t.Fatalf("Warmup did not call any provider")
+	}
+
+	content := runRequest(t, srv, SimpleContentRequest)
+	if len(content) != 5 {
+		t.Errorf("Got %d items back, want 5", len(content))
+	}
+	if totalCalls(counters) != calls {
+		t.Errorf("Providers were called %d more times after warmup", totalCalls(counters)-calls)
+	}
+}
+
+func TestFailedWarmupDoesNotCache(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: FailingContentProvider{}}, WithCache(time.Minute), WithWarmup(5))
+
+	srv.Warmup(context.Background())
+
+	if _, ok := srv.Cache.get(srv.cacheKey(pageRequest{count: 5})); ok {
+		t.Errorf("Failed warmup was cached")
+	}
+}
+
+// ttlItems returns a provider whose items may be cached for ttl
+func ttlItems(source Provider, ttl time.Duration) *CountingContentProvider {
+	items := make([]*ContentItem, 5)
+	for i := range items {
+		items[i] = &ContentItem{ID: strconv.Itoa(i), Source: string(source), CacheTTL: ttl}
+	}
+	return &CountingContentProvider{Client: FixedContentProvider{Items: items}}
+}
+
+func TestProviderCacheTTLsExpireIndependently(t *testing.T) {
+	short := ttlItems(Provider1, time.Minute)
+	long := ttlItems(Provider2, 10*time.Minute)
+	srv, _ := NewApp(
+		DefaultConfig,
+		map[Provider]Client{Provider1: short, Provider2: long, Provider3: SampleContentProvider{Source: Provider3}},
+		WithCache(5*time.Minute),
+		WithMix("short", ContentMix{{Type: Provider1}}),
+		WithMix("long", ContentMix{{Type: Provider2}}),
+	)
+	clock := time.Now()
+	srv.Cache.now = func() time.Time { return clock }
+
+	request := func(mix string) { runRequest(t, srv, httptest.NewRequest("GET", "/mix/"+mix+"?count=3", nil)) }
+	request("short")
+	request("long")
+
+	clock = clock.Add(2 * time.Minute)
+	request("short")
+	request("long")
+	if short.Calls() != 2 {
+		t.Errorf("Provider with a 1m TTL was called %d times after 2m, want 2", short.Calls())
+	}
+	if long.Calls() != 1 {
+		t.Errorf("Provider with a 10m TTL was called %d times after 2m, want 1", long.Calls())
+	}
+
+	clock = clock.Add(9 * time.Minute)
+	request("long")
+	if long.Calls() != 2 {
+		t.Errorf("Provider with a 10m TTL was called %d times after 11m, want 2", long.Calls())
+	}
+}
+
+func TestPageWithoutTTLHintsUsesCacheTTL(t *testing.T) {
+	cache := NewPageCache(time.Minute)
+	items := []returnedItem{{Item: &ContentItem{}}, {Item: &ContentItem{CacheTTL: time.Hour}}}
+
+	if ttl := cache.ttlFor(items); ttl != time.Minute {
+		t.Errorf("Got TTL %v, want the cache's 1m", ttl)
+	}
+}
+
+func TestStaleItemsStandInForFailedProviders(t *testing.T) {
+	srv, _ := NewApp(ContentMix{{Type: Provider1}, {Type: Provider2}}, sampleClients(), WithStaleCache(time.Minute, time.Hour))
+	clock := time.Now()
+	srv.Cache.now = func() time.Time { return clock }
+	request := func() *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		srv.ServeHTTP(response, httptest.NewRequest("GET", "/?count=4", nil))
+		return response
+	}
+
+	request()
+	srv.RegisterClient(Provider2, FailingContentProvider{})
+	clock = clock.Add(2 * time.Minute)
+	response := request()
+	if stale := response.Header().Get(servedStaleHeader); stale != "true" {
+		t.Errorf("Got %s header %q, want true", servedStaleHeader, stale)
+	}
+	if sources := providerSequence(decodeItems(t, response)); sources != "1212" {
+		t.Errorf("Got providers %s, want the stale page 1212", sources)
+	}
+
+	clock = clock.Add(time.Hour)
+	response = request()
+	if stale := response.Header().Get(servedStaleHeader); stale != "" {
+		t.Errorf("Got %s header %q after the grace, want none", servedStaleHeader, stale)
+	}
+	if sources := providerSequence(decodeItems(t, response)); sources != "1" {
+		t.Errorf("Got providers %s after the grace, want 1", sources)
+	}
+}
+
+func TestStalePageStandsInForFailedRequest(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, sampleClients(), WithStaleCache(time.Minute, time.Hour), WithStrictMode())
+	clock := time.Now()
+	srv.Cache.now = func() time.Time { return clock }
+
+	runRequest(t, srv, httptest.NewRequest("GET", "/?count=3", nil))
+	srv.RegisterClient(Provider1, FailingContentProvider{})
+	clock = clock.Add(2 * time.Minute)
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, httptest.NewRequest("GET", "/?count=3", nil))
+
+	if response.Code != 200 || response.Header().Get(servedStaleHeader) != "true" {
+		t.Fatalf("Got status %d and %s header %q, want 200 and true", response.Code, servedStaleHeader, response.Header().Get(servedStaleHeader))
+	}
+	if items := decodeItems(t, response); len(items) != 3 {
+		t.Errorf("Got %d items, want the 3 of the stale page", len(items))
+	}
+}
+
+func TestHeadRequestGetsHeadersOfCachedPage(t *testing.T) {
+	clients, counters := countingClients()
+	srv, _ := NewApp(DefaultConfig, clients, WithCache(time.Minute), WithCacheMaxAge(time.Minute))
+
+	get := runRawRequest(srv, "/?count=5")
+	calls := totalCalls(counters)
+	head := httptest.NewRecorder()
+	srv.ServeHTTP(head, httptest.NewRequest("HEAD", "/?count=5", nil))
+
+	if head.Code != 200 || head.Body.Len() != 0 {
+		t.Errorf("Got status %d and %d bytes of body, want 200 and none", head.Code, head.Body.Len())
+	}
+	for _, header := range []string{"Content-Type", "ETag", "Cache-Control"} {
+		if got, want := head.Header().Get(header), get.Header().Get(header); got == "" || got != want {
+			t.Errorf("Got %s %q, want %q as for GET", header, got, want)
+		}
+	}
+	if totalCalls(counters) != calls {
+		t.Error("HEAD request for a cached page called providers")
+	}
+}
+
+func TestCacheKeepsAtMostMaxEntries(t *testing.T) {
+	cache := NewPageCache(time.Minute)
+	cache.MaxEntries = 2
+	clock := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return clock }
+	items := []returnedItem{{Item: &ContentItem{ID: "a"}, Provider: Provider1}}
+
+	for offset := 0; offset < 2; offset++ {
+		cache.set(pageKey{offset: offset, count: 1}, items, cache.currentGeneration())
+		clock = clock.Add(time.Second)
+	}
+	cache.get(pageKey{offset: 0, count: 1})
+	cache.set(pageKey{offset: 2, count: 1}, items, cache.currentGeneration())
+
+	if len(cache.entries) != 2 || cache.recency.Len() != 2 {
+		t.Fatalf("Got %d cached pages, want 2", len(cache.entries))
+	}
+	if _, ok := cache.get(pageKey{offset: 1, count: 1}); ok {
+		t.Error("The least recently used page was kept")
+	}
+	if _, ok := cache.get(pageKey{offset: 0, count: 1}); !ok {
+		t.Error("The recently read page was dropped")
+	}
+}
+
+func TestCompressedPagesRoundTrip(t *testing.T) {
+	cache := NewPageCache(time.Minute)
+	cache.Compress = true
+	expiry := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	items := []returnedItem{
+		{Item: &ContentItem{ID: "a", Title: "title", Source: "1", Summary: "summary", Link: "link", Expiry: expiry, CacheTTL: time.Second}, Provider: Provider1, ConfigIndex: 2},
+		{Item: &ContentItem{ID: "b", Source: "2"}, Provider: Provider2, Fallback: true, Ad: true},
+		{Item: &ContentItem{ID: "default", Placeholder: true}, Fallback: true},
+	}
+	cache.set(pageKey{count: 3}, items, cache.currentGeneration())
+
+	if entry := cache.entries[pageKey{count: 3}].Value.(*cacheEntry); entry.items != nil || len(entry.compressed) == 0 {
+		t.Fatalf("Got entry %+v, want compressed items only", entry)
+	}
+	cached, ok := cache.get(pageKey{count: 3})
+	if !ok || len(cached) != len(items) {
+		t.Fatalf("Got %d cached items, want %d", len(cached), len(items))
+	}
+	for i, item := range cached {
+		want := items[i]
+		gotItem, wantItem := *item.Item, *want.Item
+		if !gotItem.Expiry.Equal(wantItem.Expiry) {
+			t.Errorf("Item %d: Got expiry %v, want %v", i, gotItem.Expiry, wantItem.Expiry)
+		}
+		gotItem.Expiry, wantItem.Expiry = time.Time{}, time.Time{}
+		item.Item, want.Item = nil, nil
+		if gotItem != wantItem || !reflect.DeepEqual(item, want) {
+			t.Errorf("Item %d: Got %+v %+v, want %+v %+v", i, item, gotItem, want, wantItem)
+		}
+	}
+}
+
+func TestCompressedCacheServesAndFlushesPages(t *testing.T) {
+	clients, counters := countingClients()
+	srv, _ := NewApp(DefaultConfig, clients, WithCompressedCache(time.Minute))
+
+	first := runRequest(t, srv, SimpleContentRequest)
+	calls := totalCalls(counters)
+	second := runRequest(t, srv, SimpleContentRequest)
+
+	if totalCalls(counters) != calls {
+		t.Errorf("Providers were called %d times for a cached page", totalCalls(counters)-calls)
+	}
+	if itemIDs(first) != itemIDs(second) {
+		t.Errorf("Got items %s from cache, want %s", itemIDs(second), itemIDs(first))
+	}
+	if flushed := srv.Cache.flush(Provider("4")); flushed != 0 {
+		t.Errorf("Flushed %d pages of an unused provider", flushed)
+	}
+	if flushed := srv.Cache.flush(Provider3); flushed != 1 {
+		t.Errorf("Flushed %d pages containing provider 3, want 1", flushed)
+	}
+}
+
+// BenchmarkCachedPageMemory reports the heap taken by every cached page of
+// 100 items, with and without compression
+func BenchmarkCachedPageMemory(b *testing.B) {
+	for name, compress := range map[string]bool{"plain": false, "compressed": true} {
+		b.Run(name, func(b *testing.B) {
+			cache := NewPageCache(time.Minute)
+			cache.Compress = compress
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			for i := 0; i < b.N; i++ {
+				cache.set(pageKey{offset: i, count: 100}, largeReturnList(100), cache.currentGeneration())
+			}
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(b.N), "heap-bytes/page")
+			runtime.KeepAlive(cache)
+		})
+	}
+}
+
+func fetchTimes(t *testing.T, srv *App) []string {
+	var content []map[string]interface{}
+	if err := json.NewDecoder(runRawRequest(srv, "/?count=3").Body).Decode(&content); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	times := make([]string, len(content))
+	for i, item := range content {
+		times[i], _ = item["fetched_at"].(string)
+		if times[i] == "" {
+			t.Fatalf("Item %d: Got no fetched_at in %v", i, item)
+		}
+	}
+	return times
+}
+
+func TestFetchTimesTellCachedFromFreshItems(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, sampleClients(), WithCache(time.Minute), WithFetchTimes())
+	clock := time.Now()
+	srv.Cache.now = func() time.Time { return clock }
+
+	before := time.Now()
+	fresh := fetchTimes(t, srv)
+	fetchedAt, err := time.Parse(time.RFC3339Nano, fresh[0])
+	if err != nil || fetchedAt.Before(before) || fetchedAt.After(time.Now()) {
+		t.Errorf("Got fetched_at %s (%v), want the time of the request", fresh[0], err)
+	}
+
+	time.Sleep(time.Millisecond)
+	if cached := fetchTimes(t, srv); cached[0] != fresh[0] {
+		t.Errorf("Got fetched_at %s for a cached page, want %s of the first fetch", cached[0], fresh[0])
+	}
+
+	clock = clock.Add(time.Minute)
+	if refetched := fetchTimes(t, srv); refetched[0] == fresh[0] {
+		t.Errorf("Got fetched_at %s of the expired page, want a new one", refetched[0])
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// flightGroup coalesces concurrent identical provider calls, so that only
+// the first of them reaches the provider and the others share its result.
+// The zero value is ready to use and it is safe for concurrent use.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[flightKey]*flight
+}
+
+// flightKey identifies calls which may share a result. Users are told
+// apart by the network their IP is in, see userIPBucket.
+type flightKey struct {
+	provider Provider
+	network  string
+	count    int
+}
+
+type flight struct {
+	done    chan struct{}
+	items   []*ContentItem
+	err     error
+	waiters int
+}
+
+// do calls call unless an identical call is running already, in which case
+// it waits for that one's result instead, or until ctx is done. As the first
+// call runs with its own context, the others share its cancellation.
+func (g *flightGroup) do(ctx context.Context, key flightKey, call func() ([]*ContentItem, error)) ([]*ContentItem, error) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = map[flightKey]*flight{}
+	}
+	if f, ok := g.flights[key]; ok {
+		f.waiters++
+		g.mu.Unlock()
+		select {
+		case <-f.done:
+			// every caller gets its own slice, as they may append to it
+			return append([]*ContentItem(nil), f.items...), f.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	f.items, f.err = call()
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(f.done)
+	return append([]*ContentItem(nil), f.items...), f.err
+}
+
+// waiting returns how many calls are waiting for another one's result
+func (g *flightGroup) waiting() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	waiting := 0
+	for _, f := range g.flights {
+		waiting += f.waiters
+	}
+	return waiting
+}
+
+// userIPBucket returns the network of a user's IP whose members are served
+// the same coalesced content, a /24 for IPv4 and a /48 for IPv6. Anything
+// which is not an IP is its own bucket.
+func userIPBucket(userIP string) string {
+	ip := net.ParseIP(userIP)
+	if ip == nil {
+		return userIP
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
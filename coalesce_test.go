@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentIdenticalRequestsShareOneProviderCall(t *testing.T) {
+	const requests = 20
+	release := make(chan struct{})
+	provider := &CountingContentProvider{Client: GatedContentProvider{Client: SampleContentProvider{Source: Provider1}, Release: release}}
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: provider}, WithCoalescing(), WithCache(time.Minute))
+
+	contents := make([][]*ContentItem, requests)
+	var wg sync.WaitGroup
+	for i := range contents {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			response := httptest.NewRecorder()
+			srv.ServeHTTP(response, httptest.NewRequest("GET", "/?count=3", nil))
+			if err := json.NewDecoder(response.Body).Decode(&contents[i]); err != nil {
+				t.Errorf("Request %d: couldn't decode Response json: %v", i, err)
+			}
+		}(i)
+	}
+	deadline := time.Now().Add(time.Second)
+	for srv.flights.waiting() < requests-1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if calls := provider.Calls(); calls != 1 {
+		t.Errorf("Provider was called %d times, want once", calls)
+	}
+	for i, content := range contents {
+		if itemIDs(content) != itemIDs(contents[0]) {
+			t.Errorf("Request %d: Got items %s, want %s", i, itemIDs(content), itemIDs(contents[0]))
+		}
+	}
+
+	runRequest(t, srv, httptest.NewRequest("GET", "/?count=3", nil))
+	if calls := provider.Calls(); calls != 1 {
+		t.Errorf("Provider was called %d times after a cached request, want once", calls)
+	}
+}
+
+func TestFetchesAreNotCoalescedByDefault(t *testing.T) {
+	provider := &CountingContentProvider{Client: SlowContentProvider{Client: SampleContentProvider{Source: Provider1}, Delay: 20 * time.Millisecond}}
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: provider})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runRawRequest(srv, "/?count=1")
+		}()
+	}
+	wg.Wait()
+
+	if calls := provider.Calls(); calls != 3 {
+		t.Errorf("Provider was called %d times, want 3", calls)
+	}
+}
+
+func TestUserIPBuckets(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"192.0.2.1", "192.0.2.200", true},
+		{"192.0.2.1", "192.0.3.1", false},
+		{"2001:db8:1::1", "2001:db8:1:ff::2", true},
+		{"2001:db8:1::1", "2001:db8:2::1", false},
+		{"unknown", "unknown", true},
+	}
+	for _, test := range tests {
+		if same := userIPBucket(test.a) == userIPBucket(test.b); same != test.same {
+			t.Errorf("%s and %s: Got same bucket %t, want %t", test.a, test.b, same, test.same)
+		}
+	}
+}
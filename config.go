@@ -5,6 +5,42 @@ type ContentMix []ContentConfig
 type ContentConfig struct {
 	Type     Provider
 	Fallback *Provider
+
+	// Tiers replaces Type and Fallback with tiers of equivalent providers.
+	// The providers of the first tier are tried first, each one in turn,
+	// then the ones of the second tier and so on. Type should name one of
+	// the first tier's providers for logging.
+	Tiers *ProviderTiers
+}
+
+// ProviderTiers lists groups of equivalent providers in order of preference
+type ProviderTiers [][]Provider
+
+// TierSelection decides which provider of a tier is tried first
+type TierSelection int
+
+const (
+	// TierRoundRobin starts with the next provider of the tier on every fetch
+	TierRoundRobin TierSelection = iota
+	// TierRandom starts with a random provider of the tier
+	TierRandom
+	// TierShuffle tries the providers of the tier in a random order on
+	// every fetch, so that no provider is always tried before another
+	TierShuffle
+)
+
+// isPrimary reports whether provider is one of the config's first choices
+// rather than a fallback
+func (c ContentConfig) isPrimary(provider Provider) bool {
+	if c.Tiers == nil || len(*c.Tiers) == 0 {
+		return provider == c.Type
+	}
+	for _, p := range (*c.Tiers)[0] {
+		if p == provider {
+			return true
+		}
+	}
+	return false
 }
 
 var (
@@ -29,3 +65,103 @@ var (
 		config1, config1, config2, config3, config4, config1, config1, config2,
 	}
 )
+
+// MixStrategy decides how a ContentMix is laid out over the requested items
+type MixStrategy int
+
+const (
+	// MixRotation repeats the configs in exactly the order they are listed
+	MixRotation MixStrategy = iota
+	// MixWeighted treats how often a config is listed as its weight and
+	// interleaves the configs so that each one is spread evenly, e.g.
+	// [1, 1, 1, 1, 2, 2] becomes [1, 2, 1, 1, 2, 1]
+	MixWeighted
+)
+
+// interleaveContentMix reorders the configs of a mix by smooth weighted
+// round-robin, where the weight of a config is the number of times it occurs.
+// The result has the same length and configs as the given mix.
+func interleaveContentMix(mix ContentMix) ContentMix {
+	var configs []ContentConfig
+	weights := map[ContentConfig]int{}
+	for _, config := range mix {
+		if weights[config] == 0 {
+			configs = append(configs, config)
+		}
+		weights[config]++
+	}
+
+	current := make([]int, len(configs))
+	interleaved := make(ContentMix, len(mix))
+	for i := range interleaved {
+		best := 0
+		for j, config := range configs {
+			current[j] += weights[config]
+			if current[j] > current[best] {
+				best = j
+			}
+		}
+		current[best] -= len(mix)
+		interleaved[i] = configs[best]
+	}
+	return interleaved
+}
+
+// sameMix reports whether two mixes consist of the same configs
+func sameMix(a, b ContentMix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// excludeProviders returns the mix without the excluded providers. Configs
+// using one of them fall through to their remaining providers, and configs
+// without any remaining provider are left out of the mix altogether.
+func (a *App) excludeProviders(mix ContentMix, excluded map[Provider]bool) ContentMix {
+	// every config has to be rewritten to the same value, as configs are
+	// told apart by value
+	rewritten := map[ContentConfig]*ContentConfig{}
+	result := make(ContentMix, 0, len(mix))
+	for _, config := range mix {
+		if _, ok := rewritten[config]; !ok {
+			rewritten[config] = a.excludeFromConfig(config, excluded)
+		}
+		if remaining := rewritten[config]; remaining != nil {
+			result = append(result, *remaining)
+		}
+	}
+	return result
+}
+
+// excludeFromConfig returns the config without the excluded providers, or
+// nil if none of its providers remain
+func (a *App) excludeFromConfig(config ContentConfig, excluded map[Provider]bool) *ContentConfig {
+	tiers := a.tiersFor(config)
+	changed, remaining := false, 0
+	filtered := make(ProviderTiers, len(tiers))
+	for i, tier := range tiers {
+		for _, provider := range tier {
+			if excluded[provider] {
+				changed = true
+				continue
+			}
+			filtered[i] = append(filtered[i], provider)
+			remaining++
+		}
+	}
+	if !changed {
+		return &config
+	}
+	if remaining == 0 {
+		return nil
+	}
+	// an emptied first tier is kept, so that the remaining providers are
+	// still reported as fallbacks
+	return &ContentConfig{Type: config.Type, Tiers: &filtered}
+}
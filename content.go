@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"math/rand"
 	"strconv"
 	"time"
 )
 
-// Client represents a provider's client or SDK
+// Client represents a provider's client or SDK. Clients needing credentials
+// take them as Credentials in their constructor.
+// Implementations should give up and return once ctx is done. Failures should
+// be reported as a ProviderTimeoutError, ProviderUnavailableError,
+// ProviderBadResponseError or RateLimitedError where possible, as the server
+// handles each of them differently.
 type Client interface {
-	GetContent(userIP string, count int) ([]*ContentItem, error)
+	GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error)
 }
 
 // ContentItem represent one piece of content fetched from a provider
@@ -19,6 +25,19 @@ type ContentItem struct {
 	Summary string    `json:"summary"`
 	Link    string    `json:"link"`
 	Expiry  time.Time `json:"expiry"`
+
+	// CacheTTL lets the provider tell for how long the item may be cached.
+	// Pages are cached for the shortest CacheTTL of their items, items
+	// without one count as the cache's TTL.
+	CacheTTL time.Duration `json:"-"`
+
+	// Placeholder is set by the server on copies of the App's DefaultItem
+	// which stand in for content no provider delivered
+	Placeholder bool `json:"placeholder,omitempty"`
+
+	// Emergency is set by the server on copies of the App's
+	// EmergencyContent, which is served when no provider delivered at all
+	Emergency bool `json:"emergency,omitempty"`
 }
 
 // Provider represent the 3rd party from which we are getting content
@@ -36,10 +55,22 @@ var (
 // SampleContentProvider is an example for a Provider's client
 type SampleContentProvider struct {
 	Source Provider
+
+	// Credentials would authenticate the calls to a real provider
+	Credentials Credentials
+}
+
+// NewSampleContentProvider creates a client for source which authenticates
+// with credentials
+func NewSampleContentProvider(source Provider, credentials Credentials) SampleContentProvider {
+	return SampleContentProvider{Source: source, Credentials: credentials}
 }
 
 // GetContent returns content items given a user IP, and the number of content items desired.
-func (cp SampleContentProvider) GetContent(userIP string, count int) ([]*ContentItem, error) {
+func (cp SampleContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	resp := make([]*ContentItem, count)
 	for i, _ := range resp {
 		resp[i] = &ContentItem{
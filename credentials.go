@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// redacted replaces credentials in logs and encoded output
+const redacted = "[REDACTED]"
+
+// Secret holds a credential such as an API key. It never shows its value when
+// formatted or encoded, so that it cannot end up in logs or responses by
+// accident. Clients pass Reveal to their provider.
+type Secret string
+
+// Reveal returns the credential itself
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+// Format writes the redaction marker for every verb, including %v, %+v,
+// %#v, %s and %q
+func (s Secret) Format(f fmt.State, verb rune) {
+	io.WriteString(f, redacted)
+}
+
+// MarshalText makes JSON and other encodings write the redaction marker
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(redacted), nil
+}
+
+// Credentials authenticate a Client with its provider. Clients needing them
+// take them in their constructor, e.g. NewSampleContentProvider, and keep
+// them as Secrets.
+type Credentials struct {
+	APIKey Secret `json:"api_key,omitempty"`
+	Token  Secret `json:"token,omitempty"`
+}
+
+// credentialParameter matches credential-like key=value pairs such as the
+// query parameters of a logged URL
+var credentialParameter = regexp.MustCompile(`(?i)((?:api[_-]?key|access[_-]?token|token|secret|password|authorization)=)[^&\s]+`)
+
+// redactCredentials replaces the values of credential-like key=value pairs
+func redactCredentials(message string) string {
+	return credentialParameter.ReplaceAllString(message, "${1}"+redacted)
+}
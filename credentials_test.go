@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testAPIKey = "sk-live-1234"
+
+func TestSecretsAreNeverFormatted(t *testing.T) {
+	client := NewSampleContentProvider(Provider1, Credentials{APIKey: testAPIKey, Token: "tok-5678"})
+
+	encoded, _ := json.Marshal(client)
+	outputs := map[string]string{"json": string(encoded)}
+	for _, verb := range []string{"%v", "%+v", "%#v", "%s", "%q"} {
+		outputs[verb] = fmt.Sprintf(verb, client)
+	}
+	for name, output := range outputs {
+		if strings.Contains(output, testAPIKey) || strings.Contains(output, "tok-5678") {
+			t.Errorf("%s: Got %s, want the credentials redacted", name, output)
+		}
+		if !strings.Contains(output, redacted) {
+			t.Errorf("%s: Got %s, want it to show the redaction", name, output)
+		}
+	}
+	if client.Credentials.APIKey.Reveal() != testAPIKey {
+		t.Error("Reveal does not return the credential")
+	}
+}
+
+func TestLogsRedactCredentials(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	client := NewSampleContentProvider(Provider1, Credentials{APIKey: testAPIKey})
+	logf(context.Background(), "calling %+v", client)
+	logf(context.Background(), "GET /?count=3&api_key=%s&token=%s", testAPIKey, testAPIKey)
+	runRawRequest(app, "/?count=1&password="+testAPIKey)
+
+	if strings.Contains(logs.String(), testAPIKey) {
+		t.Errorf("Logs contain a credential:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "api_key="+redacted) {
+		t.Errorf("Logs do not show the redacted parameter:\n%s", logs.String())
+	}
+}
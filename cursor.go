@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// nextCursorHeader carries the cursor of the page following a response
+const nextCursorHeader = "X-Next-Cursor"
+
+// cursorLength is the length of a decoded cursor: the offset, the mix
+// fingerprint and a signature of both
+const cursorLength = 8 + mixFingerprintLength + cursorSignatureLength
+
+const mixFingerprintLength = 8
+
+const cursorSignatureLength = 16
+
+// encodeCursor returns an opaque token standing for offset in mix, which
+// clients pass back as the cursor parameter instead of doing offset
+// arithmetic themselves. It is signed with the App's cursor key.
+func (a *App) encodeCursor(offset int, mix ContentMix) string {
+	payload := make([]byte, 0, cursorLength)
+	payload = appendUint64(payload, uint64(offset))
+	fingerprint := mixFingerprint(mix)
+	payload = append(payload, fingerprint[:]...)
+	payload = append(payload, a.signCursor(payload)...)
+	return base64.RawURLEncoding.EncodeToString(payload)
+}
+
+// decodeCursor returns the offset a cursor stands for. Cursors which were
+// not created by encodeCursor with the same key, were changed since or
+// belong to another mix are rejected.
+func (a *App) decodeCursor(token string, mix ContentMix) (int, error) {
+	payload, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(payload) != cursorLength {
+		return 0, errors.New("malformed cursor")
+	}
+	signed := payload[:cursorLength-cursorSignatureLength]
+	if !hmac.Equal(a.signCursor(signed), payload[len(signed):]) {
+		return 0, errors.New("malformed cursor")
+	}
+	fingerprint := mixFingerprint(mix)
+	if !bytes.Equal(payload[8:8+mixFingerprintLength], fingerprint[:]) {
+		return 0, errors.New("cursor belongs to a different mix")
+	}
+	offset := binary.BigEndian.Uint64(payload[:8])
+	if offset > math.MaxInt32 {
+		return 0, errors.New("malformed cursor")
+	}
+	return int(offset), nil
+}
+
+// signCursor returns the signature of a cursor's payload, an HMAC keyed with
+// the CursorKey, or with a random key if there is none
+func (a *App) signCursor(payload []byte) []byte {
+	key := a.CursorKey
+	if len(key) == 0 {
+		a.randomCursorKeyOnce.Do(func() {
+			a.randomCursorKey = make([]byte, 32)
+			if _, err := rand.Read(a.randomCursorKey); err != nil {
+				panic(fmt.Sprintf("could not generate cursor key: %v", err))
+			}
+		})
+		key = a.randomCursorKey
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(nil)[:cursorSignatureLength]
+}
+
+// parseCursor reads the offset from the cursor URL parameter, if given.
+// A cursor replaces the offset parameter, giving both is an error.
+func (a *App) parseCursor(req *http.Request, mix ContentMix) (offset int, ok bool, err error) {
+	query := req.URL.Query()
+	if len(query["cursor"]) == 0 {
+		return 0, false, nil
+	}
+	if len(query["cursor"]) > 1 {
+		return 0, false, errors.New("cursor must only be given once")
+	}
+	if len(query["offset"]) > 0 {
+		return 0, false, errors.New("cursor and offset must not both be given")
+	}
+	offset, err = a.decodeCursor(query.Get("cursor"), mix)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid cursor: %v", err)
+	}
+	return offset, true, nil
+}
+
+// mixFingerprint identifies the layout of a mix, so that a cursor is only
+// used with the mix it was created for
+func mixFingerprint(mix ContentMix) [mixFingerprintLength]byte {
+	hash := sha256.New()
+	for _, config := range mix {
+		fmt.Fprintf(hash, "%s>", config.Type)
+		if config.Fallback != nil {
+			fmt.Fprintf(hash, "%s", *config.Fallback)
+		}
+		if config.Tiers != nil {
+			fmt.Fprintf(hash, "%q", *config.Tiers)
+		}
+		hash.Write([]byte{0})
+	}
+	var fingerprint [mixFingerprintLength]byte
+	copy(fingerprint[:], hash.Sum(nil))
+	return fingerprint
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCursorRoundTrips(t *testing.T) {
+	for _, offset := range []int{0, 1, 7, 1 << 20} {
+		got, err := app.decodeCursor(app.encodeCursor(offset, DefaultConfig), DefaultConfig)
+		if err != nil || got != offset {
+			t.Errorf("Cursor for offset %d decoded to %d, %v", offset, got, err)
+		}
+	}
+}
+
+func TestCorruptedCursorsAreRejected(t *testing.T) {
+	cursor := app.encodeCursor(5, DefaultConfig)
+	flipped := []byte(cursor)
+	if flipped[3] == 'A' {
+		flipped[3] = 'B'
+	} else {
+		flipped[3] = 'A'
+	}
+
+	for name, token := range map[string]string{
+		"flipped":   string(flipped),
+		"truncated": cursor[:len(cursor)-2],
+		"garbage":   "not a cursor!",
+		"other mix": app.encodeCursor(5, ContentMix{config4}),
+	} {
+		if _, err := app.decodeCursor(token, DefaultConfig); err == nil {
+			t.Errorf("%s: cursor was accepted", name)
+		}
+	}
+}
+
+func TestForgedCursorsAreRejected(t *testing.T) {
+	other, _ := NewApp(DefaultConfig, sampleClients())
+	if _, err := app.decodeCursor(other.encodeCursor(5, DefaultConfig), DefaultConfig); err == nil {
+		t.Error("Cursor signed with another random key was accepted")
+	}
+
+	first, _ := NewApp(DefaultConfig, sampleClients(), WithCursorKey([]byte("shared")))
+	second, _ := NewApp(DefaultConfig, sampleClients(), WithCursorKey([]byte("shared")))
+	if offset, err := second.decodeCursor(first.encodeCursor(5, DefaultConfig), DefaultConfig); err != nil || offset != 5 {
+		t.Errorf("Cursor signed with the shared key decoded to %d, %v, want 5", offset, err)
+	}
+}
+
+func TestCursorServesTheNextPage(t *testing.T) {
+	first := runRawRequest(app, "/?count=3")
+	cursor := first.Header().Get(nextCursorHeader)
+	if cursor == "" {
+		t.Fatalf("Response has no %s header", nextCursorHeader)
+	}
+
+	next := runRawRequest(app, "/?count=3&cursor="+cursor)
+	if next.Code != http.StatusOK {
+		t.Fatalf("Got status %d for the next page, want 200", next.Code)
+	}
+	want := providerSequence(decodeItems(t, runRawRequest(app, "/?count=3&offset=3")))
+	if got := providerSequence(decodeItems(t, next)); got != want {
+		t.Errorf("Got providers %s for the cursor, want %s of offset 3", got, want)
+	}
+}
+
+func TestInvalidCursorsAreBadRequests(t *testing.T) {
+	cursor := runRawRequest(app, "/?count=3").Header().Get(nextCursorHeader)
+
+	for _, query := range []string{
+		"cursor=" + cursor[1:],
+		"cursor=" + cursor + "&offset=3",
+		"cursor=" + cursor + "&exclude=2",
+	} {
+		response := runRawRequest(app, "/?count=3&"+query)
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("%s: Got status %d, want 400", query, response.Code)
+		}
+		if !strings.Contains(response.Body.String(), "cursor") {
+			t.Errorf("%s: Got body %s, want it to mention the cursor", query, response.Body)
+		}
+	}
+}
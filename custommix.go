@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// customMixPath serves content from a mix given in the request body
+const customMixPath = "/mix"
+
+// maxCustomMixBytes limits the size of a custom mix request body
+const maxCustomMixBytes = 64 << 10
+
+// customMixRequest is the body of a custom mix request, e.g.
+// {"mix": [{"type": "1", "fallback": "2"}, {"type": "3"}]}
+type customMixRequest struct {
+	Mix []customConfig `json:"mix"`
+}
+
+type customConfig struct {
+	Type     Provider  `json:"type"`
+	Fallback *Provider `json:"fallback,omitempty"`
+}
+
+// serveCustomMix serves content from the mix posted in the request body, for
+// the count and offset given in the URL. Requests carrying an
+// Idempotency-Key are answered from the IdempotencyCache if possible.
+func (a *App) serveCustomMix(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		sendError(w, http.StatusMethodNotAllowed, "custom mixes must be posted")
+		return
+	}
+	if !a.requireClients(w) {
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxCustomMixBytes))
+	if err != nil {
+		sendBadRequest(w, fmt.Sprintf("could not read body: %v", err))
+		return
+	}
+
+	serve := func(w http.ResponseWriter) {
+		mix, err := a.parseCustomMix(body)
+		if err != nil {
+			sendBadRequest(w, err.Error())
+			return
+		}
+		a.serveContent(ctx, w, req, pageRequest{config: mix, custom: true})
+	}
+
+	key := req.Header.Get(idempotencyKeyHeader)
+	if key == "" || a.Idempotency == nil {
+		serve(w)
+		return
+	}
+	a.Idempotency.serve(ctx, w, key, requestFingerprint(req, body), serve)
+}
+
+// parseCustomMix reads the mix of a custom mix request and checks that every
+// provider it refers to has a client
+func (a *App) parseCustomMix(body []byte) (ContentMix, error) {
+	var request customMixRequest
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		return nil, fmt.Errorf("invalid mix: %v", err)
+	}
+	if len(request.Mix) == 0 {
+		return nil, errors.New("mix must contain at least one content config")
+	}
+
+	mix := make(ContentMix, len(request.Mix))
+	for i, config := range request.Mix {
+		if _, ok := a.client(config.Type); !ok {
+			return nil, fmt.Errorf("config %d: unknown provider %s", i, config.Type)
+		}
+		if config.Fallback != nil {
+			if _, ok := a.client(*config.Fallback); !ok {
+				return nil, fmt.Errorf("config %d: unknown fallback provider %s", i, *config.Fallback)
+			}
+		}
+		mix[i] = ContentConfig{Type: config.Type, Fallback: config.Fallback}
+	}
+	return mix, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postMix(srv http.Handler, target, body, idempotencyKey string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", target, strings.NewReader(body))
+	if idempotencyKey != "" {
+		req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+	}
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, req)
+	return response
+}
+
+func decodeItems(t *testing.T, response *httptest.ResponseRecorder) []*ContentItem {
+	t.Helper()
+	var content []*ContentItem
+	if err := json.NewDecoder(response.Body).Decode(&content); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	return content
+}
+
+func TestCustomMixIsServed(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, map[Provider]Client{
+		Provider1: FailingContentProvider{},
+		Provider2: SampleContentProvider{Source: Provider2},
+		Provider3: SampleContentProvider{Source: Provider3},
+	})
+
+	response := postMix(srv, "/mix?count=4", `{"mix": [{"type": "1", "fallback": "2"}, {"type": "3"}]}`, "")
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Response code is %d, want 200", response.Code)
+	}
+	if sources := providerSequence(decodeItems(t, response)); sources != "2323" {
+		t.Errorf("Got providers %s, want 2323", sources)
+	}
+}
+
+func TestInvalidCustomMixIsRejected(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients())
+
+	for name, body := range map[string]string{
+		"malformed":        `{"mix": [`,
+		"empty":            `{"mix": []}`,
+		"unknown provider": `{"mix": [{"type": "missing"}]}`,
+		"unknown fallback": `{"mix": [{"type": "1", "fallback": "missing"}]}`,
+		"unknown field":    `{"mix": [{"type": "1"}], "extra": true}`,
+	} {
+		if response := postMix(srv, "/mix?count=4", body, ""); response.Code != http.StatusBadRequest {
+			t.Errorf("%s: Got status %d, want 400", name, response.Code)
+		}
+	}
+	if response := runRawRequest(srv, "/mix?count=4"); response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Got status %d for GET, want 405", response.Code)
+	}
+}
+
+func TestRepeatedIdempotencyKeyReturnsCachedResponse(t *testing.T) {
+	clients, counters := countingClients()
+	srv, _ := NewApp(DefaultConfig, clients, WithIdempotencyKeys(time.Minute))
+	body := `{"mix": [{"type": "1"}, {"type": "2"}]}`
+
+	first := postMix(srv, "/mix?count=4", body, "key")
+	calls := totalCalls(counters)
+	retry := postMix(srv, "/mix?count=4", body, "key")
+
+	if retry.Code != http.StatusOK {
+		t.Fatalf("Response code is %d, want 200", retry.Code)
+	}
+	if retry.Body.String() != first.Body.String() {
+		t.Errorf("Got %s on retry, want the original %s", retry.Body, first.Body)
+	}
+	if totalCalls(counters) != calls {
+		t.Errorf("Providers were called %d more times on retry", totalCalls(counters)-calls)
+	}
+
+	postMix(srv, "/mix?count=4", body, "other key")
+	if totalCalls(counters) == calls {
+		t.Errorf("Request with a new key was served from the idempotency cache")
+	}
+}
+
+func TestIdempotencyKeyReusedForDifferentBodyConflicts(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithIdempotencyKeys(time.Minute))
+
+	postMix(srv, "/mix?count=4", `{"mix": [{"type": "1"}]}`, "key")
+	response := postMix(srv, "/mix?count=4", `{"mix": [{"type": "2"}]}`, "key")
+
+	if response.Code != http.StatusConflict {
+		t.Errorf("Got status %d, want 409", response.Code)
+	}
+}
+
+func TestIdempotencyKeyExpires(t *testing.T) {
+	clients, counters := countingClients()
+	srv, _ := NewApp(DefaultConfig, clients, WithIdempotencyKeys(time.Minute))
+	now := time.Now()
+	srv.Idempotency.now = func() time.Time { return now }
+	body := `{"mix": [{"type": "1"}]}`
+
+	postMix(srv, "/mix?count=2", body, "key")
+	calls := totalCalls(counters)
+	now = now.Add(2 * time.Minute)
+	postMix(srv, "/mix?count=2", body, "key")
+
+	if totalCalls(counters) == calls {
+		t.Errorf("Expired response was replayed")
+	}
+}
+
+func TestIdempotencyCacheKeepsAtMostMaxEntries(t *testing.T) {
+	clients, counters := countingClients()
+	srv, _ := NewApp(DefaultConfig, clients, WithIdempotencyKeys(time.Minute))
+	srv.Idempotency.MaxEntries = 2
+	now := time.Now()
+	srv.Idempotency.now = func() time.Time { return now }
+	body := `{"mix": [{"type": "1"}]}`
+
+	for _, key := range []string{"a", "b", "c"} {
+		postMix(srv, "/mix?count=2", body, key)
+		now = now.Add(time.Second)
+	}
+	if len(srv.Idempotency.entries) != 2 {
+		t.Fatalf("Got %d kept keys, want 2", len(srv.Idempotency.entries))
+	}
+	calls := totalCalls(counters)
+	postMix(srv, "/mix?count=2", body, "a")
+	if totalCalls(counters) == calls {
+		t.Error("The response expiring first was kept")
+	}
+}
+
+func TestFullIdempotencyCacheServesWithoutKeeping(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithIdempotencyKeys(time.Minute))
+	srv.Idempotency.MaxEntries = 1
+	srv.Idempotency.begin("in progress", [32]byte{})
+
+	if response := postMix(srv, "/mix?count=2", `{"mix": [{"type": "1"}]}`, "key"); response.Code != http.StatusOK {
+		t.Errorf("Got status %d, want 200", response.Code)
+	}
+	if _, kept := srv.Idempotency.entries["key"]; kept {
+		t.Error("Response was kept beyond MaxEntries")
+	}
+}
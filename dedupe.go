@@ -0,0 +1,27 @@
+package main
+
+import "fmt"
+
+// dedupKey returns the value an item is deduplicated by
+func (a *App) dedupKey(item *ContentItem) string {
+	value, _ := itemFieldValue(item, a.DeduplicateBy)
+	return fmt.Sprint(value)
+}
+
+// outranks reports whether provider's version of a duplicate item is to be
+// kept over the one of other, according to the DeduplicationPriority
+func (a *App) outranks(provider, other Provider) bool {
+	return a.DeduplicationPriority[provider] > a.DeduplicationPriority[other]
+}
+
+// preferDuplicate puts candidate in the place of the item at index i of
+// items, which it duplicates, if its provider outranks the item's one. It
+// reports whether it did, in which case candidate's config moves on to its
+// next item.
+func (a *App) preferDuplicate(items []returnedItem, i int, candidate returnedItem) bool {
+	if !a.outranks(candidate.Provider, items[i].Provider) {
+		return false
+	}
+	items[i] = candidate
+	return true
+}
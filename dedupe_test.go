@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDuplicateOfPreferredProviderIsKept(t *testing.T) {
+	srv, _ := NewApp(ContentMix{{Type: Provider1}, {Type: Provider2}}, map[Provider]Client{
+		Provider1: fixedItems(Provider1, "a", "b"),
+		Provider2: fixedItems(Provider2, "a", "x", "y"),
+	}, WithDeduplication("id"), WithDeduplicationPriority(map[Provider]int{Provider2: 2, Provider1: 1}))
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	if ids := itemIDs(content); ids != "a,x,b,y" {
+		t.Errorf("Got items %s, want a,x,b,y", ids)
+	}
+	if sources := providerSequence(content); sources != "2212" {
+		t.Errorf("Got providers %s, want 2212 with the preferred version of a", sources)
+	}
+}
+
+func TestDuplicateOfLesserProviderIsSkipped(t *testing.T) {
+	srv, _ := NewApp(ContentMix{{Type: Provider1}, {Type: Provider2}}, map[Provider]Client{
+		Provider1: fixedItems(Provider1, "a", "b"),
+		Provider2: fixedItems(Provider2, "a", "x", "y"),
+	}, WithDeduplication("id"), WithDeduplicationPriority(map[Provider]int{Provider1: 2, Provider2: 1}))
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	if ids := itemIDs(content); ids != "a,x,b,y" {
+		t.Errorf("Got items %s, want a,x,b,y", ids)
+	}
+	if sources := providerSequence(content); sources != "1212" {
+		t.Errorf("Got providers %s, want 1212 with the preferred version of a", sources)
+	}
+}
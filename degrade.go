@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+const (
+	// DefaultDegradedShare is the share of its slots a slow provider keeps,
+	// unless configured otherwise
+	DefaultDegradedShare = 0.5
+
+	// minLatencySamples is how many calls to a provider have to be observed
+	// before it can be considered slow
+	minLatencySamples = 20
+)
+
+// degradeSlowConfigs hands part of the slots of configs whose primary
+// provider is slow to the other configs of the mix, so that fewer items are
+// requested from the slow provider while the page keeps its length. A slow
+// config keeps DegradedShare of its slots, rounded up. The slots it gives up
+// go to the fast configs in turn, in the order they appear in the mix. If
+// every config is slow, there is nobody faster to take over and the mix is
+// left as it is.
+func (a *App) degradeSlowConfigs(ctx context.Context, mix ContentMix) ContentMix {
+	if a.SlowProviderP99 <= 0 || a.Metrics == nil {
+		return mix
+	}
+
+	counts := getCountsPerConfig(mix)
+	limits := map[ContentConfig]int{}
+	var fast []ContentConfig
+	for _, config := range distinctConfigs(mix, counts) {
+		if a.isSlow(config.Type) {
+			limits[config] = int(math.Ceil(float64(counts[config]) * a.DegradedShare))
+		} else {
+			fast = append(fast, config)
+		}
+	}
+	if len(limits) == 0 || len(fast) == 0 {
+		return mix
+	}
+
+	degraded := make(ContentMix, len(mix))
+	used := map[ContentConfig]int{}
+	next := 0
+	for i, config := range mix {
+		if limit, slow := limits[config]; slow && used[config] >= limit {
+			config = fast[next%len(fast)]
+			next++
+		}
+		used[config]++
+		degraded[i] = config
+	}
+	for config := range limits {
+		logf(ctx, "provider %s is slow, requesting %d instead of %d items", config.Type, used[config], counts[config])
+		a.Metrics.observeDegraded(config.Type)
+	}
+	return degraded
+}
+
+// isSlow reports whether the 99th percentile of the provider's call latency
+// exceeds SlowProviderP99
+func (a *App) isSlow(provider Provider) bool {
+	histogram := a.Metrics.providerHistogramIfAny(provider)
+	if histogram == nil {
+		return false
+	}
+	p99, ok := histogram.quantile(0.99, minLatencySamples)
+	return ok && p99 > a.SlowProviderP99
+}
+
+// quantile returns the upper bound of the bucket holding the q quantile of
+// the observed durations, which is infinite for the last bucket. It is not
+// known until at least minSamples durations were observed.
+func (h *Histogram) quantile(q float64, minSamples uint64) (time.Duration, bool) {
+	snapshot := h.snapshot()
+	if snapshot.Count < minSamples || snapshot.Count == 0 {
+		return 0, false
+	}
+	rank := uint64(math.Ceil(q * float64(snapshot.Count)))
+	for i, bucket := range snapshot.Buckets {
+		if bucket.Count >= rank && i < len(h.bounds) {
+			return h.bounds[i], true
+		}
+	}
+	return time.Duration(math.MaxInt64), true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// observeLatency records n calls to provider taking d
+func observeLatency(m *Metrics, provider Provider, d time.Duration, n int) {
+	for i := 0; i < n; i++ {
+		m.observeProvider(provider, d)
+	}
+}
+
+func TestSlowProviderIsAskedForFewerItems(t *testing.T) {
+	slow := &CountingContentProvider{Client: SampleContentProvider{Source: Provider1}}
+	fast := &CountingContentProvider{Client: SampleContentProvider{Source: Provider2}}
+	srv, _ := NewApp(
+		ContentMix{{Type: Provider1}, {Type: Provider2}},
+		map[Provider]Client{Provider1: slow, Provider2: fast},
+		WithSlowProviderDegradation(100*time.Millisecond, 0.5),
+	)
+	observeLatency(srv.Metrics, Provider1, time.Second, minLatencySamples)
+	observeLatency(srv.Metrics, Provider2, time.Millisecond, minLatencySamples)
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=10", nil))
+
+	if len(content) != 10 {
+		t.Errorf("Got %d items back, want 10", len(content))
+	}
+	if slow.Requested() != 3 || fast.Requested() != 7 {
+		t.Errorf("Slow provider was asked for %d and fast one for %d items, want 3 and 7", slow.Requested(), fast.Requested())
+	}
+	if sources := providerSequence(content); sources != "1212122222" {
+		t.Errorf("Got providers %s, want 1212122222", sources)
+	}
+	if degraded := srv.Metrics.snapshot().ProviderDegraded[Provider1]; degraded != 1 {
+		t.Errorf("Got %d degraded pages in the metrics, want 1", degraded)
+	}
+}
+
+func TestProvidersAreNotDegradedWithoutEnoughSamplesOrFasterProviders(t *testing.T) {
+	mix := stretchContentMixOverCount(ContentMix{{Type: Provider1}, {Type: Provider2}}, 10, 0)
+	srv, _ := NewApp(ContentMix{config4}, sampleClients(), WithSlowProviderDegradation(100*time.Millisecond, 0.5))
+
+	observeLatency(srv.Metrics, Provider1, time.Second, minLatencySamples-1)
+	if degraded := srv.degradeSlowConfigs(context.Background(), mix); !sameMix(degraded, mix) {
+		t.Errorf("Provider was degraded after %d calls", minLatencySamples-1)
+	}
+
+	observeLatency(srv.Metrics, Provider1, time.Second, 1)
+	observeLatency(srv.Metrics, Provider2, time.Second, minLatencySamples)
+	if degraded := srv.degradeSlowConfigs(context.Background(), mix); !sameMix(degraded, mix) {
+		t.Error("Providers were degraded although none is faster")
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	histogram := NewHistogram([]time.Duration{10 * time.Millisecond, 100 * time.Millisecond})
+	observeDurations := func(d time.Duration, n int) {
+		for i := 0; i < n; i++ {
+			histogram.Observe(d)
+		}
+	}
+	observeDurations(5*time.Millisecond, 98)
+	observeDurations(50*time.Millisecond, 2)
+
+	if p99, ok := histogram.quantile(0.99, 1); !ok || p99 != 100*time.Millisecond {
+		t.Errorf("Got p99 %v, want 100ms", p99)
+	}
+	if p50, _ := histogram.quantile(0.5, 1); p50 != 10*time.Millisecond {
+		t.Errorf("Got p50 %v, want 10ms", p50)
+	}
+	if _, ok := histogram.quantile(0.99, 101); ok {
+		t.Error("Got a quantile from too few samples")
+	}
+}
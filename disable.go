@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ErrProviderDisabled is why a provider which an operator disabled fails
+var ErrProviderDisabled = errors.New("provider is disabled")
+
+// providerSwitches records which providers are disabled. The zero value has
+// every provider enabled and it is safe for concurrent use.
+type providerSwitches struct {
+	mu       sync.RWMutex
+	disabled map[Provider]bool
+}
+
+func (s *providerSwitches) set(provider Provider, disabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disabled == nil {
+		s.disabled = map[Provider]bool{}
+	}
+	if disabled {
+		s.disabled[provider] = true
+	} else {
+		delete(s.disabled, provider)
+	}
+}
+
+func (s *providerSwitches) isDisabled(provider Provider) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.disabled[provider]
+}
+
+// DisableProvider makes every fetch treat the provider as failed while the
+// server is running, so that its configs go to their fallbacks straight
+// away, without deregistering its client. It fails for providers without a
+// client.
+func (a *App) DisableProvider(provider Provider) error {
+	if _, ok := a.client(provider); !ok {
+		return fmt.Errorf("unknown provider %s", provider)
+	}
+	a.switches.set(provider, true)
+	return nil
+}
+
+// EnableProvider undoes DisableProvider
+func (a *App) EnableProvider(provider Provider) {
+	a.switches.set(provider, false)
+}
+
+// ProviderDisabled reports whether the provider was disabled with
+// DisableProvider
+func (a *App) ProviderDisabled(provider Provider) bool {
+	return a.switches.isDisabled(provider)
+}
+
+// checkEnabled fails with a ProviderUnavailableError if the provider is
+// disabled
+func (a *App) checkEnabled(provider Provider) error {
+	if a.ProviderDisabled(provider) {
+		return &ProviderUnavailableError{Provider: provider, Err: ErrProviderDisabled}
+	}
+	return nil
+}
+
+// providerSwitchPath is followed by the provider and the action, e.g.
+// /providers/2/disable or /providers/2/enable
+const providerSwitchPath = "/providers/"
+
+// serveProviderSwitch disables or enables a provider. It has to be posted
+// with the AdminToken as bearer token and is disabled if there is no
+// AdminToken.
+func (a *App) serveProviderSwitch(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if !a.requireAdmin(w, req) {
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		sendError(w, http.StatusMethodNotAllowed, "providers must be switched with POST")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, providerSwitchPath), "/")
+	if len(parts) != 2 || parts[0] == "" || (parts[1] != "enable" && parts[1] != "disable") {
+		sendError(w, http.StatusNotFound, fmt.Sprintf("unknown path %s", req.URL.Path))
+		return
+	}
+	provider := Provider(parts[0])
+	if _, ok := a.client(provider); !ok {
+		sendError(w, http.StatusNotFound, fmt.Sprintf("unknown provider %s", provider))
+		return
+	}
+
+	if parts[1] == "disable" {
+		a.DisableProvider(provider)
+	} else {
+		a.EnableProvider(provider)
+	}
+	logf(ctx, "provider %s %sd", provider, parts[1])
+	writeJSON(w, http.StatusOK, map[string]interface{}{"provider": provider, "disabled": a.ProviderDisabled(provider)})
+}
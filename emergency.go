@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// emergencyContentHeader marks responses served from the EmergencyContent
+const emergencyContentHeader = "X-Emergency-Content"
+
+// LoadEmergencyContent reads the EmergencyContent from a JSON file holding
+// an array of items in the format the server responds with
+func LoadEmergencyContent(path string) ([]*ContentItem, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read emergency content: %v", err)
+	}
+	var items []*ContentItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("could not parse emergency content %s: %v", path, err)
+	}
+	for i, item := range items {
+		if item == nil {
+			return nil, fmt.Errorf("emergency content %s: item %d is null", path, i)
+		}
+	}
+	return items, nil
+}
+
+// emergencyPage replaces a page which failed or holds no content at all,
+// because every provider and fallback failed, with the requested part of the
+// EmergencyContent. Pages which are only throttled are left alone, so that
+// clients are told to retry. The items are copies marked as Emergency, the
+// EmergencyContent itself is never changed.
+func (a *App) emergencyPage(ctx context.Context, request pageRequest, fetched page) page {
+	if len(a.EmergencyContent) == 0 || request.count == 0 || fetched.throttled {
+		return fetched
+	}
+	if fetched.err == nil && returnedCount(fetched.items) > 0 {
+		return fetched
+	}
+	if fetched.err != nil {
+		logf(ctx, "serving emergency content instead of failing: %v", fetched.err)
+	} else {
+		logf(ctx, "serving emergency content as no provider delivered")
+	}
+
+	items := []returnedItem{}
+	for i := request.offset; i < request.offset+request.count && i < len(a.EmergencyContent); i++ {
+		item := *a.EmergencyContent[i]
+		item.Emergency = true
+		items = append(items, returnedItem{Item: &item, Fallback: true})
+	}
+	return page{items: items, emergency: true}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeEmergencyFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "emergency")
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "emergency.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Could not write emergency file: %v", err)
+	}
+	return path
+}
+
+func downClients() map[Provider]Client {
+	return map[Provider]Client{
+		Provider1: FailingContentProvider{},
+		Provider2: FailingContentProvider{},
+		Provider3: FailingContentProvider{},
+	}
+}
+
+func TestEmergencyContentIsServedWhenEveryProviderFails(t *testing.T) {
+	items, err := LoadEmergencyContent(writeEmergencyFile(t, `[
+		{"id": "e1", "title": "Emergency 1", "source": "static"},
+		{"id": "e2", "title": "Emergency 2", "source": "static"},
+		{"id": "e3", "title": "Emergency 3", "source": "static"}
+	]`))
+	if err != nil {
+		t.Fatalf("Could not load emergency content: %v", err)
+	}
+	srv, _ := NewApp(DefaultConfig, downClients(), WithEmergencyContent(items), WithStrictMode())
+
+	response := runRawRequest(srv, "/?count=2&offset=1")
+	if response.Code != http.StatusOK {
+		t.Fatalf("Got status %d, want 200", response.Code)
+	}
+	if got := response.Header().Get(emergencyContentHeader); got != "true" {
+		t.Errorf("Got %s %q, want true", emergencyContentHeader, got)
+	}
+	if got := response.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Got Cache-Control %q, want no-store", got)
+	}
+	var content []*ContentItem
+	if err := json.NewDecoder(response.Body).Decode(&content); err != nil {
+		t.Fatalf("Couldn't decode Response json: %v", err)
+	}
+	if ids := itemIDs(content); ids != "e2,e3" {
+		t.Errorf("Got items %s, want e2,e3", ids)
+	}
+	for i, item := range content {
+		if !item.Emergency {
+			t.Errorf("Position %d: Item is not marked as emergency content", i)
+		}
+	}
+	if items[1].Emergency {
+		t.Error("Emergency content itself was changed")
+	}
+}
+
+func TestEmergencyContentIsNotServedWhileProvidersDeliver(t *testing.T) {
+	clients := downClients()
+	clients[Provider2] = SampleContentProvider{Source: Provider2}
+	srv, _ := NewApp(DefaultConfig, clients, WithEmergencyContent([]*ContentItem{{ID: "e1"}}))
+
+	response := runRawRequest(srv, "/?count=5")
+	if got := response.Header().Get(emergencyContentHeader); got != "" {
+		t.Errorf("Got %s %q while a provider delivered", emergencyContentHeader, got)
+	}
+	var content []*ContentItem
+	if err := json.NewDecoder(response.Body).Decode(&content); err != nil {
+		t.Fatalf("Couldn't decode Response json: %v", err)
+	}
+	for i, item := range content {
+		if item.Emergency {
+			t.Errorf("Position %d: Got emergency item %s", i, item.ID)
+		}
+	}
+}
+
+func TestInvalidEmergencyFileFailsToLoad(t *testing.T) {
+	for name, path := range map[string]string{
+		"missing":   filepath.Join(os.TempDir(), "does-not-exist", "emergency.json"),
+		"not json":  writeEmergencyFile(t, `{"id": "e1"`),
+		"null item": writeEmergencyFile(t, `[null]`),
+	} {
+		if _, err := LoadEmergencyContent(path); err == nil {
+			t.Errorf("%s: Got no error", name)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// Enricher computes fields which the server adds to a returned item, e.g. a
+// signed impression token, the time it was served or the experiment variant.
+// It returns the fields to add by their JSON name, nil adds none. Enrichers
+// are called once per item and response, after the page was assembled, so
+// they see cached items too. They must not change the item.
+type Enricher func(item *ContentItem, ic ItemContext) map[string]interface{}
+
+// ItemContext describes the response an item is returned in
+type ItemContext struct {
+	Request   *http.Request
+	RequestID string
+	// Position is the position of the item within the whole content, i.e.
+	// the page's offset plus its position within the page
+	Position int
+	Provider Provider
+	// Variant is the Experiment variant the request was put into, empty if
+	// it is not part of the experiment
+	Variant string
+}
+
+// enrich returns a copy of items carrying the fields of every Enricher, in
+// their order. Fields which the item already has, or which an earlier
+// enricher added, are left alone, so that enrichers only ever add fields.
+// The items themselves are shared with the cache and are not changed.
+func (a *App) enrich(ctx context.Context, req *http.Request, request pageRequest, items []returnedItem) []returnedItem {
+	if len(a.Enrichers) == 0 || len(items) == 0 {
+		return items
+	}
+	ic := ItemContext{Request: req, RequestID: requestIDFromContext(ctx)}
+	if request.variant {
+		ic.Variant = request.mix
+	}
+
+	enriched := make([]returnedItem, len(items))
+	for i, item := range items {
+		ic.Position = request.offset + i
+		ic.Provider = item.Provider
+		item.Extra = map[string]interface{}{}
+		for _, enricher := range a.Enrichers {
+			fields, err := callEnricher(ctx, enricher, item.Item, ic)
+			if err != nil {
+				logf(ctx, "could not enrich item %s: %v", item.Item.ID, err)
+				continue
+			}
+			for field, value := range fields {
+				if _, taken := item.Extra[field]; taken || isItemField(field) {
+					logf(ctx, "enricher cannot replace field %q", field)
+					continue
+				}
+				item.Extra[field] = value
+			}
+		}
+		enriched[i] = item
+	}
+	return enriched
+}
+
+// callEnricher returns the fields of enricher for item. A panicking enricher
+// fails the request of ctx, see recoverCallbackPanic.
+func callEnricher(ctx context.Context, enricher Enricher, item *ContentItem, ic ItemContext) (fields map[string]interface{}, err error) {
+	defer recoverCallbackPanic(ctx, "Enricher", &err)
+	return enricher(item, ic), nil
+}
+
+// isItemField reports whether field is one of the fields items are rendered
+// with, which enrichers cannot replace
+func isItemField(field string) bool {
+	_, ok := contentItemFieldNames[field]
+	return ok || isAnnotationField(field) || field == "debug"
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func decodeItemFields(t *testing.T, srv *App, target string) []map[string]interface{} {
+	response := runRawRequest(srv, target)
+	var items []map[string]interface{}
+	if err := json.NewDecoder(response.Body).Decode(&items); err != nil {
+		t.Fatalf("Couldn't decode Response json: %v", err)
+	}
+	return items
+}
+
+func TestEnrichedFieldsAreAddedToEveryItem(t *testing.T) {
+	impressions := func(item *ContentItem, ic ItemContext) map[string]interface{} {
+		return map[string]interface{}{"impression": fmt.Sprintf("%s@%d", item.ID, ic.Position)}
+	}
+	providers := func(item *ContentItem, ic ItemContext) map[string]interface{} {
+		return map[string]interface{}{"served_by": string(ic.Provider), "title": "replaced"}
+	}
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithCache(time.Minute), WithEnricher(impressions), WithEnricher(providers))
+
+	for _, request := range []string{"fetched", "cached"} {
+		items := decodeItemFields(t, srv, "/?count=4&offset=2")
+		if len(items) != 4 {
+			t.Fatalf("%s: Got %d items, want 4", request, len(items))
+		}
+		for i, item := range items {
+			if want := fmt.Sprintf("%s@%d", item["id"], i+2); item["impression"] != want {
+				t.Errorf("%s: Position %d: Got impression %v, want %s", request, i, item["impression"], want)
+			}
+			if item["served_by"] != item["source"] {
+				t.Errorf("%s: Position %d: Got served_by %v, want %v", request, i, item["served_by"], item["source"])
+			}
+			if item["title"] == "replaced" {
+				t.Errorf("%s: Position %d: Enricher replaced the title", request, i)
+			}
+		}
+	}
+}
+
+func TestItemsAreNotEnrichedByDefault(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients())
+
+	for i, item := range decodeItemFields(t, srv, "/?count=2") {
+		for field := range item {
+			if _, known := contentItemFieldNames[field]; !known {
+				t.Errorf("Position %d: Got field %q", i, field)
+			}
+		}
+	}
+}
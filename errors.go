@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrIncompleteContent fails a request in StrictMode if any of its configs
+// could not be fetched
+var ErrIncompleteContent = errors.New("content is incomplete because a provider and its fallback failed")
+
+// Sentinel errors which the provider errors below match with errors.Is
+var (
+	ErrProviderTimeout     = errors.New("provider timed out")
+	ErrProviderUnavailable = errors.New("provider is unavailable")
+	ErrProviderBadResponse = errors.New("provider sent a bad response")
+)
+
+// ProviderTimeoutError can be returned by a Client when its provider did not
+// respond in time. It is also what a call exceeding its provider timeout
+// fails with. Timed out calls are retried once if the request has time left.
+type ProviderTimeoutError struct {
+	Provider Provider
+	Err      error
+}
+
+func (e *ProviderTimeoutError) Error() string {
+	return providerErrorMessage(e.Provider, "timed out", e.Err)
+}
+
+func (e *ProviderTimeoutError) Unwrap() error { return e.Err }
+
+// Is makes the error match ErrProviderTimeout
+func (e *ProviderTimeoutError) Is(target error) bool { return target == ErrProviderTimeout }
+
+// ProviderUnavailableError can be returned by a Client when its provider is
+// down. Such calls are not retried, and a circuit breaker opens on the first
+// one rather than waiting for its failure threshold.
+type ProviderUnavailableError struct {
+	Provider Provider
+	Err      error
+}
+
+func (e *ProviderUnavailableError) Error() string {
+	return providerErrorMessage(e.Provider, "is unavailable", e.Err)
+}
+
+func (e *ProviderUnavailableError) Unwrap() error { return e.Err }
+
+// Is makes the error match ErrProviderUnavailable
+func (e *ProviderUnavailableError) Is(target error) bool { return target == ErrProviderUnavailable }
+
+// ProviderBadResponseError can be returned by a Client when its provider's
+// response could not be understood. Such calls are not retried, as the
+// provider would most likely respond the same way again.
+type ProviderBadResponseError struct {
+	Provider Provider
+	Err      error
+}
+
+func (e *ProviderBadResponseError) Error() string {
+	return providerErrorMessage(e.Provider, "sent a bad response", e.Err)
+}
+
+func (e *ProviderBadResponseError) Unwrap() error { return e.Err }
+
+// Is makes the error match ErrProviderBadResponse
+func (e *ProviderBadResponseError) Is(target error) bool { return target == ErrProviderBadResponse }
+
+func providerErrorMessage(provider Provider, what string, err error) string {
+	message := "provider " + what
+	if provider != "" {
+		message = fmt.Sprintf("provider %s %s", provider, what)
+	}
+	if err != nil {
+		message += ": " + err.Error()
+	}
+	return message
+}
+
+// errorClass groups provider errors for logging, metrics and retries
+type errorClass string
+
+const (
+	classTimeout     errorClass = "timeout"
+	classUnavailable errorClass = "unavailable"
+	classBadResponse errorClass = "bad_response"
+	classRateLimited errorClass = "rate_limited"
+	classCanceled    errorClass = "canceled"
+	classOther       errorClass = "other"
+)
+
+// classifyError tells what kind of failure a provider error is
+func classifyError(err error) errorClass {
+	if _, throttled := getRetryAfter(err); throttled {
+		return classRateLimited
+	}
+	switch {
+	case errors.Is(err, ErrProviderTimeout), errors.Is(err, context.DeadlineExceeded):
+		return classTimeout
+	case errors.Is(err, ErrProviderUnavailable), errors.Is(err, ErrCircuitOpen):
+		return classUnavailable
+	case errors.Is(err, ErrProviderBadResponse):
+		return classBadResponse
+	case errors.Is(err, context.Canceled):
+		return classCanceled
+	default:
+		return classOther
+	}
+}
+
+// RateLimitedError can be returned by a Client when its provider is
+// throttling requests. After is how long the provider asked to wait.
+type RateLimitedError struct {
+	After time.Duration
+}
+
+func (e RateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %v", e.After)
+}
+
+// RetryAfter returns how long the provider asked to wait
+func (e RateLimitedError) RetryAfter() time.Duration {
+	return e.After
+}
+
+// retryAfterError is implemented by errors that carry a backoff hint
+type retryAfterError interface {
+	error
+	RetryAfter() time.Duration
+}
+
+// getRetryAfter returns the backoff hint of err, if it has one
+func getRetryAfter(err error) (time.Duration, bool) {
+	var hinted retryAfterError
+	if errors.As(err, &hinted) {
+		return hinted.RetryAfter(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// experimentVariantHeader tells which variant of the Experiment a response
+// was served from
+const experimentVariantHeader = "X-Experiment-Variant"
+
+// Experiment serves different mixes to buckets of users for A/B tests.
+// Every user is put into one of the Variants at random, with a chance
+// proportional to its Weight, but always into the same one for the same
+// experiment. Users are told apart by the value of Header, or by their IP
+// if Header is empty or missing from the request.
+type Experiment struct {
+	// Name salts the bucketing, so that the buckets of different
+	// experiments are independent of each other
+	Name     string
+	Header   string
+	Variants []Variant
+}
+
+// Variant is one arm of an Experiment. Mix is the name of one of the App's
+// Mixes, so that the variant is also served under /mix/{name}.
+type Variant struct {
+	Mix    string
+	Weight int
+}
+
+// variant returns the variant the user identified by key is put into
+func (e *Experiment) variant(key string) Variant {
+	total := 0
+	for _, variant := range e.Variants {
+		total += variant.Weight
+	}
+	hash := sha256.Sum256([]byte(e.Name + "\x00" + key))
+	bucket := int(binary.BigEndian.Uint64(hash[:8]) % uint64(total))
+	for _, variant := range e.Variants {
+		if bucket < variant.Weight {
+			return variant
+		}
+		bucket -= variant.Weight
+	}
+	return e.Variants[len(e.Variants)-1]
+}
+
+// userKey returns what identifies the user of a request from userIP for
+// bucketing
+func (e *Experiment) userKey(req *http.Request, userIP string) string {
+	if e.Header != "" {
+		if value := req.Header.Get(e.Header); value != "" {
+			return value
+		}
+	}
+	return userIP
+}
+
+// validateExperiment checks that every variant refers to one of the Mixes
+// and that the users can be divided between them
+func (a *App) validateExperiment() error {
+	if len(a.Experiment.Variants) == 0 {
+		return errors.New("experiment must have at least one variant")
+	}
+	for i, variant := range a.Experiment.Variants {
+		if _, ok := a.Mixes[variant.Mix]; !ok {
+			return fmt.Errorf("experiment variant %d: unknown mix %q", i, variant.Mix)
+		}
+		if variant.Weight <= 0 {
+			return fmt.Errorf("experiment variant %d: weight must be positive", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func requestFrom(srv *App, ip string, header string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", "/?count=2", nil)
+	request.RemoteAddr = ip + ":1234"
+	if header != "" {
+		request.Header.Set("X-User", header)
+	}
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, request)
+	return response
+}
+
+func TestUsersAreBucketedIntoVariantsByIP(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(),
+		WithMix("organic", ContentMix{config4}),
+		WithMix("trending", ContentMix{config2}),
+		WithExperiment(Experiment{Name: "ordering", Header: "", Variants: []Variant{
+			{Mix: "organic", Weight: 1},
+			{Mix: "trending", Weight: 1},
+		}}))
+
+	for _, test := range []struct {
+		ip      string
+		variant string
+		source  string
+	}{
+		{"192.0.2.1", "trending", "2"},
+		{"192.0.2.2", "organic", "1"},
+	} {
+		for i := 0; i < 3; i++ {
+			response := requestFrom(srv, test.ip, "")
+			if got := response.Header().Get(experimentVariantHeader); got != test.variant {
+				t.Errorf("%s: Got variant %q, want %q", test.ip, got, test.variant)
+			}
+			if body := response.Body.String(); !strings.Contains(body, `"source":"`+test.source+`"`) {
+				t.Errorf("%s: Got body %s, want items of provider %s", test.ip, body, test.source)
+			}
+			if got := response.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("%s: Got Cache-Control %q, want no-store", test.ip, got)
+			}
+		}
+	}
+}
+
+func TestExperimentHeaderTakesPrecedenceOverIP(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(),
+		WithMix("organic", ContentMix{config4}),
+		WithMix("trending", ContentMix{config2}),
+		WithExperiment(Experiment{Name: "ordering", Header: "X-User", Variants: []Variant{
+			{Mix: "organic", Weight: 1},
+			{Mix: "trending", Weight: 1},
+		}}))
+
+	if got := requestFrom(srv, "192.0.2.2", "abc").Header().Get(experimentVariantHeader); got != "trending" {
+		t.Errorf("Got variant %q, want trending", got)
+	}
+	if got := requestFrom(srv, "192.0.2.1", "def").Header().Get(experimentVariantHeader); got != "organic" {
+		t.Errorf("Got variant %q, want organic", got)
+	}
+	if got := requestFrom(srv, "192.0.2.2", "").Header().Get(experimentVariantHeader); got != "organic" {
+		t.Errorf("Got variant %q without header, want organic", got)
+	}
+}
+
+func TestVariantsFollowTheirWeights(t *testing.T) {
+	experiment := Experiment{Name: "weights", Variants: []Variant{{Mix: "a", Weight: 9}, {Mix: "b", Weight: 1}}}
+
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		counts[experiment.variant(strings.Repeat("x", i)).Mix]++
+	}
+	if counts["a"] < 850 || counts["b"] < 50 {
+		t.Errorf("Got %v, want about 900 and 100", counts)
+	}
+}
+
+func TestNamedMixesAreNotPartOfTheExperiment(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(),
+		WithMix("organic", ContentMix{config4}),
+		WithMix("trending", ContentMix{config2}),
+		WithExperiment(Experiment{Name: "ordering", Header: "", Variants: []Variant{
+			{Mix: "organic", Weight: 1},
+			{Mix: "trending", Weight: 1},
+		}}))
+
+	response := runRawRequest(srv, "/mix/organic?count=1")
+	if got := response.Header().Get(experimentVariantHeader); got != "" {
+		t.Errorf("Got variant %q for a named mix", got)
+	}
+}
+
+func TestExperimentIsValidated(t *testing.T) {
+	for name, experiment := range map[string]Experiment{
+		"no variants": {Name: "empty"},
+		"unknown mix": {Name: "unknown", Variants: []Variant{{Mix: "radio", Weight: 1}}},
+		"no weight":   {Name: "weightless", Variants: []Variant{{Mix: "tv", Weight: 0}}},
+	} {
+		if _, err := NewApp(DefaultConfig, sampleClients(), WithMix("tv", DefaultConfig), WithExperiment(experiment)); err == nil {
+			t.Errorf("%s: Got no error", name)
+		}
+	}
+}
@@ -0,0 +1,831 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// CountsPerConfig holds how many items need to be fetched for each distinct
+// config of a stretched content mix.
+type CountsPerConfig map[ContentConfig]int
+
+// FetchedContentsMap holds what was fetched for each config.
+type FetchedContentsMap map[ContentConfig]*FetchedContents
+
+// FetchedContents are the items fetched for one config. If the config's
+// provider and fallback both failed, Items is empty.
+type FetchedContents struct {
+	// Provider is the provider which delivered Items, either the config's
+	// Type or its Fallback.
+	Provider Provider
+	Items    []*ContentItem
+
+	// Failed is set if neither the provider nor its fallback delivered
+	Failed bool
+
+	// RetryAfter is set if the items could not be fetched because every
+	// provider that was tried is throttling. It is the soonest time any of
+	// them asked to be retried after.
+	RetryAfter time.Duration
+
+	// FetchedAt is when the provider delivered Items
+	FetchedAt time.Time
+}
+
+// fetchResult is what every fetching goroutine of fanOut reports back.
+type fetchResult struct {
+	config   ContentConfig
+	contents *FetchedContents
+}
+
+// returnedItem is one item of the response along with where it came from
+type returnedItem struct {
+	Item     *ContentItem
+	Provider Provider
+	Fallback bool
+	// ConfigIndex is the position in the laid out config of the item's slot,
+	// or in the AdsMix if Ad is set
+	ConfigIndex int
+	Ad          bool
+	// FetchedAt is when the item was fetched from its provider
+	FetchedAt time.Time
+	// Extra holds the fields added by the Enrichers
+	Extra map[string]interface{}
+}
+
+// page is the content assembled for one request
+type page struct {
+	items []returnedItem
+
+	// err is set if the page could not be assembled at all
+	err error
+
+	// throttled is set if the content could not be fetched because every
+	// provider is throttling, retryAfter is then the soonest retry hint
+	throttled  bool
+	retryAfter time.Duration
+
+	// stale is set if some of the items are from an expired cached page
+	stale bool
+
+	// emergency is set if the items are from the EmergencyContent
+	emergency bool
+}
+
+// pageRequest describes which content to assemble
+type pageRequest struct {
+	// mix is the name of the mix, empty for the App's Config
+	mix    string
+	config ContentMix
+	count  int
+	offset int
+	userIP string
+
+	// variant is set if the mix was chosen by the Experiment
+	variant bool
+
+	// custom is set if the mix is not one of the configured ones, e.g.
+	// because SelectMix rewrote it or its clients are overridden. Pages of
+	// custom mixes are not cached.
+	custom bool
+
+	// uncached is set for pages which have to be fetched from the providers
+	// every time, such as the polls of live feeds. They bypass the Cache.
+	uncached bool
+
+	// overrides maps providers to the keys of the clients which serve
+	// them for this request, see overrideParam
+	overrides map[Provider]Provider
+
+	// seen holds the items the client has already seen, see seenItemsHeader
+	seen *seenSet
+}
+
+// fetchPage fetches all configs needed for the requested items concurrently
+// and puts their items in order.
+func (a *App) fetchPage(ctx context.Context, request pageRequest) page {
+	config, mix := a.layoutPage(ctx, request)
+	ctx = contextWithConfigOffsets(ctx, configOffsets(config, a.organicRequest(request).offset))
+
+	if a.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.RequestTimeout)
+		defer cancel()
+	}
+	if a.FirstToRespond {
+		return a.fetchFirstToRespond(ctx, request, config, mix)
+	}
+
+	mix, contents := a.fetchStaged(ctx, request, mix)
+	countsPerConfig := getCountsPerConfig(mix)
+
+	retryAfter, throttled := getThrottledRetryAfter(countsPerConfig, contents)
+	if a.StrictMode && hasFailedConfig(mix, contents) {
+		if throttled {
+			return page{throttled: true, retryAfter: retryAfter}
+		}
+		return page{err: ErrIncompleteContent}
+	}
+
+	if a.MaxBackfillPasses > 0 {
+		mix = a.interleaveAds(a.backfill(ctx, a.organicRequest(request), config, contents), request)
+	}
+	if a.MaxItemsPerProvider > 0 {
+		mix = a.applyQuota(ctx, request, mix, contents)
+	}
+	items, err := a.generateListOfItemsToReturn(ctx, mix, contents)
+	for i := range items {
+		items[i].ConfigIndex, items[i].Ad = a.configIndex(config, request.offset+i)
+	}
+	if err == nil && a.LessItem != nil {
+		err = a.sortItems(ctx, items)
+	}
+	return page{
+		items:      items,
+		err:        err,
+		throttled:  throttled,
+		retryAfter: retryAfter,
+	}
+}
+
+// sortItems orders items with LessItem. A panicking LessItem fails the page
+// and the request of ctx, see recoverCallbackPanic.
+func (a *App) sortItems(ctx context.Context, items []returnedItem) (err error) {
+	defer recoverCallbackPanic(ctx, "LessItem", &err)
+	sort.SliceStable(items, func(i, j int) bool { return a.LessItem(items[i].Item, items[j].Item) })
+	return nil
+}
+
+// layoutPage returns the request's config as laid out by the MixStrategy,
+// and the config of every requested item, with the ads interleaved
+func (a *App) layoutPage(ctx context.Context, request pageRequest) (config ContentMix, mix ContentMix) {
+	config = request.config
+	if a.MixStrategy == MixWeighted {
+		config = interleaveContentMix(config)
+	}
+	organic := a.organicRequest(request)
+	mix = a.interleaveAds(stretchContentMixOverCount(config, organic.count, organic.offset), request)
+	return config, a.degradeSlowConfigs(ctx, mix)
+}
+
+// withinLogicalTotal cuts the request short at the LogicalTotal, down to no
+// items at all for requests starting past it
+func (a *App) withinLogicalTotal(request pageRequest) pageRequest {
+	if a.LogicalTotal <= 0 || request.offset+request.count <= a.LogicalTotal {
+		return request
+	}
+	request.count = a.LogicalTotal - request.offset
+	if request.count < 0 {
+		request.count = 0
+	}
+	return request
+}
+
+// endsContent reports whether the request reaches the LogicalTotal, so that
+// there is no next page
+func (a *App) endsContent(request pageRequest) bool {
+	return a.LogicalTotal > 0 && request.offset+request.count >= a.LogicalTotal
+}
+
+// overFetch returns how many items to ask a provider for when count are
+// needed, according to the OverFetchFactor
+func (a *App) overFetch(count int) int {
+	if a.OverFetchFactor <= 1 {
+		return count
+	}
+	return int(math.Ceil(float64(count) * a.OverFetchFactor))
+}
+
+// stretchContentMixOverCount repeats the configured mix so that it covers the
+// positions offset to offset+count.
+func stretchContentMixOverCount(config ContentMix, count int, offset int) ContentMix {
+	if len(config) == 0 {
+		return ContentMix{}
+	}
+	mix := make(ContentMix, count)
+	for i := range mix {
+		mix[i] = config[(offset+i)%len(config)]
+	}
+	return mix
+}
+
+// getCountsPerConfig sums up how many items are needed from every config so
+// that each one only has to be fetched once.
+func getCountsPerConfig(mix ContentMix) CountsPerConfig {
+	counts := CountsPerConfig{}
+	for _, config := range mix {
+		counts[config]++
+	}
+	return counts
+}
+
+// fanOut calls fetch for every config of counts concurrently and collects
+// what they return. Every goroutine sends exactly one result, and the number
+// of results waited for is the number of goroutines started, so a config can
+// neither be waited for in vain nor be left out. Results still missing once
+// ctx is done, e.g. of providers which ignore ctx, are left out; the channels
+// have room for all of them, so their goroutines do not block forever either.
+// The goroutines are started in the order the configs first appear in mix.
+// With OrderedFanOut, the results are also collected in that order rather
+// than as they arrive.
+func (a *App) fanOut(ctx context.Context, mix ContentMix, counts CountsPerConfig, fetch func(config ContentConfig, count int) *FetchedContents) FetchedContentsMap {
+	configs := distinctConfigs(mix, counts)
+	if a.OrderedFanOut {
+		slots := a.startFetches(configs, counts, fetch)
+		contents := FetchedContentsMap{}
+		for _, result := range collectInOrder(ctx, slots) {
+			contents[result.config] = result.contents
+		}
+		return contents
+	}
+
+	results := make(chan fetchResult, len(configs))
+	for _, config := range configs {
+		atomic.AddInt64(&a.inFlightFetches, 1)
+		go func(config ContentConfig, count int) {
+			defer atomic.AddInt64(&a.inFlightFetches, -1)
+			results <- fetchResult{config: config, contents: fetch(config, count)}
+		}(config, counts[config])
+	}
+	return getMapOfFetchedContents(ctx, results, len(configs))
+}
+
+// startFetches fetches every config in a goroutine of its own, whose result
+// is sent to the config's slot
+func (a *App) startFetches(configs []ContentConfig, counts CountsPerConfig, fetch func(config ContentConfig, count int) *FetchedContents) []chan fetchResult {
+	slots := make([]chan fetchResult, len(configs))
+	for i, config := range configs {
+		slots[i] = make(chan fetchResult, 1)
+		atomic.AddInt64(&a.inFlightFetches, 1)
+		go func(config ContentConfig, count int, slot chan<- fetchResult) {
+			defer atomic.AddInt64(&a.inFlightFetches, -1)
+			slot <- fetchResult{config: config, contents: fetch(config, count)}
+		}(config, counts[config], slots[i])
+	}
+	return slots
+}
+
+// distinctConfigs lists the configs of counts in the order they first appear
+// in mix
+func distinctConfigs(mix ContentMix, counts CountsPerConfig) []ContentConfig {
+	configs := make([]ContentConfig, 0, len(counts))
+	seen := map[ContentConfig]bool{}
+	for _, config := range mix {
+		if _, ok := counts[config]; ok && !seen[config] {
+			seen[config] = true
+			configs = append(configs, config)
+		}
+	}
+	return configs
+}
+
+// collectInOrder waits for the result of every slot in turn, logging each
+// one, so that the collection is the same however the goroutines are
+// scheduled. If ctx is done first, the results collected so far are returned.
+func collectInOrder(ctx context.Context, slots []chan fetchResult) []fetchResult {
+	results := make([]fetchResult, 0, len(slots))
+	for i, slot := range slots {
+		select {
+		case result := <-slot:
+			logf(ctx, "config %d: got %d items from provider %s", i, len(result.contents.Items), result.contents.Provider)
+			results = append(results, result)
+		case <-ctx.Done():
+			logf(ctx, "stopped waiting for %d of %d configs: %v", len(slots)-i, len(slots), ctx.Err())
+			return results
+		}
+	}
+	return results
+}
+
+// fetchItemsForConfig gets count items for a config, trying its providers
+// in the order of providerChain until one of them delivers, or all at once
+// with RaceTiers. If all of them fail, the returned contents hold no items.
+// Once ctx is done, no further provider is called.
+func (a *App) fetchItemsForConfig(ctx context.Context, config ContentConfig, count int, userIP string) *FetchedContents {
+	ctx, span := a.tracer().Start(ctx, fetchSpanName)
+	defer span.End()
+	span.SetAttribute(attributeConfig, string(config.Type))
+	a.waitForJitter(ctx)
+
+	chain := a.providerChain(config)
+	var attempts []providerAttempt
+	offset := configOffset(ctx, config)
+	if a.RaceTiers {
+		attempts = a.raceProviders(ctx, chain, userIP, offset, count)
+	} else {
+		attempts = a.tryInOrder(ctx, chain, userIP, offset, count)
+	}
+	var last providerAttempt
+	if len(attempts) > 0 {
+		last = attempts[len(attempts)-1]
+	}
+	provider, items, err := last.provider, last.items, last.err
+	retryAfter, throttled := attemptsRetryAfter(attempts)
+
+	contents := &FetchedContents{Provider: provider, Items: items, FetchedAt: time.Now()}
+	if err != nil {
+		logf(ctx, "could not fetch content for provider %s: %v", config.Type, err)
+		contents.Items = nil
+		contents.Failed = true
+		if throttled {
+			contents.RetryAfter = retryAfter
+		}
+		a.Metrics.observeOutcome(config.Type, outcomeFailure)
+	} else if config.isPrimary(provider) {
+		a.Metrics.observeOutcome(config.Type, outcomeSuccess)
+	} else {
+		a.Metrics.observeOutcome(config.Type, outcomeFallback)
+	}
+	span.SetAttribute(attributeProvider, string(provider))
+	span.SetAttribute(attributeFallback, !config.isPrimary(provider))
+	span.SetAttribute(attributeItems, len(contents.Items))
+	span.SetAttribute(attributeFailed, contents.Failed)
+	return contents
+}
+
+// providerAttempt is the outcome of trying one provider of a config
+type providerAttempt struct {
+	provider Provider
+	items    []*ContentItem
+	err      error
+}
+
+// tryInOrder tries the providers of chain one after the other until one of
+// them delivers, and returns every attempt, the last one being the result
+func (a *App) tryInOrder(ctx context.Context, chain []Provider, userIP string, offset, count int) []providerAttempt {
+	attempts := make([]providerAttempt, 0, len(chain))
+	for i, provider := range chain {
+		if i > 0 {
+			if ctx.Err() != nil {
+				break
+			}
+			last := attempts[i-1]
+			logf(ctx, "provider %s failed (%s), trying fallback %s: %v", last.provider, classifyError(last.err), provider, last.err)
+		}
+		items, err := a.tryProvider(ctx, provider, userIP, offset, count)
+		attempts = append(attempts, providerAttempt{provider: provider, items: items, err: err})
+		if err == nil {
+			break
+		}
+	}
+	return attempts
+}
+
+// tryProvider fetches count items from a provider which is neither disabled
+// nor known to be down, and validates its response. Paging providers are asked for the
+// items from offset on, others for their first items.
+func (a *App) tryProvider(ctx context.Context, provider Provider, userIP string, offset, count int) ([]*ContentItem, error) {
+	if err := a.checkEnabled(provider); err != nil {
+		return nil, err
+	}
+	if err := a.checkHealth(ctx, provider); err != nil {
+		return nil, err
+	}
+	var items []*ContentItem
+	var err error
+	client, _ := a.client(overrideFor(ctx, provider))
+	if paging, ok := client.(PagingClient); ok {
+		items, err = a.getPaged(ctx, provider, paging, userIP, offset, count)
+	} else {
+		items, err = a.getBatches(ctx, provider, userIP, count)
+	}
+	if err == nil {
+		items = a.trimSurplus(ctx, provider, items, count)
+		err = a.validateResponse(ctx, provider, items)
+	}
+	return items, err
+}
+
+// trimSurplus drops the items a provider returned beyond the count it was
+// asked for, copying the others into a slice of their own, so that the
+// surplus is not kept alive by the page's backing array. The surplus is kept
+// while items may be skipped, see keepsSurplus.
+func (a *App) trimSurplus(ctx context.Context, provider Provider, items []*ContentItem, count int) []*ContentItem {
+	if len(items) <= count || a.keepsSurplus() {
+		return items
+	}
+	logf(ctx, "provider %s returned %d items, dropping the %d beyond the %d requested", provider, len(items), len(items)-count, count)
+	return append([]*ContentItem(nil), items[:count]...)
+}
+
+// keepsSurplus reports whether items may be skipped while the page is
+// assembled, as duplicates, invalid items or items the client has seen, in
+// which case the surplus of a provider's response stands in for them
+func (a *App) keepsSurplus() bool {
+	return a.DeduplicateBy != "" || a.ValidateItem != nil || a.MaxSeenItems > 0 || a.MaxSeenFilterBytes > 0
+}
+
+// attemptsRetryAfter reports whether every failed attempt failed because
+// its provider is throttling, and if so, the soonest retry hint
+func attemptsRetryAfter(attempts []providerAttempt) (time.Duration, bool) {
+	var retryAfter time.Duration
+	throttled := true
+	for i, attempt := range attempts {
+		if attempt.err == nil {
+			continue
+		}
+		wait, isThrottled := getRetryAfter(attempt.err)
+		throttled = throttled && isThrottled
+		if i == 0 || wait < retryAfter {
+			retryAfter = wait
+		}
+	}
+	return retryAfter, throttled
+}
+
+// waitForJitter sleeps for a random duration below MaxJitter, so that the
+// fetches of a request do not all hit the providers at the same instant. It
+// returns early if ctx is done.
+func (a *App) waitForJitter(ctx context.Context) {
+	if a.MaxJitter <= 0 {
+		return
+	}
+	timer := time.NewTimer(time.Duration(a.randInt63n(int64(a.MaxJitter))))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// tiersFor returns the config's providers grouped in tiers. A config without
+// tiers has its Type as the only primary and its fallback as the second tier.
+func (a *App) tiersFor(config ContentConfig) ProviderTiers {
+	if config.Tiers != nil {
+		return *config.Tiers
+	}
+	tiers := ProviderTiers{{config.Type}}
+	if fallback := a.fallbackFor(config); fallback != nil {
+		tiers = append(tiers, []Provider{*fallback})
+	}
+	return tiers
+}
+
+// providerChain returns the providers to try for a config, in order: tier by
+// tier, each tier starting at the provider picked by TierSelection, or
+// shuffled with TierShuffle. With
+// AdaptiveFallbacks, the fallback tiers are ordered by reliability instead.
+func (a *App) providerChain(config ContentConfig) []Provider {
+	var chain []Provider
+	for i, tier := range a.tiersFor(config) {
+		if len(tier) == 0 {
+			continue
+		}
+		if i > 0 && a.AdaptiveFallbacks && a.Metrics != nil {
+			chain = append(chain, a.byReliability(tier)...)
+			continue
+		}
+		if a.TierSelection == TierShuffle {
+			for _, j := range a.permutation(len(tier)) {
+				chain = append(chain, tier[j])
+			}
+			continue
+		}
+		start := a.tierStart(len(tier))
+		for i := range tier {
+			chain = append(chain, tier[(start+i)%len(tier)])
+		}
+	}
+	return chain
+}
+
+// tierStart picks the index of the provider a tier of the given size is
+// tried from
+func (a *App) tierStart(size int) int {
+	if a.TierSelection == TierRandom {
+		return int(a.randInt63n(int64(size)))
+	}
+	return int(atomic.AddUint64(&a.tierCounter, 1) % uint64(size))
+}
+
+// byReliability orders providers by the share of their calls which
+// succeeded so far, most reliable first. Providers which were not called yet
+// count as reliable, so that they get a chance. Ties are broken randomly.
+func (a *App) byReliability(tier []Provider) []Provider {
+	ordered := make([]Provider, len(tier))
+	for i, j := range a.permutation(len(tier)) {
+		ordered[i] = tier[j]
+	}
+	rates := make(map[Provider]float64, len(tier))
+	for _, provider := range tier {
+		rates[provider] = a.Metrics.successRate(provider)
+	}
+	sort.SliceStable(ordered, func(i, j int) bool { return rates[ordered[i]] > rates[ordered[j]] })
+	return ordered
+}
+
+// permutation returns a random permutation of [0, n) from the RandSource
+func (a *App) permutation(n int) []int {
+	perm := make([]int, n)
+	for i := range perm {
+		j := int(a.randInt63n(int64(i + 1)))
+		perm[i] = perm[j]
+		perm[j] = i
+	}
+	return perm
+}
+
+// randInt63n returns a random number in [0, n) from the RandSource
+func (a *App) randInt63n(n int64) int64 {
+	if a.RandSource == nil {
+		return rand.Int63n(n)
+	}
+	a.randMu.Lock()
+	defer a.randMu.Unlock()
+	if a.rand == nil {
+		a.rand = rand.New(a.RandSource)
+	}
+	return a.rand.Int63n(n)
+}
+
+// fallbackFor returns the config's fallback, or the App's DefaultFallback if
+// the config does not have one
+func (a *App) fallbackFor(config ContentConfig) *Provider {
+	if config.Fallback != nil {
+		return config.Fallback
+	}
+	return a.DefaultFallback
+}
+
+// getBatches fetches count items from a provider in batches within its
+// BatchSize and aligned to its Multiple, one after the other, and trims the
+// items beyond count. It stops early if the provider runs out of items, and
+// fails if any batch fails.
+func (a *App) getBatches(ctx context.Context, provider Provider, userIP string, count int) ([]*ContentItem, error) {
+	size, ok := a.BatchSizes[provider]
+	if !ok {
+		return a.getContentWithRetry(ctx, provider, userIP, count)
+	}
+
+	var items []*ContentItem
+	for len(items) < count {
+		batch := count - len(items)
+		if size.Max > 0 && batch > size.Max {
+			batch = size.Max
+		}
+		if batch < size.Min {
+			batch = size.Min
+		}
+		if size.Multiple > 0 && batch%size.Multiple != 0 {
+			batch += size.Multiple - batch%size.Multiple
+		}
+		fetched, err := a.getContentWithRetry(ctx, provider, userIP, batch)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, fetched...)
+		if len(fetched) < batch {
+			break
+		}
+	}
+	if len(items) > count {
+		items = append([]*ContentItem(nil), items[:count]...)
+	}
+	return items, nil
+}
+
+// getContentWithRetry fetches from a provider. If the provider is throttling
+// and its backoff hint is no longer than MaxRetryWait and the remaining
+// request budget, it waits for that long and tries once more. A provider
+// which timed out is tried once more straight away if the request has time
+// left. Other errors are returned as they are, so that the fallback is tried.
+func (a *App) getContentWithRetry(ctx context.Context, provider Provider, userIP string, count int) ([]*ContentItem, error) {
+	items, err := a.getContent(ctx, provider, userIP, count)
+	if err == nil || ctx.Err() != nil {
+		return items, err
+	}
+	if classifyError(err) == classTimeout {
+		logf(ctx, "provider %s timed out, retrying", provider)
+		return a.getContent(ctx, provider, userIP, count)
+	}
+
+	wait, throttled := getRetryAfter(err)
+	if !throttled || wait > a.MaxRetryWait {
+		return items, err
+	}
+	if remaining, ok := remainingBudget(ctx); ok && remaining <= wait {
+		return items, err
+	}
+
+	logf(ctx, "provider %s is throttling, retrying after %v", provider, wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return a.getContent(ctx, provider, userIP, count)
+	case <-ctx.Done():
+		return items, err
+	}
+}
+
+// getContent calls the provider's client once, or with CoalesceFetches
+// shares the result of an identical call which is running already. The
+// client may be overridden for the request, see overrideParam.
+func (a *App) getContent(ctx context.Context, provider Provider, userIP string, count int) ([]*ContentItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	target := overrideFor(ctx, provider)
+	client, ok := a.client(target)
+	if !ok {
+		return nil, fmt.Errorf("no client registered for provider %s", target)
+	}
+	if !a.CoalesceFetches {
+		return a.callProvider(ctx, provider, client, userIP, count)
+	}
+	key := flightKey{provider: target, network: userIPBucket(userIP), count: count}
+	return a.flights.do(ctx, key, func() ([]*ContentItem, error) {
+		return a.callProvider(ctx, provider, client, userIP, count)
+	})
+}
+
+// callProvider calls the provider's client. If the call exceeds the
+// provider's own timeout, it fails with a ProviderTimeoutError. If the
+// request's remaining budget is shorter, the call only gets that remainder,
+// and running out of it is not the provider's fault. Failures are counted by
+// their class, unless the call was cancelled because another provider won
+// the race for its config.
+func (a *App) callProvider(ctx context.Context, provider Provider, client Client, userIP string, count int) (items []*ContentItem, err error) {
+	defer recoverProviderPanic(ctx, provider, &err)
+	callCtx := ctx
+	timeout := a.providerTimeout(provider)
+	if remaining, ok := remainingBudget(ctx); ok && timeout > 0 && remaining < timeout {
+		logf(ctx, "provider %s gets the remaining request budget of %v rather than its timeout of %v", provider, remaining, timeout)
+		timeout = 0
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	elapsed := a.Metrics.startTimer()
+	items, err = client.GetContent(callCtx, userIP, count)
+	a.Metrics.observeProvider(provider, elapsed())
+	if err == nil {
+		return items, nil
+	}
+
+	if callCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil && !errors.Is(err, ErrProviderTimeout) {
+		err = &ProviderTimeoutError{Provider: provider, Err: err}
+	}
+	if ctx.Err() == nil || !lostRace(ctx) {
+		a.Metrics.observeProviderError(provider, classifyError(err))
+	}
+	return items, err
+}
+
+// remainingBudget returns how long the request has left until the deadline
+// of ctx, the sooner of its RequestTimeout and the deadline of the request's
+// own context, and whether it has a deadline at all
+func remainingBudget(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(deadline), true
+}
+
+// providerTimeout returns how long a single call to provider may take
+func (a *App) providerTimeout(provider Provider) time.Duration {
+	if timeout, ok := a.ProviderTimeouts[provider]; ok {
+		return timeout
+	}
+	return a.DefaultProviderTimeout
+}
+
+// getMapOfFetchedContents collects the expected number of results sent by the
+// fetching goroutines. If ctx is done first, the configs that have not
+// reported back yet are left out.
+func getMapOfFetchedContents(ctx context.Context, results <-chan fetchResult, expected int) FetchedContentsMap {
+	contents := FetchedContentsMap{}
+	for i := 0; i < expected; i++ {
+		select {
+		case result := <-results:
+			contents[result.config] = result.contents
+		case <-ctx.Done():
+			logf(ctx, "stopped waiting for %d of %d configs: %v", expected-i, expected, ctx.Err())
+			return contents
+		}
+	}
+	return contents
+}
+
+// generateListOfItemsToReturn takes the fetched items in the order of the mix.
+// As soon as a config has no items left, the list is cut off at that point.
+// Items failing validation are dropped, or fail the whole list if the
+// InvalidItemPolicy says so. If DeduplicateBy is set, items whose field value
+// was already returned are skipped in favour of the config's next item, unless
+// their provider outranks the one of the returned item in the
+// DeduplicationPriority, which then takes over the returned item's place.
+// Lists which are cut off are counted in the Metrics.
+func (a *App) generateListOfItemsToReturn(ctx context.Context, mix ContentMix, contents FetchedContentsMap) ([]returnedItem, error) {
+	var returnList []returnedItem
+	seen := map[string]bool{}
+	positions := map[string]int{}
+	for _, config := range mix {
+		var onDuplicate func(key string, item *ContentItem) bool
+		if len(a.DeduplicationPriority) > 0 {
+			fetched := contents[config]
+			onDuplicate = func(key string, item *ContentItem) bool {
+				return a.preferDuplicate(returnList, positions[key], returnedItem{
+					Item:      item,
+					Provider:  fetched.Provider,
+					Fallback:  !config.isPrimary(fetched.Provider),
+					FetchedAt: fetched.FetchedAt,
+				})
+			}
+		}
+		item, err := a.takeNextItem(ctx, contents[config], seen, onDuplicate)
+		if err != nil {
+			return nil, err
+		}
+		if item == nil && a.DefaultItem != nil {
+			returnList = append(returnList, a.placeholder())
+			continue
+		}
+		if item == nil {
+			a.Metrics.observeTruncated(len(mix) - len(returnList))
+			break
+		}
+		provider := contents[config].Provider
+		returnList = append(returnList, returnedItem{
+			Item:      item,
+			Provider:  provider,
+			Fallback:  !config.isPrimary(provider),
+			FetchedAt: contents[config].FetchedAt,
+		})
+		if a.DeduplicateBy != "" {
+			positions[a.dedupKey(item)] = len(returnList) - 1
+		}
+	}
+	return returnList, nil
+}
+
+// placeholder returns a copy of the DefaultItem, marked as placeholder
+func (a *App) placeholder() returnedItem {
+	item := *a.DefaultItem
+	item.Placeholder = true
+	return returnedItem{Item: &item, Fallback: true}
+}
+
+// takeNextItem removes and returns the next valid item which has not been
+// seen yet, or nil if there are no items left. Items which the client has
+// already seen are skipped. Items which were seen within the page are
+// passed to onDuplicate, if it is set, which reports whether it used them.
+// Items are removed by reslicing, never by shifting them within the backing
+// array, as clients may return slices which they or other configs share.
+func (a *App) takeNextItem(ctx context.Context, contents *FetchedContents, seen map[string]bool, onDuplicate func(key string, item *ContentItem) bool) (*ContentItem, error) {
+	if contents == nil {
+		return nil, nil
+	}
+	for len(contents.Items) > 0 {
+		item := contents.Items[0]
+		contents.Items = contents.Items[1:]
+
+		if err := a.validateItem(ctx, contents.Provider, item); err != nil {
+			if a.InvalidItemPolicy == FailRequest {
+				return nil, err
+			}
+			logf(ctx, "dropping item: %v", err)
+			continue
+		}
+		if seenByClient(ctx, item) {
+			continue
+		}
+
+		if a.DeduplicateBy == "" {
+			return item, nil
+		}
+		key := a.dedupKey(item)
+		if !seen[key] {
+			seen[key] = true
+			return item, nil
+		}
+		if onDuplicate != nil && onDuplicate(key, item) {
+			logf(ctx, "preferring item %s of provider %s", key, contents.Provider)
+		}
+	}
+	return nil, nil
+}
+
+// getThrottledRetryAfter reports whether every config of the mix failed
+// because its providers are throttling, and if so, the soonest retry hint.
+func getThrottledRetryAfter(countsPerConfig CountsPerConfig, contents FetchedContentsMap) (time.Duration, bool) {
+	var soonest time.Duration
+	for config := range countsPerConfig {
+		fetched, ok := contents[config]
+		if !ok || fetched.RetryAfter == 0 {
+			return 0, false
+		}
+		if soonest == 0 || fetched.RetryAfter < soonest {
+			soonest = fetched.RetryAfter
+		}
+	}
+	return soonest, len(countsPerConfig) > 0
+}
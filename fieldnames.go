@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldCase describes how the field names of serialised items are written
+type FieldCase int
+
+const (
+	// SnakeCase keeps the JSON names of ContentItem, e.g. "expiry" or
+	// "cache_ttl"
+	SnakeCase FieldCase = iota
+	// CamelCase writes field names like "expiry" or "cacheTtl"
+	CamelCase
+	// PascalCase writes field names like "Expiry" or "CacheTtl"
+	PascalCase
+)
+
+// toCase converts a snake_case name to the field case
+func (c FieldCase) toCase(name string) string {
+	if c == SnakeCase {
+		return name
+	}
+	words := strings.Split(name, "_")
+	for i, word := range words {
+		if word != "" && (i > 0 || c == PascalCase) {
+			words[i] = strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return strings.Join(words, "")
+}
+
+// fieldRenamer returns how to rename the fields of serialised items, after
+// FieldNames and then FieldCase, or nil if they keep their JSON names
+func (a *App) fieldRenamer() func(string) string {
+	if len(a.FieldNames) == 0 && a.FieldCase == SnakeCase {
+		return nil
+	}
+	return func(name string) string {
+		if renamed, ok := a.FieldNames[name]; ok {
+			return renamed
+		}
+		return a.FieldCase.toCase(name)
+	}
+}
+
+// renameFields returns the projection with its fields renamed
+func renameFields(projection map[string]interface{}, rename func(string) string) map[string]interface{} {
+	renamed := make(map[string]interface{}, len(projection))
+	for field, value := range projection {
+		renamed[rename(field)] = value
+	}
+	return renamed
+}
+
+// annotationFields are added to items by the server rather than providers
+var annotationFields = []string{"provider", "fallback", "fetched_at"}
+
+func isAnnotationField(field string) bool {
+	for _, annotation := range annotationFields {
+		if field == annotation {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFieldNames checks that FieldNames only renames fields items have
+// and does not give two of them the same name
+func (a *App) validateFieldNames() error {
+	renamer := a.fieldRenamer()
+	if renamer == nil {
+		return nil
+	}
+	for field := range a.FieldNames {
+		if _, known := contentItemFieldNames[field]; !known && !isAnnotationField(field) {
+			return fmt.Errorf("cannot rename unknown field %q", field)
+		}
+	}
+	names := map[string]string{}
+	for _, field := range append(contentItemFields, annotationFields...) {
+		name := renamer(field)
+		if other, taken := names[name]; taken {
+			return fmt.Errorf("fields %q and %q would both be named %q", other, field, name)
+		}
+		names[name] = field
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// fetchFirstToRespond assembles a page from the configs which respond first.
+// Every config is asked for the whole page, so that any of them can fill it,
+// and as soon as the configs which responded delivered enough items between
+// them, the remaining fetches are cancelled. The items are then put in the
+// order of LessItem, as the order of the mix cannot be kept without waiting
+// for every config. Items are labelled with the first position of their
+// config in the mix.
+func (a *App) fetchFirstToRespond(ctx context.Context, request pageRequest, config ContentMix, mix ContentMix) page {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	configs := distinctConfigs(mix, getCountsPerConfig(mix))
+	positions := make(map[ContentConfig]int, len(configs))
+	for i := len(mix) - 1; i >= 0; i-- {
+		positions[mix[i]] = i
+	}
+	results := make(chan fetchResult, len(configs))
+	for _, config := range configs {
+		atomic.AddInt64(&a.inFlightFetches, 1)
+		go func(config ContentConfig) {
+			defer atomic.AddInt64(&a.inFlightFetches, -1)
+			results <- fetchResult{config: config, contents: a.fetchItemsForConfig(ctx, config, a.overFetch(len(mix)), request.userIP)}
+		}(config)
+	}
+
+	var items []returnedItem
+	seen := map[string]bool{}
+	contents := FetchedContentsMap{}
+collect:
+	for i := 0; i < len(configs) && len(items) < len(mix); i++ {
+		var result fetchResult
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			logf(ctx, "stopped waiting for %d of %d configs: %v", len(configs)-i, len(configs), ctx.Err())
+			break collect
+		}
+		contents[result.config] = result.contents
+		for {
+			item, err := a.takeNextItem(ctx, result.contents, seen, nil)
+			if err != nil {
+				return page{err: err}
+			}
+			if item == nil {
+				break
+			}
+			provider := result.contents.Provider
+			configIndex, ad := a.configIndex(config, request.offset+positions[result.config])
+			items = append(items, returnedItem{
+				Item:        item,
+				Provider:    provider,
+				Fallback:    !result.config.isPrimary(provider),
+				ConfigIndex: configIndex,
+				Ad:          ad,
+				FetchedAt:   result.contents.FetchedAt,
+			})
+		}
+	}
+
+	if len(items) == 0 {
+		retryAfter, throttled := getThrottledRetryAfter(getCountsPerConfig(configs), contents)
+		if throttled {
+			return page{throttled: true, retryAfter: retryAfter}
+		}
+	}
+	if err := a.sortItems(ctx, items); err != nil {
+		return page{err: err}
+	}
+	if len(items) > len(mix) {
+		items = items[:len(mix)]
+	}
+	if a.DefaultItem == nil && len(items) < len(mix) {
+		a.Metrics.observeTruncated(len(mix) - len(items))
+	}
+	for a.DefaultItem != nil && len(items) < len(mix) {
+		items = append(items, a.placeholder())
+	}
+	return page{items: items}
+}
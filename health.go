@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// HealthChecker can be implemented by a Client whose provider can tell
+// whether it is up without fetching content, e.g. through a status endpoint.
+// CheckHealth returns nil if the provider is up.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// HealthCache keeps the result of every provider's health probe for TTL, so
+// that providers are probed at most once per TTL however many requests use
+// them. It is safe for concurrent use and has to be created with
+// NewHealthCache.
+type HealthCache struct {
+	TTL time.Duration
+
+	// now returns the current time, it can be replaced in tests
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[Provider]healthEntry
+}
+
+type healthEntry struct {
+	err     error
+	expires time.Time
+}
+
+// NewHealthCache creates a cache which keeps probe results for ttl
+func NewHealthCache(ttl time.Duration) *HealthCache {
+	return &HealthCache{
+		TTL:     ttl,
+		now:     time.Now,
+		entries: map[Provider]healthEntry{},
+	}
+}
+
+// check returns the last result of probing the provider, probing it again
+// if that result has expired. Probes which were cut short by ctx are not
+// kept, as they say nothing about the provider.
+func (c *HealthCache) check(ctx context.Context, provider Provider, checker HealthChecker) error {
+	c.mu.Lock()
+	entry, ok := c.entries[provider]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.err
+	}
+
+	err := checker.CheckHealth(ctx)
+	if err != nil && ctx.Err() != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[provider] = healthEntry{err: err, expires: c.now().Add(c.TTL)}
+	return err
+}
+
+// checkHealth reports whether the provider is known to be down, according
+// to the HealthCache. Providers whose client cannot be probed count as up.
+func (a *App) checkHealth(ctx context.Context, provider Provider) error {
+	if a.Health == nil {
+		return nil
+	}
+	client, _ := a.client(overrideFor(ctx, provider))
+	checker, ok := client.(HealthChecker)
+	if !ok {
+		return nil
+	}
+	if err := a.Health.check(ctx, provider, checker); err != nil {
+		return &ProviderUnavailableError{Provider: provider, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ProbedContentProvider is a HealthChecker which counts its probes and
+// reports Down as its health
+type ProbedContentProvider struct {
+	CountingContentProvider
+	Down   error
+	probes int32
+}
+
+func (cp *ProbedContentProvider) CheckHealth(ctx context.Context) error {
+	atomic.AddInt32(&cp.probes, 1)
+	return cp.Down
+}
+
+func (cp *ProbedContentProvider) Probes() int {
+	return int(atomic.LoadInt32(&cp.probes))
+}
+
+func TestHealthIsProbedOncePerTTL(t *testing.T) {
+	provider := &ProbedContentProvider{CountingContentProvider: CountingContentProvider{Client: SampleContentProvider{Source: Provider1}}}
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: provider}, WithHealthChecks(time.Minute))
+	clock := time.Now()
+	srv.Health.now = func() time.Time { return clock }
+
+	for i := 0; i < 3; i++ {
+		runRequest(t, srv, SimpleContentRequest)
+	}
+	if probes := provider.Probes(); probes != 1 {
+		t.Errorf("Provider was probed %d times within the TTL, want once", probes)
+	}
+	if calls := provider.Calls(); calls != 3 {
+		t.Errorf("Provider was called %d times, want 3", calls)
+	}
+
+	clock = clock.Add(time.Minute)
+	runRequest(t, srv, SimpleContentRequest)
+	if probes := provider.Probes(); probes != 2 {
+		t.Errorf("Provider was probed %d times after the TTL, want twice", probes)
+	}
+}
+
+func TestProviderProbedDownGoesToFallback(t *testing.T) {
+	down := &ProbedContentProvider{
+		CountingContentProvider: CountingContentProvider{Client: SampleContentProvider{Source: Provider1}},
+		Down:                    errors.New("maintenance"),
+	}
+	clients := sampleClients()
+	clients[Provider1] = down
+	srv, _ := NewApp(ContentMix{config1}, clients, WithHealthChecks(time.Minute))
+
+	for i := 0; i < 2; i++ {
+		content := runRequest(t, srv, SimpleContentRequest)
+		for j, item := range content {
+			if Provider(item.Source) != Provider2 {
+				t.Errorf("Position %d: Got provider %s, want fallback 2", j, item.Source)
+			}
+		}
+	}
+	if calls := down.Calls(); calls != 0 {
+		t.Errorf("Provider which is down was called %d times", calls)
+	}
+	if probes := down.Probes(); probes != 1 {
+		t.Errorf("Provider was probed %d times, want once", probes)
+	}
+}
+
+func TestProvidersAreNotProbedByDefault(t *testing.T) {
+	provider := &ProbedContentProvider{CountingContentProvider: CountingContentProvider{Client: SampleContentProvider{Source: Provider1}}}
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: provider})
+
+	runRequest(t, srv, SimpleContentRequest)
+
+	if probes := provider.Probes(); probes != 0 {
+		t.Errorf("Provider was probed %d times, want never", probes)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyKeyHeader lets clients retry a request without it being
+// processed twice
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// DefaultMaxIdempotencyKeys is how many keys an IdempotencyCache keeps at
+// most
+const DefaultMaxIdempotencyKeys = 10000
+
+// IdempotencyCache keeps the responses to requests carrying an
+// Idempotency-Key for a while, so that a retried request gets the original
+// response instead of fetching again. Reusing a key for a different request
+// is a conflict. It is safe for concurrent use and has to be created with
+// NewIdempotencyCache.
+type IdempotencyCache struct {
+	TTL time.Duration
+
+	// MaxEntries is the number of keys kept at most, as every client can
+	// make up new ones. Once it is reached, the expired responses are
+	// dropped, and if that is not enough the response which expires first.
+	// Requests which find only keys in progress are served without being
+	// kept. 0 means no limit.
+	MaxEntries int
+
+	// now returns the current time, it can be replaced in tests
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	fingerprint [sha256.Size]byte
+	// response is nil while the original request is still being served
+	response *recordedResponse
+	expires  time.Time
+}
+
+// NewIdempotencyCache creates a cache which keeps responses for ttl
+func NewIdempotencyCache(ttl time.Duration) *IdempotencyCache {
+	return &IdempotencyCache{
+		TTL:        ttl,
+		MaxEntries: DefaultMaxIdempotencyKeys,
+		now:        time.Now,
+		entries:    map[string]*idempotencyEntry{},
+	}
+}
+
+// requestFingerprint identifies what a request asks for, so that reuses of
+// an idempotency key for something else can be told apart from retries
+func requestFingerprint(req *http.Request, body []byte) [sha256.Size]byte {
+	return sha256.Sum256([]byte(req.URL.Path + "?" + req.URL.RawQuery + "\n" + string(body)))
+}
+
+// serve replays the response recorded for key, or records what serve
+// responds with. Server errors are not kept, so that a retry can succeed.
+func (c *IdempotencyCache) serve(ctx context.Context, w http.ResponseWriter, key string, fingerprint [sha256.Size]byte, serve func(http.ResponseWriter)) {
+	response, status := c.begin(key, fingerprint)
+	switch status {
+	case idempotencyConflict:
+		sendError(w, http.StatusConflict, "idempotency key was already used for a different request")
+		return
+	case idempotencyInProgress:
+		sendError(w, http.StatusConflict, "a request with this idempotency key is still in progress")
+		return
+	case idempotencyReplay:
+		logf(ctx, "replaying response for idempotency key %q", key)
+		response.replay(w)
+		return
+	case idempotencyUntracked:
+		logf(ctx, "idempotency cache is full, not keeping the response for key %q", key)
+		serve(w)
+		return
+	}
+
+	recorder := newRecordedResponse()
+	defer func() {
+		// a recorder left empty by an aborted handler must not be replayed
+		if recovered := recover(); recovered != nil {
+			c.forget(key)
+			panic(recovered)
+		}
+	}()
+	serve(recorder)
+	c.finish(key, recorder)
+	recorder.replay(w)
+}
+
+type idempotencyStatus int
+
+const (
+	idempotencyNew idempotencyStatus = iota
+	idempotencyReplay
+	idempotencyInProgress
+	idempotencyConflict
+	// idempotencyUntracked is a new key for which there was no room
+	idempotencyUntracked
+)
+
+// begin looks up key, reserving it for the request if it is new
+func (c *IdempotencyCache) begin(key string, fingerprint [sha256.Size]byte) (*recordedResponse, idempotencyStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if ok && entry.response != nil && !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	switch {
+	case !ok && c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries && !c.makeRoom():
+		return nil, idempotencyUntracked
+	case !ok:
+		c.entries[key] = &idempotencyEntry{fingerprint: fingerprint}
+		return nil, idempotencyNew
+	case entry.fingerprint != fingerprint:
+		return nil, idempotencyConflict
+	case entry.response == nil:
+		return nil, idempotencyInProgress
+	default:
+		return entry.response, idempotencyReplay
+	}
+}
+
+// makeRoom drops the expired responses, or if there are none the response
+// which expires first. It reports whether it dropped any.
+func (c *IdempotencyCache) makeRoom() bool {
+	now := c.now()
+	first := ""
+	var firstExpires time.Time
+	swept := false
+	for key, entry := range c.entries {
+		switch {
+		case entry.response == nil:
+		case !now.Before(entry.expires):
+			delete(c.entries, key)
+			swept = true
+		case first == "" || entry.expires.Before(firstExpires):
+			first, firstExpires = key, entry.expires
+		}
+	}
+	if swept || first == "" {
+		return swept
+	}
+	delete(c.entries, first)
+	return true
+}
+
+// finish keeps the response for key, unless it is a server error
+func (c *IdempotencyCache) finish(key string, response *recordedResponse) {
+	if response.status >= http.StatusInternalServerError {
+		c.forget(key)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[key]
+	entry.response = response
+	entry.expires = c.now().Add(c.TTL)
+}
+
+func (c *IdempotencyCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// recordedResponse is an http.ResponseWriter which keeps the response so
+// that it can be sent later, possibly more than once
+type recordedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newRecordedResponse() *recordedResponse {
+	return &recordedResponse{header: http.Header{}}
+}
+
+func (r *recordedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *recordedResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *recordedResponse) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(p)
+}
+
+// replay sends the recorded response to w
+func (r *recordedResponse) replay(w http.ResponseWriter) {
+	for name, values := range r.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	status := r.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(r.body.Bytes())
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// livePath streams the items of the Config as Server-Sent Events, see
+// serveLive
+const livePath = "/live"
+
+// maxLiveSentItems bounds how many IDs of sent items a live feed remembers,
+// the oldest are forgotten first
+const maxLiveSentItems = 10000
+
+// liveFeeds ends the running live feeds once it is closed. The zero value
+// is open.
+type liveFeeds struct {
+	init    sync.Once
+	closing sync.Once
+	closed  chan struct{}
+}
+
+func (l *liveFeeds) done() <-chan struct{} {
+	l.init.Do(func() { l.closed = make(chan struct{}) })
+	return l.closed
+}
+
+func (l *liveFeeds) close() {
+	l.done()
+	l.closing.Do(func() { close(l.closed) })
+}
+
+// CloseLiveFeeds ends every running live feed and every one started later,
+// e.g. when the server shuts down, which would otherwise wait for them
+func (a *App) CloseLiveFeeds() {
+	a.live.close()
+}
+
+// sentItems remembers the IDs of the items a live feed has sent
+type sentItems struct {
+	ids   map[string]bool
+	order []string
+}
+
+func (s *sentItems) add(id string) bool {
+	if s.ids[id] {
+		return false
+	}
+	if s.ids == nil {
+		s.ids = map[string]bool{}
+	}
+	if len(s.order) == maxLiveSentItems {
+		delete(s.ids, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.ids[id] = true
+	s.order = append(s.order, id)
+	return true
+}
+
+// serveLive streams the page given by the query like serveContent does, but
+// as Server-Sent Events, and fetches it again every LiveInterval. Every item
+// which was not sent before is sent as an "item" event carrying the item's
+// ID; pages which fail are reported as "error" events. Polls without new
+// items send a comment, which keeps proxies from closing the connection. The
+// feed ends when the client disconnects or CloseLiveFeeds is called. Live
+// feeds do not take a slot of MaxInFlight, and bypass the Cache.
+func (a *App) serveLive(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if a.LiveInterval <= 0 {
+		sendError(w, http.StatusNotFound, "live feed is disabled")
+		return
+	}
+	if !a.requireClients(w) {
+		return
+	}
+	// every poll asks the providers for new items
+	request := pageRequest{config: a.config(), uncached: true}
+	format, err := a.parseContentRequest(req, &request)
+	if err != nil {
+		a.sendContentRequestError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	if req.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, http.StatusInternalServerError, "live feed needs a streaming connection")
+		return
+	}
+	ctx = contextWithOverrides(ctx, request.overrides)
+	ctx = contextWithSeen(ctx, request.seen)
+
+	// clients reconnect after an interval rather than at once
+	fmt.Fprintf(w, "retry: %d\n\n", a.LiveInterval.Milliseconds())
+	flusher.Flush()
+
+	ticker := time.NewTicker(a.LiveInterval)
+	defer ticker.Stop()
+	var sent sentItems
+	for {
+		page := a.getPage(ctx, request)
+		rethrowProviderPanic(ctx)
+		if err := a.writeLiveEvents(ctx, w, req, request, format, page, &sent); err != nil {
+			logf(ctx, "live feed closed: %v", err)
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			logf(ctx, "live feed closed: %v", ctx.Err())
+			return
+		case <-a.live.done():
+			logf(ctx, "live feed closed by the server")
+			return
+		}
+	}
+}
+
+// writeLiveEvents writes the events for a page of a live feed
+func (a *App) writeLiveEvents(ctx context.Context, w http.ResponseWriter, req *http.Request, request pageRequest, format responseFormat, page page, sent *sentItems) error {
+	if page.err != nil {
+		logf(ctx, "could not assemble live content: %v", page.err)
+		encoded, err := json.Marshal(errorResponse{Error: page.err.Error()})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "event: error\ndata: %s\n\n", encoded)
+		return err
+	}
+
+	items := a.enrich(ctx, req, request, page.items)
+	rethrowProviderPanic(ctx)
+	written := 0
+	for _, item := range items {
+		if item.Item.Placeholder || !sent.add(item.Item.ID) {
+			continue
+		}
+		encoded, err := json.Marshal(renderItem(item, format))
+		if err != nil {
+			logf(ctx, "could not marshal live item %s: %v", item.Item.ID, err)
+			continue
+		}
+		// an ID breaking the event's lines is left out
+		id := item.Item.ID
+		if strings.ContainsAny(id, "\r\n") {
+			id = ""
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: item\ndata: %s\n\n", id, encoded); err != nil {
+			return err
+		}
+		written++
+	}
+	if written == 0 {
+		_, err := fmt.Fprint(w, ": no new items\n\n")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TickingContentProvider returns one new item per call, numbered from 1
+type TickingContentProvider struct {
+	calls int32
+}
+
+func (cp *TickingContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	id := strconv.Itoa(int(atomic.AddInt32(&cp.calls, 1)))
+	return []*ContentItem{{ID: id, Source: string(Provider1)}}, nil
+}
+
+// liveServer serves srv over HTTP and closes done once the handler of a
+// request returned
+func liveServer(srv http.Handler) (*httptest.Server, <-chan struct{}) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer close(done)
+		srv.ServeHTTP(w, req)
+	}))
+	return server, done
+}
+
+// readLiveItems reads events from the feed until it got count items
+func readLiveItems(t *testing.T, reader *bufio.Reader, count int) []*ContentItem {
+	t.Helper()
+	var items []*ContentItem
+	event := ""
+	for len(items) < count {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Could not read event: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event == "item":
+			var item ContentItem
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &item); err != nil {
+				t.Fatalf("Could not decode item: %v", err)
+			}
+			items = append(items, &item)
+		case line == "":
+			event = ""
+		}
+	}
+	return items
+}
+
+func TestLiveFeedSendsNewItemsUntilTheClientDisconnects(t *testing.T) {
+	provider := &TickingContentProvider{}
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: provider}, WithLiveFeed(10*time.Millisecond))
+	server, done := liveServer(srv)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+livePath+"?count=1", nil)
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer response.Body.Close()
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Got content type %q, want text/event-stream", contentType)
+	}
+
+	items := readLiveItems(t, bufio.NewReader(response.Body), 2)
+	if items[0].ID != "1" || items[1].ID != "2" {
+		t.Errorf("Got items %s and %s, want 1 and 2", items[0].ID, items[1].ID)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Live feed kept running after the client disconnected")
+	}
+	calls := atomic.LoadInt32(&provider.calls)
+	time.Sleep(50 * time.Millisecond)
+	if after := atomic.LoadInt32(&provider.calls); after != calls {
+		t.Errorf("Provider was called %d more times after the feed ended", after-calls)
+	}
+}
+
+func TestLiveFeedPollsBypassTheCache(t *testing.T) {
+	provider := &TickingContentProvider{}
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: provider}, WithLiveFeed(10*time.Millisecond), WithCache(time.Minute))
+	server, done := liveServer(srv)
+	defer server.Close()
+
+	// a cached page would never bring a second item
+	client := &http.Client{Timeout: time.Second}
+	response, err := client.Get(server.URL + livePath + "?count=1")
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	items := readLiveItems(t, bufio.NewReader(response.Body), 2)
+	if items[0].ID != "1" || items[1].ID != "2" {
+		t.Errorf("Got items %s and %s, want 1 and 2", items[0].ID, items[1].ID)
+	}
+	response.Body.Close()
+	<-done
+}
+
+func TestLiveFeedSendsEveryItemOnce(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: fixedItems(Provider1, "a", "b")}, WithLiveFeed(10*time.Millisecond))
+	server, done := liveServer(srv)
+	defer server.Close()
+
+	response, err := http.Get(server.URL + livePath + "?count=2")
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	reader := bufio.NewReader(response.Body)
+	items := readLiveItems(t, reader, 2)
+	if ids := itemIDs(items); ids != "a,b" {
+		t.Errorf("Got items %s, want a,b", ids)
+	}
+	// the next polls only keep the connection alive
+	for i := 0; i < 2; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil || line != "\n" && line != ": no new items\n" {
+			t.Errorf("Got line %q (%v), want no further items", line, err)
+		}
+	}
+	response.Body.Close()
+	<-done
+}
+
+func TestLiveFeedsEndWhenClosed(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, sampleClients(), WithLiveFeed(10*time.Millisecond))
+	server, done := liveServer(srv)
+	defer server.Close()
+
+	response, err := http.Get(server.URL + livePath + "?count=1")
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer response.Body.Close()
+	readLiveItems(t, bufio.NewReader(response.Body), 1)
+
+	srv.CloseLiveFeeds()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Live feed kept running after it was closed")
+	}
+}
+
+func TestLiveFeedIsDisabledByDefault(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients())
+
+	if response := runRawRequest(srv, livePath); response.Code != http.StatusNotFound {
+		t.Errorf("Got status %d, want 404", response.Code)
+	}
+}
@@ -7,30 +7,41 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"time"
 )
 
 var (
 	addr = flag.String("addr", "127.0.0.1:8080", "the TCP address for the server to listen on, in the form 'host:port'")
 
 	// app gets initialised with configuration.
-	// as an example we've added 3 providers and a default configuration
-	app = App{
-		ContentClients: map[Provider]Client{
-			Provider1: SampleContentProvider{Source: Provider1},
-			Provider2: SampleContentProvider{Source: Provider2},
-			Provider3: SampleContentProvider{Source: Provider3},
-		},
-		Config: DefaultConfig,
-	}
+	// as an example we've added 3 providers and a default configuration.
+	// Every provider is guarded by a circuit breaker which stops calling it
+	// for 30 seconds after 5 failures in a row.
+	app = newSampleApp()
 )
 
+func newSampleApp() *App {
+	app, err := NewApp(DefaultConfig, map[Provider]Client{
+		Provider1: NewCircuitBreakerClient(SampleContentProvider{Source: Provider1}, 5, 30*time.Second),
+		Provider2: NewCircuitBreakerClient(SampleContentProvider{Source: Provider2}, 5, 30*time.Second),
+		Provider3: NewCircuitBreakerClient(SampleContentProvider{Source: Provider3}, 5, 30*time.Second),
+	})
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	return app
+}
+
 func main() {
 	log.Printf("initalising server on %s", *addr)
+	app.Warmup(context.Background())
 
 	srv := http.Server{
 		Addr:    *addr,
 		Handler: app,
 	}
+	// live feeds never finish on their own, Shutdown would wait for them
+	srv.RegisterOnShutdown(app.CloseLiveFeeds)
 
 	idleConnsClosed := make(chan struct{})
 	go func() {
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds of the latency histograms
+var DefaultLatencyBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// Histogram counts observed durations in buckets. Observing is lock free, so
+// it is safe and cheap to share by all requests.
+type Histogram struct {
+	bounds []time.Duration
+	// counts holds one count per bound plus one for longer durations
+	counts []uint64
+	count  uint64
+	sum    int64
+}
+
+// NewHistogram creates a histogram with the given ascending bucket bounds
+func NewHistogram(bounds []time.Duration) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Observe records one duration in the first bucket whose bound it does not
+// exceed
+func (h *Histogram) Observe(d time.Duration) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] })
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// histogramBucket is the number of observations up to and including Le
+type histogramBucket struct {
+	// Le is the bucket's bound in seconds, "+Inf" for the last bucket
+	Le    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+// histogramSnapshot is a histogram as reported by /metrics. Bucket counts
+// are cumulative.
+type histogramSnapshot struct {
+	Buckets    []histogramBucket `json:"buckets"`
+	Count      uint64            `json:"count"`
+	SumSeconds float64           `json:"sum_seconds"`
+}
+
+func (h *Histogram) snapshot() histogramSnapshot {
+	snapshot := histogramSnapshot{
+		Buckets:    make([]histogramBucket, len(h.counts)),
+		Count:      atomic.LoadUint64(&h.count),
+		SumSeconds: time.Duration(atomic.LoadInt64(&h.sum)).Seconds(),
+	}
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = formatSeconds(h.bounds[i])
+		}
+		snapshot.Buckets[i] = histogramBucket{Le: le, Count: cumulative}
+	}
+	return snapshot
+}
+
+// DefaultCountBuckets are the upper bounds of the histogram of requested
+// counts
+var DefaultCountBuckets = []int{1, 5, 10, 20, 50, 100}
+
+// DefaultOffsetBuckets are the upper bounds of the histogram of requested
+// offsets
+var DefaultOffsetBuckets = []int{0, 10, 50, 100, 500, 1000}
+
+// CountHistogram counts observed numbers, such as the requested count, in
+// buckets. Like Histogram, observing is lock free.
+type CountHistogram struct {
+	bounds []int
+	// counts holds one count per bound plus one for larger numbers
+	counts []uint64
+	count  uint64
+	sum    uint64
+}
+
+// NewCountHistogram creates a histogram with the given ascending bucket
+// bounds
+func NewCountHistogram(bounds []int) *CountHistogram {
+	return &CountHistogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Observe records n in the first bucket whose bound it does not exceed
+func (h *CountHistogram) Observe(n int) {
+	i := sort.SearchInts(h.bounds, n)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(n))
+}
+
+// countHistogramSnapshot is a CountHistogram as reported by /metrics.
+// Bucket counts are cumulative.
+type countHistogramSnapshot struct {
+	Buckets []histogramBucket `json:"buckets"`
+	Count   uint64            `json:"count"`
+	Sum     uint64            `json:"sum"`
+}
+
+func (h *CountHistogram) snapshot() countHistogramSnapshot {
+	snapshot := countHistogramSnapshot{
+		Buckets: make([]histogramBucket, len(h.counts)),
+		Count:   atomic.LoadUint64(&h.count),
+		Sum:     atomic.LoadUint64(&h.sum),
+	}
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.Itoa(h.bounds[i])
+		}
+		snapshot.Buckets[i] = histogramBucket{Le: le, Count: cumulative}
+	}
+	return snapshot
+}
+
+// Metrics records the latency of content requests and of every provider
+// call, and counts failed provider calls by the class of their error. The
+// requested counts and offsets are recorded for capacity planning. Every
+// App has metrics of its own instead of registering them globally, so that
+// creating several Apps, e.g. in tests, never clashes.
+type Metrics struct {
+	RequestDuration *Histogram
+	RequestedCount  *CountHistogram
+	RequestedOffset *CountHistogram
+
+	// now returns the current time, it can be replaced in tests
+	now func() time.Time
+
+	mu                sync.RWMutex
+	providerDurations map[Provider]*Histogram
+	providerErrors    map[Provider]map[errorClass]uint64
+	providerOutcomes  map[Provider]map[fetchOutcome]uint64
+	providerDegraded  map[Provider]uint64
+	providerInvalid   map[Provider]uint64
+	truncatedPages    uint64
+	truncatedItems    uint64
+}
+
+// fetchOutcome is how fetching for a config went
+type fetchOutcome string
+
+const (
+	// outcomeSuccess means the config's primary provider delivered
+	outcomeSuccess fetchOutcome = "success"
+	// outcomeFallback means one of the config's fallbacks delivered
+	outcomeFallback fetchOutcome = "fallback"
+	// outcomeFailure means none of the config's providers delivered
+	outcomeFailure fetchOutcome = "failure"
+)
+
+// NewMetrics creates metrics using the DefaultLatencyBuckets,
+// DefaultCountBuckets and DefaultOffsetBuckets
+func NewMetrics() *Metrics {
+	return &Metrics{
+		RequestDuration:   NewHistogram(DefaultLatencyBuckets),
+		RequestedCount:    NewCountHistogram(DefaultCountBuckets),
+		RequestedOffset:   NewCountHistogram(DefaultOffsetBuckets),
+		now:               time.Now,
+		providerDurations: map[Provider]*Histogram{},
+		providerErrors:    map[Provider]map[errorClass]uint64{},
+		providerOutcomes:  map[Provider]map[fetchOutcome]uint64{},
+		providerDegraded:  map[Provider]uint64{},
+		providerInvalid:   map[Provider]uint64{},
+	}
+}
+
+// startTimer returns a function which returns the time elapsed since
+// startTimer was called. Without metrics, no time is taken.
+func (m *Metrics) startTimer() func() time.Duration {
+	if m == nil {
+		return func() time.Duration { return 0 }
+	}
+	start := m.currentTime()
+	return func() time.Duration { return m.currentTime().Sub(start) }
+}
+
+// observeRequest records the duration of a content request
+func (m *Metrics) observeRequest(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.RequestDuration.Observe(d)
+}
+
+// observePage records the count and offset of a content request
+func (m *Metrics) observePage(count, offset int) {
+	if m == nil {
+		return
+	}
+	m.RequestedCount.Observe(count)
+	m.RequestedOffset.Observe(offset)
+}
+
+// observeProvider records the duration of a call to provider
+func (m *Metrics) observeProvider(provider Provider, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.providerHistogram(provider).Observe(d)
+}
+
+// observeProviderError counts a failed call to provider by its class
+func (m *Metrics) observeProviderError(provider Provider, class errorClass) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.providerErrors[provider] == nil {
+		m.providerErrors[provider] = map[errorClass]uint64{}
+	}
+	m.providerErrors[provider][class]++
+}
+
+// observeOutcome counts how fetching for a config with the given primary
+// provider went
+func (m *Metrics) observeOutcome(provider Provider, outcome fetchOutcome) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.providerOutcomes[provider] == nil {
+		m.providerOutcomes[provider] = map[fetchOutcome]uint64{}
+	}
+	m.providerOutcomes[provider][outcome]++
+}
+
+// observeDegraded counts a page for which fewer items were requested from
+// provider because it is slow
+func (m *Metrics) observeDegraded(provider Provider) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.providerDegraded[provider]++
+}
+
+// observeInvalidItem counts an item of provider which failed validation
+func (m *Metrics) observeInvalidItem(provider Provider) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.providerInvalid[provider]++
+}
+
+// observeTruncated counts a page which was cut off missing items because
+// its providers ran out
+func (m *Metrics) observeTruncated(missing int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.truncatedPages++
+	m.truncatedItems += uint64(missing)
+}
+
+// successRate returns the share of the calls to provider which did not
+// fail, 1 if it was not called yet
+func (m *Metrics) successRate(provider Provider) float64 {
+	histogram := m.providerHistogramIfAny(provider)
+	if histogram == nil {
+		return 1
+	}
+	calls := atomic.LoadUint64(&histogram.count)
+	if calls == 0 {
+		return 1
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var failures uint64
+	for _, count := range m.providerErrors[provider] {
+		failures += count
+	}
+	if failures > calls {
+		return 0
+	}
+	return float64(calls-failures) / float64(calls)
+}
+
+// providerHistogramIfAny returns the provider's latency histogram, or nil if
+// no call to it was observed yet
+func (m *Metrics) providerHistogramIfAny(provider Provider) *Histogram {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.providerDurations[provider]
+}
+
+func (m *Metrics) providerHistogram(provider Provider) *Histogram {
+	m.mu.RLock()
+	histogram, ok := m.providerDurations[provider]
+	m.mu.RUnlock()
+	if ok {
+		return histogram
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if histogram, ok := m.providerDurations[provider]; ok {
+		return histogram
+	}
+	histogram = NewHistogram(m.RequestDuration.bounds)
+	m.providerDurations[provider] = histogram
+	return histogram
+}
+
+func (m *Metrics) currentTime() time.Time {
+	if m.now == nil {
+		return time.Now()
+	}
+	return m.now()
+}
+
+// metricsSnapshot is the body of /metrics
+type metricsSnapshot struct {
+	RequestDuration  histogramSnapshot                    `json:"request_duration"`
+	RequestedCount   countHistogramSnapshot               `json:"requested_count"`
+	RequestedOffset  countHistogramSnapshot               `json:"requested_offset"`
+	ProviderDuration map[Provider]histogramSnapshot       `json:"provider_duration"`
+	ProviderErrors   map[Provider]map[errorClass]uint64   `json:"provider_errors"`
+	ProviderOutcomes map[Provider]map[fetchOutcome]uint64 `json:"provider_outcomes"`
+	ProviderDegraded map[Provider]uint64                  `json:"provider_degraded"`
+	ProviderInvalid  map[Provider]uint64                  `json:"provider_invalid_items"`
+	TruncatedPages   uint64                               `json:"truncated_pages"`
+	TruncatedItems   uint64                               `json:"truncated_items"`
+}
+
+func (m *Metrics) snapshot() metricsSnapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	snapshot := metricsSnapshot{
+		RequestDuration:  m.RequestDuration.snapshot(),
+		RequestedCount:   m.RequestedCount.snapshot(),
+		RequestedOffset:  m.RequestedOffset.snapshot(),
+		ProviderDuration: make(map[Provider]histogramSnapshot, len(m.providerDurations)),
+		ProviderErrors:   make(map[Provider]map[errorClass]uint64, len(m.providerErrors)),
+		ProviderOutcomes: make(map[Provider]map[fetchOutcome]uint64, len(m.providerOutcomes)),
+		ProviderDegraded: make(map[Provider]uint64, len(m.providerDegraded)),
+		ProviderInvalid:  make(map[Provider]uint64, len(m.providerInvalid)),
+		TruncatedPages:   m.truncatedPages,
+		TruncatedItems:   m.truncatedItems,
+	}
+	for provider, histogram := range m.providerDurations {
+		snapshot.ProviderDuration[provider] = histogram.snapshot()
+	}
+	for provider, counts := range m.providerErrors {
+		snapshot.ProviderErrors[provider] = make(map[errorClass]uint64, len(counts))
+		for class, count := range counts {
+			snapshot.ProviderErrors[provider][class] = count
+		}
+	}
+	for provider, counts := range m.providerOutcomes {
+		snapshot.ProviderOutcomes[provider] = make(map[fetchOutcome]uint64, len(counts))
+		for outcome, count := range counts {
+			snapshot.ProviderOutcomes[provider][outcome] = count
+		}
+	}
+	for provider, count := range m.providerDegraded {
+		snapshot.ProviderDegraded[provider] = count
+	}
+	for provider, count := range m.providerInvalid {
+		snapshot.ProviderInvalid[provider] = count
+	}
+	return snapshot
+}
+
+// serveMetrics reports the metrics as JSON, or in the Prometheus text format
+// if the client asks for plain text as Prometheus does
+func (a *App) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	if a.Metrics == nil {
+		sendError(w, http.StatusNotFound, "metrics are disabled")
+		return
+	}
+	if wantsPrometheus(req) {
+		w.Header().Set("Content-Type", prometheusContentType)
+		writePrometheus(w, a.Metrics.snapshot())
+		return
+	}
+	writeJSON(w, http.StatusOK, a.Metrics.snapshot())
+}
+
+// formatSeconds formats a duration as seconds without trailing zeros
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
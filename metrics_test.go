@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// steppingClock returns a time which advances by step on every call
+func steppingClock(step time.Duration) func() time.Time {
+	var mu sync.Mutex
+	now := time.Unix(0, 0)
+	return func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(step)
+		return now
+	}
+}
+
+func TestHistogramCountsObservationsInBuckets(t *testing.T) {
+	histogram := NewHistogram([]time.Duration{10 * time.Millisecond, 100 * time.Millisecond})
+	for _, d := range []time.Duration{time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond, time.Second} {
+		histogram.Observe(d)
+	}
+
+	snapshot := histogram.snapshot()
+	want := []histogramBucket{{Le: "0.01", Count: 2}, {Le: "0.1", Count: 3}, {Le: "+Inf", Count: 4}}
+	for i := range want {
+		if snapshot.Buckets[i] != want[i] {
+			t.Errorf("Got bucket %+v, want %+v", snapshot.Buckets[i], want[i])
+		}
+	}
+	if snapshot.Count != 4 {
+		t.Errorf("Got count %d, want 4", snapshot.Count)
+	}
+	if snapshot.SumSeconds != 1.061 {
+		t.Errorf("Got sum %v, want 1.061", snapshot.SumSeconds)
+	}
+}
+
+func TestMetricsRecordRequestAndProviderLatency(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, sampleClients())
+	srv.Metrics.now = steppingClock(30 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		runRequest(t, srv, httptest.NewRequest("GET", "/?count=2", nil))
+	}
+	response := runRawRequest(srv, "/metrics")
+
+	var metrics metricsSnapshot
+	if err := json.NewDecoder(response.Body).Decode(&metrics); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+
+	// every request takes three clock steps, the provider call in it one
+	assertBucketCount(t, metrics.RequestDuration, "0.05", 0)
+	assertBucketCount(t, metrics.RequestDuration, "0.1", 3)
+	assertBucketCount(t, metrics.ProviderDuration[Provider1], "0.025", 0)
+	assertBucketCount(t, metrics.ProviderDuration[Provider1], "0.05", 3)
+	if _, ok := metrics.ProviderDuration[Provider2]; ok {
+		t.Errorf("Got latency of provider 2, which was never called")
+	}
+}
+
+func assertBucketCount(t *testing.T, histogram histogramSnapshot, le string, want uint64) {
+	t.Helper()
+	for _, bucket := range histogram.Buckets {
+		if bucket.Le == le {
+			if bucket.Count != want {
+				t.Errorf("Got %d observations up to %ss, want %d", bucket.Count, le, want)
+			}
+			return
+		}
+	}
+	t.Errorf("No bucket for %ss", le)
+}
+
+func TestMetricsAreSafeForConcurrentUse(t *testing.T) {
+	metrics := NewMetrics()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				metrics.observeProvider(Provider1, time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count := metrics.snapshot().ProviderDuration[Provider1].Count; count != 1000 {
+		t.Errorf("Got %d observations, want 1000", count)
+	}
+}
+
+func TestMetricsRecordRequestedCountsAndOffsets(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, sampleClients())
+	for _, query := range []string{"count=1", "count=3&offset=5", "count=5&offset=10", "count=20&offset=60", "count=80&offset=2000", "count=101"} {
+		runRawRequest(srv, "/?"+query)
+	}
+
+	snapshot := srv.Metrics.snapshot()
+	tests := []struct {
+		name      string
+		histogram countHistogramSnapshot
+		want      []histogramBucket
+		sum       uint64
+	}{
+		{"count", snapshot.RequestedCount, []histogramBucket{
+			{"1", 1}, {"5", 3}, {"10", 3}, {"20", 4}, {"50", 4}, {"100", 5}, {"+Inf", 5},
+		}, 109},
+		{"offset", snapshot.RequestedOffset, []histogramBucket{
+			{"0", 1}, {"10", 3}, {"50", 3}, {"100", 4}, {"500", 4}, {"1000", 4}, {"+Inf", 5},
+		}, 2075},
+	}
+	for _, tt := range tests {
+		for i, want := range tt.want {
+			if got := tt.histogram.Buckets[i]; got != want {
+				t.Errorf("%s: Got bucket %+v, want %+v", tt.name, got, want)
+			}
+		}
+		if tt.histogram.Count != 5 || tt.histogram.Sum != tt.sum {
+			t.Errorf("%s: Got %d observations summing to %d, want 5 summing to %d", tt.name, tt.histogram.Count, tt.histogram.Sum, tt.sum)
+		}
+	}
+}
+
+func TestMetricsCountTruncatedPages(t *testing.T) {
+	clients := sampleClients()
+	clients[Provider2] = FailingContentProvider{}
+	clients[Provider3] = FailingContentProvider{}
+	srv, _ := NewApp(ContentMix{config1, config1, config2, config3}, clients)
+
+	runRequest(t, srv, SimpleContentRequest)
+	runRequest(t, srv, httptest.NewRequest("GET", "/?count=2", nil))
+	runRequest(t, srv, httptest.NewRequest("GET", "/?count=3&offset=1", nil))
+
+	// the first request misses 3 of 5 items, the last 2 of 3
+	snapshot := srv.Metrics.snapshot()
+	if snapshot.TruncatedPages != 2 || snapshot.TruncatedItems != 5 {
+		t.Errorf("Got %d truncated pages missing %d items, want 2 missing 5", snapshot.TruncatedPages, snapshot.TruncatedItems)
+	}
+}
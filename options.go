@@ -0,0 +1,650 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMaxCount is the largest count a client may ask for, unless
+	// configured otherwise
+	DefaultMaxCount = 100
+	// DefaultRequestTimeout is how long a request waits for its providers,
+	// unless configured otherwise
+	DefaultRequestTimeout = 2 * time.Second
+)
+
+// Option configures an App created by NewApp
+type Option func(*App)
+
+// NewApp creates an App serving config with the given clients. It applies
+// default limits and fails if the config refers to a provider that has no
+// client or if an option has an invalid value.
+func NewApp(config ContentMix, clients map[Provider]Client, opts ...Option) (*App, error) {
+	app := &App{
+		ContentClients: clients,
+		Config:         config,
+		MaxCount:       DefaultMaxCount,
+		RequestTimeout: DefaultRequestTimeout,
+		Metrics:        NewMetrics(),
+		DegradedShare:  DefaultDegradedShare,
+		RandSource:     rand.NewSource(time.Now().UnixNano()),
+	}
+	for _, opt := range opts {
+		opt(app)
+	}
+
+	if err := app.validate(); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// validate checks that the App is configured consistently
+func (a *App) validate() error {
+	if err := a.validateMix(a.Config); err != nil {
+		return err
+	}
+	for name, mix := range a.Mixes {
+		if err := a.validateMix(mix); err != nil {
+			return fmt.Errorf("mix %q: %v", name, err)
+		}
+	}
+	if len(a.AdsMix) > 0 {
+		if err := a.validateMix(a.AdsMix); err != nil {
+			return fmt.Errorf("ads mix: %v", err)
+		}
+		if a.AdsInterval < 2 {
+			return errors.New("ads interval must be at least 2")
+		}
+	}
+	if err := a.validateFieldNames(); err != nil {
+		return err
+	}
+	if a.Experiment != nil {
+		if err := a.validateExperiment(); err != nil {
+			return err
+		}
+	}
+	if a.DefaultFallback != nil {
+		if _, ok := a.ContentClients[*a.DefaultFallback]; !ok {
+			return fmt.Errorf("no client for default fallback provider %s", *a.DefaultFallback)
+		}
+	}
+	for provider, client := range a.ContentClients {
+		if client == nil {
+			return fmt.Errorf("client for provider %s is nil", provider)
+		}
+	}
+	for _, path := range a.ContentPaths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("content path %q must start with /", path)
+		}
+	}
+	if a.FirstToRespond && a.LessItem == nil {
+		return errors.New("first to respond requires an item order")
+	}
+	if a.FirstToRespond && a.StrictMode {
+		return errors.New("first to respond cannot be combined with strict mode")
+	}
+	if a.Health != nil && a.Health.TTL < 0 {
+		return errors.New("health check TTL must not be negative")
+	}
+	if a.MaxQueued < 0 || a.MaxQueueWait < 0 {
+		return errors.New("request queue must not be negative")
+	}
+	if a.MaxQueued > 0 && a.MaxInFlight == 0 {
+		return errors.New("requests can only be queued with a max in flight")
+	}
+	if a.MaxItemsPerProvider < 0 {
+		return errors.New("max items per provider must not be negative")
+	}
+	if a.LogicalTotal < 0 {
+		return errors.New("logical total must not be negative")
+	}
+	if a.MaxCount < 0 {
+		return errors.New("max count must not be negative")
+	}
+	if a.RequestTimeout < 0 {
+		return errors.New("request timeout must not be negative")
+	}
+	if a.DefaultProviderTimeout < 0 {
+		return errors.New("default provider timeout must not be negative")
+	}
+	for provider, timeout := range a.ProviderTimeouts {
+		if timeout < 0 {
+			return fmt.Errorf("timeout for provider %s must not be negative", provider)
+		}
+	}
+	for provider, size := range a.BatchSizes {
+		if size.Min < 0 || size.Max < 0 || (size.Max > 0 && size.Min > size.Max) {
+			return fmt.Errorf("batch size of provider %s must be non-negative with min up to max", provider)
+		}
+		if size.Multiple < 0 || (size.Multiple > 0 && size.Max%size.Multiple != 0) {
+			return fmt.Errorf("batch multiple of provider %s must be non-negative and divide the max", provider)
+		}
+	}
+	if len(a.ExpensiveProviders) > 0 && (a.MaxBackfillPasses > 0 || a.FirstToRespond) {
+		return errors.New("expensive providers cannot be combined with backfill or first to respond")
+	}
+	if a.SlowProviderP99 < 0 {
+		return errors.New("slow provider p99 must not be negative")
+	}
+	if a.SlowProviderP99 > 0 && (a.DegradedShare <= 0 || a.DegradedShare > 1) {
+		return errors.New("degraded share must be above 0 and at most 1")
+	}
+	if a.LiveInterval < 0 {
+		return errors.New("live interval must not be negative")
+	}
+	if a.MaxJitter < 0 {
+		return errors.New("max jitter must not be negative")
+	}
+	if a.MaxRetryWait < 0 {
+		return errors.New("max retry wait must not be negative")
+	}
+	if a.MaxResponseBytes < 0 {
+		return errors.New("max response bytes must not be negative")
+	}
+	if a.Cache != nil && a.Cache.StaleGrace < 0 {
+		return errors.New("stale grace must not be negative")
+	}
+	if a.Cache != nil && a.Cache.MaxEntries < 0 {
+		return errors.New("max cache entries must not be negative")
+	}
+	if a.Idempotency != nil && a.Idempotency.MaxEntries < 0 {
+		return errors.New("max idempotency keys must not be negative")
+	}
+	if a.MaxInFlight < 0 {
+		return errors.New("max in flight must not be negative")
+	}
+	if a.StreamMinCount < 0 {
+		return errors.New("stream min count must not be negative")
+	}
+	if a.WarmupCount < 0 {
+		return errors.New("warmup count must not be negative")
+	}
+	if a.CacheMaxAge < 0 {
+		return errors.New("cache max age must not be negative")
+	}
+	if a.OverFetchFactor != 0 && a.OverFetchFactor < 1 {
+		return errors.New("over-fetch factor must be at least 1")
+	}
+	if a.MaxBackfillPasses < 0 {
+		return errors.New("max backfill passes must not be negative")
+	}
+	if a.DeduplicateBy != "" {
+		if _, known := contentItemFieldNames[a.DeduplicateBy]; !known {
+			return fmt.Errorf("cannot deduplicate by unknown field %q", a.DeduplicateBy)
+		}
+	}
+	if len(a.DeduplicationPriority) > 0 && a.DeduplicateBy == "" {
+		return errors.New("deduplication priority requires deduplication")
+	}
+	if a.MaxSeenItems < 0 || a.MaxSeenFilterBytes < 0 {
+		return errors.New("seen item limits must not be negative")
+	}
+	return nil
+}
+
+// WithDefaultFallback falls back to provider for every config which has no
+// fallback of its own
+func WithDefaultFallback(provider Provider) Option {
+	return func(a *App) { a.DefaultFallback = &provider }
+}
+
+// validateMix checks that every provider of the mix has a client
+func (a *App) validateMix(mix ContentMix) error {
+	if len(mix) == 0 {
+		return errors.New("config must contain at least one content config")
+	}
+	for i, config := range mix {
+		if config.Tiers != nil {
+			for _, tier := range *config.Tiers {
+				for _, provider := range tier {
+					if _, ok := a.ContentClients[provider]; !ok {
+						return fmt.Errorf("config %d: no client for tier provider %s", i, provider)
+					}
+				}
+			}
+			continue
+		}
+		if _, ok := a.ContentClients[config.Type]; !ok {
+			return fmt.Errorf("config %d: no client for provider %s", i, config.Type)
+		}
+		if config.Fallback != nil {
+			if _, ok := a.ContentClients[*config.Fallback]; !ok {
+				return fmt.Errorf("config %d: no client for fallback provider %s", i, *config.Fallback)
+			}
+		}
+	}
+	return nil
+}
+
+// WithMix serves config under /mix/{name}
+func WithMix(name string, config ContentMix) Option {
+	return func(a *App) {
+		if a.Mixes == nil {
+			a.Mixes = map[string]ContentMix{}
+		}
+		a.Mixes[name] = config
+	}
+}
+
+// WithMaxCount limits how many items a client may ask for. 0 means no limit.
+func WithMaxCount(maxCount int) Option {
+	return func(a *App) { a.MaxCount = maxCount }
+}
+
+// WithRequestTimeout limits how long a request waits for its providers.
+// 0 means no limit.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(a *App) { a.RequestTimeout = timeout }
+}
+
+// WithProviderTimeout limits how long a single call to provider may take
+// before its fallback is tried
+func WithProviderTimeout(provider Provider, timeout time.Duration) Option {
+	return func(a *App) {
+		if a.ProviderTimeouts == nil {
+			a.ProviderTimeouts = map[Provider]time.Duration{}
+		}
+		a.ProviderTimeouts[provider] = timeout
+	}
+}
+
+// WithBatchSize asks provider for between min and max items per call
+func WithBatchSize(provider Provider, min, max int) Option {
+	return func(a *App) {
+		if a.BatchSizes == nil {
+			a.BatchSizes = map[Provider]BatchSize{}
+		}
+		size := a.BatchSizes[provider]
+		size.Min, size.Max = min, max
+		a.BatchSizes[provider] = size
+	}
+}
+
+// WithBatchMultiple rounds the batches provider is asked for up to a
+// multiple of items, trimming the surplus
+func WithBatchMultiple(provider Provider, multiple int) Option {
+	return func(a *App) {
+		if a.BatchSizes == nil {
+			a.BatchSizes = map[Provider]BatchSize{}
+		}
+		size := a.BatchSizes[provider]
+		size.Multiple = multiple
+		a.BatchSizes[provider] = size
+	}
+}
+
+// WithDefaultProviderTimeout limits how long a single call to any provider
+// without a timeout of its own may take
+func WithDefaultProviderTimeout(timeout time.Duration) Option {
+	return func(a *App) { a.DefaultProviderTimeout = timeout }
+}
+
+// WithSlowProviderDegradation requests fewer items from providers whose 99th
+// percentile latency exceeds p99, letting them keep share of their slots and
+// filling the rest from faster providers
+func WithSlowProviderDegradation(p99 time.Duration, share float64) Option {
+	return func(a *App) {
+		a.SlowProviderP99 = p99
+		a.DegradedShare = share
+	}
+}
+
+// WithExpensiveProviders only calls the providers for the slots which the
+// other providers cannot fill
+func WithExpensiveProviders(providers ...Provider) Option {
+	return func(a *App) {
+		a.ExpensiveProviders = map[Provider]bool{}
+		for _, provider := range providers {
+			a.ExpensiveProviders[provider] = true
+		}
+	}
+}
+
+// WithLiveFeed serves the live feed at /live, which fetches its page every
+// interval
+func WithLiveFeed(interval time.Duration) Option {
+	return func(a *App) { a.LiveInterval = interval }
+}
+
+// WithMaxJitter delays every provider call of a request randomly by up to
+// maxJitter
+func WithMaxJitter(maxJitter time.Duration) Option {
+	return func(a *App) { a.MaxJitter = maxJitter }
+}
+
+// WithMaxRetryWait lets requests wait for a throttling provider if it asks to
+// be retried within maxWait
+func WithMaxRetryWait(maxWait time.Duration) Option {
+	return func(a *App) { a.MaxRetryWait = maxWait }
+}
+
+// WithEmptyResponsePolicy sets how requests without any content are answered
+func WithEmptyResponsePolicy(policy EmptyResponsePolicy) Option {
+	return func(a *App) { a.EmptyResponsePolicy = policy }
+}
+
+// WithMaxResponseBytes limits the size of content responses, handling larger
+// ones according to policy
+func WithMaxResponseBytes(maxBytes int, policy OversizePolicy) Option {
+	return func(a *App) {
+		a.MaxResponseBytes = maxBytes
+		a.OversizePolicy = policy
+	}
+}
+
+// WithStrictFields rejects requests asking for unknown fields
+func WithStrictFields() Option {
+	return func(a *App) { a.StrictFields = true }
+}
+
+// WithLenientQuery uses the first value of repeated count and offset
+// parameters instead of rejecting the request
+func WithLenientQuery() Option {
+	return func(a *App) { a.LenientQuery = true }
+}
+
+// WithDeduplication skips items whose field, given by its JSON name, was
+// already returned in the same response
+func WithDeduplication(field string) Option {
+	return func(a *App) { a.DeduplicateBy = field }
+}
+
+// WithDeduplicationPriority keeps the version of a duplicate item whose
+// provider has the highest priority
+func WithDeduplicationPriority(priorities map[Provider]int) Option {
+	return func(a *App) { a.DeduplicationPriority = priorities }
+}
+
+// WithSeenItems skips the items which clients list as seen, honouring at
+// most maxIDs IDs of X-Seen-Items and seen filters of at most maxFilterBytes
+func WithSeenItems(maxIDs, maxFilterBytes int) Option {
+	return func(a *App) {
+		a.MaxSeenItems = maxIDs
+		a.MaxSeenFilterBytes = maxFilterBytes
+	}
+}
+
+// WithOverFetch asks providers for factor times the items they are needed for
+func WithOverFetch(factor float64) Option {
+	return func(a *App) { a.OverFetchFactor = factor }
+}
+
+// WithStrictMode fails requests with a 502 instead of returning a partial
+// list when a config cannot be fetched
+func WithStrictMode() Option {
+	return func(a *App) { a.StrictMode = true }
+}
+
+// WithBackfill fills the slots of failed configs from healthy ones, using at
+// most maxPasses rounds of additional fetches
+func WithBackfill(maxPasses int) Option {
+	return func(a *App) { a.MaxBackfillPasses = maxPasses }
+}
+
+// WithItemValidation checks every item with validate, handling invalid items
+// according to policy
+func WithItemValidation(validate func(*ContentItem) error, policy InvalidItemPolicy) Option {
+	return func(a *App) {
+		a.ValidateItem = validate
+		a.InvalidItemPolicy = policy
+	}
+}
+
+// WithMixStrategy sets how the config is laid out over the requested items
+func WithMixStrategy(strategy MixStrategy) Option {
+	return func(a *App) { a.MixStrategy = strategy }
+}
+
+// WithMixSelector lets selector rewrite the mix of every request based on
+// its headers
+func WithMixSelector(selector MixSelector) Option {
+	return func(a *App) { a.SelectMix = selector }
+}
+
+// WithExperiment splits the users between the variants of experiment
+func WithExperiment(experiment Experiment) Option {
+	return func(a *App) { a.Experiment = &experiment }
+}
+
+// WithTierSelection sets which provider of a tier is tried first
+func WithTierSelection(selection TierSelection) Option {
+	return func(a *App) { a.TierSelection = selection }
+}
+
+// WithRacingTiers calls all providers of a config at once, using the first
+// to deliver
+func WithRacingTiers() Option {
+	return func(a *App) { a.RaceTiers = true }
+}
+
+// WithAdaptiveFallbacks tries the most reliable fallbacks first
+func WithAdaptiveFallbacks() Option {
+	return func(a *App) { a.AdaptiveFallbacks = true }
+}
+
+// WithItemOrder sorts the items of every page with less
+func WithItemOrder(less func(a, b *ContentItem) bool) Option {
+	return func(a *App) { a.LessItem = less }
+}
+
+// WithContentPaths serves the Config under the given paths instead of "/"
+func WithContentPaths(paths ...string) Option {
+	return func(a *App) { a.ContentPaths = paths }
+}
+
+// WithClientIP takes the IP of clients from requests with clientIP
+func WithClientIP(clientIP func(req *http.Request) string) Option {
+	return func(a *App) { a.ClientIPFunc = clientIP }
+}
+
+// WithFirstToRespond returns pages from the providers which respond first,
+// sorted with less
+func WithFirstToRespond(less func(a, b *ContentItem) bool) Option {
+	return func(a *App) {
+		a.FirstToRespond = true
+		a.LessItem = less
+	}
+}
+
+// WithRandSeed makes random choices reproducible by seeding them with seed
+func WithRandSeed(seed int64) Option {
+	return func(a *App) { a.RandSource = rand.NewSource(seed) }
+}
+
+// WithCacheMaxAge lets clients cache successful responses for maxAge
+func WithCacheMaxAge(maxAge time.Duration) Option {
+	return func(a *App) { a.CacheMaxAge = maxAge }
+}
+
+// WithNoStoreMix forbids clients to cache responses of the named mix
+func WithNoStoreMix(name string) Option {
+	return func(a *App) {
+		if a.NoStoreMixes == nil {
+			a.NoStoreMixes = map[string]bool{}
+		}
+		a.NoStoreMixes[name] = true
+	}
+}
+
+// WithCache caches complete pages for ttl
+func WithCache(ttl time.Duration) Option {
+	return func(a *App) { a.Cache = NewPageCache(ttl) }
+}
+
+// WithRequestQueue lets up to max requests beyond MaxInFlight wait for up to
+// wait for a slot
+func WithRequestQueue(max int, wait time.Duration) Option {
+	return func(a *App) {
+		a.MaxQueued = max
+		a.MaxQueueWait = wait
+	}
+}
+
+// WithProviderQuota lets every provider deliver at most max items of a page
+func WithProviderQuota(max int) Option {
+	return func(a *App) { a.MaxItemsPerProvider = max }
+}
+
+// WithDefaultItem fills the slots of failed configs with copies of item
+func WithDefaultItem(item ContentItem) Option {
+	return func(a *App) { a.DefaultItem = &item }
+}
+
+// WithEnricher adds the fields computed by enricher to every returned item.
+// It can be given several times, the enrichers then run in the same order.
+func WithEnricher(enricher Enricher) Option {
+	return func(a *App) { a.Enrichers = append(a.Enrichers, enricher) }
+}
+
+// WithEmergencyContent serves the items when no provider delivered anything,
+// see LoadEmergencyContent
+func WithEmergencyContent(items []*ContentItem) Option {
+	return func(a *App) { a.EmergencyContent = items }
+}
+
+// WithStaleCache caches complete pages for ttl and keeps them for another
+// grace period, in which they are served if the providers fail
+func WithStaleCache(ttl, grace time.Duration) Option {
+	return func(a *App) {
+		a.Cache = NewPageCache(ttl)
+		a.Cache.StaleGrace = grace
+	}
+}
+
+// WithCompressedCache caches complete pages for ttl, keeping them compressed
+func WithCompressedCache(ttl time.Duration) Option {
+	return func(a *App) {
+		a.Cache = NewPageCache(ttl)
+		a.Cache.Compress = true
+	}
+}
+
+// WithIdempotencyKeys keeps the responses to custom mix requests carrying an
+// Idempotency-Key for ttl
+func WithIdempotencyKeys(ttl time.Duration) Option {
+	return func(a *App) { a.Idempotency = NewIdempotencyCache(ttl) }
+}
+
+// WithOrderedFanOut collects the results of concurrent fetches in the order
+// of the mix
+func WithOrderedFanOut() Option {
+	return func(a *App) { a.OrderedFanOut = true }
+}
+
+// WithAdminToken enables the admin endpoints for requests carrying token
+func WithAdminToken(token string) Option {
+	return func(a *App) { a.AdminToken = token }
+}
+
+// WithWarmup lets Warmup fetch the first count items into the cache. It has
+// no effect without a cache.
+func WithWarmup(count int) Option {
+	return func(a *App) { a.WarmupCount = count }
+}
+
+// WithPrefetch fetches the next page into the cache after serving a page.
+// It has no effect without a cache.
+func WithPrefetch() Option {
+	return func(a *App) { a.Prefetch = true }
+}
+
+// WithMaxInFlight sheds content requests beyond max running at once
+func WithMaxInFlight(max int) Option {
+	return func(a *App) { a.MaxInFlight = max }
+}
+
+// WithStreaming streams responses for at least minCount items
+func WithStreaming(minCount int) Option {
+	return func(a *App) { a.StreamMinCount = minCount }
+}
+
+// WithTracer records spans of requests and fetches with tracer
+func WithTracer(tracer Tracer) Option {
+	return func(a *App) { a.Tracer = tracer }
+}
+
+// WithAdsMix puts the configs of ads into every interval-th slot of the
+// served mixes
+func WithAdsMix(ads ContentMix, interval int) Option {
+	return func(a *App) {
+		a.AdsMix = ads
+		a.AdsInterval = interval
+	}
+}
+
+// WithCursorKey signs cursors with key, so that the cursors of one instance
+// are accepted by every instance sharing the key
+func WithCursorKey(key []byte) Option {
+	return func(a *App) { a.CursorKey = key }
+}
+
+// WithLogicalTotal ends the content after total items
+func WithLogicalTotal(total int) Option {
+	return func(a *App) { a.LogicalTotal = total }
+}
+
+// WithCoalescing shares concurrent identical provider calls
+func WithCoalescing() Option {
+	return func(a *App) { a.CoalesceFetches = true }
+}
+
+// WithHealthChecks probes providers which support it before calling them,
+// keeping the results for ttl
+func WithHealthChecks(ttl time.Duration) Option {
+	return func(a *App) { a.Health = NewHealthCache(ttl) }
+}
+
+// WithRangePolicy decides how ranges spanning more than MaxCount items are
+// handled
+func WithRangePolicy(policy RangePolicy) Option {
+	return func(a *App) { a.RangePolicy = policy }
+}
+
+// WithShortfallHeaders reports how many items were requested and returned
+// in response headers
+func WithShortfallHeaders() Option {
+	return func(a *App) { a.ReportShortfall = true }
+}
+
+// WithPartialContentStatus responds with 206 to requests which got fewer
+// items than they asked for
+func WithPartialContentStatus() Option {
+	return func(a *App) { a.PartialContentStatus = true }
+}
+
+// WithResponseEnvelope wraps content lists in an object with metadata
+func WithResponseEnvelope() Option {
+	return func(a *App) { a.Envelope = true }
+}
+
+// WithCompactItems leaves empty optional fields out of returned items
+func WithCompactItems() Option {
+	return func(a *App) { a.CompactItems = true }
+}
+
+// WithFetchTimes adds the time every item was fetched to it
+func WithFetchTimes() Option {
+	return func(a *App) { a.ReportFetchTimes = true }
+}
+
+// WithFieldNames serialises item fields under the given names, and the
+// others in the given case
+func WithFieldNames(names map[string]string, fieldCase FieldCase) Option {
+	return func(a *App) {
+		a.FieldNames = names
+		a.FieldCase = fieldCase
+	}
+}
+
+// WithFallbackAnnotations adds the serving provider to every returned item
+func WithFallbackAnnotations() Option {
+	return func(a *App) { a.AnnotateFallbacks = true }
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// SlowContentProvider delivers the wrapped client's content after a delay
+type SlowContentProvider struct {
+	Client Client
+	Delay  time.Duration
+}
+
+func (cp SlowContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	select {
+	case <-time.After(cp.Delay):
+		return cp.Client.GetContent(ctx, userIP, count)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func sampleClients() map[Provider]Client {
+	return map[Provider]Client{
+		Provider1: SampleContentProvider{Source: Provider1},
+		Provider2: SampleContentProvider{Source: Provider2},
+		Provider3: SampleContentProvider{Source: Provider3},
+	}
+}
+
+func TestNewAppAppliesDefaultsAndOptions(t *testing.T) {
+	srv, err := NewApp(DefaultConfig, sampleClients(), WithMaxCount(10), WithStrictFields())
+	if err != nil {
+		t.Fatalf("NewApp failed: %v", err)
+	}
+
+	if srv.MaxCount != 10 || !srv.StrictFields {
+		t.Errorf("Options were not applied: %+v", srv)
+	}
+	if srv.RequestTimeout != DefaultRequestTimeout {
+		t.Errorf("Got request timeout %v, want the default %v", srv.RequestTimeout, DefaultRequestTimeout)
+	}
+}
+
+func TestNewAppRejectsMisconfiguration(t *testing.T) {
+	missing := Provider("missing")
+	tests := map[string]struct {
+		config  ContentMix
+		clients map[Provider]Client
+		opts    []Option
+		wantErr string
+	}{
+		"empty config":                 {ContentMix{}, sampleClients(), nil, "at least one"},
+		"unknown provider":             {ContentMix{{Type: missing}}, sampleClients(), nil, "no client for provider missing"},
+		"unknown fallback":             {ContentMix{{Type: Provider1, Fallback: &missing}}, sampleClients(), nil, "no client for fallback provider missing"},
+		"unknown tier":                 {ContentMix{{Type: Provider1, Tiers: &ProviderTiers{{Provider1}, {missing}}}}, sampleClients(), nil, "no client for tier provider missing"},
+		"nil client":                   {ContentMix{config4}, map[Provider]Client{Provider1: nil}, nil, "is nil"},
+		"negative max count":           {DefaultConfig, sampleClients(), []Option{WithMaxCount(-1)}, "max count"},
+		"negative timeout":             {DefaultConfig, sampleClients(), []Option{WithRequestTimeout(-time.Second)}, "timeout"},
+		"negative provider timeout":    {DefaultConfig, sampleClients(), []Option{WithProviderTimeout(Provider1, -time.Second)}, "timeout for provider 1"},
+		"unknown default":              {DefaultConfig, sampleClients(), []Option{WithDefaultFallback(missing)}, "default fallback provider missing"},
+		"invalid named mix":            {DefaultConfig, sampleClients(), []Option{WithMix("tv", ContentMix{{Type: missing}})}, `mix "tv"`},
+		"over-fetch below 1":           {DefaultConfig, sampleClients(), []Option{WithOverFetch(0.5)}, "over-fetch"},
+		"unknown dedup field":          {DefaultConfig, sampleClients(), []Option{WithDeduplication("colour")}, "unknown field"},
+		"dedup priority without dedup": {DefaultConfig, sampleClients(), []Option{WithDeduplicationPriority(map[Provider]int{Provider2: 1})}, "requires deduplication"},
+		"inverted batch size":          {DefaultConfig, sampleClients(), []Option{WithBatchSize(Provider1, 5, 3)}, "batch size of provider 1"},
+		"unaligned batch maximum":      {DefaultConfig, sampleClients(), []Option{WithBatchSize(Provider1, 0, 12), WithBatchMultiple(Provider1, 5)}, "divide the max"},
+		"expensive with backfill":      {DefaultConfig, sampleClients(), []Option{WithExpensiveProviders(Provider2), WithBackfill(1)}, "expensive providers"},
+		"negative live interval":       {DefaultConfig, sampleClients(), []Option{WithLiveFeed(-time.Second)}, "live interval"},
+		"negative seen items":          {DefaultConfig, sampleClients(), []Option{WithSeenItems(-1, 0)}, "seen item limits"},
+		"negative logical total":       {DefaultConfig, sampleClients(), []Option{WithLogicalTotal(-1)}, "logical total"},
+		"relative content path":        {DefaultConfig, sampleClients(), []Option{WithContentPaths("feed")}, "content path"},
+		"queue without max":            {DefaultConfig, sampleClients(), []Option{WithRequestQueue(5, time.Second)}, "max in flight"},
+		"first to respond unsorted":    {DefaultConfig, sampleClients(), []Option{WithItemOrder(nil), func(a *App) { a.FirstToRespond = true }}, "item order"},
+		"first to respond strict":      {DefaultConfig, sampleClients(), []Option{WithFirstToRespond(byID), WithStrictMode()}, "strict mode"},
+	}
+
+	for name, test := range tests {
+		_, err := NewApp(test.config, test.clients, test.opts...)
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: Got error %v, want one containing %q", name, err, test.wantErr)
+		}
+	}
+}
+
+func TestCountAboveMaxCountIsRejected(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithMaxCount(4))
+
+	if response := runRawRequest(srv, "/?count=5"); response.Code != http.StatusBadRequest {
+		t.Errorf("Response code is %d, want 400", response.Code)
+	}
+	if response := runRawRequest(srv, "/?count=4"); response.Code != http.StatusOK {
+		t.Errorf("Response code is %d, want 200", response.Code)
+	}
+}
+
+func TestRequestTimeoutCutsOffSlowProviders(t *testing.T) {
+	clients := sampleClients()
+	clients[Provider2] = SlowContentProvider{Client: clients[Provider2], Delay: time.Second}
+	srv, _ := NewApp(ContentMix{config4, config2}, clients, WithRequestTimeout(50*time.Millisecond))
+
+	start := time.Now()
+	content := runRequest(t, srv, SimpleContentRequest)
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Request took %v, want it to stop waiting after the timeout", elapsed)
+	}
+	if len(content) != 1 {
+		t.Errorf("Got %d items back, want 1", len(content))
+	}
+}
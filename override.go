@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// overrideParam routes a provider's fetches to the client registered under
+// another key for one request, e.g. override=1:staging. It may be repeated or
+// list several overrides separated by commas. Overrides are only honoured
+// for requests carrying the AdminToken.
+const overrideParam = "override"
+
+type overridesKey struct{}
+
+// parseOverrides reads the client overrides of an admin request. Overrides
+// of other requests are ignored rather than rejected, so that they are
+// served as if they had not asked for any.
+func (a *App) parseOverrides(req *http.Request) (map[Provider]Provider, error) {
+	values := req.URL.Query()[overrideParam]
+	if len(values) == 0 {
+		return nil, nil
+	}
+	if a.AdminToken == "" || !a.isAdmin(req) {
+		logf(req.Context(), "ignoring client overrides of a request without admin token")
+		return nil, nil
+	}
+	overrides := map[Provider]Provider{}
+	for _, value := range values {
+		for _, pair := range strings.Split(value, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			parts := strings.SplitN(pair, ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("override %q must be given as provider:client", pair)
+			}
+			provider, target := Provider(strings.TrimSpace(parts[0])), Provider(strings.TrimSpace(parts[1]))
+			for _, key := range []Provider{provider, target} {
+				if _, ok := a.client(key); !ok {
+					return nil, fmt.Errorf("cannot override unknown provider %s", key)
+				}
+			}
+			overrides[provider] = target
+		}
+	}
+	return overrides, nil
+}
+
+func contextWithOverrides(ctx context.Context, overrides map[Provider]Provider) context.Context {
+	if len(overrides) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, overridesKey{}, overrides)
+}
+
+// overrideFor returns the key of the client which serves the provider's
+// fetches for the request of ctx
+func overrideFor(ctx context.Context, provider Provider) Provider {
+	overrides, _ := ctx.Value(overridesKey{}).(map[Provider]Provider)
+	if target, ok := overrides[provider]; ok {
+		return target
+	}
+	return provider
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const stagingProvider Provider = "staging"
+
+func overrideRequest(target, token string) *http.Request {
+	req := httptest.NewRequest("GET", target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func TestOverrideRoutesFetchesToTheAlternateClient(t *testing.T) {
+	production := &CountingContentProvider{Client: SampleContentProvider{Source: Provider1}}
+	staging := &CountingContentProvider{Client: SampleContentProvider{Source: stagingProvider}}
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: production, stagingProvider: staging}, WithAdminToken("secret"))
+
+	content := runRequest(t, srv, overrideRequest("/?count=3&override=1:staging", "secret"))
+
+	if len(content) != 3 {
+		t.Fatalf("Got %d items, want 3", len(content))
+	}
+	for i, item := range content {
+		if Provider(item.Source) != stagingProvider {
+			t.Errorf("Position %d: Got provider %s, want staging", i, item.Source)
+		}
+	}
+	if production.Calls() != 0 || staging.Calls() != 1 {
+		t.Errorf("Got %d production and %d staging calls, want only staging", production.Calls(), staging.Calls())
+	}
+}
+
+func TestUnauthorizedOverridesAreIgnored(t *testing.T) {
+	for name, token := range map[string]string{"no token": "", "wrong token": "guess"} {
+		production := &CountingContentProvider{Client: SampleContentProvider{Source: Provider1}}
+		staging := &CountingContentProvider{Client: SampleContentProvider{Source: stagingProvider}}
+		srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: production, stagingProvider: staging}, WithAdminToken("secret"))
+
+		response := httptest.NewRecorder()
+		srv.ServeHTTP(response, overrideRequest("/?count=3&override=1:staging", token))
+
+		if response.Code != http.StatusOK {
+			t.Errorf("%s: Got status %d, want 200", name, response.Code)
+		}
+		if production.Calls() != 1 || staging.Calls() != 0 {
+			t.Errorf("%s: Got %d production and %d staging calls, want only production", name, production.Calls(), staging.Calls())
+		}
+	}
+}
+
+func TestInvalidOverridesAreRejected(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{
+		Provider1:       SampleContentProvider{Source: Provider1},
+		stagingProvider: SampleContentProvider{Source: stagingProvider},
+	}, WithAdminToken("secret"))
+
+	for _, override := range []string{"1", "1:unknown", "4:staging"} {
+		response := httptest.NewRecorder()
+		srv.ServeHTTP(response, overrideRequest("/?count=1&override="+override, "secret"))
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("%s: Got status %d, want 400", override, response.Code)
+		}
+	}
+}
+
+func TestOverriddenPagesAreNotCached(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{
+		Provider1:       SampleContentProvider{Source: Provider1},
+		stagingProvider: SampleContentProvider{Source: stagingProvider},
+	}, WithAdminToken("secret"), WithCache(time.Minute))
+
+	runRequest(t, srv, overrideRequest("/?count=1&override=1:staging", "secret"))
+	content := runRequest(t, srv, overrideRequest("/?count=1", ""))
+
+	if len(content) != 1 || Provider(content[0].Source) != Provider1 {
+		t.Errorf("Got %s, want an item of provider 1", providerSequence(content))
+	}
+}
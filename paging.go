@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// PagingClient can be implemented by a Client whose provider pages through
+// its content, so that deeper pages of the server are served from deeper
+// pages of the provider rather than from its first one. GetPage returns up
+// to count items starting at the page token, which is empty for the first
+// page, along with the token of the following items, empty at the end.
+type PagingClient interface {
+	GetPage(ctx context.Context, userIP string, count int, token string) ([]*ContentItem, string, error)
+}
+
+// maxPageTokens bounds how many page tokens are kept per provider. Once it is
+// reached, tokens further into the content than all kept ones are dropped,
+// as the deepest pages are the least likely to be asked for.
+const maxPageTokens = 10000
+
+// maxPagedCalls bounds how many pages a single fetch walks through to reach
+// its offset, so that a deep offset without a token nearby fails rather than
+// keeping the provider busy
+const maxPagedCalls = 100
+
+// pageTokenStore remembers the page tokens providers returned by the
+// position of the provider's content they lead to, so that later requests
+// can start from the nearest one. Tokens are shared by all users. The zero
+// value is ready to use.
+type pageTokenStore struct {
+	mu        sync.Mutex
+	providers map[Provider]*providerPageTokens
+}
+
+// providerPageTokens are the page tokens of one provider along with the
+// positions they lead to in ascending order
+type providerPageTokens struct {
+	offsets []int
+	tokens  map[int]string
+}
+
+// nearest returns the furthest known token at or before offset, or the
+// start of the content
+func (s *pageTokenStore) nearest(provider Provider, offset int) (int, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	known := s.providers[provider]
+	if known == nil {
+		return 0, ""
+	}
+	// the index of the first offset beyond the requested one
+	i := sort.SearchInts(known.offsets, offset+1)
+	if i == 0 {
+		return 0, ""
+	}
+	start := known.offsets[i-1]
+	return start, known.tokens[start]
+}
+
+func (s *pageTokenStore) set(provider Provider, offset int, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.providers == nil {
+		s.providers = map[Provider]*providerPageTokens{}
+	}
+	known := s.providers[provider]
+	if known == nil {
+		known = &providerPageTokens{tokens: map[int]string{}}
+		s.providers[provider] = known
+	}
+	if _, ok := known.tokens[offset]; ok {
+		known.tokens[offset] = token
+		return
+	}
+	i := sort.SearchInts(known.offsets, offset)
+	if len(known.offsets) >= maxPageTokens {
+		last := len(known.offsets) - 1
+		if i > last {
+			return
+		}
+		delete(known.tokens, known.offsets[last])
+		known.offsets = known.offsets[:last]
+	}
+	known.offsets = append(known.offsets, 0)
+	copy(known.offsets[i+1:], known.offsets[i:])
+	known.offsets[i] = offset
+	known.tokens[offset] = token
+}
+
+type configOffsetsKey struct{}
+
+// configOffsets returns for every config of the laid out config how many
+// items it served before the organic offset, which is where its provider's
+// content continues
+func configOffsets(config ContentMix, offset int) map[ContentConfig]int {
+	offsets := map[ContentConfig]int{}
+	if len(config) == 0 {
+		return offsets
+	}
+	cycles := offset / len(config)
+	for i, c := range config {
+		offsets[c] += cycles
+		if i < offset%len(config) {
+			offsets[c]++
+		}
+	}
+	return offsets
+}
+
+func contextWithConfigOffsets(ctx context.Context, offsets map[ContentConfig]int) context.Context {
+	return context.WithValue(ctx, configOffsetsKey{}, offsets)
+}
+
+// configOffset returns the position of the provider's content the config's
+// fetch for the request of ctx starts at
+func configOffset(ctx context.Context, config ContentConfig) int {
+	offsets, _ := ctx.Value(configOffsetsKey{}).(map[ContentConfig]int)
+	return offsets[config]
+}
+
+// errPagedTooDeep is returned when the offset of a paged fetch is more than
+// maxPagedCalls pages away from the nearest known token
+var errPagedTooDeep = errors.New("offset is too far from any known page")
+
+// getPaged fetches count items from the offset of a paging provider's
+// content, or more if the last page reaches beyond them. It pages from the
+// nearest known token, asking for at most count items per page, skipping the
+// items before offset, and remembers the tokens it gets on the way. The calls
+// count towards the provider's metrics like those of getContent, but are
+// neither batched, retried nor coalesced.
+func (a *App) getPaged(ctx context.Context, provider Provider, client PagingClient, userIP string, offset, count int) (_ []*ContentItem, err error) {
+	defer recoverProviderPanic(ctx, provider, &err)
+	start, token := a.pageTokens.nearest(provider, offset)
+	if start < offset {
+		logf(ctx, "paging provider %s from offset %d to %d", provider, start, offset)
+	}
+	// position is where the page token leads to in the provider's content
+	position := start
+	var items []*ContentItem
+	for calls := 0; len(items) < count; calls++ {
+		if calls == maxPagedCalls {
+			return nil, errPagedTooDeep
+		}
+		pageSize := offset + count - position
+		if pageSize > count {
+			pageSize = count
+		}
+		elapsed := a.Metrics.startTimer()
+		page, next, err := client.GetPage(ctx, userIP, pageSize, token)
+		a.Metrics.observeProvider(provider, elapsed())
+		if err != nil {
+			a.Metrics.observeProviderError(provider, classifyError(err))
+			return nil, err
+		}
+		skip := offset - position
+		if skip < 0 {
+			skip = 0
+		} else if skip > len(page) {
+			skip = len(page)
+		}
+		items = append(items, page[skip:]...)
+		position += len(page)
+		if next == "" || len(page) == 0 {
+			break
+		}
+		a.pageTokens.set(provider, position, next)
+		token = next
+	}
+	return items, nil
+}
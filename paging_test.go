@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// PagingContentProvider serves items 0, 1, 2, ... in pages of at most
+// PageSize, or of the requested count if it is 0, whose tokens are the
+// position they start at, and records the tokens and counts it is asked for
+type PagingContentProvider struct {
+	PageSize int
+
+	mu     sync.Mutex
+	tokens []string
+	counts []int
+}
+
+func (cp *PagingContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	items, _, err := cp.GetPage(ctx, userIP, count, "")
+	return items, err
+}
+
+func (cp *PagingContentProvider) GetPage(ctx context.Context, userIP string, count int, token string) ([]*ContentItem, string, error) {
+	cp.mu.Lock()
+	cp.tokens = append(cp.tokens, token)
+	cp.counts = append(cp.counts, count)
+	cp.mu.Unlock()
+
+	start := 0
+	if token != "" {
+		start, _ = strconv.Atoi(strings.TrimPrefix(token, "at"))
+	}
+	if cp.PageSize > 0 && count > cp.PageSize {
+		count = cp.PageSize
+	}
+	items := make([]*ContentItem, count)
+	for i := range items {
+		items[i] = &ContentItem{ID: fmt.Sprintf("i%d", start+i), Source: string(Provider1)}
+	}
+	return items, fmt.Sprintf("at%d", start+count), nil
+}
+
+func (cp *PagingContentProvider) Tokens() string {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return strings.Join(cp.tokens, ",")
+}
+
+func TestPagingProviderIsAskedForTheRequestedOffset(t *testing.T) {
+	provider := &PagingContentProvider{PageSize: 2}
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: provider})
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?offset=4&count=3", nil))
+
+	if ids := itemIDs(content); ids != "i4,i5,i6" {
+		t.Errorf("Got items %s, want i4,i5,i6", ids)
+	}
+	if tokens := provider.Tokens(); tokens != ",at2,at4,at6" {
+		t.Errorf("Got tokens %q, want the provider paged from the start", tokens)
+	}
+
+	provider.tokens = nil
+	content = runRequest(t, srv, httptest.NewRequest("GET", "/?offset=6&count=2", nil))
+
+	if ids := itemIDs(content); ids != "i6,i7" {
+		t.Errorf("Got items %s, want i6,i7", ids)
+	}
+	if tokens := provider.Tokens(); tokens != "at6" {
+		t.Errorf("Got tokens %q, want the page at offset 6 straight away", tokens)
+	}
+}
+
+func TestPagingProvidersContinueFromTheirShareOfTheOffset(t *testing.T) {
+	provider := &PagingContentProvider{PageSize: 10}
+	srv, _ := NewApp(ContentMix{config4, {Type: Provider2}}, map[Provider]Client{
+		Provider1: provider,
+		Provider2: SampleContentProvider{Source: Provider2},
+	})
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?offset=5&count=4", nil))
+
+	// of the first 5 items, provider 1 served 3 at positions 0, 2 and 4
+	var ids []string
+	for _, item := range content {
+		if Provider(item.Source) == Provider1 {
+			ids = append(ids, item.ID)
+		}
+	}
+	if got := strings.Join(ids, ","); got != "i3,i4" {
+		t.Errorf("Got items %s of provider 1, want i3,i4", got)
+	}
+}
+
+func TestPagingProviderIsAskedForAtMostTheCountPerPage(t *testing.T) {
+	provider := &PagingContentProvider{}
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: provider})
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?offset=7&count=3", nil))
+
+	if ids := itemIDs(content); ids != "i7,i8,i9" {
+		t.Errorf("Got items %s, want i7,i8,i9", ids)
+	}
+	if tokens := provider.Tokens(); tokens != ",at3,at6,at9" {
+		t.Errorf("Got tokens %q, want pages of 3 from the start", tokens)
+	}
+	for _, count := range provider.counts {
+		if count > 3 {
+			t.Errorf("Provider was asked for a page of %d items, want at most 3", count)
+		}
+	}
+}
+
+func TestPagingTooFarFromAKnownTokenFails(t *testing.T) {
+	provider := &PagingContentProvider{}
+	srv, _ := NewApp(ContentMix{config1}, map[Provider]Client{
+		Provider1: provider,
+		Provider2: SampleContentProvider{Source: Provider2},
+	})
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?offset=1000000&count=1", nil))
+
+	if sources := providerSequence(content); sources != "2" {
+		t.Errorf("Got providers %s, want the fallback", sources)
+	}
+	if calls := len(provider.counts); calls != maxPagedCalls {
+		t.Errorf("Provider was asked for %d pages, want %d", calls, maxPagedCalls)
+	}
+}
+
+func TestPageTokenStoreFindsTheNearestTokenAndIsBounded(t *testing.T) {
+	var store pageTokenStore
+	for offset := maxPageTokens; offset >= 1; offset-- {
+		store.set(Provider1, offset*10, "at"+strconv.Itoa(offset*10))
+	}
+	store.set(Provider1, 5, "at5")
+
+	if start, token := store.nearest(Provider1, 27); start != 20 || token != "at20" {
+		t.Errorf("Got token %q at %d, want at20", token, start)
+	}
+	if start, token := store.nearest(Provider1, 3); start != 0 || token != "" {
+		t.Errorf("Got token %q at %d, want the start", token, start)
+	}
+	if start, _ := store.nearest(Provider1, maxPageTokens*10); start != (maxPageTokens-1)*10 {
+		t.Errorf("Got token at %d, want the deepest one dropped for the shallower one", start)
+	}
+	if start, _ := store.nearest(Provider2, 27); start != 0 {
+		t.Errorf("Got token at %d of another provider", start)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// prometheusContentType is the version of the Prometheus text format written
+// by writePrometheus
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// wantsPrometheus reports whether the client accepts the Prometheus text
+// format, as Prometheus scrapers say with their Accept header, or asks for
+// it explicitly with format=prometheus
+func wantsPrometheus(req *http.Request) bool {
+	if req.URL.Query().Get("format") == "prometheus" {
+		return true
+	}
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") || strings.Contains(accept, "application/openmetrics-text")
+}
+
+// writePrometheus writes the metrics in the Prometheus text format. Series
+// are only labelled by provider and by one of a fixed set of outcomes or
+// error classes, never by anything taken from requests, so there are at most
+// providers * (1 + 3 + 1 + 1 + 6) series besides the request histograms and
+// the truncation counters.
+func writePrometheus(w io.Writer, snapshot metricsSnapshot) {
+	writePrometheusHistogram(w, "content_request_duration_seconds",
+		"Duration of content requests.", map[string]histogramSnapshot{"": snapshot.RequestDuration})
+
+	writePrometheusHistogram(w, "content_requested_count",
+		"Counts asked for by content requests.", map[string]histogramSnapshot{"": snapshot.RequestedCount.asHistogram()})
+	writePrometheusHistogram(w, "content_requested_offset",
+		"Offsets asked for by content requests.", map[string]histogramSnapshot{"": snapshot.RequestedOffset.asHistogram()})
+
+	durations := map[string]histogramSnapshot{}
+	for provider, histogram := range snapshot.ProviderDuration {
+		durations[string(provider)] = histogram
+	}
+	writePrometheusHistogram(w, "content_provider_call_duration_seconds",
+		"Duration of calls to providers.", durations)
+
+	fmt.Fprintln(w, "# HELP content_provider_fetches_total Fetches for configs by primary provider and outcome.")
+	fmt.Fprintln(w, "# TYPE content_provider_fetches_total counter")
+	var providers []Provider
+	for provider := range snapshot.ProviderOutcomes {
+		providers = append(providers, provider)
+	}
+	for _, provider := range sortProviders(providers) {
+		for _, outcome := range []fetchOutcome{outcomeSuccess, outcomeFallback, outcomeFailure} {
+			fmt.Fprintf(w, "content_provider_fetches_total{provider=\"%s\",outcome=\"%s\"} %d\n",
+				escapeLabel(string(provider)), outcome, snapshot.ProviderOutcomes[provider][outcome])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP content_provider_degraded_total Pages for which fewer items were requested from a slow provider.")
+	fmt.Fprintln(w, "# TYPE content_provider_degraded_total counter")
+	providers = providers[:0]
+	for provider := range snapshot.ProviderDegraded {
+		providers = append(providers, provider)
+	}
+	for _, provider := range sortProviders(providers) {
+		fmt.Fprintf(w, "content_provider_degraded_total{provider=\"%s\"} %d\n",
+			escapeLabel(string(provider)), snapshot.ProviderDegraded[provider])
+	}
+
+	fmt.Fprintln(w, "# HELP content_provider_invalid_items_total Items of providers which failed validation.")
+	fmt.Fprintln(w, "# TYPE content_provider_invalid_items_total counter")
+	providers = providers[:0]
+	for provider := range snapshot.ProviderInvalid {
+		providers = append(providers, provider)
+	}
+	for _, provider := range sortProviders(providers) {
+		fmt.Fprintf(w, "content_provider_invalid_items_total{provider=\"%s\"} %d\n",
+			escapeLabel(string(provider)), snapshot.ProviderInvalid[provider])
+	}
+
+	fmt.Fprintln(w, "# HELP content_pages_truncated_total Pages cut off because their providers ran out of items.")
+	fmt.Fprintln(w, "# TYPE content_pages_truncated_total counter")
+	fmt.Fprintf(w, "content_pages_truncated_total %d\n", snapshot.TruncatedPages)
+	fmt.Fprintln(w, "# HELP content_truncated_items_total Items missing from truncated pages.")
+	fmt.Fprintln(w, "# TYPE content_truncated_items_total counter")
+	fmt.Fprintf(w, "content_truncated_items_total %d\n", snapshot.TruncatedItems)
+
+	fmt.Fprintln(w, "# HELP content_provider_errors_total Failed calls to providers by error class.")
+	fmt.Fprintln(w, "# TYPE content_provider_errors_total counter")
+	providers = providers[:0]
+	for provider := range snapshot.ProviderErrors {
+		providers = append(providers, provider)
+	}
+	for _, provider := range sortProviders(providers) {
+		classes := make([]string, 0, len(snapshot.ProviderErrors[provider]))
+		for class := range snapshot.ProviderErrors[provider] {
+			classes = append(classes, string(class))
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			fmt.Fprintf(w, "content_provider_errors_total{provider=\"%s\",class=\"%s\"} %d\n",
+				escapeLabel(string(provider)), class, snapshot.ProviderErrors[provider][errorClass(class)])
+		}
+	}
+}
+
+// writePrometheusHistogram writes one histogram per provider label, or a
+// single unlabelled one for the empty label
+func writePrometheusHistogram(w io.Writer, name, help string, histograms map[string]histogramSnapshot) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+
+	labels := make([]string, 0, len(histograms))
+	for label := range histograms {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		histogram := histograms[label]
+		providerLabel := ""
+		if label != "" {
+			providerLabel = fmt.Sprintf("provider=\"%s\",", escapeLabel(label))
+		}
+		for _, bucket := range histogram.Buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, providerLabel, bucket.Le, bucket.Count)
+		}
+		braced := ""
+		if providerLabel != "" {
+			braced = "{" + strings.TrimSuffix(providerLabel, ",") + "}"
+		}
+		fmt.Fprintf(w, "%s_sum%s %g\n", name, braced, histogram.SumSeconds)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, braced, histogram.Count)
+	}
+}
+
+// asHistogram converts the snapshot for writePrometheusHistogram, whose sum
+// is then the plain sum of the observed numbers rather than seconds
+func (s countHistogramSnapshot) asHistogram() histogramSnapshot {
+	return histogramSnapshot{Buckets: s.Buckets, Count: s.Count, SumSeconds: float64(s.Sum)}
+}
+
+func sortProviders(providers []Provider) []Provider {
+	sort.Slice(providers, func(i, j int) bool { return providers[i] < providers[j] })
+	return providers
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value for the Prometheus text format
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrapePrometheus(t *testing.T, srv http.Handler) string {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "text/plain;version=0.0.4;q=0.5,*/*;q=0.1")
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, req)
+
+	if contentType := response.Header().Get("Content-Type"); contentType != prometheusContentType {
+		t.Errorf("Got Content-Type %q, want %q", contentType, prometheusContentType)
+	}
+	return response.Body.String()
+}
+
+func TestPrometheusMetricsAreLabelledByProviderAndOutcome(t *testing.T) {
+	srv, _ := NewApp(
+		ContentMix{{Type: Provider1, Fallback: &Provider2}, {Type: Provider3}},
+		map[Provider]Client{
+			Provider1: ErroringContentProvider{Err: &ProviderUnavailableError{}},
+			Provider2: SampleContentProvider{Source: Provider2},
+			Provider3: SampleContentProvider{Source: Provider3},
+		},
+	)
+	runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	body := scrapePrometheus(t, srv)
+
+	for _, want := range []string{
+		"# TYPE content_request_duration_seconds histogram",
+		`content_request_duration_seconds_bucket{le="+Inf"} 1`,
+		"content_request_duration_seconds_count 1",
+		"# TYPE content_provider_call_duration_seconds histogram",
+		`content_provider_call_duration_seconds_count{provider="2"} 1`,
+		"# TYPE content_provider_fetches_total counter",
+		`content_provider_fetches_total{provider="1",outcome="fallback"} 1`,
+		`content_provider_fetches_total{provider="1",outcome="success"} 0`,
+		`content_provider_fetches_total{provider="3",outcome="success"} 1`,
+		"# TYPE content_provider_errors_total counter",
+		`content_provider_errors_total{provider="1",class="unavailable"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Metrics do not contain %q:\n%s", want, body)
+		}
+	}
+	for _, line := range strings.Split(body, "\n") {
+		if strings.Contains(line, "ip=") || strings.Contains(line, "request_id=") {
+			t.Errorf("Got a request specific label: %s", line)
+		}
+	}
+}
+
+func TestPrometheusMetricsCountTruncatedPages(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: fixedItems(Provider1, "a", "b")})
+	runRequest(t, srv, httptest.NewRequest("GET", "/?count=5", nil))
+
+	body := scrapePrometheus(t, srv)
+
+	for _, want := range []string{
+		"# TYPE content_pages_truncated_total counter",
+		"content_pages_truncated_total 1\n",
+		"# TYPE content_truncated_items_total counter",
+		"content_truncated_items_total 3\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Metrics do not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestRecreatedAppsExposeTheirOwnMetrics(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		srv, err := NewApp(DefaultConfig, sampleClients())
+		if err != nil {
+			t.Fatalf("NewApp failed: %v", err)
+		}
+		runRequest(t, srv, SimpleContentRequest)
+
+		if body := scrapePrometheus(t, srv); !strings.Contains(body, "content_request_duration_seconds_count 1\n") {
+			t.Errorf("App %d: Got metrics which do not count exactly its one request:\n%s", i, body)
+		}
+	}
+}
+
+func TestLabelValuesAreEscaped(t *testing.T) {
+	if escaped := escapeLabel(`a"b\c` + "\n"); escaped != `a\"b\\c\n` {
+		t.Errorf("Got %s", escaped)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// waitForSlot queues a request while the server is at its MaxInFlight, and
+// reports whether a slot became free within the MaxQueueWait. Requests
+// which find MaxQueued others waiting already are not queued.
+func (a *App) waitForSlot(ctx context.Context) bool {
+	if a.MaxQueued <= 0 {
+		return false
+	}
+	defer atomic.AddInt64(&a.queuedRequests, -1)
+	if queued := atomic.AddInt64(&a.queuedRequests, 1); queued > int64(a.MaxQueued) {
+		logf(ctx, "request queue is full")
+		return false
+	}
+
+	timer := time.NewTimer(a.MaxQueueWait)
+	defer timer.Stop()
+	for {
+		// the signal is taken before checking for a slot, so that a slot
+		// freed in between still wakes the request
+		freed := a.slotFreedSignal()
+		if a.takeSlot() {
+			return true
+		}
+		select {
+		case <-freed:
+		case <-timer.C:
+			logf(ctx, "no slot became free within %v", a.MaxQueueWait)
+			return a.takeSlot()
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// slotFreedSignal returns a channel which is closed once the next request
+// finishes. Every queued request is woken up and checks for a slot, as
+// there is no telling which of them gets it.
+func (a *App) slotFreedSignal() <-chan struct{} {
+	a.slotMu.Lock()
+	defer a.slotMu.Unlock()
+	if a.slotFreed == nil {
+		a.slotFreed = make(chan struct{})
+	}
+	return a.slotFreed
+}
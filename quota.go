@@ -0,0 +1,70 @@
+package main
+
+import "context"
+
+// applyQuota reassigns the slots of the mix which would take more than
+// MaxItemsPerProvider items from the provider which delivered for their
+// config to the first config of the mix whose provider is still below the
+// quota, and fetches whatever those configs need in addition. Slots for
+// which every provider reached the quota are left out, cutting the page off.
+// It returns the mix to assemble the page with.
+func (a *App) applyQuota(ctx context.Context, request pageRequest, mix ContentMix, contents FetchedContentsMap) ContentMix {
+	configs := distinctConfigs(mix, getCountsPerConfig(mix))
+	taken := map[Provider]int{}
+	quotaMix := make(ContentMix, 0, len(mix))
+	reassigned := 0
+	for _, slot := range mix {
+		fetched := contents[slot]
+		if fetched == nil || fetched.Failed {
+			quotaMix = append(quotaMix, slot)
+			continue
+		}
+		if taken[fetched.Provider] >= a.MaxItemsPerProvider {
+			alternative, ok := a.belowQuota(configs, contents, taken)
+			if !ok {
+				break
+			}
+			slot, fetched = alternative, contents[alternative]
+			reassigned++
+		}
+		taken[fetched.Provider]++
+		quotaMix = append(quotaMix, slot)
+	}
+	if reassigned == 0 {
+		return quotaMix
+	}
+
+	// configs which failed or timed out keep their slots empty
+	missing := getMissingCounts(quotaMix, contents)
+	for config := range missing {
+		if fetched := contents[config]; fetched == nil || fetched.Failed {
+			delete(missing, config)
+		}
+	}
+	logf(ctx, "provider quota moved %d slots, fetching more for %d configs", reassigned, len(missing))
+	// the goroutines may outlive the request, so they get copies of contents
+	previous := FetchedContentsMap{}
+	for config := range missing {
+		snapshot := *contents[config]
+		previous[config] = &snapshot
+	}
+	fetchedMore := a.fanOut(ctx, quotaMix, missing, func(config ContentConfig, count int) *FetchedContents {
+		return a.fetchMoreForConfig(ctx, previous[config], count, request.userIP)
+	})
+	for config, fetched := range fetchedMore {
+		contents[config] = fetched
+	}
+	return quotaMix
+}
+
+// belowQuota returns the first of configs which delivered and whose
+// provider has not reached the MaxItemsPerProvider yet
+func (a *App) belowQuota(configs []ContentConfig, contents FetchedContentsMap, taken map[Provider]int) (ContentConfig, bool) {
+	for _, config := range configs {
+		fetched := contents[config]
+		if fetched != nil && !fetched.Failed && taken[fetched.Provider] < a.MaxItemsPerProvider {
+			return config, true
+		}
+	}
+	return ContentConfig{}, false
+}
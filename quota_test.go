@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProviderQuotaRedistributesSlots(t *testing.T) {
+	dominant := &CountingContentProvider{Client: SampleContentProvider{Source: Provider1}}
+	other := &CountingContentProvider{Client: SampleContentProvider{Source: Provider2}}
+	clients := map[Provider]Client{Provider1: dominant, Provider2: other}
+	mix := ContentMix{config4, config4, config4, {Type: Provider2}}
+
+	unlimited, _ := NewApp(mix, clients)
+	if sources := providerSequence(runRequest(t, unlimited, httptest.NewRequest("GET", "/?count=4", nil))); sources != "1112" {
+		t.Fatalf("Got providers %s without quota, want 1112", sources)
+	}
+
+	calls := other.Calls()
+	srv, _ := NewApp(mix, clients, WithProviderQuota(2))
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	if sources := providerSequence(content); sources != "1122" {
+		t.Errorf("Got providers %s, want 1122", sources)
+	}
+	// provider 2 was asked for its one slot first, then for the moved one
+	if calls := other.Calls() - calls; calls != 2 {
+		t.Errorf("Provider 2 was called %d times, want twice", calls)
+	}
+}
+
+func TestProviderQuotaAppliesToStreamedPages(t *testing.T) {
+	clients := map[Provider]Client{Provider1: SampleContentProvider{Source: Provider1}, Provider2: SampleContentProvider{Source: Provider2}}
+	srv, _ := NewApp(ContentMix{config4, config4, config4, {Type: Provider2}}, clients, WithProviderQuota(2), WithStreaming(1))
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	if sources := providerSequence(content); sources != "1122" {
+		t.Errorf("Got providers %s, want 1122", sources)
+	}
+}
+
+func TestProviderQuotaLeavesTimedOutConfigsOut(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	clients := sampleClients()
+	clients[Provider2] = HangingContentProvider{Release: release}
+	srv, _ := NewApp(ContentMix{config4, config4, config4, {Type: Provider3}, {Type: Provider2}}, clients,
+		WithProviderQuota(2), WithRequestTimeout(50*time.Millisecond))
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=5", nil))
+
+	// the moved slot is not filled, as the request timed out by then
+	if sources := providerSequence(content); sources != "113" {
+		t.Errorf("Got providers %s, want 113", sources)
+	}
+}
+
+func TestProviderQuotaCutsThePageOffOnceEveryProviderReachedIt(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4, {Type: Provider2}}, sampleClients(), WithProviderQuota(2))
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=6", nil))
+
+	if sources := providerSequence(content); sources != "1212" {
+		t.Errorf("Got providers %s, want 1212", sources)
+	}
+}
+
+func TestProviderQuotaCountsFallbacksOfSeveralConfigs(t *testing.T) {
+	clients := sampleClients()
+	clients[Provider1] = FailingContentProvider{}
+	// config1 falls back to 2, which also serves config2
+	srv, _ := NewApp(ContentMix{config1, config2, config3}, clients, WithProviderQuota(1))
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=3", nil))
+
+	if sources := providerSequence(content); sources != "23" {
+		t.Errorf("Got providers %s, want 23", sources)
+	}
+}
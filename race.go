@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type lostRaceKey struct{}
+
+// raceProviders calls all providers of chain at once and returns their
+// attempts in the order they finished, up to the first which delivered. The
+// providers still running then are cancelled. If all of them fail, every
+// attempt is returned.
+func (a *App) raceProviders(ctx context.Context, chain []Provider, userIP string, offset, count int) []providerAttempt {
+	lost := new(int32)
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, lostRaceKey{}, lost))
+	defer cancel()
+
+	results := make(chan providerAttempt, len(chain))
+	for _, provider := range chain {
+		go func(provider Provider) {
+			items, err := a.tryProvider(ctx, provider, userIP, offset, count)
+			results <- providerAttempt{provider: provider, items: items, err: err}
+		}(provider)
+	}
+
+	attempts := make([]providerAttempt, 0, len(chain))
+	for range chain {
+		attempt := <-results
+		attempts = append(attempts, attempt)
+		if attempt.err == nil {
+			if running := len(chain) - len(attempts); running > 0 {
+				logf(ctx, "provider %s delivered first, cancelling %d others", attempt.provider, running)
+			}
+			atomic.StoreInt32(lost, 1)
+			break
+		}
+	}
+	return attempts
+}
+
+// lostRace reports whether ctx belongs to a provider call which was
+// cancelled because another provider won the race, see raceProviders
+func lostRace(ctx context.Context) bool {
+	lost, _ := ctx.Value(lostRaceKey{}).(*int32)
+	return lost != nil && atomic.LoadInt32(lost) == 1
+}
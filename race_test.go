@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// CancelRecordingContentProvider closes Called once it is called, blocks
+// until its context is done and then sends the context's error
+type CancelRecordingContentProvider struct {
+	Called    chan struct{}
+	Cancelled chan error
+}
+
+func (cp CancelRecordingContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	close(cp.Called)
+	<-ctx.Done()
+	cp.Cancelled <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestRacingTiersCancelTheLoser(t *testing.T) {
+	loser := CancelRecordingContentProvider{Called: make(chan struct{}), Cancelled: make(chan error, 1)}
+	// the winner only responds once the loser is called, so that it is
+	// cancelled in the middle of its call
+	winner := GatedContentProvider{Client: SampleContentProvider{Source: Provider2}, Release: loser.Called}
+	clients := map[Provider]Client{Provider1: loser, Provider2: winner}
+	srv, _ := NewApp(ContentMix{config1}, clients, WithRacingTiers(), WithRequestTimeout(time.Minute))
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=3", nil))
+
+	if sources := providerSequence(content); sources != "222" {
+		t.Errorf("Got providers %s, want the fallback 2 which delivered first", sources)
+	}
+	select {
+	case err := <-loser.Cancelled:
+		if err != context.Canceled {
+			t.Errorf("Got loser's context error %v, want it cancelled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Loser's context was not cancelled after the winner responded")
+	}
+	if errors := srv.Metrics.snapshot().ProviderErrors[Provider1]; len(errors) != 0 {
+		t.Errorf("Got errors %v for the cancelled loser, want none", errors)
+	}
+}
+
+func TestRacingTiersUseThePrimaryIfItDeliversFirst(t *testing.T) {
+	clients := map[Provider]Client{
+		Provider1: SampleContentProvider{Source: Provider1},
+		Provider2: SlowContentProvider{Client: SampleContentProvider{Source: Provider2}, Delay: time.Minute},
+	}
+	srv, _ := NewApp(ContentMix{config1}, clients, WithRacingTiers())
+
+	start := time.Now()
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=2", nil))
+
+	if sources := providerSequence(content); sources != "11" {
+		t.Errorf("Got providers %s, want the primary 1", sources)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Request took %v, want it not to wait for the slow fallback", elapsed)
+	}
+}
+
+func TestRacingTiersFailOnlyIfAllProvidersFail(t *testing.T) {
+	clients := map[Provider]Client{Provider1: FailingContentProvider{}, Provider2: FailingContentProvider{}}
+	srv, _ := NewApp(ContentMix{config1, config1}, clients, WithRacingTiers())
+
+	if content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=2", nil)); len(content) != 0 {
+		t.Errorf("Got %d items, want none", len(content))
+	}
+	outcomes := srv.Metrics.snapshot().ProviderOutcomes[Provider1]
+	if outcomes[outcomeFailure] != 1 {
+		t.Errorf("Got outcomes %v, want one failure", outcomes)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// rangeUnit is the unit of the Range header of content requests, e.g.
+// "Range: items=10-14" asks for the items at positions 10 to 14
+const rangeUnit = "items"
+
+// RangePolicy describes how to handle ranges spanning more than MaxCount
+// items
+type RangePolicy int
+
+const (
+	// RejectOversizedRange responds with 416
+	RejectOversizedRange RangePolicy = iota
+	// ClampOversizedRange serves the first MaxCount items of the range
+	ClampOversizedRange
+)
+
+// rangeNotSatisfiableError is returned for ranges which cannot be served,
+// as opposed to malformed ones
+type rangeNotSatisfiableError struct {
+	message string
+}
+
+func (e rangeNotSatisfiableError) Error() string {
+	return e.message
+}
+
+// parseRange reads the count and offset from an items Range header, which
+// takes the place of the count and offset URL parameters. Headers of other
+// units are ignored, as HTTP asks for. Only a single range with both ends
+// given is supported, as the content may have no end to count from. Ranges
+// reaching past the LogicalTotal are cut short there.
+func (a *App) parseRange(req *http.Request) (count int, offset int, ranged bool, err error) {
+	header := req.Header.Get("Range")
+	if !strings.HasPrefix(header, rangeUnit+"=") {
+		return 0, 0, false, nil
+	}
+	query := req.URL.Query()
+	for _, name := range []string{"count", "offset", "cursor"} {
+		if _, ok := query[name]; ok {
+			return 0, 0, false, fmt.Errorf("range cannot be combined with %s", name)
+		}
+	}
+
+	bounds := strings.Split(strings.TrimPrefix(header, rangeUnit+"="), "-")
+	if len(bounds) != 2 {
+		return 0, 0, false, errors.New("range must be given as items=start-end")
+	}
+	start, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil || start < 0 {
+		return 0, 0, false, errors.New("range start must be a non-negative integer")
+	}
+	end, err := strconv.Atoi(strings.TrimSpace(bounds[1]))
+	if err != nil || end < 0 {
+		return 0, 0, false, errors.New("range end must be a non-negative integer")
+	}
+	if end >= maxContentPosition {
+		return 0, 0, false, rangeNotSatisfiableError{fmt.Sprintf("range must end before %d", maxContentPosition)}
+	}
+	if end < start {
+		return 0, 0, false, rangeNotSatisfiableError{fmt.Sprintf("range ends at %d before its start %d", end, start)}
+	}
+	if a.LogicalTotal > 0 && start >= a.LogicalTotal {
+		return 0, 0, false, rangeNotSatisfiableError{fmt.Sprintf("range starts past the end of the content at %d", a.LogicalTotal)}
+	}
+
+	count = end - start + 1
+	if a.MaxCount > 0 && count > a.MaxCount {
+		if a.RangePolicy != ClampOversizedRange {
+			return 0, 0, false, rangeNotSatisfiableError{fmt.Sprintf("range must not span more than %d items", a.MaxCount)}
+		}
+		count = a.MaxCount
+	}
+	return count, start, true, nil
+}
+
+// sendContentRequestError responds to a content request which could not be
+// parsed
+func (a *App) sendContentRequestError(w http.ResponseWriter, err error) {
+	var unsatisfiable rangeNotSatisfiableError
+	if errors.As(err, &unsatisfiable) {
+		w.Header().Set("Content-Range", fmt.Sprintf("%s */%s", rangeUnit, a.rangeTotal()))
+		sendError(w, http.StatusRequestedRangeNotSatisfiable, err.Error())
+		return
+	}
+	sendBadRequest(w, err.Error())
+}
+
+// contentRange returns the Content-Range of returned items starting at
+// offset
+func (a *App) contentRange(offset int, returned int) string {
+	return fmt.Sprintf("%s %d-%d/%s", rangeUnit, offset, offset+returned-1, a.rangeTotal())
+}
+
+// rangeTotal returns the LogicalTotal for Content-Range headers, which is
+// unknown if the content has no end
+func (a *App) rangeTotal() string {
+	if a.LogicalTotal <= 0 {
+		return "*"
+	}
+	return strconv.Itoa(a.LogicalTotal)
+}
+
+// partialContentWriter sends a 206 instead of the 200 a response would get,
+// leaving other statuses alone
+type partialContentWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *partialContentWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status == http.StatusOK {
+		status = http.StatusPartialContent
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *partialContentWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.ResponseWriter.Write(p)
+}
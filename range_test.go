@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func runRangeRequest(srv http.Handler, target string, itemRange string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", target, nil)
+	request.Header.Set("Range", itemRange)
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, request)
+	return response
+}
+
+func TestRangeServesSliceAsPartialContent(t *testing.T) {
+	response := runRangeRequest(app, "/", "items=10-14")
+
+	if response.Code != http.StatusPartialContent {
+		t.Fatalf("Got status %d, want 206", response.Code)
+	}
+	if got := response.Header().Get("Content-Range"); got != "items 10-14/*" {
+		t.Errorf("Got Content-Range %q, want items 10-14/*", got)
+	}
+	var content []*ContentItem
+	if err := json.NewDecoder(response.Body).Decode(&content); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	want := runRequest(t, app, httptest.NewRequest("GET", "/?offset=10&count=5", nil))
+	if len(content) != len(want) {
+		t.Fatalf("Got %d items, want %d", len(content), len(want))
+	}
+	for i, item := range content {
+		if item.Source != want[i].Source {
+			t.Errorf("Position %d: Got source %s, want %s", i, item.Source, want[i].Source)
+		}
+	}
+}
+
+func TestRangeEndingBeforeItsStartIsNotSatisfiable(t *testing.T) {
+	response := runRangeRequest(app, "/", "items=14-10")
+
+	if response.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Got status %d, want 416", response.Code)
+	}
+	if got := response.Header().Get("Content-Range"); got != "items */*" {
+		t.Errorf("Got Content-Range %q, want items */*", got)
+	}
+}
+
+func TestOversizedRangeIsRejectedByDefault(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithMaxCount(5))
+
+	if response := runRangeRequest(srv, "/", "items=0-5"); response.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Got status %d, want 416", response.Code)
+	}
+	if response := runRangeRequest(srv, "/", "items=0-4"); response.Code != http.StatusPartialContent {
+		t.Errorf("Got status %d for a range at the limit, want 206", response.Code)
+	}
+}
+
+func TestOverflowingRangeIsNotSatisfiable(t *testing.T) {
+	limited, _ := NewApp(DefaultConfig, sampleClients(), WithMaxCount(5))
+	unlimited, _ := NewApp(DefaultConfig, sampleClients(), WithMaxCount(0))
+
+	for name, srv := range map[string]*App{"limited": limited, "unlimited": unlimited} {
+		for _, itemRange := range []string{"items=0-9223372036854775807", "items=0-1000000000000"} {
+			if response := runRangeRequest(srv, "/", itemRange); response.Code != http.StatusRequestedRangeNotSatisfiable {
+				t.Errorf("%s %s: Got status %d, want 416", name, itemRange, response.Code)
+			}
+		}
+	}
+}
+
+func TestOversizedRangeIsClampedByPolicy(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithMaxCount(5), WithRangePolicy(ClampOversizedRange))
+
+	response := runRangeRequest(srv, "/", "items=10-19")
+
+	if response.Code != http.StatusPartialContent {
+		t.Fatalf("Got status %d, want 206", response.Code)
+	}
+	if got := response.Header().Get("Content-Range"); got != "items 10-14/*" {
+		t.Errorf("Got Content-Range %q, want items 10-14/*", got)
+	}
+}
+
+func TestMalformedRangesAreRejected(t *testing.T) {
+	for _, itemRange := range []string{"items=10", "items=-5", "items=a-b", "items=1-2,4-5"} {
+		if response := runRangeRequest(app, "/", itemRange); response.Code != http.StatusBadRequest {
+			t.Errorf("%s: Got status %d, want 400", itemRange, response.Code)
+		}
+	}
+	if response := runRangeRequest(app, "/?count=5", "items=0-4"); response.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for a range with a count, want 400", response.Code)
+	}
+}
+
+func TestRangesOfOtherUnitsAreIgnored(t *testing.T) {
+	response := runRangeRequest(app, "/?count=2", "bytes=0-10")
+
+	if response.Code != http.StatusOK || response.Header().Get("Content-Range") != "" {
+		t.Errorf("Got status %d with Content-Range %q, want a plain 200", response.Code, response.Header().Get("Content-Range"))
+	}
+}
+
+func TestRangesAreBoundedByTheLogicalTotal(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithLogicalTotal(12))
+
+	response := runRangeRequest(srv, "/", "items=10-14")
+	if response.Code != http.StatusPartialContent {
+		t.Fatalf("Got status %d, want 206", response.Code)
+	}
+	if got := response.Header().Get("Content-Range"); got != "items 10-11/12" {
+		t.Errorf("Got Content-Range %q, want items 10-11/12", got)
+	}
+
+	response = runRangeRequest(srv, "/", "items=12-14")
+	if response.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Got status %d for a range past the end, want 416", response.Code)
+	}
+	if got := response.Header().Get("Content-Range"); got != "items */12" {
+		t.Errorf("Got Content-Range %q, want items */12", got)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+)
+
+// recoverPanic answers a request whose handler panicked with a 500, logging
+// the panic along with the request ID and the stack. It has to be deferred
+// by ServeHTTP with the writer returned by guardPanics. If the response was
+// already under way, it can only be cut off.
+func recoverPanic(ctx context.Context, w http.ResponseWriter) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	if recovered == http.ErrAbortHandler {
+		panic(recovered)
+	}
+	stack := debug.Stack()
+	switch panicErr := recovered.(type) {
+	case *ProviderPanicError:
+		stack = panicErr.Stack
+	case *CallbackPanicError:
+		stack = panicErr.Stack
+	}
+	logf(ctx, "panic serving request: %v\n%s", recovered, stack)
+	if guard, ok := w.(panicGuard); ok && guard.started() {
+		panic(http.ErrAbortHandler)
+	}
+	sendInternalServerError(w)
+}
+
+// guardPanics wraps w to record whether the response was started, which
+// decides how recoverPanic answers. It keeps w a Flusher if it is one.
+func guardPanics(w http.ResponseWriter) http.ResponseWriter {
+	guard := &guardedResponseWriter{ResponseWriter: w}
+	if flusher, ok := w.(http.Flusher); ok {
+		return guardedFlusher{guard, flusher}
+	}
+	return guard
+}
+
+type panicGuard interface {
+	started() bool
+}
+
+type guardedResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *guardedResponseWriter) started() bool {
+	return w.wroteHeader
+}
+
+func (w *guardedResponseWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *guardedResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+type guardedFlusher struct {
+	*guardedResponseWriter
+	flusher http.Flusher
+}
+
+func (w guardedFlusher) Flush() {
+	w.wroteHeader = true
+	w.flusher.Flush()
+}
+
+// ProviderPanicError is a panic of a provider's client, which is recovered
+// on the goroutine calling the client so that it cannot take the server
+// down. The request handler panics with it again once the page was
+// assembled, see rethrowProviderPanic.
+type ProviderPanicError struct {
+	Provider Provider
+	Value    interface{}
+	Stack    []byte
+}
+
+func (e *ProviderPanicError) Error() string {
+	return fmt.Sprintf("provider %s panicked: %v", e.Provider, e.Value)
+}
+
+// CallbackPanicError is a panic of one of the App's callbacks, such as
+// ValidateItem, LessItem or an Enricher, which is recovered and answered
+// like a ProviderPanicError
+type CallbackPanicError struct {
+	Callback string
+	Value    interface{}
+	Stack    []byte
+}
+
+func (e *CallbackPanicError) Error() string {
+	return fmt.Sprintf("%s panicked: %v", e.Callback, e.Value)
+}
+
+// providerPanics holds the first panic of a provider or callback during a
+// request, a *ProviderPanicError or a *CallbackPanicError
+type providerPanics struct {
+	mu    sync.Mutex
+	first error
+}
+
+type providerPanicsKey struct{}
+
+func contextWithProviderPanics(ctx context.Context) context.Context {
+	return context.WithValue(ctx, providerPanicsKey{}, &providerPanics{})
+}
+
+// recoverProviderPanic turns a panic of the provider's client into an error,
+// which it stores in *err, and records it for the request of ctx. It has to
+// be deferred by the caller of the client.
+func recoverProviderPanic(ctx context.Context, provider Provider, err *error) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	panicErr := &ProviderPanicError{Provider: provider, Value: recovered, Stack: debug.Stack()}
+	recordPanic(ctx, panicErr)
+	*err = panicErr
+}
+
+// recoverCallbackPanic turns a panic of the named callback into an error,
+// which it stores in *err, and records it for the request of ctx like
+// recoverProviderPanic does. It has to be deferred by the caller of the
+// callback.
+func recoverCallbackPanic(ctx context.Context, callback string, err *error) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	panicErr := &CallbackPanicError{Callback: callback, Value: recovered, Stack: debug.Stack()}
+	recordPanic(ctx, panicErr)
+	*err = panicErr
+}
+
+func recordPanic(ctx context.Context, panicErr error) {
+	if panics, ok := ctx.Value(providerPanicsKey{}).(*providerPanics); ok {
+		panics.mu.Lock()
+		if panics.first == nil {
+			panics.first = panicErr
+		}
+		panics.mu.Unlock()
+	}
+}
+
+// recoverBackgroundPanic logs a panic of work done in the background, such
+// as a prefetch, which has no request to answer. It has to be deferred by
+// the goroutine doing the work.
+func recoverBackgroundPanic(ctx context.Context, work string) {
+	if recovered := recover(); recovered != nil {
+		logf(ctx, "panic %s: %v\n%s", work, recovered, debug.Stack())
+	}
+}
+
+// rethrowProviderPanic panics with the first panic of a provider or callback
+// during the request of ctx, if there was one, so that it is answered by
+// recoverPanic
+func rethrowProviderPanic(ctx context.Context) {
+	panics, ok := ctx.Value(providerPanicsKey{}).(*providerPanics)
+	if !ok {
+		return
+	}
+	panics.mu.Lock()
+	first := panics.first
+	panics.mu.Unlock()
+	if first != nil {
+		panic(first)
+	}
+}
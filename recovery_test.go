@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// PanickingContentProvider panics instead of returning content
+type PanickingContentProvider struct{}
+
+func (PanickingContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	var items []*ContentItem
+	return []*ContentItem{items[0]}, nil
+}
+
+func assertInternalServerError(t *testing.T, response *httptest.ResponseRecorder) {
+	t.Helper()
+	if response.Code != http.StatusInternalServerError {
+		t.Fatalf("Got status %d, want 500", response.Code)
+	}
+	var body errorResponse
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil || body.Error == "" {
+		t.Errorf("Got body error %q (%v), want a JSON error", body.Error, err)
+	}
+	if response.Header().Get(requestIDHeader) == "" {
+		t.Error("Response carries no request ID")
+	}
+}
+
+func TestProviderPanicIsAnsweredWithInternalServerError(t *testing.T) {
+	clients := sampleClients()
+	clients[Provider2] = PanickingContentProvider{}
+	srv, _ := NewApp(ContentMix{config4, {Type: Provider2}}, clients)
+
+	assertInternalServerError(t, runRawRequest(srv, "/?count=2"))
+
+	// the server keeps serving
+	srv.RegisterClient(Provider2, clients[Provider3])
+	if response := runRawRequest(srv, "/?count=2"); response.Code != http.StatusOK {
+		t.Errorf("Got status %d after the panic, want 200", response.Code)
+	}
+}
+
+func TestProviderPanicInBulkRequestIsAnsweredWithInternalServerError(t *testing.T) {
+	clients := sampleClients()
+	clients[Provider1] = PanickingContentProvider{}
+	srv, _ := NewApp(ContentMix{config4}, clients)
+
+	assertInternalServerError(t, runRawRequest(srv, bulkPath+"?count=2&pages=2"))
+}
+
+func TestHandlerPanicIsAnsweredWithInternalServerError(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithEnricher(func(item *ContentItem, ic ItemContext) map[string]interface{} {
+		panic("enricher failed")
+	}))
+
+	assertInternalServerError(t, runRawRequest(srv, "/?count=2"))
+}
+
+func TestPanicAfterTheResponseStartedAbortsIt(t *testing.T) {
+	response := httptest.NewRecorder()
+	w := guardPanics(response)
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Errorf("Got panic %v, want the response aborted", recovered)
+		}
+		if response.Code != http.StatusOK {
+			t.Errorf("Got status %d, want the started 200 left alone", response.Code)
+		}
+	}()
+	func() {
+		defer recoverPanic(context.Background(), w)
+		w.WriteHeader(http.StatusOK)
+		panic("too late")
+	}()
+}
+
+func TestProviderPanicBeforeAnythingWasStreamedIsAnsweredWithInternalServerError(t *testing.T) {
+	clients := sampleClients()
+	clients[Provider2] = PanickingContentProvider{}
+	srv, _ := NewApp(ContentMix{{Type: Provider2}, config4}, clients, WithStreaming(1))
+
+	assertInternalServerError(t, runRawRequest(srv, "/?count=2"))
+}
+
+func TestProviderPanicAfterItemsWereStreamedAbortsTheResponse(t *testing.T) {
+	release := make(chan struct{})
+	clients := sampleClients()
+	clients[Provider2] = GatedContentProvider{Client: PanickingContentProvider{}, Release: release}
+	srv, _ := NewApp(ContentMix{config4, {Type: Provider2}}, clients, WithStreaming(1))
+	response := flushRecorder{ResponseRecorder: httptest.NewRecorder(), flushes: make(chan string, 10)}
+
+	recovered := make(chan interface{})
+	go func() {
+		defer func() { recovered <- recover() }()
+		srv.ServeHTTP(response, httptest.NewRequest("GET", "/?count=2", nil))
+	}()
+	<-response.flushes
+	close(release)
+
+	if got := <-recovered; got != http.ErrAbortHandler {
+		t.Errorf("Got panic %v, want the response aborted", got)
+	}
+	if response.Code != http.StatusOK {
+		t.Errorf("Got status %d, want the started 200 left alone", response.Code)
+	}
+}
+
+func TestValidatorPanicIsAnsweredWithInternalServerError(t *testing.T) {
+	validate := func(item *ContentItem) error {
+		panic("validator failed")
+	}
+	for _, policy := range []InvalidItemPolicy{DropInvalid, FailRequest, FailProvider} {
+		srv, _ := NewApp(ContentMix{config4, {Type: Provider2}}, sampleClients(), WithItemValidation(validate, policy))
+
+		assertInternalServerError(t, runRawRequest(srv, "/?count=2"))
+	}
+}
+
+func TestItemOrderPanicIsAnsweredWithInternalServerError(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithItemOrder(func(a, b *ContentItem) bool {
+		panic("less failed")
+	}))
+
+	assertInternalServerError(t, runRawRequest(srv, "/?count=2"))
+	assertInternalServerError(t, runRawRequest(srv, bulkPath+"?count=2&pages=2"))
+}
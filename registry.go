@@ -0,0 +1,111 @@
+package main
+
+import "fmt"
+
+// RegisterClient adds or replaces the client of a provider while the server
+// is running
+func (a *App) RegisterClient(provider Provider, client Client) error {
+	if client == nil {
+		return fmt.Errorf("client for provider %s is nil", provider)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	clients := a.copyClients()
+	clients[provider] = client
+	a.ContentClients = clients
+	return nil
+}
+
+// DeregisterClient removes the client of a provider while the server is
+// running. Providers which are still used by a config cannot be removed.
+func (a *App) DeregisterClient(provider Provider) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.usesProvider(provider) {
+		return fmt.Errorf("provider %s is still used by the config", provider)
+	}
+	clients := a.copyClients()
+	delete(clients, provider)
+	a.ContentClients = clients
+	return nil
+}
+
+// ReloadConfig replaces the Config while the server is running, e.g. after
+// its file was edited. The new config is validated first and left unused if
+// it is invalid. Requests in flight keep using the config they started
+// with, and cached pages of the previous config are flushed.
+func (a *App) ReloadConfig(mix ContentMix) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.validateMix(mix); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	a.Config = mix
+	if a.Cache != nil {
+		a.Cache.flush("")
+	}
+	return nil
+}
+
+// config returns the currently served Config. Like the clients, it is
+// replaced rather than modified on reload.
+func (a *App) config() ContentMix {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.Config
+}
+
+// clients returns the currently registered clients. The map is replaced
+// rather than modified on registration, so it may be read without locking.
+func (a *App) clients() map[Provider]Client {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.ContentClients
+}
+
+// client returns the client registered for a provider
+func (a *App) client(provider Provider) (Client, bool) {
+	client, ok := a.clients()[provider]
+	return client, ok
+}
+
+func (a *App) copyClients() map[Provider]Client {
+	clients := make(map[Provider]Client, len(a.ContentClients)+1)
+	for provider, client := range a.ContentClients {
+		clients[provider] = client
+	}
+	return clients
+}
+
+// usesProvider reports whether any config, including those of the AdsMix,
+// refers to the provider, or it is one of the ExpensiveProviders
+func (a *App) usesProvider(provider Provider) bool {
+	if a.DefaultFallback != nil && *a.DefaultFallback == provider || a.ExpensiveProviders[provider] {
+		return true
+	}
+	mixes := append([]ContentMix{a.Config, a.AdsMix}, mixValues(a.Mixes)...)
+	for _, mix := range mixes {
+		for _, config := range mix {
+			for _, tier := range a.tiersFor(config) {
+				for _, p := range tier {
+					if p == provider {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+func mixValues(mixes map[string]ContentMix) []ContentMix {
+	values := make([]ContentMix, 0, len(mixes))
+	for _, mix := range mixes {
+		values = append(values, mix)
+	}
+	return values
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeregisteringProviderInUseIsRejected(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients())
+
+	if err := srv.DeregisterClient(Provider1); err == nil {
+		t.Error("Deregistering a provider used by the config succeeded")
+	}
+	if _, ok := srv.client(Provider1); !ok {
+		t.Error("Provider 1 was removed")
+	}
+}
+
+func TestDeregisteringProviderOfAdsOrExpensiveProvidersIsRejected(t *testing.T) {
+	ads, _ := NewApp(ContentMix{config4}, sampleClients(), WithAdsMix(ContentMix{{Type: Provider3}}, 4))
+	if err := ads.DeregisterClient(Provider3); err == nil {
+		t.Error("Deregistering a provider used by the ads mix succeeded")
+	}
+
+	expensive, _ := NewApp(ContentMix{config4}, sampleClients(), WithExpensiveProviders(Provider3))
+	if err := expensive.DeregisterClient(Provider3); err == nil {
+		t.Error("Deregistering one of the expensive providers succeeded")
+	}
+}
+
+func TestRegisterAndDeregisterClient(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, sampleClients())
+	spare := Provider("spare")
+
+	if err := srv.RegisterClient(spare, SampleContentProvider{Source: spare}); err != nil {
+		t.Fatalf("RegisterClient failed: %v", err)
+	}
+	if _, ok := srv.client(spare); !ok {
+		t.Fatal("Registered provider is missing")
+	}
+	if err := srv.DeregisterClient(spare); err != nil {
+		t.Fatalf("DeregisterClient failed: %v", err)
+	}
+	if _, ok := srv.client(spare); ok {
+		t.Error("Deregistered provider is still there")
+	}
+	if err := srv.RegisterClient(spare, nil); err == nil {
+		t.Error("Registering a nil client succeeded")
+	}
+}
+
+func TestRegisteringClientsWhileServing(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients())
+	spare := Provider("spare")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if response := runRawRequest(srv, "/?count=5"); response.Code != 200 {
+				t.Errorf("Response code is %d, want 200", response.Code)
+			}
+			runRawRequest(srv, "/providers")
+		}()
+		go func() {
+			defer wg.Done()
+			srv.RegisterClient(Provider2, SampleContentProvider{Source: Provider2})
+			srv.RegisterClient(spare, SampleContentProvider{Source: spare})
+			srv.DeregisterClient(spare)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestReloadingConfigWhileServing(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithCache(time.Minute))
+	mixes := []ContentMix{DefaultConfig, {config4}, {{Type: Provider2}}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if response := runRawRequest(srv, "/?count=5"); response.Code != 200 {
+				t.Errorf("Response code is %d, want 200", response.Code)
+			}
+			runRawRequest(srv, "/providers")
+		}()
+		go func(i int) {
+			defer wg.Done()
+			if err := srv.ReloadConfig(mixes[i%len(mixes)]); err != nil {
+				t.Errorf("ReloadConfig failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	srv.ReloadConfig(ContentMix{{Type: Provider2}})
+	if sources := providerSequence(runRequest(t, srv, SimpleContentRequest)); strings.Trim(sources, "2") != "" {
+		t.Errorf("Got providers %s after reloading, want only 2", sources)
+	}
+}
+
+func TestInvalidConfigIsNotReloaded(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients())
+
+	for _, mix := range []ContentMix{nil, {{Type: "unknown"}}} {
+		if err := srv.ReloadConfig(mix); err == nil {
+			t.Errorf("Reloading %v succeeded", mix)
+		}
+	}
+	if !sameMix(srv.config(), DefaultConfig) {
+		t.Error("Config was replaced by an invalid one")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// requestIDHeader is read from incoming requests and echoed in responses so
+// that a request can be traced across services
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// getRequestID returns the request's X-Request-ID, or a freshly generated
+// UUID if the client did not send one.
+func getRequestID(req *http.Request) string {
+	if id := req.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+	return newUUID()
+}
+
+// newUUID generates a random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Printf("could not generate request id: %v", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func contextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logf logs a message prefixed with the ID of the request it belongs to.
+// Credential-like parameters in the message are redacted.
+func logf(ctx context.Context, format string, args ...interface{}) {
+	if id := requestIDFromContext(ctx); id != "" {
+		format = "[" + id + "] " + format
+	}
+	log.Print(redactCredentials(fmt.Sprintf(format, args...)))
+}
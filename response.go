@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// responseFormat describes how the client wants the content to be serialised
+type responseFormat struct {
+	// Fields restricts every item to the listed JSON fields, all fields are
+	// returned if it is empty
+	Fields []string
+
+	// Summary reduces every item to an itemSummary, taking precedence over
+	// Fields
+	Summary bool
+
+	// Annotate adds the provider which served each item and whether it
+	// was a fallback
+	Annotate bool
+
+	// Ranged is set if the items were asked for with a Range header, the
+	// response is then a 206
+	Ranged bool
+
+	// Compact leaves empty optional fields out, see requiredItemFields
+	Compact bool
+
+	// FetchedAt adds the time each item was fetched from its provider as
+	// fetched_at, which tells cached items from fresh ones
+	FetchedAt bool
+
+	// RenameField returns the name to serialise an item's field under,
+	// given its JSON name. nil keeps the JSON names.
+	RenameField func(string) string
+
+	// Debug adds the position in the config of each item's slot and the
+	// provider which served it, see itemDebug
+	Debug bool
+
+	// Pretty indents the response for people reading it while debugging.
+	// As it is indented as a whole, it is never streamed. Responses are
+	// compact by default.
+	Pretty bool
+
+	// MaxBytes limits the size of the response, 0 means no limit. Larger
+	// responses are cut down to the items that fit if Truncate is set, and
+	// rejected otherwise.
+	MaxBytes int
+	Truncate bool
+
+	// Envelope wraps the list in an object along with the requested Offset
+	// and Count, how many items were returned and whether that is fewer
+	// than requested, e.g. {"items":[...],"offset":5,"count":5,
+	// "returned":5,"partial":false}
+	Envelope bool
+	Offset   int
+	Count    int
+
+	// NextCursor stands for the offset of the following page, it is added
+	// to the envelope as next_cursor
+	NextCursor string
+}
+
+// annotatedItem is a ContentItem along with the provider which served it
+type annotatedItem struct {
+	*ContentItem
+	Provider Provider `json:"provider"`
+	Fallback bool     `json:"fallback"`
+}
+
+// itemDebug is added to every item as "debug" in debug mode, to help
+// diagnose the order of a page. ConfigIndex is the position in the config,
+// as laid out by the MixStrategy, of the slot the item fills, or in the
+// AdsMix for ads.
+type itemDebug struct {
+	ConfigIndex int      `json:"config_index"`
+	Ad          bool     `json:"ad,omitempty"`
+	Provider    Provider `json:"provider"`
+}
+
+// itemSummary is the lightweight representation of an item for previews
+type itemSummary struct {
+	ID     string `json:"id"`
+	Source string `json:"source"`
+}
+
+// annotatedSummary is an itemSummary along with the provider which served it
+type annotatedSummary struct {
+	itemSummary
+	Provider Provider `json:"provider"`
+	Fallback bool     `json:"fallback"`
+}
+
+// contentItemFieldNames holds the JSON names of all ContentItem fields
+var contentItemFieldNames = jsonFieldNames(reflect.TypeOf(ContentItem{}))
+
+// contentItemFields lists the JSON names of all ContentItem fields
+var contentItemFields = fieldNameList(contentItemFieldNames)
+
+// parseResponseFormat reads the serialisation related URL parameters.
+// Unknown field names are ignored unless strict is set, in which case they
+// are reported as an error.
+func parseResponseFormat(req *http.Request, strict bool) (responseFormat, error) {
+	var format responseFormat
+
+	for _, field := range strings.Split(req.URL.Query().Get("fields"), ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if _, known := contentItemFieldNames[field]; !known {
+			if strict {
+				return format, fmt.Errorf("unknown field %q", field)
+			}
+			continue
+		}
+		format.Fields = append(format.Fields, field)
+	}
+
+	if summary := req.URL.Query().Get("summary"); summary != "" {
+		var err error
+		if format.Summary, err = strconv.ParseBool(summary); err != nil {
+			return format, errors.New("summary must be true or false")
+		}
+	}
+	if debug := req.URL.Query().Get("debug"); debug != "" {
+		var err error
+		if format.Debug, err = strconv.ParseBool(debug); err != nil {
+			return format, errors.New("debug must be true or false")
+		}
+	}
+	if pretty := req.URL.Query().Get("pretty"); pretty != "" {
+		var err error
+		if format.Pretty, err = strconv.ParseBool(pretty); err != nil {
+			return format, errors.New("pretty must be true or false")
+		}
+	}
+
+	return format, nil
+}
+
+// jsonFieldNames maps the JSON names of a struct's fields to their index
+func jsonFieldNames(structType reflect.Type) map[string]int {
+	names := map[string]int{}
+	for i := 0; i < structType.NumField(); i++ {
+		name := strings.Split(structType.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = structType.Field(i).Name
+		}
+		if name != "-" {
+			names[name] = i
+		}
+	}
+	return names
+}
+
+// fieldNameList returns the names of a struct's fields in their order
+func fieldNameList(names map[string]int) []string {
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Slice(list, func(i, j int) bool { return names[list[i]] < names[list[j]] })
+	return list
+}
+
+// itemFieldValue returns the value of the item's field with the given JSON name
+func itemFieldValue(item *ContentItem, field string) (interface{}, bool) {
+	index, known := contentItemFieldNames[field]
+	if !known {
+		return nil, false
+	}
+	return reflect.ValueOf(item).Elem().Field(index).Interface(), true
+}
+
+// projectItem returns only the given fields of an item, keyed by JSON name
+func projectItem(item *ContentItem, fields []string) map[string]interface{} {
+	projection := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		projection[field], _ = itemFieldValue(item, field)
+	}
+	return projection
+}
+
+// summaryFields are the fields of an itemSummary
+var summaryFields = []string{"id", "source"}
+
+// omitEmptyItemFields are the ContentItem fields tagged omitempty
+var omitEmptyItemFields = omitEmptyFieldNames(reflect.TypeOf(ContentItem{}))
+
+// omitEmptyFieldNames returns the JSON names of a struct's fields which are
+// tagged omitempty
+func omitEmptyFieldNames(structType reflect.Type) map[string]bool {
+	names := map[string]bool{}
+	for name, index := range jsonFieldNames(structType) {
+		if strings.Contains(structType.Field(index).Tag.Get("json"), ",omitempty") {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// omitEmptyTagged removes the fields tagged omitempty which hold zero values
+// from a projection, as encoding the item itself would
+func omitEmptyTagged(projection map[string]interface{}) {
+	for field, value := range projection {
+		if omitEmptyItemFields[field] && reflect.ValueOf(value).IsZero() {
+			delete(projection, field)
+		}
+	}
+}
+
+// requiredItemFields are the fields which compact items keep even if they
+// are empty, as clients need them to tell items apart
+var requiredItemFields = map[string]bool{"id": true, "source": true}
+
+// omitEmptyFields removes the optional fields holding zero values from a
+// projection
+func omitEmptyFields(projection map[string]interface{}) {
+	for field, value := range projection {
+		if !requiredItemFields[field] && reflect.ValueOf(value).IsZero() {
+			delete(projection, field)
+		}
+	}
+}
+
+// renderItem returns the representation of an item which gets serialised
+func renderItem(item returnedItem, format responseFormat) interface{} {
+	rendered := renderFields(item, format)
+	if format.Debug {
+		return withDebug(rendered, itemDebug{ConfigIndex: item.ConfigIndex, Ad: item.Ad, Provider: item.Provider})
+	}
+	return rendered
+}
+
+// withDebug adds debug to a rendered item. It re-encodes the item, which is
+// fine for debugging but too slow for normal responses. Items which cannot be
+// encoded are left as they are, to fail when the response is written.
+func withDebug(rendered interface{}, debug itemDebug) interface{} {
+	encoded, err := json.Marshal(rendered)
+	if err != nil {
+		return rendered
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return rendered
+	}
+	fields["debug"], _ = json.Marshal(debug)
+	return fields
+}
+
+// renderFields returns the fields of an item requested by the format
+func renderFields(item returnedItem, format responseFormat) interface{} {
+	if format.Summary && format.RenameField == nil && !format.FetchedAt && item.Extra == nil {
+		summary := itemSummary{ID: item.Item.ID, Source: item.Item.Source}
+		if format.Annotate {
+			return annotatedSummary{itemSummary: summary, Provider: item.Provider, Fallback: item.Fallback}
+		}
+		return summary
+	}
+	if len(format.Fields) > 0 || format.Compact || format.RenameField != nil || format.FetchedAt || item.Extra != nil {
+		fields := format.Fields
+		switch {
+		case format.Summary:
+			fields = summaryFields
+		case len(fields) == 0:
+			fields = contentItemFields
+		}
+		projection := projectItem(item.Item, fields)
+		if format.Compact {
+			omitEmptyFields(projection)
+		} else if len(format.Fields) == 0 {
+			omitEmptyTagged(projection)
+		}
+		if format.Annotate {
+			projection["provider"] = item.Provider
+			projection["fallback"] = item.Fallback
+		}
+		if format.FetchedAt {
+			projection["fetched_at"] = item.FetchedAt
+		}
+		if format.RenameField != nil {
+			projection = renameFields(projection, format.RenameField)
+		}
+		for field, value := range item.Extra {
+			projection[field] = value
+		}
+		return projection
+	}
+	if format.Annotate {
+		return annotatedItem{ContentItem: item.Item, Provider: item.Provider, Fallback: item.Fallback}
+	}
+	return item.Item
+}
+
+// writeJsonResponse streams returnList as a JSON array with a 200 status,
+// encoding one item at a time, wrapped in an envelope if the format asks for
+// one. The output is buffered until the buffer fills
+// up, so an item failing to encode early on still results in a clean 500.
+// If the response has already been partly sent by then, the connection is
+// aborted instead, so the client cannot mistake it for a complete list.
+// An empty list is always written as [] rather than null. setHeaders, if
+// not nil, is called with the items that are sent right before the body is,
+// so that headers describing them are left out of error responses.
+func writeJsonResponse(ctx context.Context, writer http.ResponseWriter, returnList []returnedItem, format responseFormat, setHeaders func([]returnedItem)) {
+	if format.MaxBytes > 0 || format.Pretty {
+		writeBoundedJsonResponse(ctx, writer, returnList, format, setHeaders)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	sent := &sentWriter{writer: writer}
+	if setHeaders != nil {
+		sent.start = func() { setHeaders(returnList) }
+	}
+	buffered := bufio.NewWriter(sent)
+	encoder := json.NewEncoder(buffered)
+
+	buffered.WriteString(format.opening())
+	for i, item := range returnList {
+		if i > 0 {
+			buffered.WriteByte(',')
+		}
+		if err := encoder.Encode(renderItem(item, format)); err != nil {
+			logf(ctx, "could not marshal item %d of the response: %v", i, err)
+			if !sent.started {
+				sendInternalServerError(writer)
+				return
+			}
+			panic(http.ErrAbortHandler)
+		}
+	}
+	buffered.WriteString(format.closing(len(returnList)))
+	if err := buffered.Flush(); err != nil {
+		logf(ctx, "could not write response: %v", err)
+	}
+}
+
+// writeBoundedJsonResponse serialises the whole of returnList before sending
+// it, so that its size can be checked against format.MaxBytes and that it can
+// be indented if the format is Pretty. If it does not fit, the list is cut off
+// after the last item that fits or a 413 is sent, depending on
+// format.Truncate. The size is the one of the compact response.
+func writeBoundedJsonResponse(ctx context.Context, writer http.ResponseWriter, returnList []returnedItem, format responseFormat, setHeaders func([]returnedItem)) {
+	// no closing is longer than the one of an untruncated list
+	closing := format.closing(len(returnList))
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+
+	body.WriteString(format.opening())
+	returned := len(returnList)
+	for i, item := range returnList {
+		end := body.Len()
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		if err := encoder.Encode(renderItem(item, format)); err != nil {
+			logf(ctx, "could not marshal item %d of the response: %v", i, err)
+			sendInternalServerError(writer)
+			return
+		}
+		if format.MaxBytes <= 0 || body.Len()+len(closing) <= format.MaxBytes {
+			continue
+		}
+
+		if !format.Truncate {
+			logf(ctx, "response exceeds %d bytes at item %d", format.MaxBytes, i)
+			sendError(writer, http.StatusRequestEntityTooLarge, fmt.Sprintf(
+				"response exceeds %d bytes, request fewer items or fields", format.MaxBytes))
+			return
+		}
+		logf(ctx, "truncating response to %d of %d items to fit %d bytes", i, len(returnList), format.MaxBytes)
+		body.Truncate(end)
+		returned = i
+		break
+	}
+	body.WriteString(format.closing(returned))
+	if format.Pretty {
+		body = indentJSON(body)
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	if setHeaders != nil {
+		setHeaders(returnList[:returned])
+	}
+	if _, err := body.WriteTo(writer); err != nil {
+		logf(ctx, "could not write response: %v", err)
+	}
+}
+
+// indentJSON returns the indented form of a JSON document, ending in a
+// newline. Documents which cannot be indented are returned as they are.
+func indentJSON(compact bytes.Buffer) bytes.Buffer {
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, compact.Bytes(), "", "  "); err != nil {
+		return compact
+	}
+	indented.WriteByte('\n')
+	return indented
+}
+
+// opening is written before the items of a response
+func (f responseFormat) opening() string {
+	if f.Envelope {
+		return `{"items":[`
+	}
+	return "["
+}
+
+// closing is written after the items of a response with returned items
+func (f responseFormat) closing(returned int) string {
+	if f.Envelope {
+		return fmt.Sprintf(`],"offset":%d,"count":%d,"returned":%d,"partial":%t,"next_cursor":%q}`+"\n",
+			f.Offset, f.Count, returned, returned < f.Count, f.NextCursor)
+	}
+	return "]\n"
+}
+
+// sentWriter records whether anything has been written to the client yet,
+// calling start, if set, before the first write
+type sentWriter struct {
+	writer  io.Writer
+	started bool
+	start   func()
+}
+
+func (w *sentWriter) Write(p []byte) (int, error) {
+	if !w.started && w.start != nil {
+		w.start()
+	}
+	w.started = true
+	return w.writer.Write(p)
+}
+
+// headResponseWriter answers a HEAD request by sending the headers a GET
+// would get, discarding the body
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w headResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// pageETag returns a weak entity tag for the response to a page. Items are
+// told apart by their ID, so that the tag can be computed without encoding
+// them, along with whoever served them and how they are rendered.
+func pageETag(items []returnedItem, format responseFormat) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%q %t %t %t %t %t %d %d\n", format.Fields, format.Summary, format.Compact, format.Annotate, format.Debug, format.Envelope, format.Offset, format.Count)
+	for _, item := range items {
+		fmt.Fprintf(hash, "%q %q %q %t %t %t\n", item.Item.ID, item.Item.Source, item.Provider, item.Fallback, item.Item.Placeholder, item.Item.Emergency)
+		if format.FetchedAt {
+			fmt.Fprintf(hash, "%d\n", item.FetchedAt.UnixNano())
+		}
+		if item.Extra != nil {
+			fmt.Fprintf(hash, "%v\n", item.Extra)
+		}
+	}
+	return fmt.Sprintf(`W/"%x"`, hash.Sum(nil)[:16])
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(writer http.ResponseWriter, status int, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(v)
+}
+
+// setCacheHeaders allows caching the response for maxAge, or forbids caching
+// it if maxAge is 0
+func setCacheHeaders(writer http.ResponseWriter, maxAge time.Duration) {
+	if maxAge <= 0 {
+		writer.Header().Set("Cache-Control", "no-store")
+		writer.Header().Del("Expires")
+		return
+	}
+	seconds := int(maxAge.Seconds())
+	writer.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(seconds))
+	writer.Header().Set("Expires", time.Now().Add(time.Duration(seconds)*time.Second).UTC().Format(http.TimeFormat))
+}
+
+// errorResponse is the body of every error the server responds with.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func sendError(writer http.ResponseWriter, status int, message string) {
+	setCacheHeaders(writer, 0)
+	writeJSON(writer, status, errorResponse{Error: message})
+}
+
+func sendBadRequest(writer http.ResponseWriter, message string) {
+	sendError(writer, http.StatusBadRequest, message)
+}
+
+func sendInternalServerError(writer http.ResponseWriter) {
+	sendError(writer, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+}
+
+// sendTooManyRequests tells the client to come back after retryAfter, which is
+// rounded up to whole seconds
+func sendTooManyRequests(writer http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	writer.Header().Set("Retry-After", strconv.Itoa(seconds))
+	sendError(writer, http.StatusTooManyRequests, "all providers are throttling, please retry later")
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func largeReturnList(count int) []returnedItem {
+	list := make([]returnedItem, count)
+	for i := range list {
+		list[i] = returnedItem{
+			Item:     &ContentItem{ID: strconv.Itoa(i), Title: "title", Source: "1", Expiry: time.Now()},
+			Provider: Provider1,
+		}
+	}
+	return list
+}
+
+func TestLargeResponseIsStreamedCorrectly(t *testing.T) {
+	response := httptest.NewRecorder()
+	writeJsonResponse(context.Background(), response, largeReturnList(10000), responseFormat{}, nil)
+
+	var content []*ContentItem
+	if err := json.NewDecoder(response.Body).Decode(&content); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	if len(content) != 10000 {
+		t.Fatalf("Got %d items back, want 10000", len(content))
+	}
+	for i, item := range content {
+		if item.ID != strconv.Itoa(i) {
+			t.Fatalf("Position %d: Got item %s", i, item.ID)
+		}
+	}
+	if contentType := response.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Got Content-Type %q, want application/json", contentType)
+	}
+}
+
+func TestEncodingFailureAfterStreamingStartedAbortsResponse(t *testing.T) {
+	list := largeReturnList(10000)
+	list[9999].Item.Expiry = time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Errorf("Got %v, want the response to be aborted", recovered)
+		}
+	}()
+	writeJsonResponse(context.Background(), httptest.NewRecorder(), list, responseFormat{}, nil)
+}
+
+func BenchmarkWriteJsonResponse(b *testing.B) {
+	list := largeReturnList(1000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		writeJsonResponse(context.Background(), httptest.NewRecorder(), list, responseFormat{}, nil)
+	}
+}
+
+// oversizedClients serves items of about 1KB each
+func oversizedClients() map[Provider]Client {
+	items := make([]*ContentItem, 5)
+	for i := range items {
+		items[i] = &ContentItem{ID: strconv.Itoa(i), Title: strings.Repeat("x", 1000), Source: "1"}
+	}
+	return map[Provider]Client{Provider1: FixedContentProvider{Items: items}}
+}
+
+func TestOversizedResponseIsTruncated(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, oversizedClients(), WithMaxResponseBytes(2500, TruncateOversized))
+
+	response := runRawRequest(srv, "/?count=5")
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Got status %d, want 200", response.Code)
+	}
+	if response.Body.Len() > 2500 {
+		t.Errorf("Got %d bytes, want at most 2500", response.Body.Len())
+	}
+	var content []*ContentItem
+	if err := json.NewDecoder(response.Body).Decode(&content); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	if ids := itemIDs(content); ids != "0,1" {
+		t.Errorf("Got items %s, want 01", ids)
+	}
+}
+
+func TestOversizedResponseIsRejected(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, oversizedClients(), WithMaxResponseBytes(2500, RejectOversized))
+
+	if response := runRawRequest(srv, "/?count=5"); response.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Got status %d, want 413", response.Code)
+	}
+	if response := runRawRequest(srv, "/?count=2"); response.Code != http.StatusOK {
+		t.Errorf("Got status %d for a response that fits, want 200", response.Code)
+	}
+}
+
+func TestRejectedOversizedResponseCarriesNoItemHeaders(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, oversizedClients(), WithMaxResponseBytes(2500, RejectOversized))
+
+	response := runRangeRequest(srv, "/", "items=0-4")
+
+	if response.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Got status %d, want 413", response.Code)
+	}
+	for _, header := range []string{"ETag", "Content-Range"} {
+		if got := response.Header().Get(header); got != "" {
+			t.Errorf("Got %s %q on the error, want none", header, got)
+		}
+	}
+}
+
+func TestTruncatedResponseHeadersDescribeTheSentItems(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, oversizedClients(), WithMaxResponseBytes(2500, TruncateOversized))
+	unlimited, _ := NewApp(ContentMix{config4}, oversizedClients())
+
+	response := runRangeRequest(srv, "/", "items=0-4")
+
+	if got := response.Header().Get("Content-Range"); got != "items 0-1/*" {
+		t.Errorf("Got Content-Range %q, want items 0-1/*", got)
+	}
+	if tag := response.Header().Get("ETag"); tag == runRangeRequest(unlimited, "/", "items=0-4").Header().Get("ETag") {
+		t.Errorf("Truncated response got ETag %s of the whole page", tag)
+	}
+}
+
+// responseEnvelope is what an enveloped content response decodes to
+type responseEnvelope struct {
+	Items    []*ContentItem `json:"items"`
+	Offset   int            `json:"offset"`
+	Count    int            `json:"count"`
+	Returned int            `json:"returned"`
+	Partial  bool           `json:"partial"`
+}
+
+func TestResponseEnvelopeCarriesMetadata(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithResponseEnvelope())
+
+	response := runRawRequest(srv, "/?offset=5&count=5")
+
+	var envelope responseEnvelope
+	if err := json.NewDecoder(response.Body).Decode(&envelope); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	want := responseEnvelope{Offset: 5, Count: 5, Returned: 5, Partial: false}
+	if envelope.Offset != want.Offset || envelope.Count != want.Count || envelope.Returned != want.Returned || envelope.Partial {
+		t.Errorf("Got %+v, want %+v", envelope, want)
+	}
+	if len(envelope.Items) != 5 {
+		t.Errorf("Got %d items, want 5", len(envelope.Items))
+	}
+}
+
+func TestResponseEnvelopeReportsPartialLists(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4, {Type: Provider2}}, map[Provider]Client{
+		Provider1: SampleContentProvider{Source: Provider1},
+		Provider2: FailingContentProvider{},
+	}, WithResponseEnvelope())
+
+	var envelope responseEnvelope
+	if err := json.NewDecoder(runRawRequest(srv, "/?count=4").Body).Decode(&envelope); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	if envelope.Returned != 1 || len(envelope.Items) != 1 || !envelope.Partial {
+		t.Errorf("Got %d items, returned %d and partial %v, want 1, 1 and true", len(envelope.Items), envelope.Returned, envelope.Partial)
+	}
+}
+
+func TestEnvelopeIsKeptWhenTruncating(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, oversizedClients(), WithMaxResponseBytes(2500, TruncateOversized), WithResponseEnvelope())
+
+	response := runRawRequest(srv, "/?count=5")
+
+	if response.Body.Len() > 2500 {
+		t.Errorf("Got %d bytes, want at most 2500", response.Body.Len())
+	}
+	var envelope responseEnvelope
+	if err := json.NewDecoder(response.Body).Decode(&envelope); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	if envelope.Returned != len(envelope.Items) || !envelope.Partial {
+		t.Errorf("Got %d items, returned %d and partial %v", len(envelope.Items), envelope.Returned, envelope.Partial)
+	}
+}
+
+func TestBareArrayIsTheDefault(t *testing.T) {
+	response := runRawRequest(app, "/?count=2")
+
+	if body := strings.TrimSpace(response.Body.String()); !strings.HasPrefix(body, "[") || !strings.HasSuffix(body, "]") {
+		t.Errorf("Got %s, want a bare JSON array", body)
+	}
+}
+
+func TestPageETagChangesWithContentAndFormat(t *testing.T) {
+	items := []returnedItem{{Item: &ContentItem{ID: "a"}, Provider: Provider1}}
+	other := []returnedItem{{Item: &ContentItem{ID: "b"}, Provider: Provider1}}
+
+	tag := pageETag(items, responseFormat{})
+	if tag != pageETag(items, responseFormat{}) {
+		t.Error("Same page got different ETags")
+	}
+	if tag == pageETag(other, responseFormat{}) {
+		t.Error("Pages with different items got the same ETag")
+	}
+	if tag == pageETag(items, responseFormat{Summary: true}) {
+		t.Error("Different renderings of a page got the same ETag")
+	}
+}
+
+func TestCompactItemsOmitEmptyFields(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{
+		Provider1: FixedContentProvider{Items: []*ContentItem{{ID: "a", Title: "title", Source: "1"}}},
+	}, WithCompactItems())
+
+	var content []map[string]interface{}
+	if err := json.NewDecoder(runRawRequest(srv, "/?count=1").Body).Decode(&content); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	want := map[string]interface{}{"id": "a", "title": "title", "source": "1"}
+	if len(content) != 1 || len(content[0]) != len(want) {
+		t.Fatalf("Got %v, want [%v]", content, want)
+	}
+	for field, value := range want {
+		if content[0][field] != value {
+			t.Errorf("Got %s %v, want %v", field, content[0][field], value)
+		}
+	}
+}
+
+func TestCompactItemsKeepRequiredAndProjectedFields(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{
+		Provider1: FixedContentProvider{Items: []*ContentItem{{Title: "title"}}},
+	}, WithCompactItems(), WithFallbackAnnotations())
+
+	var content []map[string]interface{}
+	if err := json.NewDecoder(runRawRequest(srv, "/?count=1&fields=id,summary,title").Body).Decode(&content); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	if len(content) != 1 {
+		t.Fatalf("Got %d items, want 1", len(content))
+	}
+	if _, ok := content[0]["id"]; !ok {
+		t.Error("Got no id, want it kept while empty")
+	}
+	if _, ok := content[0]["summary"]; ok {
+		t.Error("Got an empty summary, want it omitted")
+	}
+	if content[0]["title"] != "title" || content[0]["provider"] != "1" {
+		t.Errorf("Got %v, want the title and provider", content[0])
+	}
+}
+
+func TestEmptyFieldsAreKeptByDefault(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{
+		Provider1: FixedContentProvider{Items: []*ContentItem{{ID: "a"}}},
+	})
+
+	var content []map[string]interface{}
+	if err := json.NewDecoder(runRawRequest(srv, "/?count=1").Body).Decode(&content); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	for _, field := range []string{"title", "summary", "link", "expiry"} {
+		if _, ok := content[0][field]; !ok {
+			t.Errorf("Got no %s, want every field", field)
+		}
+	}
+}
+
+func TestFieldNamesFollowTheConfiguredStyle(t *testing.T) {
+	clients := map[Provider]Client{
+		Provider1: FixedContentProvider{Items: []*ContentItem{{ID: "a", Title: "title", Source: "1"}}},
+	}
+	tests := []struct {
+		name    string
+		options []Option
+		target  string
+		want    []string
+	}{
+		{"default", nil, "/?count=1", []string{"id", "title", "source", "summary", "link", "expiry"}},
+		{"pascal case", []Option{WithFieldNames(nil, PascalCase)}, "/?count=1", []string{"Id", "Title", "Source", "Summary", "Link", "Expiry"}},
+		{"renamed", []Option{WithFieldNames(map[string]string{"id": "uuid", "expiry": "expires_at"}, SnakeCase)}, "/?count=1", []string{"uuid", "title", "source", "summary", "link", "expires_at"}},
+		{"renamed pascal case", []Option{WithFieldNames(map[string]string{"id": "ID"}, PascalCase), WithFallbackAnnotations()}, "/?count=1", []string{"ID", "Title", "Source", "Summary", "Link", "Expiry", "Provider", "Fallback"}},
+		{"projected", []Option{WithFieldNames(nil, PascalCase)}, "/?count=1&fields=id,title", []string{"Id", "Title"}},
+		{"summary", []Option{WithFieldNames(nil, PascalCase)}, "/?count=1&summary=true", []string{"Id", "Source"}},
+	}
+	for _, test := range tests {
+		srv, err := NewApp(ContentMix{config4}, clients, test.options...)
+		if err != nil {
+			t.Fatalf("%s: Could not create app: %v", test.name, err)
+		}
+
+		var content []map[string]interface{}
+		if err := json.NewDecoder(runRawRequest(srv, test.target).Body).Decode(&content); err != nil {
+			t.Fatalf("%s: couldn't decode Response json: %v", test.name, err)
+		}
+		if len(content) != 1 || len(content[0]) != len(test.want) {
+			t.Fatalf("%s: Got %v, want fields %v", test.name, content, test.want)
+		}
+		for _, field := range test.want {
+			if _, ok := content[0][field]; !ok {
+				t.Errorf("%s: Got %v, want field %s", test.name, content[0], field)
+			}
+		}
+	}
+}
+
+func TestFieldNamesAreValidated(t *testing.T) {
+	for name, names := range map[string]map[string]string{
+		"unknown field": {"headline": "title"},
+		"duplicate":     {"title": "name", "summary": "name"},
+		"taken":         {"summary": "title"},
+	} {
+		if _, err := NewApp(DefaultConfig, sampleClients(), WithFieldNames(names, SnakeCase)); err == nil {
+			t.Errorf("%s: Got no error", name)
+		}
+	}
+}
+
+func TestPrettyResponsesAreIndented(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithCache(time.Minute), WithResponseEnvelope())
+
+	compact := runRawRequest(srv, "/?count=3").Body.String()
+	pretty := runRawRequest(srv, "/?count=3&pretty=true").Body.String()
+
+	if strings.Contains(compact, "\n ") {
+		t.Errorf("Got indented response by default:\n%s", compact)
+	}
+	var want bytes.Buffer
+	if err := json.Indent(&want, []byte(compact), "", "  "); err != nil {
+		t.Fatalf("Could not indent response: %v", err)
+	}
+	if strings.TrimSpace(pretty) != strings.TrimSpace(want.String()) {
+		t.Errorf("Got pretty response:\n%s\nwant:\n%s", pretty, want.String())
+	}
+	if response := runRawRequest(srv, "/?count=3&pretty=yes"); response.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for an invalid pretty parameter, want 400", response.Code)
+	}
+}
+
+func TestPrettyResponsesAreNotStreamed(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithStreaming(1))
+
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, httptest.NewRequest("GET", "/?count=3&pretty=true", nil))
+
+	if response.Flushed {
+		t.Error("Pretty response was streamed")
+	}
+	if body := response.Body.String(); !strings.HasPrefix(body, "[\n  {\n    \"id\": ") {
+		t.Errorf("Got response which is not indented:\n%s", body)
+	}
+}
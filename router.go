@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Surface is one of the content surfaces served by a Router: an App serving
+// Config under Prefix, e.g. "/news", configured by Options. Name labels the
+// surface's metrics.
+type Surface struct {
+	Name    string
+	Prefix  string
+	Config  ContentMix
+	Options []Option
+}
+
+// Router serves several Surfaces, each an App with its own Config, from
+// distinct path prefixes. Every surface sees the path below its prefix, so
+// that e.g. /news/mix/top is /mix/top of the news surface. The surfaces share
+// their clients and, if there is one, the Cache, in which their pages are
+// kept apart. Clients must not be registered or deregistered on the
+// surfaces, as they share the clients map. /metrics reports the metrics of
+// every surface, labelled by its name.
+type Router struct {
+	// surfaces are ordered by descending length of their prefix, so that
+	// the most specific prefix matches first
+	surfaces []routedSurface
+}
+
+type routedSurface struct {
+	name   string
+	prefix string
+	app    *App
+}
+
+// routerMetricsPath serves the metrics of all surfaces
+const routerMetricsPath = "/metrics"
+
+// NewRouter creates an App for every surface with the given clients. If cache
+// is not nil, it replaces the Cache of every surface. It fails if a surface's
+// name or prefix is missing or taken, or if one of the Apps cannot be
+// created.
+func NewRouter(clients map[Provider]Client, cache *PageCache, surfaces ...Surface) (*Router, error) {
+	if len(surfaces) == 0 {
+		return nil, errors.New("router needs at least one surface")
+	}
+	router := &Router{}
+	names := map[string]bool{}
+	prefixes := map[string]bool{}
+	for _, surface := range surfaces {
+		if surface.Name == "" {
+			return nil, errors.New("surface name must not be empty")
+		}
+		if !strings.HasPrefix(surface.Prefix, "/") || (surface.Prefix != "/" && strings.HasSuffix(surface.Prefix, "/")) {
+			return nil, fmt.Errorf("surface %q: prefix %q must start and must not end with /", surface.Name, surface.Prefix)
+		}
+		if surface.Prefix == routerMetricsPath {
+			return nil, fmt.Errorf("surface %q: prefix %s is taken by the metrics", surface.Name, routerMetricsPath)
+		}
+		if names[surface.Name] || prefixes[surface.Prefix] {
+			return nil, fmt.Errorf("surface %q: name or prefix %s is taken", surface.Name, surface.Prefix)
+		}
+		names[surface.Name], prefixes[surface.Prefix] = true, true
+
+		opts := append([]Option{withSurface(surface.Name)}, surface.Options...)
+		if cache != nil {
+			opts = append(opts, func(a *App) { a.Cache = cache })
+		}
+		app, err := NewApp(surface.Config, clients, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("surface %q: %v", surface.Name, err)
+		}
+		router.surfaces = append(router.surfaces, routedSurface{name: surface.Name, prefix: surface.Prefix, app: app})
+	}
+	sort.SliceStable(router.surfaces, func(i, j int) bool {
+		return len(router.surfaces[i].prefix) > len(router.surfaces[j].prefix)
+	})
+	return router, nil
+}
+
+// withSurface names the surface an App serves for a Router
+func withSurface(name string) Option {
+	return func(a *App) { a.surface = name }
+}
+
+// Surface returns the App of the named surface, or nil if there is none
+func (r *Router) Surface(name string) *App {
+	for _, surface := range r.surfaces {
+		if surface.name == name {
+			return surface.app
+		}
+	}
+	return nil
+}
+
+// ServeHTTP passes requests on to the surface whose prefix they start with,
+// with the prefix removed from their path
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == routerMetricsPath {
+		if allowMethods(w, req, http.MethodGet, http.MethodHead) {
+			r.serveMetrics(w, req)
+		}
+		return
+	}
+	for _, surface := range r.surfaces {
+		if path, ok := trimPrefix(req.URL.Path, surface.prefix); ok {
+			routed := req.Clone(req.Context())
+			routed.URL.Path = path
+			routed.URL.RawPath = ""
+			surface.app.ServeHTTP(w, routed)
+			return
+		}
+	}
+	sendError(w, http.StatusNotFound, fmt.Sprintf("unknown path %s", req.URL.Path))
+}
+
+// trimPrefix returns the path below prefix, which is "/" for the prefix
+// itself, and whether path is below prefix at all
+func trimPrefix(path, prefix string) (string, bool) {
+	if prefix == "/" {
+		return path, true
+	}
+	if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+		return "", false
+	}
+	if path = strings.TrimPrefix(path, prefix); path == "" {
+		path = "/"
+	}
+	return path, true
+}
+
+// serveMetrics reports the metrics of every surface which has them, as an
+// object keyed by surface name, or in the Prometheus text format with a
+// surface label
+func (r *Router) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	snapshots := map[string]metricsSnapshot{}
+	for _, surface := range r.surfaces {
+		if surface.app.Metrics != nil {
+			snapshots[surface.name] = surface.app.Metrics.snapshot()
+		}
+	}
+	if len(snapshots) == 0 {
+		sendError(w, http.StatusNotFound, "metrics are disabled")
+		return
+	}
+	if wantsPrometheus(req) {
+		w.Header().Set("Content-Type", prometheusContentType)
+		writeSurfacesPrometheus(w, snapshots)
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshots)
+}
+
+// writeSurfacesPrometheus writes the metrics of several surfaces in the
+// Prometheus text format. Every family is described once, followed by the
+// samples of every surface, which carry the surface's name as label.
+func writeSurfacesPrometheus(w io.Writer, snapshots map[string]metricsSnapshot) {
+	names := make([]string, 0, len(snapshots))
+	for name := range snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var families []string
+	headers := map[string][]string{}
+	samples := map[string][]string{}
+	for i, name := range names {
+		var buffer bytes.Buffer
+		writePrometheus(&buffer, snapshots[name])
+		family := ""
+		scanner := bufio.NewScanner(&buffer)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "# ") {
+				if fields := strings.Fields(line); len(fields) > 2 {
+					family = fields[2]
+				}
+				if i == 0 {
+					if _, ok := headers[family]; !ok {
+						families = append(families, family)
+					}
+					headers[family] = append(headers[family], line)
+				}
+				continue
+			}
+			samples[family] = append(samples[family], withLabel(line, "surface", name))
+		}
+	}
+
+	for _, family := range families {
+		for _, line := range headers[family] {
+			fmt.Fprintln(w, line)
+		}
+		for _, line := range samples[family] {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// withLabel adds a label to a sample line in the Prometheus text format
+func withLabel(sample, label, value string) string {
+	pair := fmt.Sprintf("%s=\"%s\"", label, escapeLabel(value))
+	i := strings.IndexAny(sample, "{ ")
+	switch {
+	case i < 0:
+		return sample
+	case sample[i] == ' ':
+		return sample[:i] + "{" + pair + "}" + sample[i:]
+	case strings.HasPrefix(sample[i:], "{}"):
+		return sample[:i+1] + pair + sample[i+1:]
+	default:
+		return sample[:i+1] + pair + "," + sample[i+1:]
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func surfaceRouter(t *testing.T) (*Router, []*CountingContentProvider) {
+	clients, counters := countingClients()
+	router, err := NewRouter(clients, NewPageCache(time.Minute),
+		Surface{Name: "news", Prefix: "/news", Config: ContentMix{config4}},
+		Surface{Name: "video", Prefix: "/video", Config: ContentMix{config2}, Options: []Option{WithMix("trending", ContentMix{config3})}},
+	)
+	if err != nil {
+		t.Fatalf("Could not create router: %v", err)
+	}
+	return router, counters
+}
+
+func TestRouterServesEverySurfaceWithItsConfig(t *testing.T) {
+	router, counters := surfaceRouter(t)
+
+	for _, test := range []struct {
+		target    string
+		providers string
+	}{
+		{"/news?count=3", "111"},
+		{"/video/?count=3", "222"},
+		{"/video/mix/trending?count=3", "333"},
+	} {
+		content := runRequest(t, router, httptest.NewRequest("GET", test.target, nil))
+		if got := providerSequence(content); got != test.providers {
+			t.Errorf("%s: Got providers %s, want %s", test.target, got, test.providers)
+		}
+	}
+
+	calls := totalCalls(counters)
+	runRequest(t, router, httptest.NewRequest("GET", "/video?count=3", nil))
+	if totalCalls(counters) != calls {
+		t.Error("Cached page of the shared cache was fetched again")
+	}
+
+	if response := runRawRequest(router, "/music?count=3"); response.Code != http.StatusNotFound {
+		t.Errorf("Got status %d for a path without surface, want 404", response.Code)
+	}
+}
+
+func TestRouterMetricsAreLabelledBySurface(t *testing.T) {
+	router, _ := surfaceRouter(t)
+	runRawRequest(router, "/news?count=1")
+	runRawRequest(router, "/news?count=1&offset=1")
+	runRawRequest(router, "/video?count=1")
+
+	body := scrapePrometheus(t, router)
+	for _, want := range []string{
+		`content_request_duration_seconds_count{surface="news"} 2`,
+		`content_request_duration_seconds_count{surface="video"} 1`,
+		`content_provider_fetches_total{surface="news",provider="1",outcome="success"} 2`,
+		`content_provider_fetches_total{surface="video",provider="2",outcome="success"} 1`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("Metrics are missing %s:\n%s", want, body)
+		}
+	}
+	if n := strings.Count(body, "# TYPE content_request_duration_seconds histogram"); n != 1 {
+		t.Errorf("Got the request histogram described %d times, want once", n)
+	}
+}
+
+func TestRouterSurfacesAreValidated(t *testing.T) {
+	clients := sampleClients()
+	for name, surfaces := range map[string][]Surface{
+		"no surfaces":     nil,
+		"no name":         {{Prefix: "/news", Config: DefaultConfig}},
+		"no slash":        {{Name: "news", Prefix: "news", Config: DefaultConfig}},
+		"trailing slash":  {{Name: "news", Prefix: "/news/", Config: DefaultConfig}},
+		"metrics prefix":  {{Name: "metrics", Prefix: "/metrics", Config: DefaultConfig}},
+		"same prefix":     {{Name: "a", Prefix: "/news", Config: DefaultConfig}, {Name: "b", Prefix: "/news", Config: DefaultConfig}},
+		"invalid options": {{Name: "news", Prefix: "/news", Config: DefaultConfig, Options: []Option{WithMaxCount(-1)}}},
+	} {
+		if _, err := NewRouter(clients, nil, surfaces...); err == nil {
+			t.Errorf("%s: Got no error", name)
+		}
+	}
+}
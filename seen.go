@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// seenItemsHeader lists the IDs of items a client has already shown,
+// separated by commas, e.g. for infinite scrolling. seenFilterHeader carries
+// them as a SeenFilter instead, which is far smaller for long sessions.
+const (
+	seenItemsHeader  = "X-Seen-Items"
+	seenFilterHeader = "X-Seen-Filter"
+)
+
+// SeenFilter is a Bloom filter of item IDs, which clients send as
+// X-Seen-Filter in the form "{hashes}.{bits}", the bits being encoded as
+// unpadded URL-safe base64. Bit i is bit i%8 of byte i/8, counting from the
+// least significant one. An ID sets the bits (h1 + j*h2) mod m for j below
+// the number of hashes, where m is the number of bits and h1 and h2 are the
+// 64-bit FNV-1a and FNV-1 hashes of the ID. Items the filter wrongly takes
+// for seen are skipped like seen ones.
+type SeenFilter struct {
+	Hashes int
+	Bits   []byte
+}
+
+// NewSeenFilter creates an empty filter of the given size in bytes
+func NewSeenFilter(bytes, hashes int) *SeenFilter {
+	return &SeenFilter{Hashes: hashes, Bits: make([]byte, bytes)}
+}
+
+// ParseSeenFilter reads a filter in the form of the X-Seen-Filter header
+func ParseSeenFilter(value string) (*SeenFilter, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("seen filter must be given as hashes.bits")
+	}
+	hashes, err := strconv.Atoi(parts[0])
+	if err != nil || hashes < 1 {
+		return nil, errors.New("seen filter must use at least one hash")
+	}
+	bits, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(bits) == 0 {
+		return nil, errors.New("seen filter bits must be non-empty unpadded URL-safe base64")
+	}
+	return &SeenFilter{Hashes: hashes, Bits: bits}, nil
+}
+
+// String returns the filter in the form of the X-Seen-Filter header
+func (f *SeenFilter) String() string {
+	return strconv.Itoa(f.Hashes) + "." + base64.RawURLEncoding.EncodeToString(f.Bits)
+}
+
+// Add sets the bits of id
+func (f *SeenFilter) Add(id string) {
+	for _, bit := range f.positions(id) {
+		f.Bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// Contains reports whether all bits of id are set, i.e. whether id was
+// probably added
+func (f *SeenFilter) Contains(id string) bool {
+	for _, bit := range f.positions(id) {
+		if f.Bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *SeenFilter) positions(id string) []uint64 {
+	h1, h2 := fnv.New64a(), fnv.New64()
+	h1.Write([]byte(id))
+	h2.Write([]byte(id))
+	m := uint64(len(f.Bits)) * 8
+	positions := make([]uint64, f.Hashes)
+	for j := range positions {
+		positions[j] = (h1.Sum64() + uint64(j)*h2.Sum64()) % m
+	}
+	return positions
+}
+
+// seenSet holds the items a client has already seen, by ID
+type seenSet struct {
+	ids    map[string]bool
+	filter *SeenFilter
+}
+
+func (s *seenSet) contains(id string) bool {
+	return s.ids[id] || (s.filter != nil && s.filter.Contains(id))
+}
+
+// parseSeen reads the items the client has seen, if seen items are enabled.
+// Only the first MaxSeenItems IDs of X-Seen-Items are honoured, and filters
+// larger than MaxSeenFilterBytes are ignored, so that clients with long
+// sessions still get pages, if with items they may have seen. What was
+// ignored is described by the returned notes, for the caller to log.
+// Malformed filters are rejected.
+func (a *App) parseSeen(req *http.Request) (*seenSet, []string, error) {
+	seen := &seenSet{}
+	var ignored []string
+	if a.MaxSeenItems > 0 {
+	values:
+		for _, value := range req.Header.Values(seenItemsHeader) {
+			for _, id := range strings.Split(value, ",") {
+				if id = strings.TrimSpace(id); id == "" {
+					continue
+				}
+				if len(seen.ids) == a.MaxSeenItems {
+					ignored = append(ignored, fmt.Sprintf("seen items beyond the first %d", a.MaxSeenItems))
+					break values
+				}
+				if seen.ids == nil {
+					seen.ids = map[string]bool{}
+				}
+				seen.ids[id] = true
+			}
+		}
+	}
+	if value := req.Header.Get(seenFilterHeader); value != "" && a.MaxSeenFilterBytes > 0 {
+		filter, err := ParseSeenFilter(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(filter.Bits) > a.MaxSeenFilterBytes {
+			ignored = append(ignored, fmt.Sprintf("a seen filter of %d bytes, more than %d", len(filter.Bits), a.MaxSeenFilterBytes))
+		} else if filter.Hashes > maxSeenFilterHashes {
+			return nil, nil, fmt.Errorf("seen filter must not use more than %d hashes", maxSeenFilterHashes)
+		} else {
+			seen.filter = filter
+		}
+	}
+	if seen.ids == nil && seen.filter == nil {
+		return nil, ignored, nil
+	}
+	return seen, ignored, nil
+}
+
+// maxSeenFilterHashes bounds the work a filter may cause per item
+const maxSeenFilterHashes = 16
+
+type seenKey struct{}
+
+func contextWithSeen(ctx context.Context, seen *seenSet) context.Context {
+	if seen == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, seenKey{}, seen)
+}
+
+// seenByClient reports whether the client of the request of ctx has already
+// seen the item
+func seenByClient(ctx context.Context, item *ContentItem) bool {
+	seen, _ := ctx.Value(seenKey{}).(*seenSet)
+	return seen != nil && seen.contains(item.ID)
+}
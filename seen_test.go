@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seenApp serves the items a, b, c of provider 1 and x, y, z of provider 2
+// in turn, fetching spare items to replace seen ones
+func seenApp(opts ...Option) *App {
+	srv, _ := NewApp(ContentMix{{Type: Provider1}, {Type: Provider2}}, map[Provider]Client{
+		Provider1: fixedItems(Provider1, "a", "b", "c"),
+		Provider2: fixedItems(Provider2, "x", "y", "z"),
+	}, append([]Option{WithOverFetch(2)}, opts...)...)
+	return srv
+}
+
+func TestSeenItemsAreSkippedAndBackfilled(t *testing.T) {
+	srv := seenApp(WithSeenItems(10, 0))
+	req := httptest.NewRequest("GET", "/?count=4", nil)
+	req.Header.Set(seenItemsHeader, "a, y")
+
+	content := runRequest(t, srv, req)
+
+	if ids := itemIDs(content); ids != "b,x,c,z" {
+		t.Errorf("Got items %s, want b,x,c,z without the seen a and y", ids)
+	}
+}
+
+func TestSeenFilterItemsAreSkippedAndBackfilled(t *testing.T) {
+	srv := seenApp(WithSeenItems(0, 64))
+	filter := NewSeenFilter(64, 3)
+	filter.Add("b")
+	filter.Add("x")
+	req := httptest.NewRequest("GET", "/?count=4", nil)
+	req.Header.Set(seenFilterHeader, filter.String())
+
+	content := runRequest(t, srv, req)
+
+	if ids := itemIDs(content); ids != "a,y,c,z" {
+		t.Errorf("Got items %s, want a,y,c,z without the seen b and x", ids)
+	}
+}
+
+func TestSeenItemsBeyondTheLimitAreIgnored(t *testing.T) {
+	srv := seenApp(WithSeenItems(1, 0))
+	req := httptest.NewRequest("GET", "/?count=4", nil)
+	req.Header.Add(seenItemsHeader, "a,x")
+	req.Header.Add(seenItemsHeader, "y")
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	content := runRequest(t, srv, req)
+
+	if ids := itemIDs(content); ids != "b,x,c,y" {
+		t.Errorf("Got items %s, want b,x,c,y with only a skipped", ids)
+	}
+	if count := strings.Count(logs.String(), "ignoring seen items"); count != 1 {
+		t.Errorf("Ignored seen items were logged %d times, want once", count)
+	}
+}
+
+func TestOversizedSeenFilterIsIgnored(t *testing.T) {
+	srv := seenApp(WithSeenItems(0, 8))
+	filter := NewSeenFilter(16, 3)
+	filter.Add("a")
+	req := httptest.NewRequest("GET", "/?count=2", nil)
+	req.Header.Set(seenFilterHeader, filter.String())
+
+	content := runRequest(t, srv, req)
+
+	if ids := itemIDs(content); ids != "a,x" {
+		t.Errorf("Got items %s, want a,x as the filter is too large", ids)
+	}
+}
+
+func TestMalformedSeenFilterIsRejected(t *testing.T) {
+	srv := seenApp(WithSeenItems(0, 64))
+	for _, value := range []string{"AAAA", "0.AAAA", "3.!!", "3.", "99.AAAA"} {
+		req := httptest.NewRequest("GET", "/?count=2", nil)
+		req.Header.Set(seenFilterHeader, value)
+		response := httptest.NewRecorder()
+
+		srv.ServeHTTP(response, req)
+
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("%q: Got status %d, want 400", value, response.Code)
+		}
+	}
+}
+
+func TestSeenItemsAreIgnoredUnlessEnabled(t *testing.T) {
+	srv := seenApp()
+	req := httptest.NewRequest("GET", "/?count=2", nil)
+	req.Header.Set(seenItemsHeader, "a")
+	req.Header.Set(seenFilterHeader, "not a filter")
+
+	content := runRequest(t, srv, req)
+
+	if ids := itemIDs(content); ids != "a,x" {
+		t.Errorf("Got items %s, want a,x", ids)
+	}
+}
+
+func TestPagesWithSeenItemsAreNotCached(t *testing.T) {
+	srv := seenApp(WithSeenItems(10, 0), WithCache(time.Minute))
+	req := httptest.NewRequest("GET", "/?count=2", nil)
+	req.Header.Set(seenItemsHeader, "a")
+	runRequest(t, srv, req)
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=2", nil))
+
+	if ids := itemIDs(content); ids != "a,x" {
+		t.Errorf("Got items %s, want a,x unaffected by the other client's seen items", ids)
+	}
+}
+
+func TestSeenFilterRoundTrips(t *testing.T) {
+	filter := NewSeenFilter(32, 4)
+	for _, id := range []string{"a", "b", "c"} {
+		filter.Add(id)
+	}
+
+	parsed, err := ParseSeenFilter(filter.String())
+	if err != nil {
+		t.Fatalf("Could not parse filter: %v", err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if !parsed.Contains(id) {
+			t.Errorf("Parsed filter does not contain %s", id)
+		}
+	}
+	if strings.Contains(filter.String(), "=") {
+		t.Errorf("Got padded filter %s", filter.String())
+	}
+}
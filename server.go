@@ -1,18 +1,957 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // App represents the server's internal state.
 // It holds configuration about providers and content
 type App struct {
+	// ContentClients and Config must not be modified while the server is
+	// running, use RegisterClient, DeregisterClient and ReloadConfig
+	// instead.
 	ContentClients map[Provider]Client
 	Config         ContentMix
+
+	// Mixes are additional configs which are served under /mix/{name},
+	// e.g. for different client surfaces. Config is served under /.
+	Mixes map[string]ContentMix
+
+	// Experiment serves one of several Mixes instead of Config to every
+	// user, for A/B tests. Responses of variants are not cached by
+	// clients, as they differ by user. nil serves Config to everybody.
+	Experiment *Experiment
+
+	// SelectMix may rewrite the mix to serve based on the request's headers,
+	// e.g. to swap in a region-specific provider. It must not call providers
+	// or have other side effects. Rewritten mixes are neither cached by the
+	// server nor by clients, as they vary by header.
+	SelectMix MixSelector
+
+	// AdsMix is interleaved with every mix served, putting its configs
+	// into every AdsInterval-th slot, e.g. the 4th, 8th and so on, in the
+	// order they are listed. The other slots follow the mix's rotation as
+	// if there were no ads. Slots of failed ads are not backfilled.
+	// Empty disables it.
+	AdsMix      ContentMix
+	AdsInterval int
+
+	// TierSelection decides which provider of a config's tier is tried
+	// first. Defaults to round-robin.
+	TierSelection TierSelection
+
+	// RandSource drives random choices such as TierRandom and MaxJitter,
+	// so that they can be reproduced by seeding it with a fixed value.
+	// NewApp defaults it to a source seeded with the current time, nil
+	// uses the global source of math/rand.
+	RandSource rand.Source
+
+	// AdaptiveFallbacks tries the providers of every tier but the first in
+	// the order of their success rate so far, as recorded by the Metrics,
+	// rather than according to TierSelection.
+	AdaptiveFallbacks bool
+
+	// RaceTiers calls all providers of a config at once rather than trying
+	// the fallbacks only once the preferred providers failed, and uses the
+	// first to deliver. The others are cancelled as soon as it does. This
+	// cuts the latency of failing providers at the cost of calling fallbacks
+	// which are not needed.
+	RaceTiers bool
+
+	// DefaultFallback is used for every config which has no Fallback of
+	// its own. nil means such configs have no fallback.
+	DefaultFallback *Provider
+
+	// MaxInFlight is how many content requests may be served at once.
+	// Further ones are shed with a 503 unless they can be queued. 0 means
+	// no limit.
+	MaxInFlight int
+
+	// MaxQueued requests beyond MaxInFlight wait for up to MaxQueueWait
+	// for a running one to finish rather than being shed straight away, so
+	// that bursts are smoothed out. 0 queues none.
+	MaxQueued    int
+	MaxQueueWait time.Duration
+
+	// LogicalTotal is the length of the content, if it is finite. Items at
+	// positions past it are not served, so that requests beyond the end
+	// get an empty list rather than the mix repeating endlessly. 0 means
+	// the content has no end.
+	LogicalTotal int
+
+	// MaxCount is the largest count a client may ask for. 0 means no limit.
+	// RangePolicy decides whether Range headers spanning more items are
+	// rejected or cut short.
+	MaxCount    int
+	RangePolicy RangePolicy
+
+	// RequestTimeout limits how long a request waits for its providers.
+	// Configs which did not deliver in time are treated as failed. The
+	// deadline of the request's own context, if sooner, limits it further.
+	// 0 means no limit other than that deadline.
+	RequestTimeout time.Duration
+
+	// ProviderTimeouts limits how long each call to a provider may take,
+	// after which its fallback is tried. Providers not listed here use
+	// DefaultProviderTimeout, 0 means they are only limited by the request.
+	// A call never gets more than what is left of the request's budget, so
+	// that a fallback called after its primary used up most of the budget
+	// only gets the remainder rather than a timeout of its own.
+	ProviderTimeouts       map[Provider]time.Duration
+	DefaultProviderTimeout time.Duration
+
+	// CoalesceFetches lets concurrent calls to the same provider for the
+	// same count share one call, if they are for users in the same network,
+	// see userIPBucket. Those users then get the same items.
+	CoalesceFetches bool
+
+	// BatchSizes bounds how many items providers may be asked for in one
+	// call. Fewer items are fetched as the minimum and trimmed, more as
+	// several batches. Batches may also be aligned to a multiple of items
+	// the provider prefers, the surplus is trimmed as well. Providers not
+	// listed here take any count.
+	BatchSizes map[Provider]BatchSize
+
+	// SlowProviderP99 makes configs whose primary provider's 99th
+	// percentile latency exceeds it give up part of their slots to the
+	// other configs, see degradeSlowConfigs. DegradedShare is the share of
+	// its slots a slow config keeps. 0 disables this.
+	SlowProviderP99 time.Duration
+	DegradedShare   float64
+
+	// LiveInterval is how often the live feed at /live fetches its page
+	// again to send the new items, see serveLive. 0 disables the live feed.
+	LiveInterval time.Duration
+
+	// ExpensiveProviders are only called for the slots which the other
+	// providers cannot fill, e.g. because they charge per call, see
+	// fetchStaged. This costs a round trip whenever the cheap providers fall
+	// short. It cannot be combined with backfill or FirstToRespond.
+	ExpensiveProviders map[Provider]bool
+
+	// MaxJitter spreads the provider calls of a request by delaying each
+	// of them randomly by up to this long. 0 calls all of them at once.
+	MaxJitter time.Duration
+
+	// MaxRetryWait is the longest backoff hint of a throttling provider that
+	// is waited for before retrying it. Longer hints, or ones exceeding the
+	// request's remaining time, go to the fallback straight away.
+	MaxRetryWait time.Duration
+
+	// EmptyResponsePolicy decides how a request which yields no items at
+	// all is answered. Defaults to a 200 with an empty JSON array.
+	EmptyResponsePolicy EmptyResponsePolicy
+
+	// MaxResponseBytes limits the size of a content response. Larger ones
+	// are handled according to the OversizePolicy. 0 means no limit.
+	MaxResponseBytes int
+	OversizePolicy   OversizePolicy
+
+	// StrictFields rejects requests asking for unknown fields with a 400
+	// instead of ignoring those fields.
+	StrictFields bool
+
+	// LenientQuery accepts repeated count and offset parameters by using
+	// their first value. By default such requests are rejected with a 400.
+	LenientQuery bool
+
+	// DeduplicateBy is the JSON name of the ContentItem field which
+	// identifies an item, e.g. "id" or "link". If set, items that were
+	// already returned for a request are skipped, in favour of the surplus
+	// items a provider returned and spare items asked for with the
+	// OverFetchFactor. Empty disables it.
+	DeduplicateBy string
+
+	// DeduplicationPriority decides which provider's version of a duplicate
+	// item is kept, e.g. the one with richer metadata: an item whose
+	// provider has a higher priority takes the place of its duplicate which
+	// was returned earlier in the page, and the duplicate's config moves on
+	// to its next item. Providers which are not listed have priority 0.
+	// Without it, or with FirstToRespond, the first item returned is kept.
+	DeduplicationPriority map[Provider]int
+
+	// MaxSeenItems is the number of IDs of X-Seen-Items which are honoured,
+	// MaxSeenFilterBytes the size of the largest X-Seen-Filter which is. The
+	// items a client lists as seen are skipped like duplicates, in favour of
+	// surplus and spare items, and their pages are not cached. IDs beyond
+	// the limit and larger filters are ignored. 0 disables the respective
+	// header.
+	MaxSeenItems       int
+	MaxSeenFilterBytes int
+
+	// MixStrategy decides how Config is laid out over the requested items.
+	// Defaults to repeating it in order.
+	MixStrategy MixStrategy
+
+	// OverFetchFactor asks every provider for this many times the items it
+	// is needed for, so that deduplication, validation and backfill have
+	// spare items without another round trip. The response still holds
+	// at most count items. Values up to 1 disable it.
+	OverFetchFactor float64
+
+	// StrictMode fails a request with a 502 if any of its configs could not
+	// be fetched from either its provider or its fallback, rather than
+	// returning the items up to that point.
+	StrictMode bool
+
+	// MaxBackfillPasses enables filling the slots of failed configs with
+	// items of the healthy ones, continuing the mix's rotation. Each pass
+	// fetches the additional items needed, passes stop once the page is
+	// full or nothing else failed. 0 cuts the list off at the first
+	// failed config instead.
+	MaxBackfillPasses int
+
+	// MaxItemsPerProvider caps how many items of a page any provider may
+	// deliver, so that a provider serving several configs, e.g. as their
+	// fallback, does not dominate the page. The slots beyond the quota go to
+	// the other providers of the mix, see applyQuota. 0 disables the quota.
+	MaxItemsPerProvider int
+
+	// EmergencyContent is served, e.g. from LoadEmergencyContent, as a last
+	// resort when every provider and fallback of a request failed, so that
+	// clients get something rather than an error or an empty page. Requests
+	// page through it by their offset and count. Its items are marked as
+	// Emergency and responses carry X-Emergency-Content. nil disables it.
+	EmergencyContent []*ContentItem
+
+	// DefaultItem fills the slots of configs none of whose providers
+	// delivered, e.g. with a house ad, instead of cutting the list off.
+	// Its copies are marked as Placeholder. Pages holding placeholders
+	// are not cached. nil disables it.
+	DefaultItem *ContentItem
+
+	// LessItem sorts the items of every page, e.g. by recency, once they
+	// were assembled. Items it considers equal keep the order of the mix.
+	// nil keeps the order of the mix.
+	LessItem func(a, b *ContentItem) bool
+
+	// FirstToRespond returns pages as soon as the configs which responded
+	// first delivered enough items between them, rather than waiting for the
+	// slowest providers, see fetchFirstToRespond. It gives up the order and
+	// proportions of the mix, so it requires LessItem to order the pages.
+	FirstToRespond bool
+
+	// ValidateItem checks every item a provider returned before it is
+	// used, e.g. RequireFields("id", "source"). nil accepts all items.
+	ValidateItem func(*ContentItem) error
+
+	// InvalidItemPolicy decides whether items failing ValidateItem are
+	// dropped, fail the request or fail their provider's response.
+	// Defaults to dropping them.
+	InvalidItemPolicy InvalidItemPolicy
+
+	// CacheMaxAge lets clients and intermediaries cache successful
+	// responses for this long via Cache-Control and Expires. 0 marks
+	// responses as no-store.
+	CacheMaxAge time.Duration
+
+	// NoStoreMixes lists named mixes whose responses must never be cached,
+	// regardless of CacheMaxAge.
+	NoStoreMixes map[string]bool
+
+	// Cache stores assembled pages, so that repeated requests for the same
+	// offset and count do not call the providers again. nil disables it.
+	Cache *PageCache
+
+	// StreamMinCount streams responses for at least this many items,
+	// sending items as soon as their providers delivered rather than once
+	// the whole page is assembled, see streamPage. 0 disables it.
+	StreamMinCount int
+
+	// OrderedFanOut collects the results of a request's concurrent fetches
+	// in the order of the mix rather than as they arrive, which makes the
+	// logs reproducible for tests and debugging.
+	OrderedFanOut bool
+
+	// AdminToken has to be sent as bearer token to the admin endpoints
+	// which change the server's state, such as flushing the cache. Empty
+	// disables those endpoints.
+	AdminToken string
+
+	// CursorKey signs the cursors handed out to clients, so that they
+	// cannot be forged. If it is empty, a random key is used, whose cursors
+	// are only accepted by the same App, i.e. neither after a restart nor
+	// by other instances.
+	CursorKey []byte
+
+	// WarmupCount is how many items of the Config Warmup fetches into the
+	// Cache. Requests for the first page with exactly this count are then
+	// served from the cache.
+	WarmupCount int
+
+	// Health probes the providers whose clients are HealthCheckers before
+	// they are called, going to the fallback straight away if they are
+	// down. Probe results are kept for the cache's TTL. nil never probes.
+	Health *HealthCache
+
+	// Idempotency keeps the responses to custom mix requests carrying an
+	// Idempotency-Key. nil ignores the header.
+	Idempotency *IdempotencyCache
+
+	// Prefetch fetches the next page into the Cache in the background
+	// after a page has been served.
+	Prefetch bool
+
+	// Metrics records request and provider latencies for /metrics. nil
+	// disables them.
+	Metrics *Metrics
+
+	// ContentPaths are the paths the Config is served under, e.g. "/feed".
+	// Other paths which are not endpoints of their own are not found.
+	// Empty serves the Config under "/" only.
+	ContentPaths []string
+
+	// ClientIPFunc returns the IP of a request's client, which is passed to
+	// the providers and buckets users into Experiment variants, e.g.
+	// ForwardedForIP behind a proxy or one reading a CDN's header such as
+	// CF-Connecting-IP. nil uses the RemoteIP.
+	ClientIPFunc func(req *http.Request) string
+
+	// Tracer records a span for every request and a child span for every
+	// fetch of a config. nil records nothing.
+	Tracer Tracer
+
+	// mu guards ContentClients and Config
+	mu sync.RWMutex
+
+	// randMu guards rand, which is created from RandSource on first use
+	randMu sync.Mutex
+	rand   *rand.Rand
+
+	// flights coalesces provider calls if CoalesceFetches is set
+	flights flightGroup
+
+	// tierCounter rotates the providers of tiers, it is updated atomically
+	tierCounter uint64
+
+	// inFlightRequests and inFlightFetches count the running ServeHTTP
+	// calls and fetch goroutines for /debug/inflight, they are updated
+	// atomically
+	inFlightRequests int64
+	inFlightFetches  int64
+	// contentRequests counts the running content requests for MaxInFlight
+	contentRequests int64
+	// queuedRequests counts the requests waiting for a slot, which are
+	// woken up by closing slotFreed whenever a request finishes, see
+	// slotFreedSignal
+	queuedRequests int64
+	slotMu         sync.Mutex
+	slotFreed      chan struct{}
+
+	// pageTokens are the page tokens of PagingClients
+	pageTokens pageTokenStore
+
+	// randomCursorKey signs cursors if there is no CursorKey
+	randomCursorKey     []byte
+	randomCursorKeyOnce sync.Once
+
+	// surface is the name of the surface the App serves for a Router
+	surface string
+
+	// switches are the providers disabled at runtime, see DisableProvider
+	switches providerSwitches
+
+	// live ends the live feeds, see CloseLiveFeeds
+	live liveFeeds
+
+	// ReportShortfall adds the number of requested items and the number of
+	// items with content which were returned to every content response, as
+	// X-Requested-Count and X-Returned-Count, so that clients can tell
+	// whether the list was cut short.
+	ReportShortfall bool
+
+	// PartialContentStatus responds with 206 Partial Content rather than 200
+	// to requests which got fewer items with content than they asked for,
+	// e.g. as providers failed, so that clients do not take the page for a
+	// complete one. The response carries the items' Content-Range along
+	// with X-Requested-Count and X-Returned-Count. Pages without any items
+	// are answered as usual.
+	PartialContentStatus bool
+
+	// Envelope wraps content lists in an object carrying the requested
+	// offset and count, the number of returned items and whether fewer
+	// items than requested were returned. Defaults to a bare JSON array.
+	Envelope bool
+
+	// AnnotateFallbacks adds the provider which actually served an item and
+	// whether it was the config's fallback to every returned item.
+	AnnotateFallbacks bool
+
+	// ReportFetchTimes adds the time every item was fetched from its
+	// provider to it as fetched_at, e.g. to tell how stale cached items are
+	ReportFetchTimes bool
+
+	// FieldNames renames fields of returned items, by their JSON name, e.g.
+	// {"source": "origin"}, for clients expecting other names. FieldCase
+	// then writes the names of the other fields in the given case.
+	// Neither changes the names used by the fields URL parameter.
+	FieldNames map[string]string
+	FieldCase  FieldCase
+
+	// Enrichers add fields computed by the server, such as impression
+	// tokens, to every item of a content response, see Enricher. Unlike
+	// the other fields they are neither cached nor renamed.
+	Enrichers []Enricher
+
+	// CompactItems leaves the optional fields of returned items out while
+	// they are empty, e.g. an item without summary or expiry. The id and
+	// source are always kept. Defaults to writing every field.
+	CompactItems bool
+}
+
+// BatchSize is the smallest and largest number of items a provider can be
+// asked for at once. 0 leaves either of them unbounded. Multiple rounds
+// every batch up to a multiple of it, e.g. of 5 for a provider which caches
+// its responses in blocks of 5, and has to divide Max. 0 leaves batches as
+// they are.
+type BatchSize struct {
+	Min      int
+	Max      int
+	Multiple int
+}
+
+// EmptyResponsePolicy describes how to respond when there is no content to return
+type EmptyResponsePolicy int
+
+const (
+	// EmptyResponseArray responds with 200 and an empty JSON array
+	EmptyResponseArray EmptyResponsePolicy = iota
+	// EmptyResponseNoContent responds with 204 and no body
+	EmptyResponseNoContent
+)
+
+// MixSelector returns the mix to serve for a request with the given headers
+type MixSelector func(header http.Header, mix ContentMix) ContentMix
+
+// OversizePolicy describes how to respond when the content exceeds
+// MaxResponseBytes
+type OversizePolicy int
+
+const (
+	// TruncateOversized responds with as many leading items as fit
+	TruncateOversized OversizePolicy = iota
+	// RejectOversized responds with 413 and no items
+	RejectOversized
+)
+
+// ServeHTTP routes requests to the content and admin endpoints. HEAD requests
+// get the headers of the corresponding GET without its body. Pages in the
+// Cache are answered without calling providers either way.
+func (a *App) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&a.inFlightRequests, 1)
+	defer atomic.AddInt64(&a.inFlightRequests, -1)
+
+	requestID := getRequestID(req)
+	w.Header().Set(requestIDHeader, requestID)
+	ctx, span := a.tracer().Start(contextWithRequestID(req.Context(), requestID), requestSpanName)
+	defer span.End()
+	ctx = contextWithProviderPanics(ctx)
+	w = guardPanics(w)
+	defer recoverPanic(ctx, w)
+	span.SetAttribute(attributeMethod, req.Method)
+	span.SetAttribute(attributePath, req.URL.Path)
+	span.SetAttribute(attributeRequestID, requestID)
+	logf(ctx, "%s %s", req.Method, req.URL.String())
+	if req.Method == http.MethodHead {
+		w = headResponseWriter{w}
+	}
+
+	switch {
+	case req.URL.Path == customMixPath:
+		a.serveCustomMix(ctx, w, req)
+		return
+	case req.URL.Path == cacheFlushPath || strings.HasPrefix(req.URL.Path, cacheFlushPath+"/"):
+		a.serveCacheFlush(ctx, w, req)
+		return
+	case strings.HasPrefix(req.URL.Path, providerSwitchPath):
+		a.serveProviderSwitch(ctx, w, req)
+		return
+	}
+
+	// every other endpoint only reads
+	if !allowMethods(w, req, http.MethodGet, http.MethodHead) {
+		return
+	}
+	switch req.URL.Path {
+	case "/health":
+		a.serveHealth(w)
+	case "/providers":
+		a.serveProviders(w)
+	case "/metrics":
+		a.serveMetrics(w, req)
+	case inFlightPath:
+		a.serveInFlight(w)
+	case configPath:
+		a.serveConfig(w, req)
+	case bulkPath:
+		a.serveBulk(ctx, w, req)
+	case livePath:
+		a.serveLive(ctx, w, req)
+	default:
+		if strings.HasPrefix(req.URL.Path, mixPathPrefix) {
+			a.serveNamedMix(ctx, w, req)
+			return
+		}
+		if !a.isContentPath(req.URL.Path) {
+			sendError(w, http.StatusNotFound, fmt.Sprintf("unknown path %s", req.URL.Path))
+			return
+		}
+		a.serveContent(ctx, w, req, pageRequest{config: a.config()})
+	}
+}
+
+// defaultContentPath serves the Config unless ContentPaths are configured
+const defaultContentPath = "/"
+
+// isContentPath reports whether the Config is served under path
+func (a *App) isContentPath(path string) bool {
+	if len(a.ContentPaths) == 0 {
+		return path == defaultContentPath
+	}
+	for _, contentPath := range a.ContentPaths {
+		if path == contentPath {
+			return true
+		}
+	}
+	return false
+}
+
+// allowMethods responds with a 405 listing the allowed methods and returns
+// false if the request uses a different one
+func allowMethods(w http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	sendError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s is not allowed", req.Method))
+	return false
+}
+
+// contentDegradedHeader lists the positions of a page which were served by
+// a fallback or are missing, see degradedPositions
+const contentDegradedHeader = "X-Content-Degraded"
+
+// degradedPositions describes which of the count positions of a page were
+// served by a fallback and which are missing, either because they were cut
+// off or filled with a placeholder, e.g. "fallback=1,3; missing=4,5".
+// Positions start at 0 within the page. It is empty if no position is
+// degraded.
+func degradedPositions(items []returnedItem, count int) string {
+	var fallback, missing []string
+	for i, item := range items {
+		switch {
+		case item.Item.Placeholder:
+			missing = append(missing, strconv.Itoa(i))
+		case item.Fallback:
+			fallback = append(fallback, strconv.Itoa(i))
+		}
+	}
+	for i := len(items); i < count; i++ {
+		missing = append(missing, strconv.Itoa(i))
+	}
+
+	var parts []string
+	if len(fallback) > 0 {
+		parts = append(parts, "fallback="+strings.Join(fallback, ","))
+	}
+	if len(missing) > 0 {
+		parts = append(parts, "missing="+strings.Join(missing, ","))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// requestedCountHeader and returnedCountHeader tell clients how many items
+// they asked for and how many they got, so that they can decide whether to
+// retry a page which was cut short
+const (
+	requestedCountHeader = "X-Requested-Count"
+	returnedCountHeader  = "X-Returned-Count"
+)
+
+// returnedCount returns how many of the items hold content rather than a
+// placeholder
+func returnedCount(items []returnedItem) int {
+	returned := 0
+	for _, item := range items {
+		if !item.Item.Placeholder {
+			returned++
+		}
+	}
+	return returned
+}
+
+// servedStaleHeader marks responses holding items of an expired cached page
+const servedStaleHeader = "X-Served-Stale"
+
+// mixPathPrefix is followed by the name of the mix to serve
+const mixPathPrefix = "/mix/"
+
+// serveNamedMix serves content from the mix named in the path
+func (a *App) serveNamedMix(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, mixPathPrefix)
+	config, ok := a.Mixes[name]
+	if !ok {
+		sendError(w, http.StatusNotFound, fmt.Sprintf("unknown mix %q", name))
+		return
+	}
+	a.serveContent(ctx, w, req, pageRequest{mix: name, config: config})
+}
+
+// serveContent responds with the content of the mix given by request for the
+// requested count and offset
+func (a *App) serveContent(ctx context.Context, w http.ResponseWriter, req *http.Request, request pageRequest) {
+	if !a.requireClients(w) || !a.acquireSlot(ctx, w) {
+		return
+	}
+	defer a.releaseSlot()
+	elapsed := a.Metrics.startTimer()
+	defer func() { a.Metrics.observeRequest(elapsed()) }()
+
+	format, err := a.parseContentRequest(req, &request)
+	if err != nil {
+		a.sendContentRequestError(w, err)
+		return
+	}
+	a.Metrics.observePage(request.count, request.offset)
+	ctx = contextWithOverrides(ctx, request.overrides)
+	ctx = contextWithSeen(ctx, request.seen)
+	var page page
+	if flusher, ok := a.streams(w, request); ok && !format.Ranged && !format.Pretty {
+		var streamed bool
+		if page, streamed = a.streamPage(ctx, w, flusher, request, format); streamed {
+			return
+		}
+	} else {
+		page = a.getPage(ctx, request)
+	}
+	rethrowProviderPanic(ctx)
+	page = a.emergencyPage(ctx, request, page)
+	if page.err != nil {
+		logf(ctx, "could not assemble content: %v", page.err)
+		sendError(w, http.StatusBadGateway, page.err.Error())
+		return
+	}
+	if len(page.items) == 0 && page.throttled {
+		sendTooManyRequests(w, page.retryAfter)
+		return
+	}
+	returnList := a.enrich(ctx, req, request, page.items)
+	rethrowProviderPanic(ctx)
+	setPageHeaders(w, request, format)
+	partial := a.PartialContentStatus && returnedCount(returnList) < request.count
+	if (format.Ranged || partial) && len(returnList) > 0 {
+		w = &partialContentWriter{ResponseWriter: w}
+	}
+	// the headers describing the items are set once it is known which are
+	// sent, as MaxResponseBytes may cut them down
+	setItemHeaders := func(sent []returnedItem) {
+		a.setItemHeaders(w, request, format, partial, sent)
+	}
+	switch {
+	case page.emergency:
+		w.Header().Set(emergencyContentHeader, "true")
+		setCacheHeaders(w, 0)
+	case page.stale:
+		w.Header().Set(servedStaleHeader, "true")
+		setCacheHeaders(w, 0)
+	default:
+		setCacheHeaders(w, a.cacheMaxAgeFor(request))
+	}
+	if len(returnList) == 0 && a.EmptyResponsePolicy == EmptyResponseNoContent {
+		setItemHeaders(returnList)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJsonResponse(ctx, w, returnList, format, setItemHeaders)
+
+	if a.Prefetch && a.Cache != nil && !request.custom && request.count > 0 && req.Method != http.MethodHead {
+		next := request
+		next.offset += request.count
+		if next = a.withinLogicalTotal(next); next.count > 0 {
+			go a.prefetchPage(requestIDFromContext(ctx), next)
+		}
+	}
+}
+
+// setPageHeaders sets the headers of a content response which do not depend
+// on its items
+func setPageHeaders(w http.ResponseWriter, request pageRequest, format responseFormat) {
+	w.Header().Set("Accept-Ranges", rangeUnit)
+	if request.variant {
+		w.Header().Set(experimentVariantHeader, request.mix)
+	}
+	if format.NextCursor != "" {
+		w.Header().Set(nextCursorHeader, format.NextCursor)
+	}
+}
+
+// setItemHeaders sets the headers of a content response which describe the
+// items sent, which are a partial page if partial is set
+func (a *App) setItemHeaders(w http.ResponseWriter, request pageRequest, format responseFormat, partial bool, sent []returnedItem) {
+	if (format.Ranged || partial) && len(sent) > 0 {
+		w.Header().Set("Content-Range", a.contentRange(request.offset, len(sent)))
+	}
+	w.Header().Set("ETag", pageETag(sent, format))
+	if degraded := degradedPositions(sent, request.count); degraded != "" {
+		w.Header().Set(contentDegradedHeader, degraded)
+	}
+	if a.ReportShortfall || partial {
+		w.Header().Set(requestedCountHeader, strconv.Itoa(request.count))
+		w.Header().Set(returnedCountHeader, strconv.Itoa(returnedCount(sent)))
+	}
+}
+
+// requireClients responds with a 503 and returns false if the App has no
+// clients at all, e.g. because it was created without NewApp, as there is no
+// content to serve then
+func (a *App) requireClients(w http.ResponseWriter) bool {
+	if len(a.clients()) > 0 {
+		return true
+	}
+	sendError(w, http.StatusServiceUnavailable, "no content providers are configured")
+	return false
+}
+
+// overloadRetryAfter is how long clients are asked to wait when the server
+// is at its MaxInFlight
+const overloadRetryAfter = time.Second
+
+// acquireSlot counts a content request against MaxInFlight. If the server is
+// at capacity and the request cannot be queued until a slot is free, it
+// responds with a 503 and returns false; otherwise releaseSlot has to be
+// called once the request is done.
+func (a *App) acquireSlot(ctx context.Context, w http.ResponseWriter) bool {
+	if !a.takeSlot() && !a.waitForSlot(ctx) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(overloadRetryAfter.Seconds())))
+		sendError(w, http.StatusServiceUnavailable, "the server is at capacity, please retry later")
+		return false
+	}
+	return true
+}
+
+// takeSlot counts a content request against MaxInFlight unless the server
+// is at capacity
+func (a *App) takeSlot() bool {
+	if running := atomic.AddInt64(&a.contentRequests, 1); a.MaxInFlight > 0 && running > int64(a.MaxInFlight) {
+		atomic.AddInt64(&a.contentRequests, -1)
+		return false
+	}
+	return true
+}
+
+func (a *App) releaseSlot() {
+	atomic.AddInt64(&a.contentRequests, -1)
+	a.slotMu.Lock()
+	defer a.slotMu.Unlock()
+	if a.slotFreed != nil {
+		close(a.slotFreed)
+		a.slotFreed = nil
+	}
+}
+
+// parseContentRequest completes request with the count, offset and user of
+// req, putting it into its Experiment variant, rewriting its mix with
+// SelectMix, leaving out excluded providers and overriding clients for
+// admins, and returns the requested format. The offset may also be given as
+// a cursor of the final mix, or together with the count as an items Range
+// header.
+func (a *App) parseContentRequest(req *http.Request, request *pageRequest) (responseFormat, error) {
+	count, offset, ranged, err := a.parseRange(req)
+	if err != nil {
+		return responseFormat{}, err
+	}
+	if !ranged {
+		count, offset, err = parseCountAndOffset(req, a.LenientQuery)
+		if err != nil {
+			return responseFormat{}, err
+		}
+		if a.MaxCount > 0 && count > a.MaxCount {
+			return responseFormat{}, fmt.Errorf("count must not exceed %d", a.MaxCount)
+		}
+	}
+	format, err := parseResponseFormat(req, a.StrictFields)
+	if err != nil {
+		return responseFormat{}, err
+	}
+	format.Ranged = ranged
+	format.Annotate = a.AnnotateFallbacks
+	format.MaxBytes = a.MaxResponseBytes
+	format.Truncate = a.OversizePolicy == TruncateOversized
+	format.Envelope = a.Envelope
+	format.Compact = a.CompactItems
+	format.RenameField = a.fieldRenamer()
+	format.FetchedAt = a.ReportFetchTimes
+	format.Offset = offset
+	format.Count = count
+
+	request.count = count
+	request.offset = offset
+	request.userIP = a.clientIP(req)
+	if a.Experiment != nil && request.mix == "" && !request.custom {
+		variant := a.Experiment.variant(a.Experiment.userKey(req, request.userIP))
+		request.mix = variant.Mix
+		request.config = a.Mixes[variant.Mix]
+		request.variant = true
+	}
+	config := request.config
+	if a.SelectMix != nil {
+		request.config = a.SelectMix(req.Header, request.config)
+	}
+	excluded, err := a.parseExclude(req)
+	if err != nil {
+		return responseFormat{}, err
+	}
+	if len(excluded) > 0 {
+		request.config = a.excludeProviders(request.config, excluded)
+		if len(request.config) == 0 {
+			return responseFormat{}, errors.New("every provider of the mix is excluded")
+		}
+	}
+	request.custom = request.custom || !sameMix(request.config, config)
+	if request.overrides, err = a.parseOverrides(req); err != nil {
+		return responseFormat{}, err
+	}
+	request.custom = request.custom || len(request.overrides) > 0
+	var ignoredSeen []string
+	if request.seen, ignoredSeen, err = a.parseSeen(req); err != nil {
+		return responseFormat{}, err
+	}
+	if len(ignoredSeen) > 0 {
+		logf(req.Context(), "ignoring %s", strings.Join(ignoredSeen, " and "))
+	}
+	request.custom = request.custom || request.seen != nil
+
+	cursorOffset, ok, err := a.parseCursor(req, request.config)
+	if err != nil {
+		return responseFormat{}, err
+	}
+	if ok {
+		request.offset = cursorOffset
+		format.Offset = cursorOffset
+	}
+	*request = a.withinLogicalTotal(*request)
+	format.Count = request.count
+	if !a.endsContent(*request) {
+		format.NextCursor = a.encodeCursor(request.offset+request.count, request.config)
+	}
+	return format, nil
+}
+
+// parseExclude reads the providers to leave out from the exclude URL
+// parameter, which may be repeated or list several providers separated by
+// commas
+func (a *App) parseExclude(req *http.Request) (map[Provider]bool, error) {
+	excluded := map[Provider]bool{}
+	for _, value := range req.URL.Query()["exclude"] {
+		for _, name := range strings.Split(value, ",") {
+			provider := Provider(strings.TrimSpace(name))
+			if provider == "" {
+				continue
+			}
+			if _, ok := a.client(provider); !ok {
+				return nil, fmt.Errorf("cannot exclude unknown provider %s", provider)
+			}
+			excluded[provider] = true
+		}
+	}
+	return excluded, nil
+}
+
+// cacheMaxAgeFor returns for how long responses to a request may be cached
+func (a *App) cacheMaxAgeFor(request pageRequest) time.Duration {
+	if request.custom || request.variant || a.NoStoreMixes[request.mix] {
+		return 0
+	}
+	return a.CacheMaxAge
+}
+
+// parseCountAndOffset reads the count and offset URL parameters.
+// count is mandatory, offset defaults to 0. Unless lenient is set, giving
+// either of them more than once is an error; otherwise the first value wins.
+func parseCountAndOffset(req *http.Request, lenient bool) (count int, offset int, err error) {
+	query := req.URL.Query()
+
+	if !lenient {
+		for _, name := range []string{"count", "offset"} {
+			if len(query[name]) > 1 {
+				return 0, 0, fmt.Errorf("%s must only be given once", name)
+			}
+		}
+	}
+
+	count, err = parseNonNegativeInt(query.Get("count"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid count: %v", err)
+	}
+
+	if query.Get("offset") != "" {
+		offset, err = parseNonNegativeInt(query.Get("offset"))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid offset: %v", err)
+		}
+	}
+	if offset > maxContentPosition-count {
+		return 0, 0, fmt.Errorf("offset and count must not reach past %d", maxContentPosition)
+	}
+
+	return count, offset, nil
+}
+
+// maxContentPosition is the furthest position requests may reach, so that
+// the positions computed from their offset and count cannot overflow
+const maxContentPosition = math.MaxInt32
+
+func parseNonNegativeInt(value string) (int, error) {
+	if value == "" {
+		return 0, errors.New("parameter is required")
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New("parameter must be an integer")
+	}
+	if number < 0 {
+		return 0, errors.New("parameter must not be negative")
+	}
+	return number, nil
+}
+
+// clientIP returns the IP of the client according to ClientIPFunc
+func (a *App) clientIP(req *http.Request) string {
+	if a.ClientIPFunc == nil {
+		return RemoteIP(req)
+	}
+	return a.ClientIPFunc(req)
+}
+
+// RemoteIP returns the IP of the remote address of the connection, which is
+// the client's unless the server is behind a proxy.
+func RemoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
 }
 
-func (App) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	log.Printf("%s %s", req.Method, req.URL.String())
-	w.WriteHeader(http.StatusNotImplemented)
+// ForwardedForIP returns the first entry of X-Forwarded-For, falling back to
+// the RemoteIP. It is only to be used behind a proxy which sets the header,
+// as clients can send any X-Forwarded-For themselves.
+func ForwardedForIP(req *http.Request) string {
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	return RemoteIP(req)
 }
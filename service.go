@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ContentRequest asks for a page of content independently of HTTP, e.g. for
+// a server of the service defined in content.proto, which this package does
+// not provide. Mix is the name of one of the App's Mixes, empty for its
+// Config.
+type ContentRequest struct {
+	Mix    string
+	Count  int
+	Offset int
+	UserIP string
+}
+
+// Content assembles the requested page from the same fetch logic and cache
+// as a plain content request over HTTP, so that other transports return the
+// same items in the same order for it. The features which depend on the
+// HTTP request are left out: the Experiment, SelectMix, excluded providers,
+// client overrides, seen items and EmergencyContent. Panics of providers
+// fail the page's configs like other provider errors rather than the whole
+// call. Pages whose providers all throttle fail with a RateLimitedError.
+func (a *App) Content(ctx context.Context, request ContentRequest) ([]*ContentItem, error) {
+	if len(a.clients()) == 0 {
+		return nil, errors.New("no content providers are configured")
+	}
+	if request.Count < 0 || request.Offset < 0 {
+		return nil, errors.New("count and offset must not be negative")
+	}
+	if a.MaxCount > 0 && request.Count > a.MaxCount {
+		return nil, fmt.Errorf("count must not exceed %d", a.MaxCount)
+	}
+	config := a.config()
+	if request.Mix != "" {
+		var ok bool
+		if config, ok = a.Mixes[request.Mix]; !ok {
+			return nil, fmt.Errorf("unknown mix %q", request.Mix)
+		}
+	}
+
+	a.Metrics.observePage(request.Count, request.Offset)
+	page := a.getPage(ctx, a.withinLogicalTotal(pageRequest{
+		mix:    request.Mix,
+		config: config,
+		count:  request.Count,
+		offset: request.Offset,
+		userIP: request.UserIP,
+	}))
+	if page.err != nil {
+		return nil, page.err
+	}
+	if len(page.items) == 0 && page.throttled {
+		return nil, RateLimitedError{After: page.retryAfter}
+	}
+	items := make([]*ContentItem, len(page.items))
+	for i, item := range page.items {
+		items[i] = item.Item
+	}
+	return items, nil
+}
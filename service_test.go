@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestContentMatchesTheHTTPOrder(t *testing.T) {
+	for _, test := range []struct {
+		offset int
+		count  int
+	}{{0, 5}, {5, 5}, {3, 11}} {
+		content, err := app.Content(context.Background(), ContentRequest{Count: test.count, Offset: test.offset})
+		if err != nil {
+			t.Fatalf("Got error %v", err)
+		}
+		want := runRequest(t, app, httptest.NewRequest("GET", fmt.Sprintf("/?offset=%d&count=%d", test.offset, test.count), nil))
+		if len(content) != len(want) {
+			t.Fatalf("Offset %d: Got %d items, want %d", test.offset, len(content), len(want))
+		}
+		for i := range content {
+			if content[i].Source != want[i].Source {
+				t.Errorf("Offset %d, position %d: Got source %s, want %s", test.offset, i, content[i].Source, want[i].Source)
+			}
+		}
+	}
+}
+
+func TestContentSharesTheCacheWithHTTP(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithCache(time.Minute), WithMix("tv", ContentMix{config2}))
+
+	want := runRequest(t, srv, httptest.NewRequest("GET", "/mix/tv?count=4", nil))
+	content, err := srv.Content(context.Background(), ContentRequest{Mix: "tv", Count: 4})
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if itemIDs(content) != itemIDs(want) {
+		t.Errorf("Got items %s, want %s", itemIDs(content), itemIDs(want))
+	}
+}
+
+func TestContentRejectsInvalidRequests(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithMaxCount(10))
+
+	for name, request := range map[string]ContentRequest{
+		"unknown mix":     {Mix: "radio", Count: 1},
+		"negative count":  {Count: -1},
+		"negative offset": {Count: 1, Offset: -1},
+		"count too large": {Count: 11},
+	} {
+		if _, err := srv.Content(context.Background(), request); err == nil {
+			t.Errorf("%s: Got no error", name)
+		}
+	}
+}
+
+func TestContentFailsOverFromPanickingProviders(t *testing.T) {
+	clients := sampleClients()
+	clients[Provider1] = PanickingContentProvider{}
+	srv, _ := NewApp(ContentMix{config1}, clients)
+
+	content, err := srv.Content(context.Background(), ContentRequest{Count: 2})
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if sources := providerSequence(content); sources != "22" {
+		t.Errorf("Got providers %s, want the fallback 22", sources)
+	}
+}
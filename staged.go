@@ -0,0 +1,87 @@
+package main
+
+import "context"
+
+// fetchStaged fetches the configs of the mix in two stages. The configs
+// whose primary provider is not one of the ExpensiveProviders go first, and
+// they are asked for the slots of the expensive configs as well, handed out
+// to them in turn like degradeSlowConfigs does. Only the slots they could not
+// fill go back to their expensive configs, which are fetched for those in the
+// second stage. Ad slots are left alone. It returns the mix to assemble the
+// page with and the contents fetched for it.
+func (a *App) fetchStaged(ctx context.Context, request pageRequest, mix ContentMix) (ContentMix, FetchedContentsMap) {
+	fetch := func(config ContentConfig, count int) *FetchedContents {
+		return a.fetchItemsForConfig(ctx, config, a.overFetch(count), request.userIP)
+	}
+
+	var cheap []ContentConfig
+	expensive := false
+	for i, config := range mix {
+		switch {
+		case a.isAdSlot(request.offset + i):
+		case a.ExpensiveProviders[config.Type]:
+			expensive = true
+		case !containsConfig(cheap, config):
+			cheap = append(cheap, config)
+		}
+	}
+	if !expensive || len(cheap) == 0 {
+		return mix, a.fanOut(ctx, mix, getCountsPerConfig(mix), fetch)
+	}
+
+	staged := make(ContentMix, len(mix))
+	next := 0
+	for i, config := range mix {
+		if !a.isAdSlot(request.offset+i) && a.ExpensiveProviders[config.Type] {
+			config = cheap[next%len(cheap)]
+			next++
+		}
+		staged[i] = config
+	}
+	contents := a.fanOut(ctx, staged, getCountsPerConfig(staged), fetch)
+
+	// the cheap configs fill their own slots first, then the ones they took
+	// over in the order of the mix
+	spare := map[ContentConfig]int{}
+	for config, count := range getCountsPerConfig(mix) {
+		if fetched := contents[config]; fetched != nil && !fetched.Failed {
+			spare[config] = len(fetched.Items) - count
+		}
+	}
+	unfilled := 0
+	for i, config := range staged {
+		if config == mix[i] {
+			continue
+		}
+		if spare[config] > 0 {
+			spare[config]--
+			continue
+		}
+		staged[i] = mix[i]
+		unfilled++
+	}
+	if unfilled == 0 {
+		return staged, contents
+	}
+
+	remaining := CountsPerConfig{}
+	for config, count := range getCountsPerConfig(staged) {
+		if _, fetched := contents[config]; !fetched {
+			remaining[config] = count
+		}
+	}
+	logf(ctx, "fetching %d slots the cheap providers could not fill from expensive ones", unfilled)
+	for config, fetched := range a.fanOut(ctx, staged, remaining, fetch) {
+		contents[config] = fetched
+	}
+	return staged, contents
+}
+
+func containsConfig(configs []ContentConfig, config ContentConfig) bool {
+	for _, c := range configs {
+		if c == config {
+			return true
+		}
+	}
+	return false
+}
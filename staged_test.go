@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExpensiveProviderIsSkippedWhenTheCheapOneFillsItsSlots(t *testing.T) {
+	cheap := &CountingContentProvider{Client: fixedItems(Provider1, "a", "b", "c", "d")}
+	expensive := &CountingContentProvider{Client: fixedItems(Provider2, "x", "y", "z")}
+	srv, _ := NewApp(ContentMix{{Type: Provider1}, {Type: Provider2}}, map[Provider]Client{
+		Provider1: cheap,
+		Provider2: expensive,
+	}, WithExpensiveProviders(Provider2))
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	if ids := itemIDs(content); ids != "a,b,c,d" {
+		t.Errorf("Got items %s, want a,b,c,d", ids)
+	}
+	if cheap.Requested() != 4 {
+		t.Errorf("Cheap provider was asked for %d items, want 4 including the expensive slots", cheap.Requested())
+	}
+	if expensive.Calls() != 0 {
+		t.Errorf("Expensive provider was called %d times, want 0", expensive.Calls())
+	}
+}
+
+func TestExpensiveProviderFillsOnlyTheUnfilledSlots(t *testing.T) {
+	expensive := &CountingContentProvider{Client: fixedItems(Provider2, "x", "y", "z")}
+	srv, _ := NewApp(ContentMix{{Type: Provider1}, {Type: Provider2}}, map[Provider]Client{
+		Provider1: fixedItems(Provider1, "a", "b", "c"),
+		Provider2: expensive,
+	}, WithExpensiveProviders(Provider2))
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	if ids := itemIDs(content); ids != "a,b,c,x" {
+		t.Errorf("Got items %s, want a,b,c,x", ids)
+	}
+	if sources := providerSequence(content); sources != "1112" {
+		t.Errorf("Got providers %s, want 1112", sources)
+	}
+	if expensive.Calls() != 1 || expensive.Requested() != 1 {
+		t.Errorf("Expensive provider was called %d times for %d items, want once for 1", expensive.Calls(), expensive.Requested())
+	}
+}
+
+func TestExpensiveProviderKeepsItsSlotsWhenTheCheapOneFails(t *testing.T) {
+	expensive := &CountingContentProvider{Client: fixedItems(Provider2, "x", "y", "z")}
+	srv, _ := NewApp(ContentMix{{Type: Provider1}, {Type: Provider2}}, map[Provider]Client{
+		Provider1: FailingContentProvider{},
+		Provider2: expensive,
+	}, WithExpensiveProviders(Provider2))
+
+	runRequest(t, srv, httptest.NewRequest("GET", "/?count=4", nil))
+
+	if expensive.Calls() != 1 || expensive.Requested() != 2 {
+		t.Errorf("Expensive provider was called %d times for %d items, want once for 2", expensive.Calls(), expensive.Requested())
+	}
+}
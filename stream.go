@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// streams returns the flusher to stream a page with, if it is to be streamed
+// rather than assembled first. Streaming needs a writer which can flush, and
+// is not used along with the features which need the whole page before
+// responding: StrictMode, backfill, MaxItemsPerProvider, MaxResponseBytes,
+// LessItem, ReportShortfall, PartialContentStatus and DeduplicationPriority,
+// nor along with Enrichers or ExpensiveProviders.
+func (a *App) streams(w http.ResponseWriter, request pageRequest) (http.Flusher, bool) {
+	if a.StreamMinCount <= 0 || request.count < a.StreamMinCount {
+		return nil, false
+	}
+	if a.StrictMode || a.MaxBackfillPasses > 0 || a.MaxItemsPerProvider > 0 || a.MaxResponseBytes > 0 || a.LessItem != nil || a.ReportShortfall || a.PartialContentStatus || len(a.DeduplicationPriority) > 0 || len(a.Enrichers) > 0 || len(a.ExpensiveProviders) > 0 {
+		return nil, false
+	}
+	flusher, ok := w.(http.Flusher)
+	return flusher, ok
+}
+
+// streamPage fetches the page's configs concurrently like fetchPage, but
+// writes the items in order as soon as the configs they come from have
+// delivered, flushing whenever it has to wait for the next one. Streamed
+// pages bypass the Cache. Nothing is sent before the first item is ready, so
+// if there are no items or the page fails at once, streamPage returns the
+// page for the caller to respond with and false. As the headers are sent
+// along with the first items, the ETag and X-Content-Degraded headers of
+// streamed pages are sent as trailers.
+func (a *App) streamPage(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, request pageRequest, format responseFormat) (page, bool) {
+	layout, mix := a.layoutPage(ctx, request)
+	countsPerConfig := getCountsPerConfig(mix)
+	ctx = contextWithConfigOffsets(ctx, configOffsets(layout, a.organicRequest(request).offset))
+
+	if a.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.RequestTimeout)
+		defer cancel()
+	}
+
+	configs := distinctConfigs(mix, countsPerConfig)
+	slots := a.startFetches(configs, countsPerConfig, func(config ContentConfig, count int) *FetchedContents {
+		return a.fetchItemsForConfig(ctx, config, a.overFetch(count), request.userIP)
+	})
+	slotOf := make(map[ContentConfig]chan fetchResult, len(configs))
+	for i, config := range configs {
+		slotOf[config] = slots[i]
+	}
+
+	stream := &itemStream{writer: w, flusher: flusher, format: format}
+	stream.start = func() {
+		setPageHeaders(w, request, format)
+		w.Header().Set("Content-Type", "application/json")
+		setCacheHeaders(w, a.cacheMaxAgeFor(request))
+		w.Header().Set("Trailer", "ETag, "+contentDegradedHeader)
+	}
+	contents := FetchedContentsMap{}
+	seen := map[string]bool{}
+	for _, config := range mix {
+		if _, ok := contents[config]; !ok {
+			stream.flush()
+			select {
+			case result := <-slotOf[config]:
+				contents[config] = result.contents
+				// answered with a 500 if nothing was sent yet, otherwise
+				// the response is cut off
+				rethrowProviderPanic(ctx)
+			case <-ctx.Done():
+				logf(ctx, "stopped waiting for provider %s: %v", config.Type, ctx.Err())
+				contents[config] = nil
+			}
+		}
+
+		item, err := a.takeNextItem(ctx, contents[config], seen, nil)
+		if err != nil {
+			if !stream.started {
+				return page{err: err}, false
+			}
+			logf(ctx, "aborting streamed response: %v", err)
+			panic(http.ErrAbortHandler)
+		}
+		var returned returnedItem
+		switch {
+		case item != nil:
+			provider := contents[config].Provider
+			returned = returnedItem{Item: item, Provider: provider, Fallback: !config.isPrimary(provider), FetchedAt: contents[config].FetchedAt}
+		case a.DefaultItem != nil:
+			returned = a.placeholder()
+		}
+		if returned.Item == nil {
+			a.Metrics.observeTruncated(request.count - stream.returned)
+			break
+		}
+		returned.ConfigIndex, returned.Ad = a.configIndex(layout, request.offset+stream.returned)
+		if err := stream.write(returned); err != nil {
+			logf(ctx, "could not marshal item %d of the response: %v", stream.returned, err)
+			if !stream.started {
+				return page{err: err}, false
+			}
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	if stream.returned == 0 {
+		retryAfter, throttled := getThrottledRetryAfter(countsPerConfig, contents)
+		return page{throttled: throttled, retryAfter: retryAfter}, false
+	}
+	stream.buffer.WriteString(format.closing(stream.returned))
+	stream.flush()
+	a.setItemHeaders(w, request, format, false, stream.items)
+	return page{}, true
+}
+
+// itemStream buffers the items of a streamed response until they are
+// flushed to the client
+type itemStream struct {
+	writer  http.ResponseWriter
+	flusher http.Flusher
+	format  responseFormat
+	// start sets the headers right before they are sent
+	start func()
+
+	buffer   bytes.Buffer
+	returned int
+	items    []returnedItem
+	// started is set once the headers have been sent
+	started bool
+}
+
+func (s *itemStream) write(item returnedItem) error {
+	encoded, err := json.Marshal(renderItem(item, s.format))
+	if err != nil {
+		return err
+	}
+	if s.returned == 0 {
+		s.buffer.WriteString(s.format.opening())
+	} else {
+		s.buffer.WriteByte(',')
+	}
+	s.buffer.Write(encoded)
+	s.buffer.WriteByte('\n')
+	s.returned++
+	s.items = append(s.items, item)
+	return nil
+}
+
+// flush sends the buffered items to the client, along with the headers if
+// they were not sent yet
+func (s *itemStream) flush() {
+	if s.buffer.Len() == 0 {
+		return
+	}
+	if !s.started {
+		s.start()
+		s.started = true
+	}
+	s.writer.Write(s.buffer.Bytes())
+	s.buffer.Reset()
+	s.flusher.Flush()
+}
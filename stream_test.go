@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// GatedContentProvider only delivers the content of Client once Release is
+// closed
+type GatedContentProvider struct {
+	Client  Client
+	Release chan struct{}
+}
+
+func (cp GatedContentProvider) GetContent(ctx context.Context, userIP string, count int) ([]*ContentItem, error) {
+	<-cp.Release
+	return cp.Client.GetContent(ctx, userIP, count)
+}
+
+// flushRecorder sends what has been written so far on every flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes chan string
+}
+
+func (r flushRecorder) Flush() {
+	r.ResponseRecorder.Flush()
+	r.flushes <- r.Body.String()
+}
+
+func TestStreamedItemsArriveBeforeSlowProviderDelivers(t *testing.T) {
+	release := make(chan struct{})
+	clients := map[Provider]Client{
+		Provider1: SampleContentProvider{Source: Provider1},
+		Provider2: GatedContentProvider{Client: SampleContentProvider{Source: Provider2}, Release: release},
+	}
+	srv, _ := NewApp(ContentMix{config4, {Type: Provider2}}, clients, WithStreaming(4))
+	response := flushRecorder{ResponseRecorder: httptest.NewRecorder(), flushes: make(chan string, 10)}
+
+	done := make(chan struct{})
+	go func() {
+		srv.ServeHTTP(response, httptest.NewRequest("GET", "/?count=4", nil))
+		close(done)
+	}()
+
+	select {
+	case early := <-response.flushes:
+		if !strings.HasPrefix(early, "[") || !strings.Contains(early, `"source":"1"`) || strings.Contains(early, `"source":"2"`) {
+			t.Errorf("Got %s before the slow provider delivered, want the first item only", early)
+		}
+	case <-time.After(time.Second):
+		t.Error("Nothing was flushed while the slow provider was pending")
+	}
+	close(release)
+	<-done
+
+	var content []*ContentItem
+	if err := json.NewDecoder(response.Body).Decode(&content); err != nil {
+		t.Fatalf("couldn't decode Response json: %v", err)
+	}
+	if sources := providerSequence(content); sources != "1212" {
+		t.Errorf("Got providers %s, want 1212", sources)
+	}
+}
+
+func TestPagesAreNotStreamedWithoutFlushingOrBelowMinCount(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithStreaming(4))
+
+	// hides the recorder's Flush
+	unflushable := struct{ http.ResponseWriter }{httptest.NewRecorder()}
+	srv.ServeHTTP(unflushable, httptest.NewRequest("GET", "/?count=5", nil))
+	if recorder := unflushable.ResponseWriter.(*httptest.ResponseRecorder); recorder.Code != 200 || recorder.Flushed {
+		t.Errorf("Got status %d and flushed %t without a flusher, want 200 and no flush", recorder.Code, recorder.Flushed)
+	}
+
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, httptest.NewRequest("GET", "/?count=3", nil))
+	if response.Flushed {
+		t.Error("Page below the min count was streamed")
+	}
+}
+
+func TestStreamedPageWithoutItemsIsAnsweredNormally(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: &ThrottlingContentProvider{Throttled: 10, RetryAfter: time.Second}}, WithStreaming(1))
+
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, httptest.NewRequest("GET", "/?count=4", nil))
+	if response.Code != http.StatusTooManyRequests {
+		t.Errorf("Got status %d, want 429", response.Code)
+	}
+}
+
+func TestStreamedPagesCarryTheHeadersOfOtherPages(t *testing.T) {
+	clients := map[Provider]Client{Provider1: fixedItems(Provider1, "a", "b"), Provider2: FailingContentProvider{}}
+	// the page ends the content, so there is no cursor to the next one
+	srv, _ := NewApp(ContentMix{config4, {Type: Provider2}}, clients, WithStreaming(1), WithLogicalTotal(4))
+	buffered, _ := NewApp(ContentMix{config4, {Type: Provider2}}, clients, WithLogicalTotal(4))
+
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, httptest.NewRequest("GET", "/?count=4", nil))
+	want := runRawRequest(buffered, "/?count=4")
+
+	if !response.Flushed {
+		t.Fatal("Page was not streamed")
+	}
+	result := response.Result()
+	if got := result.Header.Get("Accept-Ranges"); got != rangeUnit {
+		t.Errorf("Got Accept-Ranges %q, want %s", got, rangeUnit)
+	}
+	if _, ok := result.Header[nextCursorHeader]; ok {
+		t.Errorf("Got %s header without a cursor", nextCursorHeader)
+	}
+	for _, header := range []string{"ETag", contentDegradedHeader} {
+		if got := result.Trailer.Get(header); got == "" || got != want.Header().Get(header) {
+			t.Errorf("Got %s trailer %q, want %q as for a page which is not streamed", header, got, want.Header().Get(header))
+		}
+	}
+	// both pages miss 3 of 4 items
+	if snapshot := srv.Metrics.snapshot(); snapshot.TruncatedPages != 1 || snapshot.TruncatedItems != 3 {
+		t.Errorf("Got %d truncated pages missing %d items, want 1 missing 3", snapshot.TruncatedPages, snapshot.TruncatedItems)
+	}
+}
+
+func TestStreamedPagesCarryTheExperimentVariant(t *testing.T) {
+	srv, _ := NewApp(DefaultConfig, sampleClients(), WithStreaming(1),
+		WithMix("organic", ContentMix{config4}),
+		WithExperiment(Experiment{Name: "ordering", Variants: []Variant{{Mix: "organic", Weight: 1}}}))
+
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, httptest.NewRequest("GET", "/?count=2", nil))
+
+	if !response.Flushed {
+		t.Fatal("Page was not streamed")
+	}
+	if got := response.Header().Get(experimentVariantHeader); got != "organic" {
+		t.Errorf("Got variant %q, want organic", got)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryTracer keeps every span it started in memory, for asserting the
+// shape of traces
+type memoryTracer struct {
+	mu    sync.Mutex
+	spans []*memorySpan
+}
+
+type memorySpan struct {
+	tracer     *memoryTracer
+	name       string
+	parent     *memorySpan
+	attributes map[string]interface{}
+	start      time.Time
+	end        time.Time
+}
+
+type memorySpanKey struct{}
+
+func (t *memoryTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(memorySpanKey{}).(*memorySpan)
+	span := &memorySpan{tracer: t, name: name, parent: parent, attributes: map[string]interface{}{}, start: time.Now()}
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return context.WithValue(ctx, memorySpanKey{}, span), span
+}
+
+func (s *memorySpan) SetAttribute(key string, value interface{}) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.attributes[key] = value
+}
+
+func (s *memorySpan) End() {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.end = time.Now()
+}
+
+// children returns the spans started from parent, ordered by the config
+// they fetched and the provider which served it
+func (t *memoryTracer) children(parent *memorySpan) []*memorySpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var children []*memorySpan
+	for _, span := range t.spans {
+		if span.parent == parent {
+			children = append(children, span)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool {
+		a, b := children[i].attributes, children[j].attributes
+		if a[attributeConfig] != b[attributeConfig] {
+			return fmt.Sprint(a[attributeConfig]) < fmt.Sprint(b[attributeConfig])
+		}
+		return fmt.Sprint(a[attributeProvider]) < fmt.Sprint(b[attributeProvider])
+	})
+	return children
+}
+
+func TestRequestsAreTracedWithAChildSpanPerFetch(t *testing.T) {
+	tracer := &memoryTracer{}
+	srv, _ := NewApp(ContentMix{config1, config2, config4}, map[Provider]Client{
+		Provider1: FailingContentProvider{},
+		Provider2: SampleContentProvider{Source: Provider2},
+		Provider3: SampleContentProvider{Source: Provider3},
+	}, WithTracer(tracer))
+
+	response := httptest.NewRecorder()
+	srv.ServeHTTP(response, httptest.NewRequest("GET", "/?count=3", nil))
+
+	roots := tracer.children(nil)
+	if len(roots) != 1 {
+		t.Fatalf("Got %d root spans, want 1", len(roots))
+	}
+	root := roots[0]
+	if root.name != requestSpanName || root.attributes[attributePath] != "/" || root.attributes[attributeMethod] != "GET" {
+		t.Errorf("Got root span %s with attributes %v, want a GET request span for /", root.name, root.attributes)
+	}
+	if root.attributes[attributeRequestID] != response.Header().Get(requestIDHeader) {
+		t.Errorf("Got request ID %v, want %s", root.attributes[attributeRequestID], response.Header().Get(requestIDHeader))
+	}
+
+	fetches := tracer.children(root)
+	want := []struct {
+		config   Provider
+		provider Provider
+		fallback bool
+		failed   bool
+	}{
+		// config1 and config4 both have Provider1 as primary
+		{Provider1, Provider1, false, true},
+		{Provider1, Provider2, true, false},
+		{Provider2, Provider2, false, false},
+	}
+	if len(fetches) != len(want) {
+		t.Fatalf("Got %d fetch spans, want %d", len(fetches), len(want))
+	}
+	for i, span := range fetches {
+		if span.name != fetchSpanName {
+			t.Errorf("Span %d: Got name %s, want %s", i, span.name, fetchSpanName)
+		}
+		if span.attributes[attributeConfig] != string(want[i].config) ||
+			span.attributes[attributeProvider] != string(want[i].provider) ||
+			span.attributes[attributeFallback] != want[i].fallback ||
+			span.attributes[attributeFailed] != want[i].failed {
+			t.Errorf("Span %d: Got attributes %v, want %+v", i, span.attributes, want[i])
+		}
+		if len(tracer.children(span)) != 0 {
+			t.Errorf("Span %d: Got children, want a leaf", i)
+		}
+	}
+}
+
+func TestSpansEndAfterTheirWork(t *testing.T) {
+	tracer := &memoryTracer{}
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{
+		Provider1: SlowContentProvider{Client: SampleContentProvider{Source: Provider1}, Delay: 20 * time.Millisecond},
+	}, WithTracer(tracer))
+
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?count=1", nil))
+
+	roots := tracer.children(nil)
+	if len(roots) != 1 {
+		t.Fatalf("Got %d root spans, want 1", len(roots))
+	}
+	fetches := tracer.children(roots[0])
+	if len(fetches) != 1 {
+		t.Fatalf("Got %d fetch spans, want 1", len(fetches))
+	}
+	fetch := fetches[0]
+	if fetch.end.Sub(fetch.start) < 20*time.Millisecond {
+		t.Errorf("Got fetch span of %v, want at least the provider's delay", fetch.end.Sub(fetch.start))
+	}
+	if roots[0].end.Before(fetch.end) {
+		t.Errorf("Request span ended at %v before its fetch at %v", roots[0].end, fetch.end)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+)
+
+// InvalidItemPolicy decides what happens when a provider returns an item
+// which fails validation
+type InvalidItemPolicy int
+
+const (
+	// DropInvalid skips the item and fills its slot with the next one
+	DropInvalid InvalidItemPolicy = iota
+	// FailRequest fails the whole request with a 502
+	FailRequest
+	// FailProvider treats the whole response of a provider returning an
+	// invalid item as a bad response, so that the config's fallback is
+	// tried instead
+	FailProvider
+)
+
+// InvalidItemError reports an item rejected by validation
+type InvalidItemError struct {
+	Provider Provider
+	ItemID   string
+	Err      error
+}
+
+func (e *InvalidItemError) Error() string {
+	return fmt.Sprintf("provider %s returned invalid item %q: %v", e.Provider, e.ItemID, e.Err)
+}
+
+func (e *InvalidItemError) Unwrap() error {
+	return e.Err
+}
+
+// RequireFields returns a validator which rejects items that leave any of the
+// given fields, named by their JSON name, empty
+func RequireFields(fields ...string) func(*ContentItem) error {
+	return func(item *ContentItem) error {
+		for _, field := range fields {
+			value, known := itemFieldValue(item, field)
+			if !known {
+				return fmt.Errorf("unknown field %q", field)
+			}
+			if reflect.ValueOf(value).IsZero() {
+				return fmt.Errorf("%s is empty", field)
+			}
+		}
+		return nil
+	}
+}
+
+// ValidateShape returns a validator which checks that items have the shape
+// clients expect: the given fields, named by their JSON name, are not empty,
+// the link is an absolute http or https URL if there is one, and the expiry
+// is set. The types of the fields are already ensured by ContentItem.
+func ValidateShape(required ...string) func(*ContentItem) error {
+	requireFields := RequireFields(required...)
+	return func(item *ContentItem) error {
+		if err := requireFields(item); err != nil {
+			return err
+		}
+		if item.Link != "" {
+			link, err := url.Parse(item.Link)
+			if err != nil || !link.IsAbs() || (link.Scheme != "http" && link.Scheme != "https") {
+				return fmt.Errorf("link %q is not an http or https URL", item.Link)
+			}
+		}
+		if item.Expiry.IsZero() {
+			return errors.New("expiry is not set")
+		}
+		return nil
+	}
+}
+
+// validateItem checks an item with the App's validator, if it has one.
+// Invalid items are counted in the Metrics. A panicking validator fails the
+// item and the request of ctx, see recoverCallbackPanic.
+func (a *App) validateItem(ctx context.Context, provider Provider, item *ContentItem) (err error) {
+	if a.ValidateItem == nil {
+		return nil
+	}
+	defer recoverCallbackPanic(ctx, "ValidateItem", &err)
+	if item == nil {
+		err = &InvalidItemError{Provider: provider, Err: fmt.Errorf("item is nil")}
+	} else if invalid := a.ValidateItem(item); invalid != nil {
+		err = &InvalidItemError{Provider: provider, ItemID: item.ID, Err: invalid}
+	}
+	if err != nil {
+		a.Metrics.observeInvalidItem(provider)
+	}
+	return err
+}
+
+// validateResponse checks every item of a provider's response under the
+// FailProvider policy, failing the response as a bad one if any item is
+// invalid
+func (a *App) validateResponse(ctx context.Context, provider Provider, items []*ContentItem) error {
+	if a.InvalidItemPolicy != FailProvider {
+		return nil
+	}
+	for _, item := range items {
+		if err := a.validateItem(ctx, provider, item); err != nil {
+			a.Metrics.observeProviderError(provider, classBadResponse)
+			return &ProviderBadResponseError{Provider: provider, Err: err}
+		}
+	}
+	return nil
+}
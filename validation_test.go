@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func mixedValidityProvider() FixedContentProvider {
+	provider := fixedItems(Provider1, "a", "", "b", "c")
+	provider.Items[2].Source = ""
+	return provider
+}
+
+func TestInvalidItemsAreDroppedAndBackfilled(t *testing.T) {
+	srv := &App{
+		ContentClients: map[Provider]Client{Provider1: mixedValidityProvider()},
+		Config:         ContentMix{config4},
+		ValidateItem:   RequireFields("id", "source"),
+	}
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=2", nil))
+
+	if ids := itemIDs(content); ids != "a,c" {
+		t.Errorf("Got items %s, want a,c", ids)
+	}
+}
+
+func TestInvalidItemsFailTheRequestUnderFailRequest(t *testing.T) {
+	srv := &App{
+		ContentClients:    map[Provider]Client{Provider1: mixedValidityProvider()},
+		Config:            ContentMix{config4},
+		ValidateItem:      RequireFields("id", "source"),
+		InvalidItemPolicy: FailRequest,
+	}
+
+	response := runRawRequest(srv, "/?count=2")
+
+	if response.Code != http.StatusBadGateway {
+		t.Errorf("Response code is %d, want 502", response.Code)
+	}
+}
+
+func TestRequireFields(t *testing.T) {
+	validate := RequireFields("id", "title")
+
+	if err := validate(&ContentItem{ID: "1", Title: "title"}); err != nil {
+		t.Errorf("Got error %v for a valid item", err)
+	}
+	if err := validate(&ContentItem{ID: "1"}); err == nil {
+		t.Error("Got no error for an item without title")
+	}
+	if err := RequireFields("colour")(&ContentItem{}); err == nil {
+		t.Error("Got no error for an unknown field")
+	}
+}
+
+func TestInvalidItemErrorUnwraps(t *testing.T) {
+	cause := errors.New("broken")
+	srv := &App{ValidateItem: func(*ContentItem) error { return cause }}
+
+	err := srv.validateItem(context.Background(), Provider1, &ContentItem{ID: "1"})
+
+	var invalid *InvalidItemError
+	if !errors.As(err, &invalid) || invalid.Provider != Provider1 || !errors.Is(err, cause) {
+		t.Errorf("Got error %v, want an InvalidItemError wrapping the cause", err)
+	}
+}
+
+func TestInvalidItemsFailTheProviderUnderFailProvider(t *testing.T) {
+	srv, _ := NewApp(
+		ContentMix{config1},
+		map[Provider]Client{Provider1: mixedValidityProvider(), Provider2: SampleContentProvider{Source: Provider2}},
+		WithItemValidation(RequireFields("id", "source"), FailProvider),
+	)
+
+	content := runRequest(t, srv, httptest.NewRequest("GET", "/?count=2", nil))
+
+	if sources := providerSequence(content); sources != "22" {
+		t.Errorf("Got providers %s, want the fallback 22", sources)
+	}
+	metrics := srv.Metrics.snapshot()
+	if invalid := metrics.ProviderInvalid[Provider1]; invalid != 1 {
+		t.Errorf("Got %d invalid items counted, want 1", invalid)
+	}
+	if errs := metrics.ProviderErrors[Provider1][classBadResponse]; errs != 1 {
+		t.Errorf("Got %d bad responses counted, want 1", errs)
+	}
+}
+
+func TestDroppedItemsAreCounted(t *testing.T) {
+	srv, _ := NewApp(ContentMix{config4}, map[Provider]Client{Provider1: mixedValidityProvider()},
+		WithItemValidation(RequireFields("id", "source"), DropInvalid))
+
+	runRequest(t, srv, httptest.NewRequest("GET", "/?count=2", nil))
+
+	if invalid := srv.Metrics.snapshot().ProviderInvalid[Provider1]; invalid != 2 {
+		t.Errorf("Got %d invalid items counted, want 2", invalid)
+	}
+}
+
+func TestValidateShape(t *testing.T) {
+	validate := ValidateShape("id", "source")
+	valid := ContentItem{ID: "1", Source: "1", Link: "https://example.com/a", Expiry: time.Now()}
+
+	if err := validate(&valid); err != nil {
+		t.Errorf("Got error %v for a valid item", err)
+	}
+	for name, change := range map[string]func(*ContentItem){
+		"missing id":     func(item *ContentItem) { item.ID = "" },
+		"relative link":  func(item *ContentItem) { item.Link = "/a" },
+		"other scheme":   func(item *ContentItem) { item.Link = "ftp://example.com/a" },
+		"missing expiry": func(item *ContentItem) { item.Expiry = time.Time{} },
+	} {
+		item := valid
+		change(&item)
+		if err := validate(&item); err == nil {
+			t.Errorf("%s: Got no error", name)
+		}
+	}
+}